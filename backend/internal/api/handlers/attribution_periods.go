@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/convin/crae/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ListAttributionPeriods returns the tenant's closed and reopened periods
+func (h *Handlers) ListAttributionPeriods(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	periods, err := h.attributionSvc.ListAttributionPeriods(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"periods": periods})
+}
+
+// ListAttributionPeriodEvents returns the period close and reopen audit
+// trail, optionally for one period (?period=2006-01)
+func (h *Handlers) ListAttributionPeriodEvents(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var period *time.Time
+	if periodStr := c.Query("period"); periodStr != "" {
+		t, err := time.Parse("2006-01", periodStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+			return
+		}
+		period = &t
+	}
+
+	events, err := h.attributionSvc.ListAttributionPeriodEvents(tenantID, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// CloseAttributionPeriod closes a month, freezing its attribution results
+func (h *Handlers) CloseAttributionPeriod(c *gin.Context) {
+	h.changeAttributionPeriod(c, h.attributionSvc.CloseAttributionPeriod)
+}
+
+// ReopenAttributionPeriod reopens a closed month
+func (h *Handlers) ReopenAttributionPeriod(c *gin.Context) {
+	h.changeAttributionPeriod(c, h.attributionSvc.ReopenAttributionPeriod)
+}
+
+// changeAttributionPeriod closes or reopens the :period month on behalf of
+// the acting user, who needs the close period permission
+func (h *Handlers) changeAttributionPeriod(c *gin.Context, change func(tenantID, userID int64, period time.Time, reason string) (*services.AttributionPeriod, error)) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	userID, ok := h.requirePermission(c, tenantID, services.PermissionClosePeriod)
+	if !ok {
+		return
+	}
+
+	period, err := time.Parse("2006-01", c.Param("period"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	updated, err := change(tenantID, userID, period, req.Reason)
+	if err != nil {
+		h.attributionPeriodError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// userIDKey is the context key authentication middleware sets the
+// authenticated user's ID (an int64) under
+const userIDKey = "user_id"
+
+// getUserID returns the acting user, the authenticated one. There is none
+// when no authentication middleware set it; a client-supplied user ID is
+// never trusted.
+func getUserID(c *gin.Context) (int64, bool) {
+	value, ok := c.Get(userIDKey)
+	if !ok {
+		return 0, false
+	}
+	userID, ok := value.(int64)
+	return userID, ok
+}
+
+// requirePermission checks the acting user holds the permission in the
+// tenant, responding 401 or 403 when they don't
+func (h *Handlers) requirePermission(c *gin.Context, tenantID int64, permission string) (int64, bool) {
+	userID, ok := getUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return 0, false
+	}
+
+	allowed, err := h.permissionSvc.CheckTenantPermission(tenantID, userID, permission)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+		return 0, false
+	}
+	return userID, true
+}
+
+func (h *Handlers) attributionPeriodError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidPeriod):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPeriodClosed), errors.Is(err, services.ErrPeriodNotClosed),
+		errors.Is(err, services.ErrLaterPeriodClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/convin/crae/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// Dead letter sources: the endpoints whose rejected payloads are kept
+const (
+	DeadLetterSourceInteractions     = "interactions"
+	DeadLetterSourceInteractionBatch = "interactions/batch"
+	DeadLetterSourceImpressions      = "impressions"
+	DeadLetterSourceConversions      = "conversions"
+	DeadLetterSourceConversionBatch  = "conversions/batch"
+	DeadLetterSourceEvents           = "events"
+	DeadLetterSourcePageViews        = "page-views"
+	DeadLetterSourceConvinWebhook    = "webhooks/convin"
+	DeadLetterSourceTelephonyWebhook = "webhooks/telephony"
+)
+
+// deadLetterTenantKey holds the tenant a handler resolved from its payload
+// rather than the X-Tenant-ID header
+const deadLetterTenantKey = "dead_letter_tenant_id"
+
+// DeadLetter keeps the payload of every request to source that the handler
+// rejects, with the error it responded with, so it can be fixed and replayed.
+// Requests without a valid tenant aren't kept.
+func (h *Handlers) DeadLetter(source string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		if recorder.Status() < http.StatusBadRequest {
+			return
+		}
+		var tenantID int64
+		if resolved, ok := c.Get(deadLetterTenantKey); ok {
+			tenantID = resolved.(int64)
+		} else if tenantID, err = h.getTenantID(c); err != nil {
+			return
+		}
+
+		var resp struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(recorder.body.Bytes(), &resp)
+		if resp.Error == "" {
+			resp.Error = http.StatusText(recorder.Status())
+		}
+		err = h.ingestionSvc.RecordDeadLetters(tenantID, []services.DeadLetterInput{{
+			Source:     source,
+			Payload:    body,
+			StatusCode: recorder.Status(),
+			Error:      resp.Error,
+			Key:        c.GetHeader(IdempotencyKeyHeader),
+		}})
+		if err != nil {
+			// The response is already sent; leave the error to the request log
+			c.Error(err)
+		}
+	}
+}
+
+// recordBatchDeadLetters keeps the rejected records of a batch to be replayed
+// one at a time. If they can't be kept the error is logged and set on the
+// response, as the records were processed all the same.
+func (h *Handlers) recordBatchDeadLetters(c *gin.Context, tenantID int64, letters []services.DeadLetterInput, resp *services.BatchIngestResponse) {
+	if err := h.ingestionSvc.RecordDeadLetters(tenantID, letters); err != nil {
+		c.Error(err)
+		resp.DeadLetterError = err.Error()
+	}
+}
+
+// batchDeadLetters returns the rejected records of a batch as dead letters
+func batchDeadLetters[T any](source string, records []T, resp *services.BatchIngestResponse) []services.DeadLetterInput {
+	var letters []services.DeadLetterInput
+	for i, result := range resp.Results {
+		if result.Status != services.BatchRecordRejected {
+			continue
+		}
+		payload, err := json.Marshal(records[i])
+		if err != nil {
+			continue
+		}
+		letters = append(letters, services.DeadLetterInput{Source: source, Payload: payload, Error: result.Reason})
+	}
+	return letters
+}
+
+// replayDeadLetter processes a dead letter's payload again the way its
+// source endpoint would. Records rejected from a batch are replayed one at a
+// time, and batches rejected as a whole as a batch.
+func (h *Handlers) replayDeadLetter(letter *services.DeadLetter) error {
+	payload := []byte(letter.RawPayload)
+	tenantID := letter.TenantID
+
+	switch letter.Source {
+	case DeadLetterSourceInteractions:
+		var req services.IngestInteractionRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		_, err := h.ingestionSvc.IngestInteraction(tenantID, req)
+		return err
+	case DeadLetterSourceInteractionBatch:
+		return replayBatchDeadLetter(payload,
+			func(reqs []services.IngestInteractionRequest) (*services.BatchIngestResponse, error) {
+				return h.ingestionSvc.IngestInteractionBatch(tenantID, reqs)
+			},
+			func(req services.IngestInteractionRequest) error {
+				_, err := h.ingestionSvc.IngestInteraction(tenantID, req)
+				return err
+			},
+		)
+	case DeadLetterSourceImpressions:
+		var req services.IngestImpressionRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		_, err := h.ingestionSvc.IngestImpression(tenantID, req)
+		return err
+	case DeadLetterSourceConversions:
+		var req services.IngestConversionRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		_, err := h.ingestionSvc.IngestConversion(tenantID, req)
+		return err
+	case DeadLetterSourceConversionBatch:
+		return replayBatchDeadLetter(payload,
+			func(reqs []services.IngestConversionRequest) (*services.BatchIngestResponse, error) {
+				return h.ingestionSvc.IngestConversionBatch(tenantID, reqs)
+			},
+			func(req services.IngestConversionRequest) error {
+				_, err := h.ingestionSvc.IngestConversion(tenantID, req)
+				return err
+			},
+		)
+	case DeadLetterSourceEvents:
+		var event services.Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		return h.realtimeSvc.IngestEvent(tenantID, &event)
+	case DeadLetterSourcePageViews:
+		var pageView services.PageView
+		if err := json.Unmarshal(payload, &pageView); err != nil {
+			return err
+		}
+		return h.behaviorSvc.TrackPageView(tenantID, &pageView)
+	case DeadLetterSourceConvinWebhook:
+		var event ConvinWebhookPayload
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		_, err := h.processConvinEvent(tenantID, event)
+		return err
+	case DeadLetterSourceTelephonyWebhook:
+		var body map[string]interface{}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			return err
+		}
+		event, ok := telephonyEvent(tenantID, body, letter.CreatedAt)
+		if !ok {
+			return nil
+		}
+		_, err := h.processConvinEvent(tenantID, event)
+		return err
+	default:
+		return fmt.Errorf("unknown dead letter source %s", letter.Source)
+	}
+}
+
+// replayBatchDeadLetter replays a dead letter of a batch endpoint: a batch
+// the endpoint rejected as a whole ({"records": [...]}), or one record it
+// rejected from a batch. A batch that rejects any record fails the replay;
+// replaying it again leaves the records it stored unchanged.
+func replayBatchDeadLetter[T any](payload []byte, ingestBatch func([]T) (*services.BatchIngestResponse, error), ingestRecord func(T) error) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return err
+	}
+	records, ok := fields["records"]
+	if !ok {
+		var req T
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		return ingestRecord(req)
+	}
+
+	var reqs []T
+	if err := json.Unmarshal(records, &reqs); err != nil {
+		return err
+	}
+	resp, err := ingestBatch(reqs)
+	if err != nil {
+		return err
+	}
+	for _, result := range resp.Results {
+		if result.Status == services.BatchRecordRejected {
+			return fmt.Errorf("%d of %d records rejected, first at index %d: %s",
+				resp.Rejected, len(resp.Results), result.Index, result.Reason)
+		}
+	}
+	return nil
+}
+
+// ListDeadLetters lists rejected payloads, newest first, optionally by
+// status, source, error text (?error=currency) and time received
+func (h *Handlers) ListDeadLetters(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	filter, ok := deadLetterFilter(c)
+	if !ok {
+		return
+	}
+	filter.Status = c.Query("status")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	letters, total, err := h.ingestionSvc.ListDeadLetters(tenantID, filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dead_letters": letters, "total": total, "limit": limit, "offset": offset})
+}
+
+// deadLetterFilter reads the source, error, from and to query parameters
+func deadLetterFilter(c *gin.Context) (services.DeadLetterFilter, bool) {
+	filter := services.DeadLetterFilter{Source: c.Query("source"), Error: c.Query("error")}
+	for param, target := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s, expected RFC 3339", param)})
+			return filter, false
+		}
+		*target = &t
+	}
+	return filter, true
+}
+
+// GetDeadLetter returns a rejected payload with its error
+func (h *Handlers) GetDeadLetter(c *gin.Context) {
+	tenantID, id, ok := h.deadLetterParams(c)
+	if !ok {
+		return
+	}
+
+	letter, err := h.ingestionSvc.GetDeadLetter(tenantID, id)
+	if err != nil {
+		h.deadLetterError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, letter)
+}
+
+// UpdateDeadLetter replaces the payload of a pending dead letter with
+// {"payload": ...}
+func (h *Handlers) UpdateDeadLetter(c *gin.Context) {
+	tenantID, id, ok := h.deadLetterParams(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	letter, err := h.ingestionSvc.UpdateDeadLetterPayload(tenantID, id, req.Payload)
+	if err != nil {
+		h.deadLetterError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, letter)
+}
+
+// DiscardDeadLetter marks a pending dead letter as not to be replayed
+func (h *Handlers) DiscardDeadLetter(c *gin.Context) {
+	tenantID, id, ok := h.deadLetterParams(c)
+	if !ok {
+		return
+	}
+
+	letter, err := h.ingestionSvc.DiscardDeadLetter(tenantID, id)
+	if err != nil {
+		h.deadLetterError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, letter)
+}
+
+// ReplayDeadLetter replays one dead letter
+func (h *Handlers) ReplayDeadLetter(c *gin.Context) {
+	tenantID, id, ok := h.deadLetterParams(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.ingestionSvc.GetDeadLetter(tenantID, id); err != nil {
+		h.deadLetterError(c, err)
+		return
+	}
+
+	result, err := h.ingestionSvc.ReplayDeadLetters(tenantID, []int64{id}, h.replayDeadLetter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result.Results[0])
+}
+
+// ReplayDeadLetters replays dead letters in bulk: those listed in "ids", or
+// else the pending ones matching "source", "error", "from" and "to" (up to
+// 1,000, oldest first)
+func (h *Handlers) ReplayDeadLetters(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req struct {
+		IDs    []int64    `json:"ids"`
+		Source string     `json:"source"`
+		Error  string     `json:"error"`
+		From   *time.Time `json:"from"`
+		To     *time.Time `json:"to"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if len(req.IDs) > services.MaxDeadLetterReplay {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d ids can be replayed at once", services.MaxDeadLetterReplay)})
+		return
+	}
+
+	ids := req.IDs
+	if len(ids) == 0 {
+		ids, err = h.ingestionSvc.PendingDeadLetterIDs(tenantID, services.DeadLetterFilter{
+			Source: req.Source,
+			Error:  req.Error,
+			From:   req.From,
+			To:     req.To,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := h.ingestionSvc.ReplayDeadLetters(tenantID, ids, h.replayDeadLetter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// deadLetterParams reads the tenant and the :id of a dead letter
+func (h *Handlers) deadLetterParams(c *gin.Context) (int64, int64, bool) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, 0, false
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dead letter ID"})
+		return 0, 0, false
+	}
+	return tenantID, id, true
+}
+
+func (h *Handlers) deadLetterError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrDeadLetterNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidDeadLetterPayload):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrDeadLetterNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
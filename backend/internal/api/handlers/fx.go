@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/convin/crae/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// GetReportingCurrency returns the tenant's reporting currency
+func (h *Handlers) GetReportingCurrency(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	currency, err := h.fxSvc.GetReportingCurrency(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, currency)
+}
+
+// SetReportingCurrency sets (or, with an empty currency, clears) the tenant's
+// reporting currency
+func (h *Handlers) SetReportingCurrency(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req struct {
+		Currency string `json:"currency"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency, err := h.fxSvc.SetReportingCurrency(tenantID, req.Currency)
+	if err != nil {
+		h.fxError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, currency)
+}
+
+// ListFXRates returns the tenant's FX rates
+func (h *Handlers) ListFXRates(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var from, to *time.Time
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := time.Parse("2006-01-02", fromStr)
+		if err == nil {
+			from = &t
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := time.Parse("2006-01-02", toStr)
+		if err == nil {
+			to = &t
+		}
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	rates, err := h.fxSvc.ListFXRates(tenantID, c.Query("currency"), from, to, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rates": rates})
+}
+
+// LoadFXRates loads daily FX rates from a JSON body
+func (h *Handlers) LoadFXRates(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req struct {
+		Rates []services.FXRateInput `json:"rates" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	loaded, err := h.fxSvc.LoadFXRates(tenantID, req.Rates)
+	if err != nil {
+		h.fxError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"loaded": loaded})
+}
+
+// LoadFXRatesCSV loads daily FX rates from a CSV file, sent either as the
+// request body or as the "file" field of a multipart form
+func (h *Handlers) LoadFXRatesCSV(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	rates, err := services.ParseFXRatesCSV(body)
+	if err != nil {
+		h.fxError(c, err)
+		return
+	}
+
+	loaded, err := h.fxSvc.LoadFXRates(tenantID, rates)
+	if err != nil {
+		h.fxError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"loaded": loaded})
+}
+
+// fxError maps FX errors to HTTP responses
+func (h *Handlers) fxError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidFXRate), errors.Is(err, services.ErrUnknownCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
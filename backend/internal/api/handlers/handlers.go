@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -29,6 +30,9 @@ type Handlers struct {
 	userMgmtSvc          *services.UserManagementService
 	roleMgmtSvc          *services.RoleManagementService
 	teamMgmtSvc          *services.TeamManagementService
+	fxSvc                *services.FXService
+	permissionSvc        *services.PermissionService
+	importSvc            *services.ImportService
 }
 
 func NewHandlers(
@@ -50,6 +54,9 @@ func NewHandlers(
 	userMgmtSvc *services.UserManagementService,
 	roleMgmtSvc *services.RoleManagementService,
 	teamMgmtSvc *services.TeamManagementService,
+	fxSvc *services.FXService,
+	permissionSvc *services.PermissionService,
+	importSvc *services.ImportService,
 ) *Handlers {
 	return &Handlers{
 		identitySvc:          identitySvc,
@@ -70,6 +77,9 @@ func NewHandlers(
 		userMgmtSvc:          userMgmtSvc,
 		roleMgmtSvc:          roleMgmtSvc,
 		teamMgmtSvc:          teamMgmtSvc,
+		fxSvc:                fxSvc,
+		permissionSvc:        permissionSvc,
+		importSvc:            importSvc,
 	}
 }
 
@@ -113,6 +123,33 @@ func (h *Handlers) IngestInteraction(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+// IngestImpression handles ad impression (view-through touch) ingestion
+func (h *Handlers) IngestImpression(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req services.IngestImpressionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.ingestionSvc.IngestImpression(tenantID, req)
+	if errors.Is(err, services.ErrInvalidImpression) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 // IngestConversion handles conversion event ingestion
 func (h *Handlers) IngestConversion(c *gin.Context) {
 	tenantID, err := h.getTenantID(c)
@@ -128,11 +165,79 @@ func (h *Handlers) IngestConversion(c *gin.Context) {
 	}
 
 	resp, err := h.ingestionSvc.IngestConversion(tenantID, req)
+	if errors.Is(err, services.ErrOriginalConversionNotFound) || errors.Is(err, services.ErrReversalWithoutOriginal) ||
+		errors.Is(err, services.ErrOriginalWithoutReversal) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// IngestInteractionBatch handles batch interaction ingestion. The batch is
+// accepted as a whole; each record's status is in the results.
+func (h *Handlers) IngestInteractionBatch(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req struct {
+		Records []services.IngestInteractionRequest `json:"records"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.ingestionSvc.IngestInteractionBatch(tenantID, req.Records)
+	if errors.Is(err, services.ErrInvalidBatch) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.recordBatchDeadLetters(c, tenantID, batchDeadLetters(DeadLetterSourceInteractionBatch, req.Records, resp), resp)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// IngestConversionBatch handles batch conversion event ingestion
+func (h *Handlers) IngestConversionBatch(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req struct {
+		Records []services.IngestConversionRequest `json:"records"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.ingestionSvc.IngestConversionBatch(tenantID, req.Records)
+	if errors.Is(err, services.ErrInvalidBatch) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	h.recordBatchDeadLetters(c, tenantID, batchDeadLetters(DeadLetterSourceConversionBatch, req.Records, resp), resp)
+
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -185,6 +290,10 @@ func (h *Handlers) CreateAttributionRun(c *gin.Context) {
 	}
 
 	run, err := h.attributionSvc.CreateAttributionRun(tenantID, req.ModelCode, req.Name, req.Config)
+	if errors.Is(err, services.ErrInvalidAttributionConfig) || errors.Is(err, services.ErrAttributionModelNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -193,21 +302,115 @@ func (h *Handlers) CreateAttributionRun(c *gin.Context) {
 	c.JSON(http.StatusOK, run)
 }
 
-// GetAttributionRun returns attribution run details
+// ListAttributionModels returns the built-in models and the tenant's rule models
+func (h *Handlers) ListAttributionModels(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	list, err := h.attributionSvc.ListAttributionModels(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"models": list})
+}
+
+// CreateAttributionModel creates a tenant rule model
+func (h *Handlers) CreateAttributionModel(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req services.RuleModelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	model, err := h.attributionSvc.CreateRuleModel(tenantID, req)
+	if err != nil {
+		h.attributionModelError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, model)
+}
+
+// UpdateAttributionModel replaces the rules of a tenant rule model
+func (h *Handlers) UpdateAttributionModel(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req services.RuleModelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	model, err := h.attributionSvc.UpdateRuleModel(tenantID, c.Param("code"), req)
+	if err != nil {
+		h.attributionModelError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, model)
+}
+
+// attributionModelError maps rule model errors to HTTP responses
+func (h *Handlers) attributionModelError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidRuleModel):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAttributionModelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAttributionModelExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetAttributionRun returns attribution run details and progress
 func (h *Handlers) GetAttributionRun(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
 	runIDStr := c.Param("run_id")
-	_, err := strconv.ParseInt(runIDStr, 10, 64)
+	runID, err := strconv.ParseInt(runIDStr, 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
 		return
 	}
 
-	// This would need to be implemented in the service
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	run, err := h.attributionSvc.GetAttributionRun(tenantID, runID)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
 }
 
-// ExecuteAttributionRun executes an attribution run
+// ExecuteAttributionRun queues an attribution run for the background workers
 func (h *Handlers) ExecuteAttributionRun(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
 	runIDStr := c.Param("run_id")
 	runID, err := strconv.ParseInt(runIDStr, 10, 64)
 	if err != nil {
@@ -215,13 +418,223 @@ func (h *Handlers) ExecuteAttributionRun(c *gin.Context) {
 		return
 	}
 
-	err = h.attributionSvc.ExecuteAttributionRun(runID)
+	run, err := h.attributionSvc.QueueAttributionRun(tenantID, runID)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, run)
+}
+
+// CancelAttributionRun cancels a queued or running attribution run
+func (h *Handlers) CancelAttributionRun(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	run, err := h.attributionSvc.CancelAttributionRun(tenantID, runID)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, run)
+}
+
+// GetAttributionRunErrors lists the conversions an attribution run failed to attribute
+func (h *Handlers) GetAttributionRunErrors(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	version, _ := strconv.Atoi(c.Query("version"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	runErrors, err := h.attributionSvc.GetAttributionRunErrors(tenantID, runID, version, limit, offset)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"errors": runErrors, "limit": limit, "offset": offset})
+}
+
+// ListAttributionRunVersions lists the result versions of an attribution run
+func (h *Handlers) ListAttributionRunVersions(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	versions, err := h.attributionSvc.ListAttributionRunVersions(tenantID, runID)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+// DiffAttributionRunVersions compares two result versions of an attribution run
+func (h *Handlers) DiffAttributionRunVersions(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	fromVersion, _ := strconv.Atoi(c.Query("from"))
+	toVersion, _ := strconv.Atoi(c.Query("to"))
+	dimension := c.DefaultQuery("dimension", "agent")
+
+	diff, err := h.attributionSvc.DiffAttributionRunVersions(tenantID, runID, fromVersion, toVersion, dimension)
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// GetAttributionRunIntervals returns a run's agent, vendor or channel totals
+// with their bootstrap confidence intervals
+func (h *Handlers) GetAttributionRunIntervals(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	intervals, err := h.attributionSvc.GetAttributionRunIntervals(tenantID, runID, c.DefaultQuery("dimension", "vendor"))
+	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, intervals)
+}
+
+// SetLiveAttributionRun designates the live run for its model, kept up to date
+// by incremental attribution
+func (h *Handlers) SetLiveAttributionRun(c *gin.Context) {
+	h.setLiveAttributionRun(c, true)
+}
+
+// ClearLiveAttributionRun stops incremental attribution for a run
+func (h *Handlers) ClearLiveAttributionRun(c *gin.Context) {
+	h.setLiveAttributionRun(c, false)
+}
+
+func (h *Handlers) setLiveAttributionRun(c *gin.Context, live bool) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	runID, err := strconv.ParseInt(c.Param("run_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	run, err := h.attributionSvc.SetLiveAttributionRun(tenantID, runID, live)
 	if err != nil {
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
+
+// attributionRunError maps attribution run errors to HTTP responses
+func (h *Handlers) attributionRunError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAttributionRunNotFound), errors.Is(err, services.ErrAttributionVersionNotFound),
+		errors.Is(err, services.ErrNoBootstrapIntervals):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUnsupportedDimension):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAttributionRunActive), errors.Is(err, services.ErrAttributionRunNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetConversionAttribution explains how an attribution run credited a
+// conversion: the touches it split the amount across and the excluded ones
+func (h *Handlers) GetConversionAttribution(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	conversionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversion ID"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "completed"})
+	var runID int64
+	if runIDStr := c.Query("run_id"); runIDStr != "" {
+		runID, err = strconv.ParseInt(runIDStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+	}
+	version, _ := strconv.Atoi(c.Query("version"))
+
+	explanation, err := h.attributionSvc.ExplainConversionAttribution(tenantID, conversionID, runID, version)
+	if err != nil {
+		if errors.Is(err, services.ErrConversionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, explanation)
 }
 
 // GetAgentRevenueSummary returns agent revenue summary
@@ -254,19 +667,36 @@ func (h *Handlers) GetAgentRevenueSummary(c *gin.Context) {
 		}
 	}
 
+	// A run fixes the model, so the default model only applies without one
+	var runID *int64
 	modelCode := c.DefaultQuery("model_code", "AI_WEIGHTED")
+	if runIDStr := c.Query("run_id"); runIDStr != "" {
+		id, err := strconv.ParseInt(runIDStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+		runID = &id
+		modelCode = c.Query("model_code")
+	}
+	level, ok := attributionLevelParam(c, runID)
+	if !ok {
+		return
+	}
 
-	results, err := h.analyticsSvc.GetAgentRevenueSummary(tenantID, from, to, vendorID, modelCode)
+	results, err := h.analyticsSvc.GetAgentRevenueSummary(tenantID, from, to, vendorID, modelCode, runID, level, c.Query("recompute_intervals") == "true")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"from":       from,
-		"to":         to,
-		"model_code": modelCode,
-		"agents":     results,
+		"from":              from,
+		"to":                to,
+		"model_code":        modelCode,
+		"run_id":            runID,
+		"attribution_level": level,
+		"agents":            results,
 	})
 }
 
@@ -292,9 +722,24 @@ func (h *Handlers) GetVendorComparison(c *gin.Context) {
 		}
 	}
 
+	// A run fixes the model, so the default model only applies without one
+	var runID *int64
 	modelCode := c.DefaultQuery("model_code", "AI_WEIGHTED")
+	if runIDStr := c.Query("run_id"); runIDStr != "" {
+		id, err := strconv.ParseInt(runIDStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+		runID = &id
+		modelCode = c.Query("model_code")
+	}
+	level, ok := attributionLevelParam(c, runID)
+	if !ok {
+		return
+	}
 
-	results, err := h.analyticsSvc.GetVendorComparison(tenantID, from, to, modelCode)
+	results, err := h.analyticsSvc.GetVendorComparison(tenantID, from, to, modelCode, runID, level, c.Query("recompute_intervals") == "true")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -305,6 +750,130 @@ func (h *Handlers) GetVendorComparison(c *gin.Context) {
 	})
 }
 
+// attributionLevelParam reads the attribution_level (customer by default)
+// whose runs are summed when no run_id is given; a run fixes its own level
+func attributionLevelParam(c *gin.Context, runID *int64) (string, bool) {
+	if runID != nil {
+		return "", true
+	}
+	level := c.DefaultQuery("attribution_level", services.AttributionLevelCustomer)
+	if level != services.AttributionLevelCustomer && level != services.AttributionLevelAccount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attribution_level, expected customer or account"})
+		return "", false
+	}
+	return level, true
+}
+
+// CompareAttributionRuns compares the credit two or more attribution runs gave
+// per agent, team, vendor, channel and intent
+func (h *Handlers) CompareAttributionRuns(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var runIDs []int64
+	for _, idStr := range strings.Split(c.Query("run_ids"), ",") {
+		if idStr = strings.TrimSpace(idStr); idStr == "" {
+			continue
+		}
+		runID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID: " + idStr})
+			return
+		}
+		runIDs = append(runIDs, runID)
+	}
+
+	var dimensions []string
+	if dimensionsStr := c.Query("dimensions"); dimensionsStr != "" {
+		dimensions = strings.Split(dimensionsStr, ",")
+	}
+
+	var from, to *time.Time
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := time.Parse(time.RFC3339, fromStr)
+		if err == nil {
+			from = &t
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err == nil {
+			to = &t
+		}
+	}
+
+	comparison, err := h.analyticsSvc.CompareAttributionRuns(tenantID, runIDs, dimensions, from, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidComparison), errors.Is(err, services.ErrUnsupportedDimension):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			h.attributionRunError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, comparison)
+}
+
+// GetConvertingPaths returns the most common ordered touch sequences before
+// conversion
+func (h *Handlers) GetConvertingPaths(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	query := services.PathAnalysisQuery{
+		Level:  c.Query("level"),
+		Intent: c.Query("intent"),
+	}
+	if channelsStr := c.Query("channels"); channelsStr != "" {
+		query.Channels = strings.Split(channelsStr, ",")
+	}
+	if eventTypesStr := c.Query("event_types"); eventTypesStr != "" {
+		query.EventTypes = strings.Split(eventTypesStr, ",")
+	}
+	if vendorIDStr := c.Query("vendor_id"); vendorIDStr != "" {
+		id, err := strconv.Atoi(vendorIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vendor ID"})
+			return
+		}
+		query.VendorID = &id
+	}
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := time.Parse(time.RFC3339, fromStr)
+		if err == nil {
+			query.From = &t
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err == nil {
+			query.To = &t
+		}
+	}
+	query.WindowHours, _ = strconv.Atoi(c.Query("window_hours"))
+	query.Limit, _ = strconv.Atoi(c.Query("limit"))
+
+	analysis, err := h.analyticsSvc.GetConvertingPaths(tenantID, query)
+	if errors.Is(err, services.ErrInvalidPathQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, analysis)
+}
+
 // GetIntentProfitability returns intent-level profitability
 func (h *Handlers) GetIntentProfitability(c *gin.Context) {
 	tenantID, err := h.getTenantID(c)
@@ -605,6 +1174,58 @@ func (h *Handlers) GetAccountSummary(c *gin.Context) {
 	c.JSON(http.StatusOK, summary)
 }
 
+// GetAccountAttribution returns the revenue account-level attribution credited
+// to an account's contacts and engagements, by channel, agent and vendor
+func (h *Handlers) GetAccountAttribution(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	accountID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var runID *int64
+	if runIDStr := c.Query("run_id"); runIDStr != "" {
+		id, err := strconv.ParseInt(runIDStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+		runID = &id
+	}
+
+	var from, to *time.Time
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := time.Parse(time.RFC3339, fromStr)
+		if err == nil {
+			from = &t
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err == nil {
+			to = &t
+		}
+	}
+
+	attribution, err := h.abmSvc.GetAccountAttribution(tenantID, accountID, runID, from, to)
+	if err != nil {
+		if errors.Is(err, services.ErrAccountNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		h.attributionRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, attribution)
+}
+
 // TrackAccountEngagement tracks an account engagement event
 func (h *Handlers) TrackAccountEngagement(c *gin.Context) {
 	tenantID, err := h.getTenantID(c)
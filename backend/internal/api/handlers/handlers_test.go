@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/convin/crae/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -37,3 +39,89 @@ func TestWebhookSignatureValidation(t *testing.T) {
 	t.Skip("Webhook signature validation tests to be implemented")
 }
 
+
+func TestTelephonyEvent(t *testing.T) {
+	receivedAt := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+
+	event, ok := telephonyEvent(7, map[string]interface{}{"call_id": "c-1", "event": "call.start"}, receivedAt)
+	assert.True(t, ok)
+	assert.Equal(t, "call.started", event.EventType)
+	assert.Equal(t, "c-1", event.CallID)
+	assert.Equal(t, int64(7), event.TenantID)
+	assert.Equal(t, receivedAt, event.Timestamp)
+
+	_, ok = telephonyEvent(7, map[string]interface{}{"call_id": "c-1", "event": "call.ringing"}, receivedAt)
+	assert.False(t, ok)
+}
+
+func TestBatchDeadLetters(t *testing.T) {
+	records := []services.IngestConversionRequest{{ExternalEventID: "o-1"}, {ExternalEventID: "o-2", Currency: "INRR"}}
+	resp := &services.BatchIngestResponse{Results: []services.BatchRecordResult{
+		{Index: 0, ExternalID: "o-1", Status: services.BatchRecordCreated},
+		{Index: 1, ExternalID: "o-2", Status: services.BatchRecordRejected, Reason: "currency not found: INRR"},
+	}}
+
+	letters := batchDeadLetters(DeadLetterSourceConversionBatch, records, resp)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, DeadLetterSourceConversionBatch, letters[0].Source)
+	assert.Equal(t, "currency not found: INRR", letters[0].Error)
+
+	var payload services.IngestConversionRequest
+	assert.NoError(t, json.Unmarshal(letters[0].Payload, &payload))
+	assert.Equal(t, "o-2", payload.ExternalEventID)
+}
+
+func TestReplayBatchDeadLetter(t *testing.T) {
+	var batches [][]services.IngestConversionRequest
+	var records []services.IngestConversionRequest
+	rejected := false
+	ingestBatch := func(reqs []services.IngestConversionRequest) (*services.BatchIngestResponse, error) {
+		batches = append(batches, reqs)
+		resp := &services.BatchIngestResponse{}
+		for i, req := range reqs {
+			result := services.BatchRecordResult{Index: i, ExternalID: req.ExternalEventID, Status: services.BatchRecordCreated}
+			if rejected && i == 1 {
+				result.Status, result.Reason = services.BatchRecordRejected, "currency not found: INRR"
+				resp.Rejected++
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		return resp, nil
+	}
+	ingestRecord := func(req services.IngestConversionRequest) error {
+		records = append(records, req)
+		return nil
+	}
+
+	// A record rejected from a batch is replayed on its own
+	assert.NoError(t, replayBatchDeadLetter([]byte(`{"external_event_id": "o-1"}`), ingestBatch, ingestRecord))
+	assert.Len(t, records, 1)
+	assert.Empty(t, batches)
+
+	// A batch rejected as a whole is replayed as a batch
+	batch := []byte(`{"records": [{"external_event_id": "o-1"}, {"external_event_id": "o-2"}]}`)
+	assert.NoError(t, replayBatchDeadLetter(batch, ingestBatch, ingestRecord))
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 2)
+
+	rejected = true
+	err := replayBatchDeadLetter(batch, ingestBatch, ingestRecord)
+	assert.EqualError(t, err, "1 of 2 records rejected, first at index 1: currency not found: INRR")
+
+	assert.Error(t, replayBatchDeadLetter([]byte(`{"records": [`), ingestBatch, ingestRecord))
+}
+
+func TestGetUserID(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/", nil)
+
+	// A client-supplied user ID is never trusted, whatever the gin mode
+	c.Request.Header.Set("X-User-ID", "42")
+	_, ok := getUserID(c)
+	assert.False(t, ok)
+
+	c.Set(userIDKey, int64(7))
+	userID, ok := getUserID(c)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), userID)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/convin/crae/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateImport uploads a CSV or NDJSON file of interactions or conversions.
+// The multipart form carries the file, the entity, an optional format (else
+// taken from the file extension) and an optional JSON column mapping. With
+// dry_run=true every row is validated and the errors returned; otherwise the
+// file is queued and ingested in the background.
+func (h *Handlers) CreateImport(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	if header.Size > services.MaxImportFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is larger than %d MB", services.MaxImportFileSize>>20)})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var mapping services.ImportMapping
+	if mappingJSON := c.PostForm("mapping"); mappingJSON != "" {
+		if err := json.Unmarshal([]byte(mappingJSON), &mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mapping: " + err.Error()})
+			return
+		}
+	}
+	entity := c.PostForm("entity")
+	format := c.PostForm("format")
+
+	if dryRun, _ := strconv.ParseBool(c.PostForm("dry_run")); dryRun {
+		result, err := h.importSvc.DryRunImport(tenantID, entity, format, header.Filename, mapping, data)
+		if err != nil {
+			h.importError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	job, err := h.importSvc.CreateImport(tenantID, entity, format, header.Filename, mapping, data)
+	if err != nil {
+		h.importError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// ListImports lists the tenant's imports, newest first
+func (h *Handlers) ListImports(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	jobs, err := h.importSvc.ListImports(tenantID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imports": jobs, "limit": limit, "offset": offset})
+}
+
+// GetImport returns an import with its progress
+func (h *Handlers) GetImport(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+		return
+	}
+
+	job, err := h.importSvc.GetImport(tenantID, id)
+	if err != nil {
+		h.importError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// GetImportRejectedRows downloads the rows of an import that weren't
+// ingested, in the format they were uploaded in, with the reason for each
+func (h *Handlers) GetImportRejectedRows(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+		return
+	}
+
+	job, err := h.importSvc.GetImport(tenantID, id)
+	if err != nil {
+		h.importError(c, err)
+		return
+	}
+
+	contentType := "text/csv"
+	if job.Format == services.ImportFormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%d-rejected.%s"`, job.ID, job.Format))
+	c.Status(http.StatusOK)
+
+	if err := h.importSvc.WriteRejectedRows(job, c.Writer); err != nil {
+		// The status is already sent; the body ends early
+		c.Error(err)
+	}
+}
+
+func (h *Handlers) importError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidImport):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrImportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/convin/crae/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ListUnresolvedReferences lists the agent, vendor and product keys ingested
+// records sent that weren't known, most often sent first, optionally by type
+// and status (open, mapped or created)
+func (h *Handlers) ListUnresolvedReferences(c *gin.Context) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	refType := c.Query("type")
+	switch refType {
+	case "", services.ReferenceAgent, services.ReferenceVendor, services.ReferenceProduct:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, expected agent, vendor or product"})
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", services.ReferenceOpen, services.ReferenceMapped, services.ReferenceCreated:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status, expected open, mapped or created"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	refs, total, err := h.ingestionSvc.ListUnresolvedReferences(tenantID, refType, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"references": refs, "total": total, "limit": limit, "offset": offset})
+}
+
+// MapUnresolvedReference maps an open reference to the existing agent,
+// vendor or product {"target_id": ...} and fills it in on the records that
+// sent it
+func (h *Handlers) MapUnresolvedReference(c *gin.Context) {
+	tenantID, userID, id, ok := h.unresolvedReferenceParams(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		TargetID int `json:"target_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resolution, err := h.ingestionSvc.MapUnresolvedReference(tenantID, userID, id, req.TargetID)
+	if err != nil {
+		h.unresolvedReferenceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resolution)
+}
+
+// CreateReferenceTarget creates the agent, vendor or product an open
+// reference names and fills it in on the records that sent it
+func (h *Handlers) CreateReferenceTarget(c *gin.Context) {
+	tenantID, userID, id, ok := h.unresolvedReferenceParams(c)
+	if !ok {
+		return
+	}
+
+	var req services.CreateReferenceTargetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resolution, err := h.ingestionSvc.CreateReferenceTarget(tenantID, userID, id, req)
+	if err != nil {
+		h.unresolvedReferenceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, resolution)
+}
+
+// unresolvedReferenceParams reads the tenant, the acting user, who needs the
+// map references permission, and the :id of an unresolved reference
+func (h *Handlers) unresolvedReferenceParams(c *gin.Context) (int64, int64, int64, bool) {
+	tenantID, err := h.getTenantID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, 0, 0, false
+	}
+	userID, ok := h.requirePermission(c, tenantID, services.PermissionMapReferences)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reference ID"})
+		return 0, 0, 0, false
+	}
+	return tenantID, userID, id, true
+}
+
+func (h *Handlers) unresolvedReferenceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrUnresolvedReferenceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidReferenceTarget):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrReferenceAlreadyResolved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -31,40 +31,37 @@ func (h *Handlers) HandleConvinWebhook(c *gin.Context) {
 		// Try to get from header
 		tenantID, _ = h.getTenantID(c)
 	}
+	c.Set(deadLetterTenantKey, tenantID)
 
-	// Process different event types
+	processed, err := h.processConvinEvent(tenantID, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !processed {
+		// Unknown event type, but acknowledge receipt
+		c.JSON(http.StatusOK, gin.H{"status": "received", "message": "Event type not processed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
+
+// processConvinEvent processes a webhook event, reporting whether its event
+// type is one that is processed
+func (h *Handlers) processConvinEvent(tenantID int64, payload ConvinWebhookPayload) (bool, error) {
 	switch payload.EventType {
 	case "call.started":
-		err := h.processCallStarted(tenantID, payload)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		return true, h.processCallStarted(tenantID, payload)
 	case "call.ended":
-		err := h.processCallEnded(tenantID, payload)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		return true, h.processCallEnded(tenantID, payload)
 	case "call.transcript.updated":
-		err := h.processTranscriptUpdate(tenantID, payload)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		return true, h.processTranscriptUpdate(tenantID, payload)
 	case "call.intent.detected":
-		err := h.processIntentDetection(tenantID, payload)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		return true, h.processIntentDetection(tenantID, payload)
 	default:
-		// Unknown event type, but acknowledge receipt
-		c.JSON(http.StatusOK, gin.H{"status": "received", "message": "Event type not processed"})
-		return
+		return false, nil
 	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "processed"})
 }
 
 func (h *Handlers) processCallStarted(tenantID int64, payload ConvinWebhookPayload) error {
@@ -245,33 +242,43 @@ func (h *Handlers) HandleGenericTelephonyWebhook(c *gin.Context) {
 
 	tenantID, _ := h.getTenantID(c)
 
+	event, ok := telephonyEvent(tenantID, payload, time.Now())
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"status": "received"})
+		return
+	}
+	if _, err := h.processConvinEvent(tenantID, event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
+
+// telephonyEvent converts a telephony webhook received at receivedAt to the
+// Convin format, reporting whether its event type is one that is processed
+func telephonyEvent(tenantID int64, payload map[string]interface{}, receivedAt time.Time) (ConvinWebhookPayload, bool) {
 	// Extract common fields
 	callID, _ := payload["call_id"].(string)
 	eventType, _ := payload["event"].(string)
 
-	// Convert to standard format and process
-	convinPayload := ConvinWebhookPayload{
-		EventType: eventType,
+	// Convert to standard format
+	event := ConvinWebhookPayload{
 		CallID:    callID,
 		TenantID:  tenantID,
 		Data:      payload,
-		Timestamp: time.Now(),
+		Timestamp: receivedAt,
 	}
 
-	// Process based on event type
 	switch eventType {
 	case "call.start", "call.started":
-		convinPayload.EventType = "call.started"
-		h.processCallStarted(tenantID, convinPayload)
+		event.EventType = "call.started"
 	case "call.end", "call.ended":
-		convinPayload.EventType = "call.ended"
-		h.processCallEnded(tenantID, convinPayload)
+		event.EventType = "call.ended"
 	default:
-		c.JSON(http.StatusOK, gin.H{"status": "received"})
-		return
+		return event, false
 	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+	return event, true
 }
 
 // Helper function to safely get string from map
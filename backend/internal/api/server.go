@@ -26,6 +26,10 @@ type Server struct {
 	logger     *zap.Logger
 	cfg        *config.Config
 	httpServer *http.Server
+
+	attributionJobs   *services.AttributionJobRunner
+	importJobs        *services.ImportJobRunner
+	idempotencyPurger *services.IdempotencyKeyPurger
 }
 
 func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
@@ -50,7 +54,7 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 	corsConfig := cors.Config{
 		AllowOrigins:     cfg.CORSAllowOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "X-Tenant-ID", "Authorization", "X-API-Key"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "X-Tenant-ID", "Authorization", "X-API-Key", "Idempotency-Key"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: cfg.CORSAllowCredentials,
 		MaxAge:           12 * time.Hour,
@@ -67,6 +71,13 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 	identitySvc := services.NewIdentityService(db)
 	ingestionSvc := services.NewIngestionService(db, identitySvc)
 	attributionSvc := services.NewAttributionService(db)
+	attributionJobs := services.NewAttributionJobRunner(
+		attributionSvc,
+		cfg.AttributionWorkers,
+		time.Duration(cfg.AttributionPollInterval)*time.Second,
+		time.Duration(cfg.AttributionIncrementalInterval)*time.Second,
+		appLogger,
+	)
 	analyticsSvc := services.NewAnalyticsService(db)
 	advancedAnalyticsSvc := services.NewAdvancedAnalyticsService(db)
 	abmSvc := services.NewABMService(db)
@@ -82,6 +93,16 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 	userMgmtSvc := services.NewUserManagementService(db)
 	roleMgmtSvc := services.NewRoleManagementService(db)
 	teamMgmtSvc := services.NewTeamManagementService(db)
+	fxSvc := services.NewFXService(db)
+	permissionSvc := services.NewPermissionService(db)
+	importSvc := services.NewImportService(db, ingestionSvc)
+	importJobs := services.NewImportJobRunner(
+		importSvc,
+		cfg.ImportWorkers,
+		time.Duration(cfg.ImportPollInterval)*time.Second,
+		appLogger,
+	)
+	idempotencyPurger := services.NewIdempotencyKeyPurger(ingestionSvc, 0, appLogger)
 
 	// Initialize handlers with all services
 	h := handlers.NewHandlers(
@@ -103,6 +124,9 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 		userMgmtSvc,
 		roleMgmtSvc,
 		teamMgmtSvc,
+		fxSvc,
+		permissionSvc,
+		importSvc,
 	)
 
 	// ========================================================================
@@ -122,6 +146,7 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 				if cfg.ConvinWebhookSecret != "" {
 					convinWebhooks.Use(middleware.WebhookSignatureMiddleware(cfg.ConvinWebhookSecret))
 				}
+				convinWebhooks.Use(h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceConvinWebhook))
 				convinWebhooks.POST("", h.HandleConvinWebhook)
 
 				// Generic telephony webhook
@@ -129,6 +154,7 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 				if cfg.TelephonyWebhookSecret != "" {
 					telephonyWebhooks.Use(middleware.WebhookSignatureMiddleware(cfg.TelephonyWebhookSecret))
 				}
+				telephonyWebhooks.Use(h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceTelephonyWebhook))
 				telephonyWebhooks.POST("", h.HandleGenericTelephonyWebhook)
 			}
 		}
@@ -136,10 +162,32 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 		// ====================================================================
 		// Data Ingestion APIs
 		// ====================================================================
-		v1.POST("/interactions", h.IngestInteraction)
-		v1.POST("/conversions", h.IngestConversion)
-		v1.POST("/events", h.IngestEvent)
-		v1.POST("/page-views", h.TrackPageView)
+		v1.POST("/interactions", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceInteractions), h.IngestInteraction)
+		v1.POST("/interactions/batch", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceInteractionBatch), h.IngestInteractionBatch)
+		v1.POST("/impressions", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceImpressions), h.IngestImpression)
+		v1.POST("/conversions", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceConversions), h.IngestConversion)
+		v1.POST("/conversions/batch", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceConversionBatch), h.IngestConversionBatch)
+		v1.POST("/events", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourceEvents), h.IngestEvent)
+		v1.POST("/page-views", h.Idempotent(), h.DeadLetter(handlers.DeadLetterSourcePageViews), h.TrackPageView)
+
+		// File imports (CSV / NDJSON)
+		v1.POST("/imports", h.CreateImport)
+		v1.GET("/imports", h.ListImports)
+		v1.GET("/imports/:id", h.GetImport)
+		v1.GET("/imports/:id/rejected", h.GetImportRejectedRows)
+
+		// Rejected payloads (dead letters) and replay
+		v1.GET("/dead-letters", h.ListDeadLetters)
+		v1.POST("/dead-letters/replay", h.ReplayDeadLetters)
+		v1.GET("/dead-letters/:id", h.GetDeadLetter)
+		v1.PUT("/dead-letters/:id", h.UpdateDeadLetter)
+		v1.DELETE("/dead-letters/:id", h.DiscardDeadLetter)
+		v1.POST("/dead-letters/:id/replay", h.ReplayDeadLetter)
+
+		// Unknown agents, vendors and products ingested records refer to
+		v1.GET("/unresolved-references", h.ListUnresolvedReferences)
+		v1.POST("/unresolved-references/:id/map", h.MapUnresolvedReference)
+		v1.POST("/unresolved-references/:id/create", h.CreateReferenceTarget)
 
 		// ====================================================================
 		// Customer Identity & Journey
@@ -149,9 +197,24 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 		// ====================================================================
 		// Attribution Engine
 		// ====================================================================
+		v1.GET("/attribution/models", h.ListAttributionModels)
+		v1.POST("/attribution/models", h.CreateAttributionModel)
+		v1.PUT("/attribution/models/:code", h.UpdateAttributionModel)
+		v1.GET("/attribution/periods", h.ListAttributionPeriods)
+		v1.GET("/attribution/periods/events", h.ListAttributionPeriodEvents)
+		v1.POST("/attribution/periods/:period/close", h.CloseAttributionPeriod)
+		v1.POST("/attribution/periods/:period/reopen", h.ReopenAttributionPeriod)
 		v1.POST("/attribution/runs", h.CreateAttributionRun)
 		v1.GET("/attribution/runs/:run_id", h.GetAttributionRun)
 		v1.POST("/attribution/runs/:run_id/execute", h.ExecuteAttributionRun)
+		v1.POST("/attribution/runs/:run_id/cancel", h.CancelAttributionRun)
+		v1.GET("/attribution/runs/:run_id/errors", h.GetAttributionRunErrors)
+		v1.GET("/attribution/runs/:run_id/versions", h.ListAttributionRunVersions)
+		v1.GET("/attribution/runs/:run_id/versions/diff", h.DiffAttributionRunVersions)
+		v1.GET("/attribution/runs/:run_id/intervals", h.GetAttributionRunIntervals)
+		v1.GET("/conversions/:id/attribution", h.GetConversionAttribution)
+		v1.POST("/attribution/runs/:run_id/live", h.SetLiveAttributionRun)
+		v1.DELETE("/attribution/runs/:run_id/live", h.ClearLiveAttributionRun)
 
 		// ====================================================================
 		// Core Analytics
@@ -162,6 +225,8 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 			analytics.GET("/agents/revenue", h.GetAgentRevenueSummary)
 			analytics.GET("/vendors/comparison", h.GetVendorComparison)
 			analytics.GET("/intents/revenue", h.GetIntentProfitability)
+			analytics.GET("/attribution/compare", h.CompareAttributionRuns)
+			analytics.GET("/paths", h.GetConvertingPaths)
 
 			// Advanced analytics (Factors.ai-style)
 			analytics.GET("/funnel/stages", h.GetFunnelStageMetrics)
@@ -174,6 +239,18 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 			analytics.GET("/realtime/metrics", h.GetRealtimeMetrics)
 		}
 
+		// ====================================================================
+		// Currencies & FX Rates
+		// ====================================================================
+		fx := v1.Group("/fx")
+		{
+			fx.GET("/reporting-currency", h.GetReportingCurrency)
+			fx.PUT("/reporting-currency", h.SetReportingCurrency)
+			fx.GET("/rates", h.ListFXRates)
+			fx.POST("/rates", h.LoadFXRates)
+			fx.POST("/rates/csv", h.LoadFXRatesCSV)
+		}
+
 		// ====================================================================
 		// Vendors
 		// ====================================================================
@@ -188,6 +265,7 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 			abm.GET("/accounts", h.ListAccounts)
 			abm.GET("/accounts/:id", h.GetAccount)
 			abm.GET("/accounts/:id/summary", h.GetAccountSummary)
+			abm.GET("/accounts/:id/attribution", h.GetAccountAttribution)
 			abm.POST("/accounts/engagements", h.TrackAccountEngagement)
 			abm.GET("/insights/target-accounts", h.GetTargetAccountInsights)
 		}
@@ -402,10 +480,13 @@ func NewServer(db *sqlx.DB, cfg *config.Config) (*Server, error) {
 	})
 
 	return &Server{
-		Router: router,
-		db:     db,
-		logger: appLogger,
-		cfg:    cfg,
+		Router:            router,
+		db:                db,
+		logger:            appLogger,
+		cfg:               cfg,
+		attributionJobs:   attributionJobs,
+		importJobs:        importJobs,
+		idempotencyPurger: idempotencyPurger,
 	}, nil
 }
 
@@ -419,6 +500,11 @@ func (s *Server) Start() error {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Start background attribution workers
+	s.attributionJobs.Start(context.Background())
+	s.importJobs.Start(context.Background())
+	s.idempotencyPurger.Start(context.Background())
+
 	// Start server in a goroutine
 	go func() {
 		s.logger.Info("Server starting", zap.String("port", s.cfg.Port), zap.String("environment", s.cfg.Environment))
@@ -443,6 +529,11 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	// Stop attribution workers; runs in progress go back on the queue
+	s.attributionJobs.Stop()
+	s.importJobs.Stop()
+	s.idempotencyPurger.Stop()
+
 	s.logger.Info("Server exited gracefully")
 	return nil
 }
@@ -50,6 +50,15 @@ type Config struct {
 	SentryDSN          string
 	NewRelicLicenseKey string
 
+	// Attribution job runner
+	AttributionWorkers             int
+	AttributionPollInterval        int // seconds
+	AttributionIncrementalInterval int // seconds between live run updates, 0 disables
+
+	// File import workers
+	ImportWorkers      int
+	ImportPollInterval int // seconds
+
 	// Feature Flags
 	EnableWebhooks           bool
 	EnableRealtimeProcessing bool
@@ -103,6 +112,15 @@ func Load() *Config {
 		SentryDSN:          getEnv("SENTRY_DSN", ""),
 		NewRelicLicenseKey: getEnv("NEW_RELIC_LICENSE_KEY", ""),
 
+		// Attribution job runner
+		AttributionWorkers:             getEnvAsInt("ATTRIBUTION_WORKERS", 2),
+		AttributionPollInterval:        getEnvAsInt("ATTRIBUTION_POLL_INTERVAL", 5),
+		AttributionIncrementalInterval: getEnvAsInt("ATTRIBUTION_INCREMENTAL_INTERVAL", 300),
+
+		// File import workers
+		ImportWorkers:      getEnvAsInt("IMPORT_WORKERS", 1),
+		ImportPollInterval: getEnvAsInt("IMPORT_POLL_INTERVAL", 5),
+
 		// Feature Flags
 		EnableWebhooks:           getEnvAsBool("ENABLE_WEBHOOKS", true),
 		EnableRealtimeProcessing: getEnvAsBool("ENABLE_REALTIME_PROCESSING", true),
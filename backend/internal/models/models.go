@@ -46,6 +46,19 @@ type Currency struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
+// FXRate is a daily exchange rate: one unit of BaseCurrency is worth Rate
+// units of QuoteCurrency on RateDate
+type FXRate struct {
+	ID            int64     `db:"id" json:"id"`
+	TenantID      int64     `db:"tenant_id" json:"tenant_id"`
+	RateDate      time.Time `db:"rate_date" json:"rate_date"`
+	BaseCurrency  string    `db:"base_currency" json:"base_currency"`
+	QuoteCurrency string    `db:"quote_currency" json:"quote_currency"`
+	Rate          float64   `db:"rate" json:"rate"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+}
+
 // Channel represents a communication channel
 type Channel struct {
 	ID          int       `db:"id" json:"id"`
@@ -70,6 +83,8 @@ type AttributionModel struct {
 	Name        string    `db:"name" json:"name"`
 	Description string    `db:"description" json:"description"`
 	Params      JSONB     `db:"params" json:"params"`
+	TenantID    *int64    `db:"tenant_id" json:"tenant_id,omitempty"`
+	ModelType   string    `db:"model_type" json:"model_type"`
 	CreatedAt   time.Time `db:"created_at" json:"created_at"`
 }
 
@@ -199,7 +214,9 @@ type ConversionEvent struct {
 	AmountDecimal   float64   `db:"amount_decimal" json:"amount_decimal"`
 	OccurredAt      time.Time `db:"occurred_at" json:"occurred_at"`
 	RawPayload      JSONB     `db:"raw_payload" json:"raw_payload"`
+	ReversesEventID *int64    `db:"reverses_event_id" json:"reverses_event_id,omitempty"`
 	CreatedAt       time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt       *time.Time `db:"updated_at" json:"updated_at,omitempty"`
 }
 
 // AttributionRun represents a batch attribution calculation
@@ -211,19 +228,62 @@ type AttributionRun struct {
 	Description string    `db:"description" json:"description"`
 	Config      JSONB     `db:"config" json:"config"`
 	Status      string    `db:"status" json:"status"`
+	ModelOutput JSONB     `db:"model_output" json:"model_output,omitempty"`
+	CurrentVersion *int   `db:"current_version" json:"current_version"`
+	IsLive            bool       `db:"is_live" json:"is_live"`
+	Watermark         *time.Time `db:"watermark" json:"watermark,omitempty"`
+	LastIncrementalAt *time.Time `db:"last_incremental_at" json:"last_incremental_at,omitempty"`
+	QueuedAt    *time.Time `db:"queued_at" json:"queued_at,omitempty"`
 	StartedAt   *time.Time `db:"started_at" json:"started_at"`
 	CompletedAt *time.Time `db:"completed_at" json:"completed_at"`
+	TotalConversions     int     `db:"total_conversions" json:"total_conversions"`
+	ProcessedConversions int     `db:"processed_conversions" json:"processed_conversions"`
+	FailedConversions    int     `db:"failed_conversions" json:"failed_conversions"`
+	ProgressPercent      float64 `db:"-" json:"progress_percent"`
+	CancelRequested      bool    `db:"cancel_requested" json:"cancel_requested"`
+	ErrorMessage         *string `db:"error_message" json:"error_message,omitempty"`
 	CreatedAt   time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
 }
 
+// AttributionRunVersion is one execution of an attribution run and the
+// result set it wrote
+type AttributionRunVersion struct {
+	ID                   int64      `db:"id" json:"id"`
+	AttributionRunID     int64      `db:"attribution_run_id" json:"attribution_run_id"`
+	Version              int        `db:"version" json:"version"`
+	Status               string     `db:"status" json:"status"`
+	IsCurrent            bool       `db:"is_current" json:"is_current"`
+	TotalConversions     int        `db:"total_conversions" json:"total_conversions"`
+	ProcessedConversions int        `db:"processed_conversions" json:"processed_conversions"`
+	FailedConversions    int        `db:"failed_conversions" json:"failed_conversions"`
+	ResultRows           int        `db:"result_rows" json:"result_rows"`
+	AttributedAmount     float64    `db:"attributed_amount" json:"attributed_amount"`
+	ModelOutput          JSONB      `db:"model_output" json:"model_output,omitempty"`
+	ErrorMessage         *string    `db:"error_message" json:"error_message,omitempty"`
+	StartedAt            *time.Time `db:"started_at" json:"started_at"`
+	CompletedAt          *time.Time `db:"completed_at" json:"completed_at"`
+}
+
+// AttributionRunError records a conversion that could not be attributed in a run
+type AttributionRunError struct {
+	ID                int64     `db:"id" json:"id"`
+	AttributionRunID  int64     `db:"attribution_run_id" json:"attribution_run_id"`
+	ConversionEventID *int64    `db:"conversion_event_id" json:"conversion_event_id"`
+	ResultVersion     int       `db:"result_version" json:"result_version"`
+	ErrorMessage      string    `db:"error_message" json:"error_message"`
+	CreatedAt         time.Time `db:"created_at" json:"created_at"`
+}
+
 // AttributionResult represents an attribution result
 type AttributionResult struct {
 	ID                 int64     `db:"id" json:"id"`
 	TenantID           int64     `db:"tenant_id" json:"tenant_id"`
 	AttributionRunID   int64     `db:"attribution_run_id" json:"attribution_run_id"`
 	ConversionEventID  int64     `db:"conversion_event_id" json:"conversion_event_id"`
-	InteractionID      int64     `db:"interaction_id" json:"interaction_id"`
+	InteractionID      *int64    `db:"interaction_id" json:"interaction_id"`
+	AccountEngagementID *int64   `db:"account_engagement_id" json:"account_engagement_id,omitempty"`
+	AccountID          *int64    `db:"account_id" json:"account_id,omitempty"`
 	CustomerID         int64     `db:"customer_id" json:"customer_id"`
 	AgentID            *int       `db:"agent_id" json:"agent_id"`
 	TeamID             *int       `db:"team_id" json:"team_id"`
@@ -232,6 +292,16 @@ type AttributionResult struct {
 	AttributionWeight  float64   `db:"attribution_weight" json:"attribution_weight"`
 	AttributedAmount   float64   `db:"attributed_amount" json:"attributed_amount"`
 	IsPrimaryTouch     bool      `db:"is_primary_touch" json:"is_primary_touch"`
+	Explanation        JSONB     `db:"explanation" json:"explanation,omitempty"`
+	ResultVersion      int       `db:"result_version" json:"result_version"`
+	ReversalEventID    *int64    `db:"reversal_event_id" json:"reversal_event_id,omitempty"`
+	CurrencyID         *int      `db:"currency_id" json:"currency_id"`
+	SourceAmount       *float64  `db:"source_amount" json:"source_amount"`
+	FXRate             *float64  `db:"fx_rate" json:"fx_rate"`
+	AgentRole          *string   `db:"agent_role" json:"agent_role,omitempty"`
+	AgentShare         *float64  `db:"agent_share" json:"agent_share,omitempty"`
+	AdjustmentPeriod   *time.Time `db:"adjustment_period" json:"adjustment_period,omitempty"`
+	ReportedAt         *time.Time `db:"reported_at" json:"reported_at,omitempty"`
 	CreatedAt          time.Time `db:"created_at" json:"created_at"`
 }
 
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAccountNotFound is returned for an account the tenant doesn't have
+var ErrAccountNotFound = errors.New("account not found")
+
+// AccountAttribution is the credit an account-level run gave the touches
+// behind one account's conversions
+type AccountAttribution struct {
+	AccountID        int64                     `json:"account_id"`
+	RunID            int64                     `json:"run_id"`
+	Version          int                       `json:"version"`
+	ModelCode        string                    `json:"model_code"`
+	AttributedAmount float64                   `json:"attributed_amount"`
+	Conversions      int                       `json:"conversions"`
+	ByChannel        []AttributionBreakdownRow `json:"by_channel"`
+	ByAgent          []AttributionBreakdownRow `json:"by_agent"`
+	ByVendor         []AttributionBreakdownRow `json:"by_vendor"`
+}
+
+// GetAccountAttribution totals an account's attributed revenue by channel (or
+// engagement type), agent and vendor. Without a runID it uses the most recent
+// account-level run with results, preferring the live one.
+func (s *ABMService) GetAccountAttribution(tenantID, accountID int64, runID *int64, from, to *time.Time) (*AccountAttribution, error) {
+	var exists bool
+	err := s.db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND tenant_id = $2)`, accountID, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrAccountNotFound, accountID)
+	}
+
+	var run struct {
+		ID        int64  `db:"id"`
+		Version   *int   `db:"current_version"`
+		ModelCode string `db:"model_code"`
+	}
+	query := `
+		SELECT r.id, r.current_version, m.code as model_code
+		FROM attribution_runs r
+		INNER JOIN attribution_models m ON r.model_id = m.id
+		WHERE r.tenant_id = $1`
+	if runID != nil {
+		err = s.db.Get(&run, query+` AND r.id = $2`, tenantID, *runID)
+	} else {
+		err = s.db.Get(&run, query+`
+			AND r.current_version IS NOT NULL
+			AND r.config->>'attribution_level' = $2
+			ORDER BY r.is_live DESC, r.created_at DESC
+			LIMIT 1`,
+			tenantID, AttributionLevelAccount,
+		)
+	}
+	if err == sql.ErrNoRows {
+		if runID != nil {
+			return nil, fmt.Errorf("%w: %d", ErrAttributionRunNotFound, *runID)
+		}
+		return nil, fmt.Errorf("%w: no account-level run has results", ErrAttributionRunNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution run: %w", err)
+	}
+	if run.Version == nil {
+		return nil, fmt.Errorf("%w: run %d has no completed results", ErrAttributionVersionNotFound, run.ID)
+	}
+
+	attribution := &AccountAttribution{
+		AccountID: accountID,
+		RunID:     run.ID,
+		Version:   *run.Version,
+		ModelCode: run.ModelCode,
+	}
+	breakdowns := map[string]*[]AttributionBreakdownRow{
+		"channel": &attribution.ByChannel,
+		"agent":   &attribution.ByAgent,
+		"vendor":  &attribution.ByVendor,
+	}
+	for dimension, rows := range breakdowns {
+		*rows, err = queryAttributionBreakdown(s.db, tenantID, run.ID, *run.Version, dimension, from, to, &accountID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range attribution.ByChannel {
+		attribution.AttributedAmount += row.AttributedAmount
+	}
+
+	query = `
+		SELECT COUNT(DISTINCT ar.conversion_event_id)
+		FROM attribution_results ar
+		INNER JOIN conversion_events ce ON ar.conversion_event_id = ce.id
+		WHERE ar.tenant_id = $1 AND ar.attribution_run_id = $2 AND ar.result_version = $3 AND ar.account_id = $4`
+	args := []interface{}{tenantID, run.ID, *run.Version, accountID}
+	if from != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", len(args)+1)
+		args = append(args, *from)
+	}
+	if to != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", len(args)+1)
+		args = append(args, *to)
+	}
+	if err := s.db.Get(&attribution.Conversions, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to count account conversions: %w", err)
+	}
+
+	return attribution, nil
+}
@@ -36,7 +36,7 @@ func (s *AdvancedAnalyticsService) GetFunnelStageMetrics(tenantID int64, from, t
 				COALESCE(SUM(ar.attributed_amount), 0) as total_revenue,
 				AVG(EXTRACT(EPOCH FROM (i.ended_at - i.started_at))/3600) as avg_time_in_stage
 			FROM interactions i
-			LEFT JOIN attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
+			LEFT JOIN current_attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
 			LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id
 			WHERE i.tenant_id = $1
 	`
@@ -171,7 +171,7 @@ func (s *AdvancedAnalyticsService) GetContentEngagementMetrics(tenantID int64, f
 			END as conversion_rate
 		FROM content_assets ca
 		LEFT JOIN content_engagements ce ON ca.id = ce.content_id AND ce.tenant_id = $1
-		LEFT JOIN attribution_results ar ON ce.interaction_id = ar.interaction_id AND ar.tenant_id = $1
+		LEFT JOIN current_attribution_results ar ON ce.interaction_id = ar.interaction_id AND ar.tenant_id = $1
 		WHERE ca.tenant_id = $1
 	`
 
@@ -207,64 +207,90 @@ func (s *AdvancedAnalyticsService) GetContentEngagementMetrics(tenantID int64, f
 
 // MultiChannelROI represents ROI across different ad platforms
 type MultiChannelROI struct {
-	Platform           string  `json:"platform" db:"platform"`
-	TotalSpend         float64 `json:"total_spend" db:"total_spend"`
-	TotalImpressions   int64   `json:"total_impressions" db:"total_impressions"`
-	TotalClicks        int64   `json:"total_clicks" db:"total_clicks"`
-	AttributedRevenue  float64 `json:"attributed_revenue" db:"attributed_revenue"`
-	ROI                float64 `json:"roi" db:"roi"`
-	CPC                float64 `json:"cpc" db:"cpc"`
-	CPM                float64 `json:"cpm" db:"cpm"`
+	Platform            string  `json:"platform" db:"platform"`
+	TotalSpend          float64 `json:"total_spend" db:"total_spend"`
+	TotalImpressions    int64   `json:"total_impressions" db:"total_impressions"`
+	TotalClicks         int64   `json:"total_clicks" db:"total_clicks"`
+	AttributedRevenue   float64 `json:"attributed_revenue" db:"attributed_revenue"`
+	// Revenue credited to clicks and calls vs. to ad impressions (view-through)
+	ClickThroughRevenue float64 `json:"click_through_revenue" db:"click_through_revenue"`
+	ViewThroughRevenue  float64 `json:"view_through_revenue" db:"view_through_revenue"`
+	ROI                 float64 `json:"roi" db:"roi"`
+	CPC                 float64 `json:"cpc" db:"cpc"`
+	CPM                 float64 `json:"cpm" db:"cpm"`
 }
 
-// GetMultiChannelROI returns ROI metrics across ad platforms
+// GetMultiChannelROI returns ROI metrics across ad platforms. Revenue is
+// credited to a platform through the interaction's campaign (or its
+// ad_platform) and split between click-through and view-through touches.
 func (s *AdvancedAnalyticsService) GetMultiChannelROI(tenantID int64, from, to *time.Time) ([]MultiChannelROI, error) {
-	query := `
-		SELECT 
-			COALESCE(as_spend.platform, 'Unknown') as platform,
-			COALESCE(SUM(as_spend.spend_amount), 0) as total_spend,
-			COALESCE(SUM(as_spend.impressions), 0) as total_impressions,
-			COALESCE(SUM(as_spend.clicks), 0) as total_clicks,
-			COALESCE(SUM(ar.attributed_amount), 0) as attributed_revenue,
-			CASE 
-				WHEN SUM(as_spend.spend_amount) > 0 THEN
-					((SUM(ar.attributed_amount) - SUM(as_spend.spend_amount)) / SUM(as_spend.spend_amount)) * 100
-				ELSE 0
-			END as roi,
-			CASE 
-				WHEN SUM(as_spend.clicks) > 0 THEN
-					SUM(as_spend.spend_amount) / SUM(as_spend.clicks)
-				ELSE 0
-			END as cpc,
-			CASE 
-				WHEN SUM(as_spend.impressions) > 0 THEN
-					(SUM(as_spend.spend_amount) / SUM(as_spend.impressions)) * 1000
-				ELSE 0
-			END as cpm
-		FROM ad_spend as_spend
-		LEFT JOIN campaigns c ON as_spend.campaign_id = c.id
-		LEFT JOIN interactions i ON i.campaign_id = c.id AND i.tenant_id = $1
-		LEFT JOIN attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
-		WHERE as_spend.tenant_id = $1
-	`
-
 	args := []interface{}{tenantID}
 	argPos := 2
 
+	spendFilter, revenueFilter := "", ""
 	if from != nil {
-		query += fmt.Sprintf(" AND as_spend.date >= $%d", argPos)
+		spendFilter += fmt.Sprintf(" AND as_spend.date >= $%d", argPos)
+		revenueFilter += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", argPos)
 		args = append(args, *from)
 		argPos++
 	}
 
 	if to != nil {
-		query += fmt.Sprintf(" AND as_spend.date <= $%d", argPos)
+		spendFilter += fmt.Sprintf(" AND as_spend.date <= $%d", argPos)
+		revenueFilter += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", argPos)
 		args = append(args, *to)
 		argPos++
 	}
 
-	query += `
-		GROUP BY as_spend.platform
+	query := `
+		WITH platform_spend AS (
+			SELECT 
+				as_spend.platform,
+				SUM(as_spend.spend_amount) as spend,
+				SUM(as_spend.impressions) as impressions,
+				SUM(as_spend.clicks) as clicks
+			FROM ad_spend as_spend
+			WHERE as_spend.tenant_id = $1` + spendFilter + `
+			GROUP BY as_spend.platform
+		),
+		platform_revenue AS (
+			SELECT 
+				COALESCE(c.platform, i.ad_platform) as platform,
+				SUM(ar.attributed_amount) FILTER (WHERE NOT COALESCE(i.is_view_through, FALSE)) as click_through,
+				SUM(ar.attributed_amount) FILTER (WHERE i.is_view_through) as view_through
+			FROM current_attribution_results ar
+			INNER JOIN interactions i ON ar.interaction_id = i.id
+			LEFT JOIN campaigns c ON i.campaign_id = c.id
+			LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id
+			WHERE ar.tenant_id = $1
+			  AND COALESCE(c.platform, i.ad_platform) IS NOT NULL` + revenueFilter + `
+			GROUP BY 1
+		)
+		SELECT 
+			COALESCE(ps.platform, pr.platform, 'Unknown') as platform,
+			COALESCE(ps.spend, 0) as total_spend,
+			COALESCE(ps.impressions, 0) as total_impressions,
+			COALESCE(ps.clicks, 0) as total_clicks,
+			COALESCE(pr.click_through, 0) + COALESCE(pr.view_through, 0) as attributed_revenue,
+			COALESCE(pr.click_through, 0) as click_through_revenue,
+			COALESCE(pr.view_through, 0) as view_through_revenue,
+			CASE 
+				WHEN ps.spend > 0 THEN
+					((COALESCE(pr.click_through, 0) + COALESCE(pr.view_through, 0) - ps.spend) / ps.spend) * 100
+				ELSE 0
+			END as roi,
+			CASE 
+				WHEN ps.clicks > 0 THEN
+					ps.spend / ps.clicks
+				ELSE 0
+			END as cpc,
+			CASE 
+				WHEN ps.impressions > 0 THEN
+					(ps.spend / ps.impressions) * 1000
+				ELSE 0
+			END as cpm
+		FROM platform_spend ps
+		FULL OUTER JOIN platform_revenue pr ON ps.platform = pr.platform
 		ORDER BY attributed_revenue DESC
 	`
 
@@ -374,7 +400,7 @@ func (s *AdvancedAnalyticsService) GetCustomReport(tenantID int64, req CustomRep
 		FROM interactions i
 		LEFT JOIN channels c ON i.channel_id = c.id
 		LEFT JOIN campaigns camp ON i.campaign_id = camp.id
-		LEFT JOIN attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
+		LEFT JOIN current_attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
 		WHERE i.tenant_id = $1
 	`
 
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -24,16 +25,22 @@ type AgentRevenueSummary struct {
 	VendorName                     string  `json:"vendor_name" db:"vendor_name"`
 	TeamID                         *int    `json:"team_id" db:"team_id"`
 	TeamName                       string  `json:"team_name" db:"team_name"`
-	TotalAttributedAmount          float64 `json:"total_attributed_amount" db:"total_attributed_amount"`
+	TotalAttributedAmount          float64 `json:"total_attributed_amount" db:"total_attributed_amount"` // net of reversals
+	GrossAttributedAmount          float64 `json:"gross_attributed_amount" db:"gross_attributed_amount"`
+	ReversedAmount                 float64 `json:"reversed_amount" db:"reversed_amount"`
 	TotalConversions               int     `json:"total_conversions" db:"total_conversions"`
 	AvgAttributedAmountPerInteraction float64 `json:"avg_attributed_amount_per_interaction" db:"avg_attributed_amount_per_interaction"`
+	// Interval is the bootstrap range of TotalAttributedAmount, for runs with bootstrap_samples
+	Interval                       *ConfidenceInterval `json:"interval,omitempty" db:"-"`
 }
 
-// GetAgentRevenueSummary returns revenue summary for agents
-func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time.Time, vendorID *int, modelCode string) ([]AgentRevenueSummary, error) {
+// GetAgentRevenueSummary returns revenue summary for agents. Without a run,
+// the results of the model's runs at the attribution level are summed. With
+// a date range, a run's intervals are only given if recomputeIntervals.
+func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time.Time, vendorID *int, modelCode string, runID *int64, level string, recomputeIntervals bool) ([]AgentRevenueSummary, error) {
 	// Check if attribution_results exist, otherwise use fallback
 	var hasAttribution int
-	_ = s.db.Get(&hasAttribution, `SELECT COUNT(*) FROM attribution_results WHERE tenant_id = $1 LIMIT 1`, tenantID)
+	_ = s.db.Get(&hasAttribution, `SELECT COUNT(*) FROM current_attribution_results WHERE tenant_id = $1 LIMIT 1`, tenantID)
 
 	var query string
 	args := []interface{}{tenantID}
@@ -51,12 +58,14 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 				a.team_id,
 				t.name as team_name,
 				COALESCE(SUM(ar.attributed_amount), 0) as total_attributed_amount,
+				COALESCE(SUM(ar.attributed_amount) FILTER (WHERE ar.reversal_event_id IS NULL), 0) as gross_attributed_amount,
+				COALESCE(-SUM(ar.attributed_amount) FILTER (WHERE ar.reversal_event_id IS NOT NULL), 0) as reversed_amount,
 				COUNT(DISTINCT ar.conversion_event_id) as total_conversions,
 				COALESCE(SUM(ar.attributed_amount) / NULLIF(COUNT(DISTINCT ar.interaction_id), 0), 0) as avg_attributed_amount_per_interaction
 			FROM agents a
 			LEFT JOIN vendors v ON a.vendor_id = v.id
 			LEFT JOIN teams t ON a.team_id = t.id
-			LEFT JOIN attribution_results ar ON a.id = ar.agent_id AND ar.tenant_id = $1
+			LEFT JOIN current_attribution_results ar ON a.id = ar.agent_id AND ar.tenant_id = $1
 			LEFT JOIN attribution_runs run ON ar.attribution_run_id = run.id
 			LEFT JOIN attribution_models am ON run.model_id = am.id
 			LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id
@@ -69,14 +78,25 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 			argPos++
 		}
 
+		if runID != nil {
+			query += fmt.Sprintf(" AND ar.attribution_run_id = $%d", argPos)
+			args = append(args, *runID)
+			argPos++
+		} else {
+			// Customer- and account-level runs credit the same conversions
+			query += fmt.Sprintf(" AND "+runAttributionLevel+" = $%d", argPos)
+			args = append(args, level)
+			argPos++
+		}
+
 		if from != nil {
-			query += fmt.Sprintf(" AND ce.occurred_at >= $%d", argPos)
+			query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", argPos)
 			args = append(args, *from)
 			argPos++
 		}
 
 		if to != nil {
-			query += fmt.Sprintf(" AND ce.occurred_at <= $%d", argPos)
+			query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", argPos)
 			args = append(args, *to)
 			argPos++
 		}
@@ -97,9 +117,11 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 				COALESCE(v.name, '') as vendor_name,
 				a.team_id,
 				COALESCE(t.name, '') as team_name,
-				COALESCE(SUM(ce.amount_decimal), 0) as total_attributed_amount,
-				COUNT(DISTINCT ce.id) as total_conversions,
-				COALESCE(SUM(ce.amount_decimal) / NULLIF(COUNT(DISTINCT i.id), 0), 0) as avg_attributed_amount_per_interaction
+				COALESCE(SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)), 0) as total_attributed_amount,
+				COALESCE(SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) FILTER (WHERE ce.reverses_event_id IS NULL), 0) as gross_attributed_amount,
+				COALESCE(-SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) FILTER (WHERE ce.reverses_event_id IS NOT NULL), 0) as reversed_amount,
+				COUNT(DISTINCT ce.id) FILTER (WHERE ce.reverses_event_id IS NULL) as total_conversions,
+				COALESCE(SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) / NULLIF(COUNT(DISTINCT i.id), 0), 0) as avg_attributed_amount_per_interaction
 			FROM agents a
 			LEFT JOIN vendors v ON a.vendor_id = v.id
 			LEFT JOIN teams t ON a.team_id = t.id
@@ -130,7 +152,7 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 
 		query += `
 			GROUP BY a.id, a.name, a.email, a.vendor_id, COALESCE(v.name, ''), a.team_id, COALESCE(t.name, '')
-			HAVING COUNT(DISTINCT ce.id) > 0
+			HAVING COUNT(DISTINCT ce.id) FILTER (WHERE ce.reverses_event_id IS NULL) > 0
 			ORDER BY total_attributed_amount DESC
 		`
 	}
@@ -146,6 +168,18 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 		results = []AgentRevenueSummary{}
 	}
 
+	if hasAttribution > 0 && runID != nil {
+		intervals, err := runBootstrapRanges(s.db, tenantID, *runID, "agent", from, to, recomputeIntervals)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			if interval, ok := intervals[strconv.Itoa(results[i].AgentID)]; ok {
+				results[i].Interval = &interval
+			}
+		}
+	}
+
 	return results, nil
 }
 
@@ -153,21 +187,29 @@ func (s *AnalyticsService) GetAgentRevenueSummary(tenantID int64, from, to *time
 type VendorComparison struct {
 	VendorID            int     `json:"vendor_id" db:"vendor_id"`
 	Name                string  `json:"name" db:"name"`
-	TotalAttributedAmount float64 `json:"total_attributed_amount" db:"total_attributed_amount"`
+	TotalAttributedAmount float64 `json:"total_attributed_amount" db:"total_attributed_amount"` // net of reversals
+	GrossAttributedAmount float64 `json:"gross_attributed_amount" db:"gross_attributed_amount"`
+	ReversedAmount      float64 `json:"reversed_amount" db:"reversed_amount"`
 	TotalConversions    int     `json:"total_conversions" db:"total_conversions"`
 	AvgConversionValue  float64 `json:"avg_conversion_value" db:"avg_conversion_value"`
+	// Interval is the bootstrap range of TotalAttributedAmount, for runs with bootstrap_samples
+	Interval            *ConfidenceInterval `json:"interval,omitempty" db:"-"`
 }
 
-// GetVendorComparison returns comparison data for vendors
-func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Time, modelCode string) ([]VendorComparison, error) {
+// GetVendorComparison returns comparison data for vendors. Without a run,
+// the results of the model's runs at the attribution level are summed. With
+// a date range, a run's intervals are only given if recomputeIntervals.
+func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Time, modelCode string, runID *int64, level string, recomputeIntervals bool) ([]VendorComparison, error) {
 	query := `
 		WITH vendor_conversions AS (
 			-- Use attribution_results if available
 			SELECT 
 				ar.vendor_id,
 				SUM(ar.attributed_amount) as total_amount,
+				COALESCE(SUM(ar.attributed_amount) FILTER (WHERE ar.reversal_event_id IS NULL), 0) as gross_amount,
+				COALESCE(-SUM(ar.attributed_amount) FILTER (WHERE ar.reversal_event_id IS NOT NULL), 0) as reversed_amount,
 				COUNT(DISTINCT ar.conversion_event_id) as conversions
-			FROM attribution_results ar
+			FROM current_attribution_results ar
 			LEFT JOIN attribution_runs run ON ar.attribution_run_id = run.id
 			LEFT JOIN attribution_models am ON run.model_id = am.id
 			LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id
@@ -183,14 +225,25 @@ func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Ti
 		argPos++
 	}
 
+	if runID != nil {
+		query += fmt.Sprintf(" AND ar.attribution_run_id = $%d", argPos)
+		args = append(args, *runID)
+		argPos++
+	} else {
+		// Customer- and account-level runs credit the same conversions
+		query += fmt.Sprintf(" AND "+runAttributionLevel+" = $%d", argPos)
+		args = append(args, level)
+		argPos++
+	}
+
 	if from != nil {
-		query += fmt.Sprintf(" AND ce.occurred_at >= $%d", argPos)
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", argPos)
 		args = append(args, *from)
 		argPos++
 	}
 
 	if to != nil {
-		query += fmt.Sprintf(" AND ce.occurred_at <= $%d", argPos)
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", argPos)
 		args = append(args, *to)
 		argPos++
 	}
@@ -202,8 +255,10 @@ func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Ti
 			-- Fallback: Link interactions -> agents -> vendors -> customers -> conversions
 			SELECT 
 				v.id as vendor_id,
-				SUM(ce.amount_decimal) as total_amount,
-				COUNT(DISTINCT ce.id) as conversions
+				SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) as total_amount,
+				COALESCE(SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) FILTER (WHERE ce.reverses_event_id IS NULL), 0) as gross_amount,
+				COALESCE(-SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) FILTER (WHERE ce.reverses_event_id IS NOT NULL), 0) as reversed_amount,
+				COUNT(DISTINCT ce.id) FILTER (WHERE ce.reverses_event_id IS NULL) as conversions
 			FROM interactions i
 			INNER JOIN interaction_participants ip ON i.id = ip.interaction_id AND ip.participant_type = 'agent'
 			INNER JOIN agents a ON ip.agent_id = a.id
@@ -232,6 +287,8 @@ func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Ti
 			SELECT 
 				COALESCE(vc.vendor_id, vcf.vendor_id) as vendor_id,
 				COALESCE(vc.total_amount, vcf.total_amount, 0) as total_amount,
+				COALESCE(vc.gross_amount, vcf.gross_amount, 0) as gross_amount,
+				COALESCE(vc.reversed_amount, vcf.reversed_amount, 0) as reversed_amount,
 				COALESCE(vc.conversions, vcf.conversions, 0) as conversions
 			FROM vendor_conversions vc
 			FULL OUTER JOIN vendor_conversions_fallback vcf ON vc.vendor_id = vcf.vendor_id
@@ -240,12 +297,14 @@ func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Ti
 			v.id as vendor_id,
 			v.name,
 			COALESCE(cvd.total_amount, 0) as total_attributed_amount,
+			COALESCE(cvd.gross_amount, 0) as gross_attributed_amount,
+			COALESCE(cvd.reversed_amount, 0) as reversed_amount,
 			COALESCE(cvd.conversions, 0) as total_conversions,
 			COALESCE(cvd.total_amount / NULLIF(cvd.conversions, 0), 0) as avg_conversion_value
 		FROM vendors v
 		LEFT JOIN combined_vendor_data cvd ON v.id = cvd.vendor_id
 		WHERE v.tenant_id = $1
-		GROUP BY v.id, v.name, cvd.total_amount, cvd.conversions
+		GROUP BY v.id, v.name, cvd.total_amount, cvd.gross_amount, cvd.reversed_amount, cvd.conversions
 		HAVING COALESCE(cvd.conversions, 0) > 0
 		ORDER BY total_attributed_amount DESC
 	`
@@ -256,6 +315,18 @@ func (s *AnalyticsService) GetVendorComparison(tenantID int64, from, to *time.Ti
 		return nil, fmt.Errorf("failed to get vendor comparison: %w", err)
 	}
 
+	if runID != nil {
+		intervals, err := runBootstrapRanges(s.db, tenantID, *runID, "vendor", from, to, recomputeIntervals)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			if interval, ok := intervals[strconv.Itoa(results[i].VendorID)]; ok {
+				results[i].Interval = &interval
+			}
+		}
+	}
+
 	return results, nil
 }
 
@@ -279,7 +350,7 @@ func (s *AnalyticsService) GetIntentProfitability(tenantID int64, from, to *time
 				COUNT(DISTINCT ar.conversion_event_id) as conversions,
 				AVG(i.duration_seconds) as avg_duration
 			FROM interactions i
-			INNER JOIN attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
+			INNER JOIN current_attribution_results ar ON i.id = ar.interaction_id AND ar.tenant_id = $1
 			LEFT JOIN attribution_runs run ON ar.attribution_run_id = run.id
 			LEFT JOIN attribution_models am ON run.model_id = am.id
 			LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id
@@ -298,13 +369,13 @@ func (s *AnalyticsService) GetIntentProfitability(tenantID int64, from, to *time
 	}
 
 	if from != nil {
-		query += fmt.Sprintf(" AND ce.occurred_at >= $%d", argPos)
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", argPos)
 		args = append(args, *from)
 		argPos++
 	}
 
 	if to != nil {
-		query += fmt.Sprintf(" AND ce.occurred_at <= $%d", argPos)
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", argPos)
 		args = append(args, *to)
 		argPos++
 	}
@@ -316,7 +387,7 @@ func (s *AnalyticsService) GetIntentProfitability(tenantID int64, from, to *time
 			-- Fallback: Link interactions -> customers -> conversions
 			SELECT 
 				i.primary_intent,
-				SUM(ce.amount_decimal) as total_amount,
+				SUM(to_reporting_currency(ce.tenant_id, ce.amount_decimal, ce.currency_id, ce.occurred_at)) as total_amount,
 				COUNT(DISTINCT ce.id) as conversions,
 				AVG(i.duration_seconds) as avg_duration
 			FROM interactions i
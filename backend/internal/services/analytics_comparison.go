@@ -0,0 +1,230 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxComparedRuns bounds the number of runs one comparison can include
+const maxComparedRuns = 10
+
+// ComparisonDimensions are the breakdowns returned by CompareAttributionRuns
+var ComparisonDimensions = []string{"agent", "team", "vendor", "channel", "intent"}
+
+// ErrInvalidComparison is returned when the runs to compare are not valid
+var ErrInvalidComparison = errors.New("invalid attribution comparison")
+
+// ComparedRun describes one run in a comparison
+type ComparedRun struct {
+	RunID            int64   `db:"id" json:"run_id"`
+	Name             string  `db:"name" json:"name"`
+	ModelCode        string  `db:"model_code" json:"model_code"`
+	ModelName        string  `db:"model_name" json:"model_name"`
+	Version          *int    `db:"current_version" json:"version"`
+	AttributedAmount float64 `db:"-" json:"attributed_amount"`
+}
+
+// AttributionComparison compares the credit several runs gave per agent,
+// team, vendor, channel and intent. Deltas and rank changes are measured
+// against the first (baseline) run.
+type AttributionComparison struct {
+	BaselineRunID int64                                 `json:"baseline_run_id"`
+	Runs          []ComparedRun                         `json:"runs"`
+	Dimensions    map[string][]AttributionComparisonRow `json:"dimensions"`
+}
+
+// AttributionComparisonRow is one agent, team, vendor, channel or intent
+// across the compared runs
+type AttributionComparisonRow struct {
+	Key    string                       `json:"key"`
+	Label  string                       `json:"label"`
+	Values []AttributionComparisonValue `json:"values"`
+}
+
+// AttributionComparisonValue is a row's credit under one run. Rank is 1 for the
+// largest amount and nil when the run gave the row no credit; RankChange is
+// positive when the row moved up from the baseline.
+type AttributionComparisonValue struct {
+	RunID            int64    `json:"run_id"`
+	AttributedAmount float64  `json:"attributed_amount"`
+	Conversions      int      `json:"conversions"`
+	Rank             *int     `json:"rank"`
+	DeltaAmount      float64  `json:"delta_amount"`
+	DeltaPercent     *float64 `json:"delta_percent"`
+	RankChange       *int     `json:"rank_change"`
+}
+
+// CompareAttributionRuns compares the current result version of two or more
+// runs, typically of different models, along the given dimensions (all of
+// ComparisonDimensions when empty)
+func (s *AnalyticsService) CompareAttributionRuns(tenantID int64, runIDs []int64, dimensions []string, from, to *time.Time) (*AttributionComparison, error) {
+	if len(runIDs) < 2 {
+		return nil, fmt.Errorf("%w: at least two run IDs are required", ErrInvalidComparison)
+	}
+	if len(runIDs) > maxComparedRuns {
+		return nil, fmt.Errorf("%w: at most %d runs can be compared", ErrInvalidComparison, maxComparedRuns)
+	}
+	seen := map[int64]bool{}
+	for _, runID := range runIDs {
+		if seen[runID] {
+			return nil, fmt.Errorf("%w: run %d is listed twice", ErrInvalidComparison, runID)
+		}
+		seen[runID] = true
+	}
+
+	if len(dimensions) == 0 {
+		dimensions = ComparisonDimensions
+	}
+	for _, dimension := range dimensions {
+		if _, ok := attributionDimensions[dimension]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedDimension, dimension)
+		}
+	}
+
+	comparison := &AttributionComparison{
+		BaselineRunID: runIDs[0],
+		Dimensions:    map[string][]AttributionComparisonRow{},
+	}
+
+	for _, runID := range runIDs {
+		var run ComparedRun
+		err := s.db.Get(&run,
+			`SELECT run.id, COALESCE(run.name, '') as name, am.code as model_code, am.name as model_name, run.current_version
+			 FROM attribution_runs run
+			 INNER JOIN attribution_models am ON run.model_id = am.id
+			 WHERE run.id = $1 AND run.tenant_id = $2`,
+			runID, tenantID,
+		)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %d", ErrAttributionRunNotFound, runID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get attribution run: %w", err)
+		}
+		if run.Version == nil {
+			return nil, fmt.Errorf("%w: run %d has no completed results", ErrInvalidComparison, runID)
+		}
+		comparison.Runs = append(comparison.Runs, run)
+	}
+
+	for d, dimension := range dimensions {
+		breakdowns := make([][]AttributionBreakdownRow, len(comparison.Runs))
+		for i, run := range comparison.Runs {
+			rows, err := queryAttributionBreakdown(s.db, tenantID, run.RunID, *run.Version, dimension, from, to, nil)
+			if err != nil {
+				return nil, err
+			}
+			breakdowns[i] = rows
+			if d == 0 {
+				for _, row := range rows {
+					comparison.Runs[i].AttributedAmount += row.AttributedAmount
+				}
+			}
+		}
+		comparison.Dimensions[dimension] = compareBreakdowns(runIDs, breakdowns)
+	}
+
+	return comparison, nil
+}
+
+// compareBreakdowns lines up the breakdowns of several runs by key, ranks each
+// run's rows by amount and measures every run against the first. Rows are
+// ordered by baseline amount, then by the largest amount under any run.
+func compareBreakdowns(runIDs []int64, breakdowns [][]AttributionBreakdownRow) []AttributionComparisonRow {
+	index := map[string]int{}
+	rows := []AttributionComparisonRow{}
+	for i, breakdown := range breakdowns {
+		ranks := competitionRanks(breakdown)
+		for j, b := range breakdown {
+			at, ok := index[b.Key]
+			if !ok {
+				at = len(rows)
+				index[b.Key] = at
+				row := AttributionComparisonRow{Key: b.Key, Label: b.Label, Values: make([]AttributionComparisonValue, len(runIDs))}
+				for k, runID := range runIDs {
+					row.Values[k].RunID = runID
+				}
+				rows = append(rows, row)
+			}
+			rank := ranks[j]
+			rows[at].Values[i].AttributedAmount = b.AttributedAmount
+			rows[at].Values[i].Conversions = b.Conversions
+			rows[at].Values[i].Rank = &rank
+		}
+	}
+
+	for r := range rows {
+		baseline := rows[r].Values[0]
+		for i := 1; i < len(rows[r].Values); i++ {
+			value := &rows[r].Values[i]
+			value.DeltaAmount = value.AttributedAmount - baseline.AttributedAmount
+			if baseline.AttributedAmount != 0 {
+				percent := value.DeltaAmount / baseline.AttributedAmount * 100
+				value.DeltaPercent = &percent
+			}
+			if baseline.Rank != nil && value.Rank != nil {
+				change := *baseline.Rank - *value.Rank
+				value.RankChange = &change
+			}
+		}
+	}
+
+	sort.SliceStable(rows, func(a, b int) bool {
+		baseA, baseB := rows[a].Values[0].AttributedAmount, rows[b].Values[0].AttributedAmount
+		if baseA != baseB {
+			return baseA > baseB
+		}
+		maxA, maxB := maxComparedAmount(rows[a]), maxComparedAmount(rows[b])
+		if maxA != maxB {
+			return maxA > maxB
+		}
+		return naturalKeyLess(rows[a].Key, rows[b].Key)
+	})
+	return rows
+}
+
+// competitionRanks ranks rows by amount, largest first, with ties sharing a
+// rank (1, 2, 2, 4)
+func competitionRanks(rows []AttributionBreakdownRow) []int {
+	order := make([]int, len(rows))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return rows[order[a]].AttributedAmount > rows[order[b]].AttributedAmount
+	})
+
+	ranks := make([]int, len(rows))
+	for position, i := range order {
+		if position > 0 && rows[i].AttributedAmount == rows[order[position-1]].AttributedAmount {
+			ranks[i] = ranks[order[position-1]]
+		} else {
+			ranks[i] = position + 1
+		}
+	}
+	return ranks
+}
+
+func maxComparedAmount(row AttributionComparisonRow) float64 {
+	max := row.Values[0].AttributedAmount
+	for _, value := range row.Values[1:] {
+		if value.AttributedAmount > max {
+			max = value.AttributedAmount
+		}
+	}
+	return max
+}
+
+// naturalKeyLess orders numeric keys numerically and anything else as text
+func naturalKeyLess(a, b string) bool {
+	na, errA := strconv.ParseInt(a, 10, 64)
+	nb, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
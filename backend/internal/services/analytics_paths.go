@@ -0,0 +1,305 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/lib/pq"
+)
+
+// Path levels: what each step of a converting path is labelled by
+const (
+	PathLevelChannel = "channel"
+	PathLevelVendor  = "vendor"
+	PathLevelIntent  = "intent"
+)
+
+// pathStepSeparator joins the steps of a path key, e.g. "Webchat > Voice(inbound)"
+const pathStepSeparator = " > "
+
+// defaultPathLimit is the number of paths returned when no limit is given
+const defaultPathLimit = 20
+
+// ErrInvalidPathQuery is returned for path analysis filters that can't be used
+var ErrInvalidPathQuery = errors.New("invalid path query")
+
+// PathAnalysisQuery selects the conversions and touches behind converting
+// paths. Channels, VendorID and Intent keep only matching touches in each
+// path; From and To bound the conversion time.
+type PathAnalysisQuery struct {
+	Level       string
+	Channels    []string
+	VendorID    *int
+	Intent      string
+	EventTypes  []string
+	From        *time.Time
+	To          *time.Time
+	WindowHours int
+	Limit       int
+}
+
+// ConvertingPath is one ordered touch sequence and the conversions it preceded
+type ConvertingPath struct {
+	Path               string   `json:"path"`
+	Steps              []string `json:"steps"`
+	Conversions        int      `json:"conversions"`
+	Revenue            float64  `json:"revenue"`
+	AvgPathLength      float64  `json:"avg_path_length"`
+	AvgHoursToConvert  float64  `json:"avg_hours_to_convert"`
+	ShareOfConversions float64  `json:"share_of_conversions"`
+}
+
+// PathAnalysis lists the most common converting paths
+type PathAnalysis struct {
+	Level       string `json:"level"`
+	WindowHours int    `json:"window_hours"`
+	Conversions int    `json:"conversions"`
+	// WithoutTouches counts conversions with no matching touch in the window
+	WithoutTouches int              `json:"without_touches"`
+	DistinctPaths  int              `json:"distinct_paths"`
+	Paths          []ConvertingPath `json:"paths"`
+}
+
+// pathConversion is a conversion with its amount in the reporting currency
+type pathConversion struct {
+	models.ConversionEvent
+	ReportingAmount *float64 `db:"reporting_amount"`
+}
+
+// convertingTouchPath is the touches that preceded one conversion
+type convertingTouchPath struct {
+	Steps          []string
+	Revenue        float64
+	HoursToConvert float64
+}
+
+// GetConvertingPaths returns the most common ordered touch sequences before
+// conversions. Touches are selected the way attribution runs select them: the
+// converting customer's interactions inside the lookback window, leaving out
+// ad impressions.
+func (s *AnalyticsService) GetConvertingPaths(tenantID int64, q PathAnalysisQuery) (*PathAnalysis, error) {
+	if q.Level == "" {
+		q.Level = PathLevelChannel
+	}
+	switch q.Level {
+	case PathLevelChannel, PathLevelVendor, PathLevelIntent:
+	default:
+		return nil, fmt.Errorf("%w: level must be %s, %s or %s", ErrInvalidPathQuery, PathLevelChannel, PathLevelVendor, PathLevelIntent)
+	}
+	if q.WindowHours <= 0 {
+		q.WindowHours = 72
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultPathLimit
+	}
+	config := AttributionConfig{TimeWindowHours: q.WindowHours, IncludeChannels: q.Channels, EventTypes: q.EventTypes}
+
+	query, args, argPos := runConversionsQuery(tenantID, config)
+	if q.From != nil {
+		query += fmt.Sprintf(" AND ce.occurred_at >= $%d", argPos)
+		args = append(args, *q.From)
+		argPos++
+	}
+	if q.To != nil {
+		query += fmt.Sprintf(" AND ce.occurred_at <= $%d", argPos)
+		args = append(args, *q.To)
+		argPos++
+	}
+	query = `SELECT c.*, to_reporting_currency(c.tenant_id, c.amount_decimal, c.currency_id, c.occurred_at) as reporting_amount
+		FROM (` + query + `) c
+		ORDER BY c.customer_id, c.occurred_at`
+
+	var conversions []pathConversion
+	if err := s.db.Select(&conversions, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get conversion events: %w", err)
+	}
+
+	analysis := &PathAnalysis{Level: q.Level, WindowHours: q.WindowHours, Conversions: len(conversions), Paths: []ConvertingPath{}}
+	if len(conversions) == 0 {
+		return analysis, nil
+	}
+
+	touchesByCustomer, err := s.convertingTouches(tenantID, conversions, q.WindowHours)
+	if err != nil {
+		return nil, err
+	}
+	vendorNames := map[int]string{}
+	if q.Level == PathLevelVendor {
+		if vendorNames, err = s.vendorNames(tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []convertingTouchPath
+	for _, conversion := range conversions {
+		var steps []string
+		var first time.Time
+		for _, touch := range touchesByCustomer[conversion.CustomerID] {
+			if reason, _ := touchExclusion(touch, conversion.ConversionEvent, config); reason != "" {
+				continue
+			}
+			if q.VendorID != nil && (touch.VendorID == nil || *touch.VendorID != *q.VendorID) {
+				continue
+			}
+			if q.Intent != "" && (touch.PrimaryIntent == nil || !strings.EqualFold(*touch.PrimaryIntent, q.Intent)) {
+				continue
+			}
+			if len(steps) == 0 {
+				first = touch.StartedAt
+			}
+			steps = append(steps, pathStep(touch, q.Level, vendorNames))
+		}
+		if len(steps) == 0 {
+			analysis.WithoutTouches++
+			continue
+		}
+
+		revenue := 0.0
+		if conversion.ReportingAmount != nil {
+			revenue = *conversion.ReportingAmount
+		}
+		paths = append(paths, convertingTouchPath{
+			Steps:          steps,
+			Revenue:        revenue,
+			HoursToConvert: conversion.OccurredAt.Sub(first).Hours(),
+		})
+	}
+
+	analysis.Paths, analysis.DistinctPaths = aggregateConvertingPaths(paths, analysis.Conversions, q.Limit)
+	return analysis, nil
+}
+
+// convertingTouches loads, per customer and in time order, the interactions
+// that could precede the given conversions
+func (s *AnalyticsService) convertingTouches(tenantID int64, conversions []pathConversion, windowHours int) (map[int64][]attributionTouch, error) {
+	var customerIDs []int64
+	from, to := conversions[0].OccurredAt, conversions[0].OccurredAt
+	for i, conversion := range conversions {
+		if i == 0 || conversion.CustomerID != conversions[i-1].CustomerID {
+			customerIDs = append(customerIDs, conversion.CustomerID)
+		}
+		if conversion.OccurredAt.Before(from) {
+			from = conversion.OccurredAt
+		}
+		if conversion.OccurredAt.After(to) {
+			to = conversion.OccurredAt
+		}
+	}
+
+	var touches []attributionTouch
+	err := s.db.Select(&touches,
+		`SELECT `+attributionTouchColumns+attributionTouchJoins+`
+		WHERE i.tenant_id = $1
+		  AND i.customer_id = ANY($2)
+		  AND i.started_at >= $3
+		  AND i.started_at <= $4
+		GROUP BY i.id, ch.name
+		ORDER BY i.customer_id, i.started_at ASC`,
+		tenantID, pq.Array(customerIDs), from.Add(-time.Duration(windowHours)*time.Hour), to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interactions: %w", err)
+	}
+
+	byCustomer := make(map[int64][]attributionTouch, len(customerIDs))
+	for _, touch := range touches {
+		byCustomer[*touch.CustomerID] = append(byCustomer[*touch.CustomerID], touch)
+	}
+	return byCustomer, nil
+}
+
+// vendorNames maps the tenant's vendor IDs to their names
+func (s *AnalyticsService) vendorNames(tenantID int64) (map[int]string, error) {
+	var vendors []struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := s.db.Select(&vendors, `SELECT id, name FROM vendors WHERE tenant_id = $1`, tenantID); err != nil {
+		return nil, fmt.Errorf("failed to get vendors: %w", err)
+	}
+	names := make(map[int]string, len(vendors))
+	for _, vendor := range vendors {
+		names[vendor.ID] = vendor.Name
+	}
+	return names, nil
+}
+
+// pathStep labels a touch at the given level: its channel (with direction,
+// e.g. "Voice(inbound)"), vendor or primary intent
+func pathStep(touch attributionTouch, level string, vendorNames map[int]string) string {
+	switch level {
+	case PathLevelVendor:
+		if touch.VendorID == nil {
+			return "no vendor"
+		}
+		if name, ok := vendorNames[*touch.VendorID]; ok {
+			return name
+		}
+		return "vendor:" + strconv.Itoa(*touch.VendorID)
+	case PathLevelIntent:
+		if touch.PrimaryIntent == nil || *touch.PrimaryIntent == "" {
+			return "unknown"
+		}
+		return *touch.PrimaryIntent
+	default:
+		if touch.Direction == nil || *touch.Direction == "" {
+			return touch.ChannelName
+		}
+		return touch.ChannelName + "(" + *touch.Direction + ")"
+	}
+}
+
+// aggregateConvertingPaths groups identical step sequences and returns the
+// limit most common (by conversions, then revenue) with the number of
+// distinct sequences
+func aggregateConvertingPaths(paths []convertingTouchPath, totalConversions, limit int) ([]ConvertingPath, int) {
+	type accumulator struct {
+		path       ConvertingPath
+		touches    int
+		totalHours float64
+	}
+	byKey := map[string]*accumulator{}
+	for _, path := range paths {
+		key := strings.Join(path.Steps, pathStepSeparator)
+		acc, ok := byKey[key]
+		if !ok {
+			acc = &accumulator{path: ConvertingPath{Path: key, Steps: path.Steps}}
+			byKey[key] = acc
+		}
+		acc.path.Conversions++
+		acc.path.Revenue += path.Revenue
+		acc.touches += len(path.Steps)
+		acc.totalHours += path.HoursToConvert
+	}
+
+	result := make([]ConvertingPath, 0, len(byKey))
+	for _, acc := range byKey {
+		path := acc.path
+		path.AvgPathLength = float64(acc.touches) / float64(path.Conversions)
+		path.AvgHoursToConvert = acc.totalHours / float64(path.Conversions)
+		if totalConversions > 0 {
+			path.ShareOfConversions = float64(path.Conversions) / float64(totalConversions)
+		}
+		result = append(result, path)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a].Conversions != result[b].Conversions {
+			return result[a].Conversions > result[b].Conversions
+		}
+		if result[a].Revenue != result[b].Revenue {
+			return result[a].Revenue > result[b].Revenue
+		}
+		return result[a].Path < result[b].Path
+	})
+
+	distinct := len(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, distinct
+}
@@ -1,57 +1,221 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/convin/crae/internal/models"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type AttributionService struct {
 	db *sqlx.DB
+
+	// wake signals idle job runner workers that a run was queued
+	wake chan struct{}
+	// running holds the cancel func of each run executing in this process
+	running sync.Map
 }
 
 func NewAttributionService(db *sqlx.DB) *AttributionService {
-	return &AttributionService{db: db}
+	return &AttributionService{db: db, wake: make(chan struct{}, 1)}
 }
 
 // AttributionConfig represents configuration for an attribution run
 type AttributionConfig struct {
-	TimeWindowHours    int      `json:"time_window_hours"`
-	IncludeChannels    []string `json:"include_channels"`
-	EventTypes         []string `json:"event_types"`
-	MinPurchaseAmount  float64  `json:"min_purchase_amount"`
+	TimeWindowHours     int      `json:"time_window_hours"`
+	IncludeChannels     []string `json:"include_channels"`
+	EventTypes          []string `json:"event_types"`
+	MinPurchaseAmount   float64  `json:"min_purchase_amount"`
+	ShapleyDimension    string   `json:"shapley_dimension,omitempty"`     // channel (default), agent or vendor
+	MarkovIncludeVendor bool     `json:"markov_include_vendor,omitempty"` // Markov states per channel and vendor
+	HalfLifeHours       float64  `json:"half_life_hours,omitempty"`       // TIME_DECAY half-life, overrides the model params
+	// WindowRules override TimeWindowHours per channel, direction and event type
+	WindowRules []AttributionWindowRule `json:"window_rules,omitempty"`
+	// AttributionLevel is customer (default) or account
+	AttributionLevel string `json:"attribution_level,omitempty"`
+	// IncludeViewThrough credits ad impressions, within their own window and
+	// discounted against other touches
+	IncludeViewThrough     bool     `json:"include_view_through,omitempty"`
+	ViewThroughWindowHours int      `json:"view_through_window_hours,omitempty"` // default 24
+	ViewThroughDiscount    *float64 `json:"view_through_discount,omitempty"`     // default 0.5
+	// AgentRoleShares splits a touch's credit across its agent participants
+	// by role, e.g. {"primary": 0.7, "transfer": 0.3}; even split when unset
+	AgentRoleShares map[string]float64 `json:"agent_role_shares,omitempty"`
+	// BootstrapSamples resamples conversions to put a p5/p50/p95 range on
+	// every agent, vendor and channel total; 0 (default) skips it
+	BootstrapSamples int   `json:"bootstrap_samples,omitempty"`
+	BootstrapSeed    int64 `json:"bootstrap_seed,omitempty"` // default: the run ID
+}
+
+// defaultHalfLifeHours is the TIME_DECAY half-life used when neither the run
+// config nor the model params set one
+const defaultHalfLifeHours = 168
+
+// toJSONB converts the config into the JSONB form stored on attribution_runs
+func (c AttributionConfig) toJSONB() (models.JSONB, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var out models.JSONB
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseAttributionConfig reads a stored run config, applying defaults for missing values
+func parseAttributionConfig(raw models.JSONB) (AttributionConfig, error) {
+	config := AttributionConfig{
+		TimeWindowHours:   72, // default
+		IncludeChannels:   []string{},
+		EventTypes:        []string{},
+		MinPurchaseAmount: 0,
+	}
+	if raw == nil {
+		return config, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return config, fmt.Errorf("failed to read run config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid run config: %w", err)
+	}
+	if config.TimeWindowHours <= 0 {
+		config.TimeWindowHours = 72
+	}
+
+	return config, nil
+}
+
+// validate checks the config can be used for a run
+func (c AttributionConfig) validate() error {
+	switch c.AttributionLevel {
+	case "", AttributionLevelCustomer, AttributionLevelAccount:
+	default:
+		return fmt.Errorf("%w: attribution_level must be %s or %s", ErrInvalidAttributionConfig, AttributionLevelCustomer, AttributionLevelAccount)
+	}
+	if err := c.validateViewThrough(); err != nil {
+		return err
+	}
+	if err := c.validateAgentRoleShares(); err != nil {
+		return err
+	}
+	if err := c.validateBootstrap(); err != nil {
+		return err
+	}
+	return c.validateWindowRules()
+}
+
+// attributionTouch is an interaction considered for attribution, joined with
+// its channel and the agent/team/vendor that handled it
+type attributionTouch struct {
+	ID                  int64        `db:"id"`
+	CustomerID          *int64       `db:"customer_id"`
+	ChannelID           int          `db:"channel_id"`
+	ChannelName         string       `db:"channel_name"`
+	StartedAt           time.Time    `db:"started_at"`
+	DurationSeconds     *int         `db:"duration_seconds"`
+	Direction           *string      `db:"direction"`
+	PrimaryIntent       *string      `db:"primary_intent"`
+	SecondaryIntents    models.JSONB `db:"secondary_intents"`
+	OutcomePrediction   *string      `db:"outcome_prediction"`
+	FunnelStage         *string      `db:"funnel_stage"`
+	PurchaseProbability *float64     `db:"purchase_probability"`
+	AgentID             *int         `db:"agent_id"`
+	TeamID              *int         `db:"team_id"`
+	VendorID            *int         `db:"vendor_id"`
+	// EngagementID is set (and ID is not) for account engagement touches
+	EngagementID *int64 `db:"engagement_id"`
+	// IsViewThrough marks an ad impression
+	IsViewThrough bool `db:"is_view_through"`
+}
+
+// attributionTouchColumns selects an attributionTouch from interactions i,
+// channels ch and the agent participant joins used by the attribution queries
+const attributionTouchColumns = `
+	i.id, i.customer_id, i.channel_id, ch.name as channel_name, i.started_at,
+	i.duration_seconds, i.direction, i.primary_intent, i.secondary_intents,
+	i.outcome_prediction, i.funnel_stage, i.purchase_probability,
+	COALESCE(i.is_view_through, FALSE) as is_view_through,
+	MAX(CASE WHEN ip.participant_type = 'agent' THEN ip.agent_id END) as agent_id,
+	MAX(CASE WHEN ip.participant_type = 'agent' THEN t.id END) as team_id,
+	MAX(CASE WHEN ip.participant_type = 'agent' THEN v.id END) as vendor_id`
+
+// attributionTouchJoins joins the tables referenced by attributionTouchColumns
+const attributionTouchJoins = `
+	FROM interactions i
+	INNER JOIN channels ch ON i.channel_id = ch.id
+	LEFT JOIN interaction_participants ip ON i.id = ip.interaction_id AND ip.participant_type = 'agent'
+	LEFT JOIN agents a ON ip.agent_id = a.id
+	LEFT JOIN teams t ON a.team_id = t.id
+	LEFT JOIN vendors v ON a.vendor_id = v.id`
+
+// attributionModelState carries model parameters and anything precomputed
+// once per run (for example data-driven channel values) into calculateWeights
+type attributionModelState struct {
+	Params    models.JSONB
+	Shapley   *shapleyResult
+	Markov    *markovResult
+	HalfLife  time.Duration
+	AISignals aiSignalParams
+	Position  positionParams
+	// Rules is set for tenant rule models, whose weights come from the rule set
+	Rules *ruleModelParams
+}
+
+// paramFloat reads a numeric model parameter, returning def when unset
+func paramFloat(params models.JSONB, key string, def float64) float64 {
+	if value, ok := params[key].(float64); ok {
+		return value
+	}
+	return def
 }
 
 // CreateAttributionRun creates a new attribution run
 func (s *AttributionService) CreateAttributionRun(tenantID int64, modelCode string, name string, config AttributionConfig) (*models.AttributionRun, error) {
-	// Get model ID
+	// Get model ID: one of the tenant's rule models or a built-in model
 	var modelID int
-	err := s.db.Get(&modelID, `SELECT id FROM attribution_models WHERE code = $1`, modelCode)
+	err := s.db.Get(&modelID,
+		`SELECT id FROM attribution_models
+		 WHERE code = $1 AND (tenant_id IS NULL OR tenant_id = $2)
+		 ORDER BY tenant_id NULLS LAST LIMIT 1`,
+		modelCode, tenantID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrAttributionModelNotFound, modelCode)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("attribution model not found: %s", modelCode)
+		return nil, fmt.Errorf("failed to get attribution model: %w", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
 
 	// Convert config to JSONB
-	configJSON := models.JSONB{
-		"time_window_hours":   config.TimeWindowHours,
-		"include_channels":    config.IncludeChannels,
-		"event_types":         config.EventTypes,
-		"min_purchase_amount": config.MinPurchaseAmount,
+	configJSON, err := config.toJSONB()
+	if err != nil {
+		return nil, fmt.Errorf("invalid attribution config: %w", err)
 	}
 
 	var run models.AttributionRun
 	err = s.db.QueryRowx(
 		`INSERT INTO attribution_runs (tenant_id, model_id, name, config, status)
 		 VALUES ($1, $2, $3, $4, 'pending')
-		 RETURNING id, tenant_id, model_id, name, description, config, status, started_at, completed_at, created_at, updated_at`,
+		 RETURNING `+attributionRunColumns,
 		tenantID, modelID, name, configJSON,
-	).Scan(
-		&run.ID, &run.TenantID, &run.ModelID, &run.Name, &run.Description,
-		&run.Config, &run.Status, &run.StartedAt, &run.CompletedAt, &run.CreatedAt, &run.UpdatedAt,
-	)
+	).StructScan(&run)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create attribution run: %w", err)
 	}
@@ -59,74 +223,160 @@ func (s *AttributionService) CreateAttributionRun(tenantID int64, modelCode stri
 	return &run, nil
 }
 
-// ExecuteAttributionRun executes an attribution run
-func (s *AttributionService) ExecuteAttributionRun(runID int64) error {
-	// Get run details
-	var run models.AttributionRun
-	err := s.db.Get(&run, `SELECT * FROM attribution_runs WHERE id = $1`, runID)
+// ExecuteAttributionRun attributes every conversion matching the run config,
+// recording progress and per-conversion errors on the run, and sets its final
+// status: completed, partial (some conversions failed), failed or cancelled.
+// If ctx ends for any reason other than CancelAttributionRun (for example a
+// shutdown) the run is put back on the queue.
+func (s *AttributionService) ExecuteAttributionRun(ctx context.Context, runID int64) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s.running.Store(runID, cancel)
+	defer s.running.Delete(runID)
+	go s.heartbeatAttributionRun(ctx, runID, cancel)
+
+	progress, err := s.processAttributionRun(ctx, runID, cancel)
+	if ctx.Err() != nil {
+		if errors.Is(context.Cause(ctx), ErrAttributionRunCancelled) {
+			return s.finishAttributionRun(runID, "cancelled", progress, nil)
+		}
+		return s.requeueAttributionRun(runID)
+	}
 	if err != nil {
-		return fmt.Errorf("attribution run not found: %w", err)
+		if finishErr := s.finishAttributionRun(runID, "failed", progress, err); finishErr != nil {
+			return finishErr
+		}
+		return err
+	}
+	return s.finishAttributionRun(runID, progress.status(), progress, nil)
+}
+
+// processAttributionRun does the work of ExecuteAttributionRun. Per-conversion
+// errors are recorded and counted; the returned error is fatal to the run.
+func (s *AttributionService) processAttributionRun(ctx context.Context, runID int64, cancel context.CancelCauseFunc) (attributionRunProgress, error) {
+	var progress attributionRunProgress
+
+	run, err := s.getAttributionRun(runID)
+	if err != nil {
+		return progress, err
 	}
 
-	// Update status to running
-	now := time.Now()
-	_, err = s.db.Exec(
-		`UPDATE attribution_runs SET status = 'running', started_at = $1 WHERE id = $2`,
-		now, runID,
+	// Each execution writes a new result version; the previous version stays
+	// current until this one completes
+	progress.Version, err = s.startAttributionRunVersion(runID)
+	if err != nil {
+		return progress, err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE attribution_runs
+		 SET status = 'running', started_at = NOW(), completed_at = NULL, error_message = NULL,
+		     total_conversions = 0, processed_conversions = 0, failed_conversions = 0, updated_at = NOW()
+		 WHERE id = $1`,
+		runID,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to update run status: %w", err)
+		return progress, fmt.Errorf("failed to update run status: %w", err)
 	}
 
 	// Parse config
-	config := AttributionConfig{
-		TimeWindowHours:   72, // default
-		IncludeChannels:   []string{},
-		EventTypes:        []string{},
-		MinPurchaseAmount: 0,
+	config, err := parseAttributionConfig(run.Config)
+	if err != nil {
+		return progress, err
+	}
+
+	// Get model code and params
+	model, err := s.getAttributionModel(run.ModelID)
+	if err != nil {
+		return progress, err
+	}
+	modelCode := model.Code
+
+	// Precompute data-driven model state for the whole tenant
+	state, err := s.prepareModelState(run, model, config, false)
+	if err != nil {
+		return progress, err
 	}
-	if run.Config != nil {
-		if tw, ok := run.Config["time_window_hours"].(float64); ok {
-			config.TimeWindowHours = int(tw)
+
+	// Conversions and interactions ingested after this point are picked up
+	// by incremental runs
+	if err := s.db.Get(&progress.Watermark, `SELECT LOCALTIMESTAMP`); err != nil {
+		return progress, fmt.Errorf("failed to read watermark: %w", err)
+	}
+
+	// Get conversion events for this tenant
+	conversions, err := s.getRunConversions(run.TenantID, config)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = len(conversions)
+	if err := s.saveAttributionRunProgress(runID, progress); err != nil {
+		return progress, err
+	}
+
+	// Process each conversion event
+	lastSaved := time.Now()
+	for _, conversion := range conversions {
+		if ctx.Err() != nil {
+			return progress, ctx.Err()
 		}
-		if ch, ok := run.Config["include_channels"].([]interface{}); ok {
-			for _, v := range ch {
-				if s, ok := v.(string); ok {
-					config.IncludeChannels = append(config.IncludeChannels, s)
-				}
+
+		if err := s.attributeConversion(runID, progress.Version, run, conversion, modelCode, config, state); err != nil {
+			progress.Failed++
+			if err := s.recordAttributionRunError(runID, progress.Version, conversion.ID, err); err != nil {
+				return progress, err
 			}
 		}
-		if et, ok := run.Config["event_types"].([]interface{}); ok {
-			for _, v := range et {
-				if s, ok := v.(string); ok {
-					config.EventTypes = append(config.EventTypes, s)
-				}
+		progress.Processed++
+
+		if progress.Processed%attributionProgressEvery == 0 || time.Since(lastSaved) >= attributionProgressInterval {
+			if err := s.saveAttributionRunProgress(runID, progress); err != nil {
+				return progress, err
 			}
-		}
-		if mp, ok := run.Config["min_purchase_amount"].(float64); ok {
-			config.MinPurchaseAmount = mp
+			lastSaved = time.Now()
 		}
 	}
 
-	// Get model code
-	var modelCode string
-	err = s.db.Get(&modelCode, `SELECT code FROM attribution_models WHERE id = $1`, run.ModelID)
+	if err := s.saveBootstrapIntervals(run, progress.Version, config); err != nil {
+		return progress, err
+	}
+
+	return progress, nil
+}
+
+// conversionEventColumns selects a models.ConversionEvent from conversion_events ce
+const conversionEventColumns = `
+	ce.id, ce.tenant_id, ce.customer_id, ce.event_source_id, ce.external_event_id,
+	ce.event_type, ce.product_id, ce.currency_id, ce.amount_decimal, ce.occurred_at,
+	ce.raw_payload, ce.reverses_event_id, ce.created_at, ce.updated_at`
+
+// attributionModelColumns selects a models.AttributionModel
+const attributionModelColumns = `id, code, name, COALESCE(description, '') as description, params,
+	tenant_id, model_type, created_at`
+
+// getAttributionModel loads a model with its params
+func (s *AttributionService) getAttributionModel(modelID int) (models.AttributionModel, error) {
+	var model models.AttributionModel
+	err := s.db.Get(&model, `SELECT `+attributionModelColumns+` FROM attribution_models WHERE id = $1`, modelID)
 	if err != nil {
-		return fmt.Errorf("failed to get model code: %w", err)
+		return model, fmt.Errorf("failed to get model code: %w", err)
 	}
+	return model, nil
+}
 
-	// Get conversion events for this tenant
-	query := `
-		SELECT ce.*
+// runConversionsQuery selects the tenant's conversion events matching the run
+// config; callers may append further conditions starting at the returned argPos
+func runConversionsQuery(tenantID int64, config AttributionConfig) (string, []interface{}, int) {
+	query := `SELECT ` + conversionEventColumns + `
 		FROM conversion_events ce
 		WHERE ce.tenant_id = $1
+		  AND ce.reverses_event_id IS NULL
 	`
-	args := []interface{}{run.TenantID}
+	args := []interface{}{tenantID}
 	argPos := 2
 
 	if len(config.EventTypes) > 0 {
 		query += fmt.Sprintf(" AND ce.event_type = ANY($%d)", argPos)
-		args = append(args, config.EventTypes)
+		args = append(args, pq.Array(config.EventTypes))
 		argPos++
 	}
 	if config.MinPurchaseAmount > 0 {
@@ -135,93 +385,279 @@ func (s *AttributionService) ExecuteAttributionRun(runID int64) error {
 		argPos++
 	}
 
+	return query, args, argPos
+}
+
+// getRunConversions returns the tenant's conversion events matching the run config
+func (s *AttributionService) getRunConversions(tenantID int64, config AttributionConfig) ([]models.ConversionEvent, error) {
+	query, args, _ := runConversionsQuery(tenantID, config)
+	query += " ORDER BY ce.customer_id, ce.occurred_at"
+
 	var conversions []models.ConversionEvent
-	err = s.db.Select(&conversions, query, args...)
+	err := s.db.Select(&conversions, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to get conversion events: %w", err)
+		return nil, fmt.Errorf("failed to get conversion events: %w", err)
 	}
 
-	// Process each conversion event
-	for _, conversion := range conversions {
-		err = s.attributeConversion(runID, &run, conversion, modelCode, config)
+	return conversions, nil
+}
+
+// prepareModelState loads model params and precomputes any tenant-wide model
+// inputs. Data-driven outputs are saved on the run so they can be inspected.
+// With reuseOutput the outputs already saved on the run are used instead, so
+// incremental updates credit new conversions consistently with the rest.
+func (s *AttributionService) prepareModelState(run *models.AttributionRun, model models.AttributionModel, config AttributionConfig, reuseOutput bool) (*attributionModelState, error) {
+	state := &attributionModelState{Params: model.Params}
+
+	if model.ModelType == ModelTypeRules {
+		params, err := parseRuleModelParams(model.Params)
 		if err != nil {
-			// Log error but continue
-			fmt.Printf("Error attributing conversion %d: %v\n", conversion.ID, err)
+			return nil, err
+		}
+		state.Rules = &params
+		// The run's half-life overrides the rule set's for a TIME_DECAY base
+		if config.HalfLifeHours > 0 {
+			state.HalfLife = time.Duration(config.HalfLifeHours * float64(time.Hour))
 		}
+		return state, nil
 	}
 
-	// Update status to completed
-	_, err = s.db.Exec(
-		`UPDATE attribution_runs SET status = 'completed', completed_at = $1 WHERE id = $2`,
-		time.Now(), runID,
-	)
+	switch model.Code {
+	case "AI_WEIGHTED":
+		params, err := parseAISignalParams(model.Params)
+		if err != nil {
+			return nil, err
+		}
+		state.AISignals = params
+
+	case "U_SHAPED", "W_SHAPED", "CUSTOM_POSITION":
+		params, err := parsePositionParams(model.Code, model.Params)
+		if err != nil {
+			return nil, err
+		}
+		state.Position = params
+
+	case "TIME_DECAY":
+		halfLifeHours := config.HalfLifeHours
+		if halfLifeHours <= 0 {
+			halfLifeHours = paramFloat(model.Params, "half_life_hours", defaultHalfLifeHours)
+		}
+		if halfLifeHours <= 0 {
+			return nil, fmt.Errorf("time decay half-life must be positive")
+		}
+		state.HalfLife = time.Duration(halfLifeHours * float64(time.Hour))
+
+	case "SHAPLEY":
+		dimension := config.ShapleyDimension
+		if dimension == "" {
+			dimension, _ = model.Params["dimension"].(string)
+		}
+		switch dimension {
+		case "":
+			dimension = "channel"
+		case "channel", "agent", "vendor":
+		default:
+			return nil, fmt.Errorf("unsupported shapley dimension: %s", dimension)
+		}
+		if reuseOutput && decodeModelOutput(run.ModelOutput, "shapley", &state.Shapley) {
+			break
+		}
+		paths, err := s.loadAttributionPaths(run.TenantID, config)
+		if err != nil {
+			return nil, err
+		}
+		state.Shapley = computeShapleyValues(paths, dimension)
+		if err := s.saveModelOutput(run.ID, models.JSONB{"shapley": state.Shapley}); err != nil {
+			return nil, err
+		}
+
+	case "MARKOV":
+		dimension := "channel"
+		includeVendor, _ := model.Params["include_vendor"].(bool)
+		if config.MarkovIncludeVendor || includeVendor {
+			dimension = "channel_vendor"
+		}
+		if reuseOutput && decodeModelOutput(run.ModelOutput, "markov", &state.Markov) {
+			break
+		}
+		paths, err := s.loadAttributionPaths(run.TenantID, config)
+		if err != nil {
+			return nil, err
+		}
+		state.Markov = computeMarkovAttribution(paths, dimension)
+		if err := s.saveModelOutput(run.ID, models.JSONB{"markov": state.Markov}); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// decodeModelOutput reads a model's saved output into dst, reporting whether
+// one was found
+func decodeModelOutput(output models.JSONB, key string, dst interface{}) bool {
+	saved, ok := output[key]
+	if !ok || saved == nil {
+		return false
+	}
+	data, err := json.Marshal(saved)
 	if err != nil {
-		return fmt.Errorf("failed to update run status: %w", err)
+		return false
 	}
+	return json.Unmarshal(data, dst) == nil
+}
 
+// saveModelOutput stores tenant-wide model output on the run for inspection
+func (s *AttributionService) saveModelOutput(runID int64, output models.JSONB) error {
+	_, err := s.db.Exec(`UPDATE attribution_runs SET model_output = $1 WHERE id = $2`, output, runID)
+	if err != nil {
+		return fmt.Errorf("failed to save model output: %w", err)
+	}
 	return nil
 }
 
 // attributeConversion attributes a single conversion event
-func (s *AttributionService) attributeConversion(runID int64, run *models.AttributionRun, conversion models.ConversionEvent, modelCode string, config AttributionConfig) error {
+func (s *AttributionService) attributeConversion(runID int64, version int, run *models.AttributionRun, conversion models.ConversionEvent, modelCode string, config AttributionConfig, state *attributionModelState) error {
 	// Get interactions within the time window
-	windowStart := conversion.OccurredAt.Add(-time.Duration(config.TimeWindowHours) * time.Hour)
-
-	query := `
-		SELECT i.*, 
-		       COALESCE(MAX(CASE WHEN ip.participant_type = 'agent' THEN ip.agent_id END), NULL) as agent_id,
-		       COALESCE(MAX(CASE WHEN ip.participant_type = 'agent' THEN t.id END), NULL) as team_id,
-		       COALESCE(MAX(CASE WHEN ip.participant_type = 'agent' THEN v.id END), NULL) as vendor_id
-		FROM interactions i
-		LEFT JOIN interaction_participants ip ON i.id = ip.interaction_id AND ip.participant_type = 'agent'
-		LEFT JOIN agents a ON ip.agent_id = a.id
-		LEFT JOIN teams t ON a.team_id = t.id
-		LEFT JOIN vendors v ON a.vendor_id = v.id
-		WHERE i.customer_id = $1
-		  AND i.started_at >= $2
-		  AND i.started_at <= $3
-		GROUP BY i.id
-	`
-	args := []interface{}{conversion.CustomerID, windowStart, conversion.OccurredAt}
+	windowStart := conversion.OccurredAt.Add(-time.Duration(config.maxWindowHours(conversion.EventType)) * time.Hour)
 
-	if len(config.IncludeChannels) > 0 {
-		query += ` AND i.channel_id IN (SELECT id FROM channels WHERE name = ANY($4))`
-		args = append(args, config.IncludeChannels)
+	accountID, err := s.customerAccountID(conversion.CustomerID)
+	if err != nil {
+		return err
 	}
-
-	query += ` ORDER BY i.started_at ASC`
-
-	type InteractionWithAgent struct {
-		models.Interaction
-		AgentID  *int `db:"agent_id"`
-		TeamID   *int `db:"team_id"`
-		VendorID *int `db:"vendor_id"`
+	var touchAccountID *int64
+	if config.accountLevel() {
+		touchAccountID = accountID
 	}
 
-	var interactions []InteractionWithAgent
-	err := s.db.Select(&interactions, query, args...)
+	candidates, err := s.getCandidateTouches(conversion.TenantID, conversion.CustomerID, touchAccountID, config, windowStart, conversion.OccurredAt)
 	if err != nil {
-		return fmt.Errorf("failed to get interactions: %w", err)
+		return err
 	}
 
-	if len(interactions) == 0 {
-		return nil // No interactions to attribute
+	// Apply the exclusion rules the query can't express
+	interactions := candidates[:0]
+	for _, touch := range candidates {
+		if reason, _ := touchExclusion(touch, conversion, config); reason == "" {
+			interactions = append(interactions, touch)
+		}
 	}
 
-	// Calculate attribution weights based on model
-	weights := s.calculateWeights(len(interactions), modelCode, conversion.OccurredAt)
+	// Credit is written in the tenant's reporting currency
+	fxRate, err := reportingFXRate(s.db, conversion.TenantID, conversion.CurrencyID, conversion.OccurredAt)
+	if err != nil {
+		return err
+	}
 
-	// Insert attribution results
+	// Replace any results this version already holds for the conversion
+	// (incremental runs re-attribute conversions in place). Results of
+	// conversions in a closed period are settled with adjustments instead.
 	tx, err := s.db.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	for i, interaction := range interactions {
-		weight := weights[i]
-		attributedAmount := conversion.AmountDecimal * weight
+	lock, err := closedPeriodLock(tx, conversion.TenantID, conversion.OccurredAt)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		_, err = tx.Exec(
+			`DELETE FROM attribution_results
+			 WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3`,
+			runID, version, conversion.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to clear previous results: %w", err)
+		}
+	}
 
+	var rows []attributionResultRow
+	if len(interactions) > 0 {
+		rows, err = s.creditRows(tx, interactions, conversion, modelCode, config, state, fxRate)
+		if err != nil {
+			return err
+		}
+	}
+	result := attributionResultContext{
+		RunID: runID, Version: version, ModelID: run.ModelID,
+		Conversion: conversion, AccountID: accountID, FXRate: fxRate,
+	}
+
+	if lock != nil {
+		if err := settleClosedConversion(tx, run, result, rows, *lock); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if len(rows) == 0 {
+		return tx.Commit() // No interactions to attribute
+	}
+	for _, row := range rows {
+		if err := insertAttributionResult(tx, result, row, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := applyConversionReversals(tx, runID, version, conversion.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// attributionResultRow is the credit one touch (or one agent of a touch)
+// gets from a conversion
+type attributionResultRow struct {
+	InteractionID       *int64
+	AccountEngagementID *int64
+	AgentID             *int
+	TeamID              *int
+	VendorID            *int
+	AgentRole           *string
+	AgentShare          *float64
+	Weight              float64
+	AttributedAmount    float64
+	SourceAmount        float64
+	IsPrimaryTouch      bool
+	Explanation         models.JSONB
+}
+
+// attributionResultContext is what every result row of a conversion shares
+type attributionResultContext struct {
+	RunID      int64
+	Version    int
+	ModelID    int
+	Conversion models.ConversionEvent
+	AccountID  *int64
+	FXRate     float64
+}
+
+// creditRows splits a conversion's amount across its touches by model weight,
+// and each touch's credit across its agents
+func (s *AttributionService) creditRows(tx *sqlx.Tx, interactions []attributionTouch, conversion models.ConversionEvent, modelCode string, config AttributionConfig, state *attributionModelState, fxRate float64) ([]attributionResultRow, error) {
+	// Calculate attribution weights based on model
+	weights, explanations := s.calculateWeights(interactions, modelCode, conversion.OccurredAt, state)
+	if config.IncludeViewThrough {
+		weights = discountViewThrough(interactions, weights, config.viewThroughDiscount())
+	}
+
+	// Each touch's credit is split across its agents
+	var interactionIDs []int64
+	for _, interaction := range interactions {
+		if id := interaction.interactionID(); id != nil {
+			interactionIDs = append(interactionIDs, *id)
+		}
+	}
+	touchAgents, err := getTouchAgents(tx, interactionIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []attributionResultRow
+	for i, interaction := range interactions {
 		// Determine if this is primary touch
 		isPrimaryTouch := false
 		if modelCode == "FIRST_TOUCH" && i == 0 {
@@ -230,26 +666,72 @@ func (s *AttributionService) attributeConversion(runID int64, run *models.Attrib
 			isPrimaryTouch = true
 		}
 
-		_, err = tx.Exec(
-			`INSERT INTO attribution_results (
-				tenant_id, attribution_run_id, conversion_event_id, interaction_id,
-				customer_id, agent_id, team_id, vendor_id, model_id,
-				attribution_weight, attributed_amount, is_primary_touch
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
-			conversion.TenantID, runID, conversion.ID, interaction.ID,
-			conversion.CustomerID, interaction.AgentID, interaction.TeamID, interaction.VendorID, run.ModelID,
-			weight, attributedAmount, isPrimaryTouch,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to insert attribution result: %w", err)
+		var explanation models.JSONB
+		if explanations != nil {
+			explanation = explanations[i]
+		}
+
+		for _, credit := range config.agentCredits(interaction, touchAgents[interaction.ID]) {
+			weight := weights[i]
+			if credit.Share != nil {
+				weight *= *credit.Share
+			}
+			sourceAmount := conversion.AmountDecimal * weight
+			rows = append(rows, attributionResultRow{
+				InteractionID:       interaction.interactionID(),
+				AccountEngagementID: interaction.EngagementID,
+				AgentID:             credit.AgentID,
+				TeamID:              credit.TeamID,
+				VendorID:            credit.VendorID,
+				AgentRole:           credit.Role,
+				AgentShare:          credit.Share,
+				Weight:              weight,
+				AttributedAmount:    sourceAmount * fxRate,
+				SourceAmount:        sourceAmount,
+				IsPrimaryTouch:      isPrimaryTouch,
+				Explanation:         explanation,
+			})
 		}
 	}
+	return rows, nil
+}
 
-	return tx.Commit()
+// insertAttributionResult writes one result row, as an adjustment reported in
+// an open period when adjustment is set
+func insertAttributionResult(tx *sqlx.Tx, result attributionResultContext, row attributionResultRow, adjustment *periodLock) error {
+	var adjustmentPeriod, reportedAt *time.Time
+	if adjustment != nil {
+		adjustmentPeriod, reportedAt = &adjustment.AdjustmentPeriod, &adjustment.ReportedAt
+	}
+	conversion := result.Conversion
+	_, err := tx.Exec(
+		`INSERT INTO attribution_results (
+			tenant_id, attribution_run_id, conversion_event_id, interaction_id,
+			customer_id, agent_id, team_id, vendor_id, model_id,
+			attribution_weight, attributed_amount, is_primary_touch, explanation, result_version,
+			currency_id, source_amount, fx_rate, account_engagement_id, account_id,
+			agent_role, agent_share, adjustment_period, reported_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
+		conversion.TenantID, result.RunID, conversion.ID, row.InteractionID,
+		conversion.CustomerID, row.AgentID, row.TeamID, row.VendorID, result.ModelID,
+		row.Weight, row.AttributedAmount, row.IsPrimaryTouch, row.Explanation, result.Version,
+		conversion.CurrencyID, row.SourceAmount, result.FXRate, row.AccountEngagementID, result.AccountID,
+		row.AgentRole, row.AgentShare, adjustmentPeriod, reportedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert attribution result: %w", err)
+	}
+	return nil
 }
 
-// calculateWeights calculates attribution weights based on the model
-func (s *AttributionService) calculateWeights(n int, modelCode string, conversionTime time.Time) []float64 {
+// calculateWeights calculates attribution weights based on the model. Models
+// that can justify their weights also return a per-touch explanation.
+func (s *AttributionService) calculateWeights(touches []attributionTouch, modelCode string, conversionTime time.Time, state *attributionModelState) ([]float64, []models.JSONB) {
+	if state != nil && state.Rules != nil {
+		return s.ruleWeights(touches, conversionTime, *state.Rules, state.HalfLife)
+	}
+
+	n := len(touches)
 	weights := make([]float64, n)
 
 	switch modelCode {
@@ -272,33 +754,38 @@ func (s *AttributionService) calculateWeights(n int, modelCode string, conversio
 		}
 
 	case "TIME_DECAY":
-		// Exponential decay: more recent interactions get more weight
-		totalWeight := 0.0
-		decayWeights := make([]float64, n)
-		for i := 0; i < n; i++ {
-			// Get interaction time (simplified - would need actual interaction struct)
-			// For now, use position-based decay
-			decayWeights[i] = math.Exp(-float64(n-i-1) * 0.5)
-			totalWeight += decayWeights[i]
-		}
-		for i := range weights {
-			weights[i] = decayWeights[i] / totalWeight
+		halfLife := defaultHalfLifeHours * time.Hour
+		if state != nil && state.HalfLife > 0 {
+			halfLife = state.HalfLife
 		}
+		return timeDecayWeights(touches, conversionTime, halfLife), nil
 
 	case "AI_WEIGHTED":
-		// Simplified AI-weighted: use purchase probability if available
-		// In production, this would use a trained model
-		totalWeight := 0.0
-		aiWeights := make([]float64, n)
-		for i := 0; i < n; i++ {
-			// Default weight based on position
-			aiWeights[i] = 1.0 / float64(n)
-			// Could enhance with purchase_probability from interaction
-			totalWeight += aiWeights[i]
+		// Weight touches by Convin conversation signals
+		params := defaultAISignalParams()
+		if state != nil {
+			params = state.AISignals
 		}
-		for i := range weights {
-			weights[i] = aiWeights[i] / totalWeight
+		return aiSignalWeights(touches, params)
+
+	case "U_SHAPED", "W_SHAPED", "CUSTOM_POSITION":
+		params := defaultPositionParams(modelCode)
+		if state != nil {
+			params = state.Position
 		}
+		return positionWeights(touches, params)
+
+	case "SHAPLEY":
+		if state != nil && state.Shapley != nil {
+			return shapleyTouchWeights(touches, state.Shapley), nil
+		}
+		return linearWeights(n), nil
+
+	case "MARKOV":
+		if state != nil && state.Markov != nil {
+			return markovTouchWeights(touches, state.Markov), nil
+		}
+		return linearWeights(n), nil
 
 	default:
 		// Default to linear
@@ -308,6 +795,42 @@ func (s *AttributionService) calculateWeights(n int, modelCode string, conversio
 		}
 	}
 
+	return weights, nil
+}
+
+// linearWeights splits credit equally across n touches
+func linearWeights(n int) []float64 {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1.0 / float64(n)
+	}
 	return weights
 }
 
+// timeDecayWeights gives each touch a weight that halves for every half-life
+// between its started_at and the conversion, so more recent interactions get
+// more credit regardless of how many touches sit between them
+func timeDecayWeights(touches []attributionTouch, conversionTime time.Time, halfLife time.Duration) []float64 {
+	gaps := make([]float64, len(touches))
+	minGap := math.Inf(1)
+	for i, touch := range touches {
+		gaps[i] = math.Max(conversionTime.Sub(touch.StartedAt).Hours(), 0)
+		minGap = math.Min(minGap, gaps[i])
+	}
+
+	// Decay relative to the most recent touch; the normalised weights are the
+	// same and very old paths do not underflow to zero
+	weights := make([]float64, len(touches))
+	totalWeight := 0.0
+	for i := range touches {
+		weights[i] = math.Exp2(-(gaps[i] - minGap) / halfLife.Hours())
+		totalWeight += weights[i]
+	}
+	if totalWeight <= 0 {
+		return linearWeights(len(touches))
+	}
+	for i := range weights {
+		weights[i] /= totalWeight
+	}
+	return weights
+}
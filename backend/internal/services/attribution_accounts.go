@@ -0,0 +1,108 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Attribution levels: a customer's conversion is credited across its own
+// interactions, or across every contact and engagement of its account
+const (
+	AttributionLevelCustomer = "customer"
+	AttributionLevelAccount  = "account"
+)
+
+// runAttributionLevel is the attribution level of attribution_runs run
+const runAttributionLevel = `COALESCE(NULLIF(run.config->>'attribution_level', ''), 'customer')`
+
+// accountLevel reports whether the run credits conversions at the account level
+func (c AttributionConfig) accountLevel() bool {
+	return c.AttributionLevel == AttributionLevelAccount
+}
+
+// interactionID is the interaction the touch is, or nil for an account engagement
+func (t attributionTouch) interactionID() *int64 {
+	if t.EngagementID != nil {
+		return nil
+	}
+	id := t.ID
+	return &id
+}
+
+// attributionEngagementColumns selects an account engagement as an
+// attributionTouch whose channel is the engagement type. Engagement dates are
+// stored with a time zone; they are compared in UTC like every other timestamp.
+const attributionEngagementColumns = `
+	ae.id as engagement_id, ae.engagement_type as channel_name,
+	(ae.engagement_date AT TIME ZONE 'UTC') as started_at`
+
+// customerAccountID returns the account a customer belongs to, if any
+func (s *AttributionService) customerAccountID(customerID int64) (*int64, error) {
+	var accountID *int64
+	err := s.db.Get(&accountID, `SELECT account_id FROM customers WHERE id = $1`, customerID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer account: %w", err)
+	}
+	return accountID, nil
+}
+
+// getCandidateTouches returns, in time order, the interactions (and for
+// account-level runs, the account engagements) that started in [from, to]
+// for the converting customer, or for every contact of its account when
+// accountID is set
+func (s *AttributionService) getCandidateTouches(tenantID, customerID int64, accountID *int64, config AttributionConfig, from, to time.Time) ([]attributionTouch, error) {
+	query := `SELECT ` + attributionTouchColumns + attributionTouchJoins + `
+		WHERE i.started_at >= $1
+		  AND i.started_at <= $2
+	`
+	args := []interface{}{from, to}
+
+	if accountID != nil {
+		query += ` AND i.tenant_id = $3 AND i.customer_id IN (SELECT id FROM customers WHERE account_id = $4)`
+		args = append(args, tenantID, *accountID)
+	} else {
+		query += ` AND i.customer_id = $3`
+		args = append(args, customerID)
+	}
+
+	if len(config.IncludeChannels) > 0 {
+		query += fmt.Sprintf(` AND ch.name = ANY($%d)`, len(args)+1)
+		args = append(args, pq.Array(config.IncludeChannels))
+	}
+
+	query += ` GROUP BY i.id, ch.name ORDER BY i.started_at ASC`
+
+	var touches []attributionTouch
+	if err := s.db.Select(&touches, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get interactions: %w", err)
+	}
+	if accountID == nil {
+		return touches, nil
+	}
+
+	var engagements []attributionTouch
+	err := s.db.Select(&engagements,
+		`SELECT `+attributionEngagementColumns+`
+		 FROM account_engagements ae
+		 WHERE ae.tenant_id = $1 AND ae.account_id = $2
+		   AND (ae.engagement_date AT TIME ZONE 'UTC') >= $3
+		   AND (ae.engagement_date AT TIME ZONE 'UTC') <= $4`,
+		tenantID, *accountID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account engagements: %w", err)
+	}
+
+	touches = append(touches, engagements...)
+	sort.SliceStable(touches, func(a, b int) bool {
+		return touches[a].StartedAt.Before(touches[b].StartedAt)
+	})
+	return touches, nil
+}
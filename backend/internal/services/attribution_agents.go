@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// defaultAgentRole is the agent_role_shares key used for roles not listed
+const defaultAgentRole = "default"
+
+// touchAgent is an agent participant of an interaction
+type touchAgent struct {
+	InteractionID int64   `db:"interaction_id"`
+	AgentID       int     `db:"agent_id"`
+	TeamID        *int    `db:"team_id"`
+	VendorID      *int    `db:"vendor_id"`
+	Role          *string `db:"role"`
+}
+
+// agentCredit is the part of a touch's credit that goes to one agent. Touches
+// without agents have a single credit with no agent and no share.
+type agentCredit struct {
+	AgentID  *int
+	TeamID   *int
+	VendorID *int
+	Role     *string
+	Share    *float64
+}
+
+// getTouchAgents returns the agent participants of the given interactions, in
+// the order they joined
+func getTouchAgents(q sqlx.Queryer, interactionIDs []int64) (map[int64][]touchAgent, error) {
+	byInteraction := map[int64][]touchAgent{}
+	if len(interactionIDs) == 0 {
+		return byInteraction, nil
+	}
+
+	var agents []touchAgent
+	err := sqlx.Select(q, &agents,
+		`SELECT ip.interaction_id, ip.agent_id, a.team_id, a.vendor_id, ip.role
+		 FROM interaction_participants ip
+		 INNER JOIN agents a ON ip.agent_id = a.id
+		 WHERE ip.interaction_id = ANY($1) AND ip.participant_type = 'agent'
+		 ORDER BY ip.interaction_id, ip.id`,
+		pq.Array(interactionIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent participants: %w", err)
+	}
+	for _, agent := range agents {
+		byInteraction[agent.InteractionID] = append(byInteraction[agent.InteractionID], agent)
+	}
+	return byInteraction, nil
+}
+
+// roleShare is the relative share of an agent in the given role. Roles not in
+// agent_role_shares get the "default" share, or none when that isn't set.
+func (c AttributionConfig) roleShare(role *string) float64 {
+	if len(c.AgentRoleShares) == 0 {
+		return 1
+	}
+	if role != nil {
+		for name, share := range c.AgentRoleShares {
+			if strings.EqualFold(name, *role) {
+				return share
+			}
+		}
+	}
+	return c.AgentRoleShares[defaultAgentRole]
+}
+
+// agentCredits splits a touch's credit across its agent participants by role
+// share, normalized so the shares sum to 1. An agent listed more than once
+// gets the sum of its shares; when every share is zero the split is even.
+func (c AttributionConfig) agentCredits(touch attributionTouch, agents []touchAgent) []agentCredit {
+	if len(agents) == 0 {
+		return []agentCredit{{AgentID: touch.AgentID, TeamID: touch.TeamID, VendorID: touch.VendorID}}
+	}
+
+	var credits []agentCredit
+	var shares []float64
+	index := map[int]int{}
+	for _, agent := range agents {
+		share := c.roleShare(agent.Role)
+		if i, ok := index[agent.AgentID]; ok {
+			shares[i] += share
+			continue
+		}
+		agentID := agent.AgentID
+		index[agentID] = len(credits)
+		credits = append(credits, agentCredit{AgentID: &agentID, TeamID: agent.TeamID, VendorID: agent.VendorID, Role: agent.Role})
+		shares = append(shares, share)
+	}
+
+	total := 0.0
+	for _, share := range shares {
+		total += share
+	}
+	for i := range credits {
+		share := 1 / float64(len(credits))
+		if total > 0 {
+			share = shares[i] / total
+		}
+		credits[i].Share = &share
+	}
+	return credits
+}
+
+// validateAgentRoleShares checks no role has a negative share
+func (c AttributionConfig) validateAgentRoleShares() error {
+	for role, share := range c.AgentRoleShares {
+		if share < 0 {
+			return fmt.Errorf("%w: agent role share for %s must not be negative", ErrInvalidAttributionConfig, role)
+		}
+	}
+	return nil
+}
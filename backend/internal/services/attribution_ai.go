@@ -0,0 +1,184 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/convin/crae/internal/models"
+)
+
+// aiSignalParams are the AI_WEIGHTED coefficients stored in
+// attribution_models.params. A touch's score is Base plus the contribution of
+// each Convin conversation signal; scores are normalised into weights.
+type aiSignalParams struct {
+	Base                  float64            `json:"base"`
+	PurchaseProbability   float64            `json:"purchase_probability"`
+	IntentWeights         map[string]float64 `json:"intent_weights"`
+	SecondaryIntentFactor float64            `json:"secondary_intent_factor"`
+	OutcomeWeights        map[string]float64 `json:"outcome_weights"`
+	DurationPerMinute     float64            `json:"duration_per_minute"`
+	DurationCapMinutes    float64            `json:"duration_cap_minutes"`
+	DirectionWeights      map[string]float64 `json:"direction_weights"`
+	MinScore              float64            `json:"min_score"`
+}
+
+// defaultAISignalParams is used for any coefficient missing from the model params
+func defaultAISignalParams() aiSignalParams {
+	return aiSignalParams{
+		Base:                1.0,
+		PurchaseProbability: 2.0,
+		IntentWeights: map[string]float64{
+			"purchase":     1.0,
+			"upgrade":      0.8,
+			"renewal":      0.6,
+			"pricing":      0.5,
+			"support":      0.0,
+			"complaint":    -0.5,
+			"cancellation": -0.5,
+		},
+		SecondaryIntentFactor: 0.25,
+		OutcomeWeights: map[string]float64{
+			"converted":       1.0,
+			"likely_purchase": 0.75,
+			"follow_up":       0.25,
+			"not_interested":  -0.5,
+		},
+		DurationPerMinute:  0.05,
+		DurationCapMinutes: 20,
+		DirectionWeights: map[string]float64{
+			"inbound":  0.25,
+			"outbound": 0.0,
+		},
+		MinScore: 0.05,
+	}
+}
+
+// parseAISignalParams overlays the model params on the defaults
+func parseAISignalParams(raw models.JSONB) (aiSignalParams, error) {
+	params := defaultAISignalParams()
+	if raw == nil {
+		return params, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return params, fmt.Errorf("failed to read AI_WEIGHTED params: %w", err)
+	}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return params, fmt.Errorf("invalid AI_WEIGHTED params: %w", err)
+	}
+	if params.MinScore <= 0 {
+		params.MinScore = 0.05
+	}
+	return params, nil
+}
+
+// aiSignalWeights scores each touch from its conversation signals (purchase
+// probability, primary and secondary intents, predicted outcome, call
+// duration and direction), normalises the scores into weights and returns a
+// per-touch explanation of how each weight was reached
+func aiSignalWeights(touches []attributionTouch, params aiSignalParams) ([]float64, []models.JSONB) {
+	scores := make([]float64, len(touches))
+	explanations := make([]models.JSONB, len(touches))
+	total := 0.0
+
+	for i, touch := range touches {
+		factors := models.JSONB{"base": params.Base}
+		score := params.Base
+
+		if touch.PurchaseProbability != nil {
+			contribution := params.PurchaseProbability * *touch.PurchaseProbability
+			factors["purchase_probability"] = contribution
+			score += contribution
+		}
+
+		if touch.PrimaryIntent != nil && *touch.PrimaryIntent != "" {
+			if weight, ok := lookupSignal(params.IntentWeights, *touch.PrimaryIntent); ok {
+				factors["primary_intent"] = weight
+				score += weight
+			}
+		}
+
+		secondary := 0.0
+		for _, intent := range touch.secondaryIntents() {
+			if weight, ok := lookupSignal(params.IntentWeights, intent); ok {
+				secondary += weight * params.SecondaryIntentFactor
+			}
+		}
+		if secondary != 0 {
+			factors["secondary_intents"] = secondary
+			score += secondary
+		}
+
+		if touch.OutcomePrediction != nil && *touch.OutcomePrediction != "" {
+			if weight, ok := lookupSignal(params.OutcomeWeights, *touch.OutcomePrediction); ok {
+				factors["outcome_prediction"] = weight
+				score += weight
+			}
+		}
+
+		if touch.DurationSeconds != nil && params.DurationPerMinute != 0 {
+			minutes := float64(*touch.DurationSeconds) / 60
+			if params.DurationCapMinutes > 0 {
+				minutes = math.Min(minutes, params.DurationCapMinutes)
+			}
+			contribution := params.DurationPerMinute * minutes
+			factors["duration"] = contribution
+			score += contribution
+		}
+
+		if touch.Direction != nil && *touch.Direction != "" {
+			if weight, ok := lookupSignal(params.DirectionWeights, *touch.Direction); ok {
+				factors["direction"] = weight
+				score += weight
+			}
+		}
+
+		if score < params.MinScore {
+			factors["min_score_applied"] = true
+			score = params.MinScore
+		}
+
+		scores[i] = score
+		total += score
+		explanations[i] = models.JSONB{"score": score, "factors": factors}
+	}
+
+	weights := make([]float64, len(touches))
+	for i := range scores {
+		weights[i] = scores[i] / total
+		explanations[i]["weight"] = weights[i]
+	}
+
+	return weights, explanations
+}
+
+// lookupSignal matches a signal value case-insensitively
+func lookupSignal(weights map[string]float64, value string) (float64, bool) {
+	if weight, ok := weights[value]; ok {
+		return weight, true
+	}
+	for key, weight := range weights {
+		if strings.EqualFold(key, value) {
+			return weight, true
+		}
+	}
+	return 0, false
+}
+
+// secondaryIntents returns the intents stored in secondary_intents
+// ({"intents": [...]}, as written by ingestion)
+func (t attributionTouch) secondaryIntents() []string {
+	raw, ok := t.SecondaryIntents["intents"].([]interface{})
+	if !ok {
+		return nil
+	}
+	intents := make([]string, 0, len(raw))
+	for _, value := range raw {
+		if intent, ok := value.(string); ok {
+			intents = append(intents, intent)
+		}
+	}
+	return intents
+}
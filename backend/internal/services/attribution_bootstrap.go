@@ -0,0 +1,325 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// Bootstrap confidence intervals: a run with bootstrap_samples set resamples
+// its conversions with replacement that many times and records the 5th, 50th
+// and 95th percentile of every agent's, vendor's and channel's resampled
+// total. Totals whose ranges overlap can't be told apart from the data.
+const (
+	minBootstrapSamples = 100
+	maxBootstrapSamples = 10000
+)
+
+// bootstrapDimensions are the breakdowns a run computes intervals for
+var bootstrapDimensions = []string{"agent", "vendor", "channel"}
+
+// ErrNoBootstrapIntervals is returned for a run that doesn't compute intervals
+var ErrNoBootstrapIntervals = errors.New("attribution run has no bootstrap intervals")
+
+// ConfidenceInterval is the p5/p50/p95 range of a bootstrapped total
+type ConfidenceInterval struct {
+	P5  float64 `db:"p5" json:"p5"`
+	P50 float64 `db:"p50" json:"p50"`
+	P95 float64 `db:"p95" json:"p95"`
+}
+
+// AttributionRunIntervals is a run version's breakdown along a dimension with
+// the bootstrap interval of each total
+type AttributionRunIntervals struct {
+	RunID     int64                     `json:"run_id"`
+	Version   int                       `json:"version"`
+	Dimension string                    `json:"dimension"`
+	Samples   int                       `json:"samples"`
+	Rows      []AttributionBreakdownRow `json:"rows"`
+}
+
+// bootstrapContribution is the credit one conversion gave one key
+type bootstrapContribution struct {
+	ConversionID int64   `db:"conversion_event_id"`
+	Key          string  `db:"key"`
+	Amount       float64 `db:"amount"`
+}
+
+// validateBootstrap checks the bootstrap sample count
+func (c AttributionConfig) validateBootstrap() error {
+	if c.BootstrapSamples != 0 && (c.BootstrapSamples < minBootstrapSamples || c.BootstrapSamples > maxBootstrapSamples) {
+		return fmt.Errorf("%w: bootstrap_samples must be between %d and %d", ErrInvalidAttributionConfig, minBootstrapSamples, maxBootstrapSamples)
+	}
+	return nil
+}
+
+// bootstrapSeed seeds the resampling so a run's intervals are reproducible;
+// without bootstrap_seed the run ID is used
+func (c AttributionConfig) bootstrapSeed(runID int64) int64 {
+	if c.BootstrapSeed != 0 {
+		return c.BootstrapSeed
+	}
+	return runID
+}
+
+// bootstrapIntervals resamples the conversions behind the contributions, which
+// must be ordered by conversion, and returns each key's interval
+func bootstrapIntervals(contributions []bootstrapContribution, samples int, seed int64) map[string]ConfidenceInterval {
+	type conversionCredit struct {
+		keys    []int
+		amounts []float64
+	}
+	var conversions []conversionCredit
+	var keys []string
+	keyIndex := map[string]int{}
+	for i, c := range contributions {
+		if i == 0 || c.ConversionID != contributions[i-1].ConversionID {
+			conversions = append(conversions, conversionCredit{})
+		}
+		k, ok := keyIndex[c.Key]
+		if !ok {
+			k = len(keys)
+			keyIndex[c.Key] = k
+			keys = append(keys, c.Key)
+		}
+		last := &conversions[len(conversions)-1]
+		last.keys = append(last.keys, k)
+		last.amounts = append(last.amounts, c.Amount)
+	}
+
+	intervals := make(map[string]ConfidenceInterval, len(keys))
+	if len(conversions) == 0 || samples <= 0 {
+		return intervals
+	}
+
+	totals := make([][]float64, len(keys))
+	for k := range totals {
+		totals[k] = make([]float64, samples)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	for b := 0; b < samples; b++ {
+		for range conversions {
+			conversion := conversions[rng.Intn(len(conversions))]
+			for j, k := range conversion.keys {
+				totals[k][b] += conversion.amounts[j]
+			}
+		}
+	}
+
+	for k, key := range keys {
+		sort.Float64s(totals[k])
+		intervals[key] = ConfidenceInterval{
+			P5:  percentile(totals[k], 0.05),
+			P50: percentile(totals[k], 0.5),
+			P95: percentile(totals[k], 0.95),
+		}
+	}
+	return intervals
+}
+
+// percentile interpolates the p-th quantile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// queryBootstrapContributions returns the credit each conversion of a run
+// version gave each key of the dimension, ordered by conversion, optionally
+// limited to conversions that occurred between from and to
+func queryBootstrapContributions(db *sqlx.DB, tenantID, runID int64, version int, dimension string, from, to *time.Time) ([]bootstrapContribution, error) {
+	expr, ok := attributionDimensions[dimension]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDimension, dimension)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT ar.conversion_event_id,
+		       COALESCE(%s, '') as key,
+		       COALESCE(SUM(ar.attributed_amount), 0) as amount
+		%s
+		WHERE ar.tenant_id = $1 AND ar.attribution_run_id = $2 AND ar.result_version = $3`,
+		expr.key, attributionBreakdownJoins,
+	)
+	args := []interface{}{tenantID, runID, version}
+	if from != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", len(args)+1)
+		args = append(args, *from)
+	}
+	if to != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", len(args)+1)
+		args = append(args, *to)
+	}
+	query += " GROUP BY 1, 2 ORDER BY 1, 2"
+
+	var contributions []bootstrapContribution
+	if err := db.Select(&contributions, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get conversion credit: %w", err)
+	}
+	return contributions, nil
+}
+
+// saveBootstrapIntervals computes and stores a run version's intervals,
+// replacing any it already has. Runs without bootstrap_samples are skipped.
+func (s *AttributionService) saveBootstrapIntervals(run *models.AttributionRun, version int, config AttributionConfig) error {
+	if config.BootstrapSamples <= 0 {
+		return nil
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`DELETE FROM attribution_result_intervals WHERE attribution_run_id = $1 AND result_version = $2`,
+		run.ID, version,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to clear bootstrap intervals: %w", err)
+	}
+
+	for _, dimension := range bootstrapDimensions {
+		contributions, err := queryBootstrapContributions(s.db, run.TenantID, run.ID, version, dimension, nil, nil)
+		if err != nil {
+			return err
+		}
+		intervals := bootstrapIntervals(contributions, config.BootstrapSamples, config.bootstrapSeed(run.ID))
+		for key, interval := range intervals {
+			_, err = tx.Exec(
+				`INSERT INTO attribution_result_intervals (
+					attribution_run_id, result_version, dimension, key, samples, p5, p50, p95
+				) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				run.ID, version, dimension, key, config.BootstrapSamples, interval.P5, interval.P50, interval.P95,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to save bootstrap interval: %w", err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storedBootstrapIntervals returns the intervals saved for a run version,
+// by key
+func storedBootstrapIntervals(db *sqlx.DB, runID int64, version int, dimension string) (map[string]ConfidenceInterval, error) {
+	var stored []struct {
+		Key string `db:"key"`
+		ConfidenceInterval
+	}
+	err := db.Select(&stored,
+		`SELECT key, p5, p50, p95 FROM attribution_result_intervals
+		 WHERE attribution_run_id = $1 AND result_version = $2 AND dimension = $3`,
+		runID, version, dimension,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bootstrap intervals: %w", err)
+	}
+	intervals := make(map[string]ConfidenceInterval, len(stored))
+	for _, interval := range stored {
+		intervals[interval.Key] = interval.ConfidenceInterval
+	}
+	return intervals, nil
+}
+
+// GetAttributionRunIntervals returns the current version's agent, vendor or
+// channel totals with their bootstrap intervals
+func (s *AttributionService) GetAttributionRunIntervals(tenantID, runID int64, dimension string) (*AttributionRunIntervals, error) {
+	if dimension == "" {
+		dimension = "vendor"
+	}
+	if !containsString(bootstrapDimensions, dimension) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDimension, dimension)
+	}
+
+	run, err := s.GetAttributionRun(tenantID, runID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseAttributionConfig(run.Config)
+	if err != nil {
+		return nil, err
+	}
+	if config.BootstrapSamples <= 0 {
+		return nil, fmt.Errorf("%w: run %d has no bootstrap_samples", ErrNoBootstrapIntervals, runID)
+	}
+	if run.CurrentVersion == nil {
+		return nil, fmt.Errorf("%w: run %d has no completed results", ErrAttributionVersionNotFound, runID)
+	}
+
+	rows, err := s.attributionBreakdown(tenantID, runID, *run.CurrentVersion, dimension)
+	if err != nil {
+		return nil, err
+	}
+
+	intervals, err := storedBootstrapIntervals(s.db, runID, *run.CurrentVersion, dimension)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		if interval, ok := intervals[rows[i].Key]; ok {
+			rows[i].Interval = &interval
+		}
+	}
+	sort.Slice(rows, func(a, b int) bool { return rows[a].AttributedAmount > rows[b].AttributedAmount })
+
+	return &AttributionRunIntervals{
+		RunID:     runID,
+		Version:   *run.CurrentVersion,
+		Dimension: dimension,
+		Samples:   config.BootstrapSamples,
+		Rows:      rows,
+	}, nil
+}
+
+// runBootstrapRanges returns the intervals of a run's current version. Without
+// a date range these are the ones stored when the run executed. With one, the
+// stored intervals don't apply: the totals are only bootstrapped again, with
+// the run's own samples and seed, when recompute is set, and otherwise no
+// intervals are returned. It returns nil for runs without bootstrap_samples.
+func runBootstrapRanges(db *sqlx.DB, tenantID, runID int64, dimension string, from, to *time.Time, recompute bool) (map[string]ConfidenceInterval, error) {
+	var run struct {
+		Config         models.JSONB `db:"config"`
+		CurrentVersion *int         `db:"current_version"`
+	}
+	err := db.Get(&run, `SELECT config, current_version FROM attribution_runs WHERE id = $1 AND tenant_id = $2`, runID, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution run: %w", err)
+	}
+	config, err := parseAttributionConfig(run.Config)
+	if err != nil {
+		return nil, err
+	}
+	if config.BootstrapSamples <= 0 || run.CurrentVersion == nil {
+		return nil, nil
+	}
+
+	if from == nil && to == nil {
+		return storedBootstrapIntervals(db, runID, *run.CurrentVersion, dimension)
+	}
+	if !recompute {
+		return nil, nil
+	}
+	contributions, err := queryBootstrapContributions(db, tenantID, runID, *run.CurrentVersion, dimension, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return bootstrapIntervals(contributions, config.BootstrapSamples, config.bootstrapSeed(runID)), nil
+}
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+)
+
+// Reasons an interaction of the converting customer was not credited
+const (
+	exclusionAfterConversion = "after_conversion"
+	exclusionOutsideWindow   = "outside_window"
+	exclusionChannelFiltered = "channel_filtered"
+	exclusionViewThrough     = "view_through_excluded"
+	exclusionNotAttributed   = "not_attributed"
+)
+
+// maxExcludedTouches bounds the excluded interactions returned for a
+// conversion; the ones closest in time to the conversion are kept
+const maxExcludedTouches = 200
+
+// ErrConversionNotFound is returned when a conversion does not exist for the tenant
+var ErrConversionNotFound = errors.New("conversion not found")
+
+// touchExclusion returns why a touch cannot be credited for a conversion
+// under config, with a human-readable detail, or "" when it can
+func touchExclusion(touch attributionTouch, conversion models.ConversionEvent, config AttributionConfig) (string, string) {
+	conversionTime := conversion.OccurredAt
+	hours, rule := config.touchWindow(touch, conversion.EventType)
+
+	if touch.StartedAt.After(conversionTime) {
+		return exclusionAfterConversion, fmt.Sprintf("started %s after the conversion", formatHours(touch.StartedAt.Sub(conversionTime)))
+	}
+	if touch.IsViewThrough && !config.IncludeViewThrough {
+		return exclusionViewThrough, "ad impression and the run does not include view-through touches"
+	}
+	if gap := conversionTime.Sub(touch.StartedAt); gap > time.Duration(hours)*time.Hour {
+		return exclusionOutsideWindow, fmt.Sprintf("started %s before the conversion; the lookback window is %dh (rule: %s)", formatHours(gap), hours, rule)
+	}
+	if len(config.IncludeChannels) > 0 && !containsString(config.IncludeChannels, touch.ChannelName) {
+		return exclusionChannelFiltered, fmt.Sprintf("channel %s is not in the run's channels (%s)", touch.ChannelName, strings.Join(config.IncludeChannels, ", "))
+	}
+	return "", ""
+}
+
+// conversionExclusion returns why the run config leaves a conversion out, or ""
+func conversionExclusion(conversion models.ConversionEvent, config AttributionConfig) string {
+	if len(config.EventTypes) > 0 && !containsString(config.EventTypes, conversion.EventType) {
+		return fmt.Sprintf("event type %s is not in the run's event types (%s)", conversion.EventType, strings.Join(config.EventTypes, ", "))
+	}
+	if config.MinPurchaseAmount > 0 && conversion.AmountDecimal < config.MinPurchaseAmount {
+		return fmt.Sprintf("amount %.2f is below the run's minimum of %.2f", conversion.AmountDecimal, config.MinPurchaseAmount)
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func formatHours(d time.Duration) string {
+	return fmt.Sprintf("%.1fh", d.Hours())
+}
+
+// ConversionAttributionExplanation shows how a run split one conversion: the
+// ordered touch path that was credited and the customer's other interactions
+// with the reason each was left out
+type ConversionAttributionExplanation struct {
+	Conversion          models.ConversionEvent `json:"conversion"`
+	RunID               int64                  `json:"run_id"`
+	ModelCode           string                 `json:"model_code"`
+	AccountID           *int64                 `json:"account_id,omitempty"`
+	ResultVersion       int                    `json:"result_version"`
+	Config              AttributionConfig      `json:"config"`
+	WindowStart         time.Time              `json:"window_start"`
+	ConversionExclusion string                 `json:"conversion_exclusion,omitempty"`
+	TotalAttributed     float64                `json:"total_attributed"`
+	TotalReversed       float64                `json:"total_reversed"`
+	Touches             []ExplainedTouch       `json:"touches"`
+	Excluded            []ExplainedTouch       `json:"excluded"`
+	ExcludedTruncated   bool                   `json:"excluded_truncated"`
+}
+
+// ExplainedTouch is an interaction of the converting customer (or, for
+// account-level runs, of any contact of its account, or an account
+// engagement) with its credit (for touches) or the reason it got none (for
+// excluded interactions)
+type ExplainedTouch struct {
+	Position            int                    `json:"position,omitempty"`
+	InteractionID       *int64                 `json:"interaction_id"`
+	AccountEngagementID *int64                 `json:"account_engagement_id,omitempty"`
+	CustomerID          *int64                 `json:"customer_id,omitempty"`
+	Channel             string                 `json:"channel"`
+	AgentID             *int                   `json:"agent_id"`
+	AgentName           *string                `json:"agent_name"`
+	TeamID              *int                   `json:"team_id"`
+	TeamName            *string                `json:"team_name"`
+	VendorID            *int                   `json:"vendor_id"`
+	VendorName          *string                `json:"vendor_name"`
+	StartedAt           time.Time              `json:"started_at"`
+	Direction           *string                `json:"direction,omitempty"`
+	PrimaryIntent       *string                `json:"primary_intent,omitempty"`
+	IsViewThrough       bool                   `json:"is_view_through,omitempty"`
+	Agents              []ExplainedAgentCredit `json:"agents,omitempty"`
+	Weight              float64                `json:"weight"`
+	AttributedAmount    float64                `json:"attributed_amount"`
+	ReversedAmount      float64                `json:"reversed_amount,omitempty"`
+	IsPrimaryTouch      bool                   `json:"is_primary_touch"`
+	Explanation         models.JSONB           `json:"explanation,omitempty"`
+	Reason              string                 `json:"reason,omitempty"`
+	Detail              string                 `json:"detail,omitempty"`
+	WindowRule          string                 `json:"window_rule,omitempty"`
+}
+
+// ExplainedAgentCredit is one agent's part of a touch handled by several agents
+type ExplainedAgentCredit struct {
+	AgentID          *int     `json:"agent_id"`
+	AgentName        *string  `json:"agent_name"`
+	Role             *string  `json:"role,omitempty"`
+	Share            *float64 `json:"share,omitempty"`
+	Weight           float64  `json:"weight"`
+	AttributedAmount float64  `json:"attributed_amount"`
+	ReversedAmount   float64  `json:"reversed_amount,omitempty"`
+}
+
+// explainedInteraction is an attributionTouch with the names needed to explain it
+type explainedInteraction struct {
+	attributionTouch
+	AgentName  *string `db:"agent_name"`
+	TeamName   *string `db:"team_name"`
+	VendorName *string `db:"vendor_name"`
+}
+
+// explainedResult is the credit stored for one touch of the conversion, with
+// the amount refunds and chargebacks clawed back from it
+type explainedResult struct {
+	InteractionID     *int64       `db:"interaction_id"`
+	EngagementID      *int64       `db:"account_engagement_id"`
+	AgentID           *int         `db:"agent_id"`
+	AgentName         *string      `db:"agent_name"`
+	AgentRole         *string      `db:"agent_role"`
+	AgentShare        *float64     `db:"agent_share"`
+	AttributionWeight float64      `db:"attribution_weight"`
+	AttributedAmount  float64      `db:"attributed_amount"`
+	ReversedAmount    float64      `db:"reversed_amount"`
+	IsPrimaryTouch    bool         `db:"is_primary_touch"`
+	Explanation       models.JSONB `db:"explanation"`
+}
+
+// ExplainConversionAttribution explains how a run's current result version
+// (or the given version) credited a conversion. Without a run ID the tenant's
+// most recent run crediting the conversion is used, preferring live runs.
+func (s *AttributionService) ExplainConversionAttribution(tenantID, conversionID, runID int64, version int) (*ConversionAttributionExplanation, error) {
+	var conversion models.ConversionEvent
+	err := s.db.Get(&conversion,
+		`SELECT `+conversionEventColumns+` FROM conversion_events ce WHERE ce.id = $1 AND ce.tenant_id = $2`,
+		conversionID, tenantID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrConversionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversion: %w", err)
+	}
+
+	if runID == 0 {
+		err := s.db.Get(&runID,
+			`SELECT run.id FROM attribution_runs run
+			 WHERE run.tenant_id = $1
+			   AND EXISTS (
+				SELECT 1 FROM attribution_results ar
+				WHERE ar.attribution_run_id = run.id
+				  AND ar.result_version = run.current_version
+				  AND ar.conversion_event_id = $2
+			   )
+			 ORDER BY run.is_live DESC, run.id DESC
+			 LIMIT 1`,
+			tenantID, conversionID,
+		)
+		if err == sql.ErrNoRows {
+			return nil, ErrAttributionRunNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find attribution run: %w", err)
+		}
+	}
+
+	run, err := s.GetAttributionRun(tenantID, runID)
+	if err != nil {
+		return nil, err
+	}
+	if version <= 0 {
+		if run.CurrentVersion == nil {
+			return nil, fmt.Errorf("%w: run has no completed version", ErrAttributionVersionNotFound)
+		}
+		version = *run.CurrentVersion
+	}
+
+	config, err := parseAttributionConfig(run.Config)
+	if err != nil {
+		return nil, err
+	}
+	model, err := s.getAttributionModel(run.ModelID)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &ConversionAttributionExplanation{
+		Conversion:          conversion,
+		RunID:               runID,
+		ModelCode:           model.Code,
+		ResultVersion:       version,
+		Config:              config,
+		WindowStart:         conversion.OccurredAt.Add(-time.Duration(config.maxWindowHours(conversion.EventType)) * time.Hour),
+		ConversionExclusion: conversionExclusion(conversion, config),
+		Touches:             []ExplainedTouch{},
+		Excluded:            []ExplainedTouch{},
+	}
+
+	var results []explainedResult
+	err = s.db.Select(&results,
+		`SELECT ar.interaction_id, ar.account_engagement_id, ar.agent_id, a.name as agent_name,
+		        ar.agent_role, ar.agent_share, ar.attribution_weight, ar.attributed_amount,
+		        ar.is_primary_touch, ar.explanation,
+		        COALESCE((SELECT -SUM(c.attributed_amount) FROM attribution_results c
+		                  WHERE c.attribution_run_id = ar.attribution_run_id AND c.result_version = ar.result_version
+		                    AND c.conversion_event_id = ar.conversion_event_id
+		                    AND c.interaction_id IS NOT DISTINCT FROM ar.interaction_id
+		                    AND c.account_engagement_id IS NOT DISTINCT FROM ar.account_engagement_id
+		                    AND c.agent_id IS NOT DISTINCT FROM ar.agent_id
+		                    AND c.reversal_event_id IS NOT NULL), 0) as reversed_amount
+		 FROM attribution_results ar
+		 LEFT JOIN agents a ON ar.agent_id = a.id
+		 WHERE ar.attribution_run_id = $1 AND ar.result_version = $2 AND ar.conversion_event_id = $3
+		   AND ar.reversal_event_id IS NULL
+		 ORDER BY ar.agent_share DESC NULLS LAST, ar.id`,
+		runID, version, conversionID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution results: %w", err)
+	}
+	// A touch split across agents has a result per agent
+	credited := make(map[explainedTouchRef][]explainedResult, len(results))
+	for _, result := range results {
+		ref := touchRef(result.InteractionID, result.EngagementID)
+		credited[ref] = append(credited[ref], result)
+	}
+
+	if config.accountLevel() {
+		explanation.AccountID, err = s.customerAccountID(conversion.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	interactions, err := s.explainedInteractions(tenantID, conversion.CustomerID, explanation.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, interaction := range interactions {
+		touch := ExplainedTouch{
+			InteractionID:       interaction.interactionID(),
+			AccountEngagementID: interaction.EngagementID,
+			CustomerID:          interaction.CustomerID,
+			Channel:             interaction.ChannelName,
+			AgentID:             interaction.AgentID,
+			AgentName:           interaction.AgentName,
+			TeamID:              interaction.TeamID,
+			TeamName:            interaction.TeamName,
+			VendorID:            interaction.VendorID,
+			VendorName:          interaction.VendorName,
+			StartedAt:           interaction.StartedAt,
+			Direction:           interaction.Direction,
+			PrimaryIntent:       interaction.PrimaryIntent,
+			IsViewThrough:       interaction.IsViewThrough,
+		}
+
+		if touchResults, ok := credited[touchRef(touch.InteractionID, touch.AccountEngagementID)]; ok {
+			touch.Position = len(explanation.Touches) + 1
+			touch.IsPrimaryTouch = touchResults[0].IsPrimaryTouch
+			touch.Explanation = touchResults[0].Explanation
+			for _, result := range touchResults {
+				touch.Weight += result.AttributionWeight
+				touch.AttributedAmount += result.AttributedAmount
+				touch.ReversedAmount += result.ReversedAmount
+				if len(touchResults) > 1 {
+					touch.Agents = append(touch.Agents, ExplainedAgentCredit{
+						AgentID:          result.AgentID,
+						AgentName:        result.AgentName,
+						Role:             result.AgentRole,
+						Share:            result.AgentShare,
+						Weight:           result.AttributionWeight,
+						AttributedAmount: result.AttributedAmount,
+						ReversedAmount:   result.ReversedAmount,
+					})
+				}
+			}
+			explanation.TotalAttributed += touch.AttributedAmount
+			explanation.TotalReversed += touch.ReversedAmount
+			explanation.Touches = append(explanation.Touches, touch)
+			continue
+		}
+
+		touch.Reason, touch.Detail = touchExclusion(interaction.attributionTouch, conversion, config)
+		if touch.Reason == exclusionOutsideWindow {
+			_, touch.WindowRule = config.touchWindow(interaction.attributionTouch, conversion.EventType)
+		}
+		if touch.Reason == "" {
+			// Eligible now, but not credited when this version ran (for
+			// example ingested afterwards, or the conversion was left out)
+			touch.Reason = exclusionNotAttributed
+			touch.Detail = "eligible but not credited in this result version"
+			if explanation.ConversionExclusion != "" {
+				touch.Detail = "the run does not attribute this conversion"
+			}
+		}
+		explanation.Excluded = append(explanation.Excluded, touch)
+	}
+
+	explanation.Excluded, explanation.ExcludedTruncated = nearestExcluded(explanation.Excluded, conversion.OccurredAt)
+	return explanation, nil
+}
+
+// explainedTouchRef identifies a credited interaction or account engagement;
+// zero stands for "not set" since ids start at one
+type explainedTouchRef struct {
+	interactionID int64
+	engagementID  int64
+}
+
+func touchRef(interactionID, engagementID *int64) explainedTouchRef {
+	var ref explainedTouchRef
+	if interactionID != nil {
+		ref.interactionID = *interactionID
+	}
+	if engagementID != nil {
+		ref.engagementID = *engagementID
+	}
+	return ref
+}
+
+// explainedInteractions returns, in time order, the customer's interactions,
+// or for an account every contact's interactions and the account's engagements
+func (s *AttributionService) explainedInteractions(tenantID, customerID int64, accountID *int64) ([]explainedInteraction, error) {
+	query := `SELECT ` + attributionTouchColumns + `,
+			MAX(CASE WHEN ip.participant_type = 'agent' THEN a.name END) as agent_name,
+			MAX(CASE WHEN ip.participant_type = 'agent' THEN t.name END) as team_name,
+			MAX(CASE WHEN ip.participant_type = 'agent' THEN v.name END) as vendor_name
+		` + attributionTouchJoins + `
+		WHERE i.tenant_id = $1`
+	args := []interface{}{tenantID}
+	if accountID != nil {
+		query += ` AND i.customer_id IN (SELECT id FROM customers WHERE account_id = $2)`
+		args = append(args, *accountID)
+	} else {
+		query += ` AND i.customer_id = $2`
+		args = append(args, customerID)
+	}
+	query += ` GROUP BY i.id, ch.name ORDER BY i.started_at ASC`
+
+	var interactions []explainedInteraction
+	if err := s.db.Select(&interactions, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get interactions: %w", err)
+	}
+	if accountID == nil {
+		return interactions, nil
+	}
+
+	var engagements []explainedInteraction
+	err := s.db.Select(&engagements,
+		`SELECT `+attributionEngagementColumns+` FROM account_engagements ae WHERE ae.tenant_id = $1 AND ae.account_id = $2`,
+		tenantID, *accountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account engagements: %w", err)
+	}
+
+	interactions = append(interactions, engagements...)
+	sort.SliceStable(interactions, func(a, b int) bool {
+		return interactions[a].StartedAt.Before(interactions[b].StartedAt)
+	})
+	return interactions, nil
+}
+
+// nearestExcluded keeps the maxExcludedTouches interactions closest in time
+// to the conversion, in chronological order
+func nearestExcluded(excluded []ExplainedTouch, conversionTime time.Time) ([]ExplainedTouch, bool) {
+	if len(excluded) <= maxExcludedTouches {
+		return excluded, false
+	}
+	distance := func(t ExplainedTouch) float64 {
+		return math.Abs(float64(t.StartedAt.Sub(conversionTime)))
+	}
+	sort.SliceStable(excluded, func(a, b int) bool {
+		return distance(excluded[a]) < distance(excluded[b])
+	})
+	excluded = excluded[:maxExcludedTouches]
+	sort.SliceStable(excluded, func(a, b int) bool {
+		return excluded[a].StartedAt.Before(excluded[b].StartedAt)
+	})
+	return excluded, true
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// attributionIncrementalOverlap re-reads rows ingested shortly before the
+// watermark, so rows written by transactions still open when the watermark was
+// taken are not missed. Re-attributing a conversion is idempotent.
+const attributionIncrementalOverlap = 5 * time.Minute
+
+// SetLiveAttributionRun designates the run as the live run for its model, or
+// clears the designation. Live runs are kept up to date by incremental runs;
+// any other live run of the same tenant and model stops being live.
+func (s *AttributionService) SetLiveAttributionRun(tenantID, runID int64, live bool) (*models.AttributionRun, error) {
+	run, err := s.GetAttributionRun(tenantID, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if live {
+		_, err = tx.Exec(
+			`UPDATE attribution_runs SET is_live = FALSE, updated_at = NOW()
+			 WHERE tenant_id = $1 AND model_id = $2 AND is_live AND id <> $3`,
+			tenantID, run.ModelID, runID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to clear live run: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE attribution_runs SET is_live = $1, updated_at = NOW() WHERE id = $2`, live, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set live run: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to set live run: %w", err)
+	}
+
+	return s.GetAttributionRun(tenantID, runID)
+}
+
+// ExecuteIncrementalAttribution re-attributes, in place in the run's current
+// result version, the conversions ingested since the run's watermark and the
+// conversions whose lookback window gained interactions ingested since then
+// (late-arriving data). It returns the number of conversions attributed.
+func (s *AttributionService) ExecuteIncrementalAttribution(ctx context.Context, runID int64) (int, error) {
+	run, err := s.getAttributionRun(runID)
+	if err != nil {
+		return 0, err
+	}
+	if run.CurrentVersion == nil {
+		return 0, fmt.Errorf("attribution run %d has no completed version to update", runID)
+	}
+	version := *run.CurrentVersion
+
+	config, err := parseAttributionConfig(run.Config)
+	if err != nil {
+		return 0, err
+	}
+
+	model, err := s.getAttributionModel(run.ModelID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Data-driven models keep the values computed for the current version
+	var versionStartedAt *time.Time
+	err = s.db.QueryRowx(
+		`SELECT model_output, started_at FROM attribution_run_versions WHERE attribution_run_id = $1 AND version = $2`,
+		runID, version,
+	).Scan(&run.ModelOutput, &versionStartedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get run version: %w", err)
+	}
+
+	state, err := s.prepareModelState(run, model, config, true)
+	if err != nil {
+		return 0, err
+	}
+
+	since := run.Watermark
+	if since == nil {
+		since = versionStartedAt
+	}
+	if since == nil {
+		return 0, fmt.Errorf("attribution run %d has no watermark", runID)
+	}
+
+	var until time.Time
+	if err := s.db.Get(&until, `SELECT LOCALTIMESTAMP`); err != nil {
+		return 0, fmt.Errorf("failed to read watermark: %w", err)
+	}
+
+	conversions, err := s.getIncrementalConversions(run.TenantID, config, since.Add(-attributionIncrementalOverlap), until)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, conversion := range conversions {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err := s.attributeConversion(runID, version, run, conversion, model.Code, config, state); err != nil {
+			if err := s.recordAttributionRunError(runID, version, conversion.ID, err); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Intervals are recomputed over the whole version, new conversions included
+	if err := s.saveBootstrapIntervals(run, version, config); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := refreshAttributionVersionTotals(tx, runID, version); err != nil {
+		return 0, err
+	}
+
+	// A full re-execution that completed meanwhile owns the watermark
+	_, err = tx.Exec(
+		`UPDATE attribution_runs SET watermark = $1, updated_at = NOW()
+		 WHERE id = $2 AND current_version = $3`,
+		until, runID, version,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to advance watermark: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to advance watermark: %w", err)
+	}
+
+	return len(conversions), nil
+}
+
+// refreshAttributionVersionTotals recomputes a result version's row count and
+// attributed amount after its results were changed in place
+func refreshAttributionVersionTotals(tx *sqlx.Tx, runID int64, version int) error {
+	_, err := tx.Exec(
+		`UPDATE attribution_run_versions v
+		 SET result_rows = totals.result_rows, attributed_amount = totals.attributed_amount
+		 FROM (SELECT COUNT(*) as result_rows, COALESCE(SUM(attributed_amount), 0) as attributed_amount
+		       FROM attribution_results WHERE attribution_run_id = $1 AND result_version = $2) totals
+		 WHERE v.attribution_run_id = $1 AND v.version = $2`,
+		runID, version,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update run version: %w", err)
+	}
+	return nil
+}
+
+// getIncrementalConversions returns the conversions matching the run config
+// that were ingested or updated in (since, until], or whose lookback window
+// holds an interaction ingested or updated in (since, until]
+func (s *AttributionService) getIncrementalConversions(tenantID int64, config AttributionConfig, since, until time.Time) ([]models.ConversionEvent, error) {
+	// Account-level runs also re-attribute when another contact of the account
+	// interacted, or the account engaged, within the window
+	touchCustomers := `i.customer_id = ce.customer_id`
+	engagements := ``
+	if config.accountLevel() {
+		touchCustomers = `(i.customer_id = ce.customer_id OR i.customer_id IN (
+				    SELECT other.id FROM customers own
+				    INNER JOIN customers other ON other.account_id = own.account_id
+				    WHERE own.id = ce.customer_id))`
+		engagements = `
+			OR EXISTS (
+				SELECT 1 FROM account_engagements ae
+				INNER JOIN customers own ON ae.account_id = own.account_id
+				WHERE own.id = ce.customer_id
+				  AND ae.created_at > $%[1]d
+				  AND ae.created_at <= $%[2]d
+				  AND (ae.engagement_date AT TIME ZONE 'UTC') <= ce.occurred_at
+				  AND (ae.engagement_date AT TIME ZONE 'UTC') >= ce.occurred_at - make_interval(hours => $%[3]d)
+			)`
+	}
+
+	query, args, argPos := runConversionsQuery(tenantID, config)
+	query += fmt.Sprintf(`
+		AND (
+			(GREATEST(ce.created_at, ce.updated_at) > $%[1]d AND GREATEST(ce.created_at, ce.updated_at) <= $%[2]d)
+			OR EXISTS (
+				SELECT 1 FROM interactions i
+				WHERE i.tenant_id = ce.tenant_id
+				  AND `+touchCustomers+`
+				  AND GREATEST(i.created_at, i.updated_at) > $%[1]d
+				  AND GREATEST(i.created_at, i.updated_at) <= $%[2]d
+				  AND i.started_at <= ce.occurred_at
+				  AND i.started_at >= ce.occurred_at - make_interval(hours => $%[3]d)
+			)`+engagements+`
+		)
+		ORDER BY ce.customer_id, ce.occurred_at`,
+		argPos, argPos+1, argPos+2,
+	)
+	args = append(args, since, until, config.longestWindowHours())
+
+	var conversions []models.ConversionEvent
+	if err := s.db.Select(&conversions, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get new conversion events: %w", err)
+	}
+	return conversions, nil
+}
+
+// claimDueLiveAttributionRuns marks the live runs whose last incremental run
+// is older than interval as started and returns them. Runs with a full
+// execution queued or in progress are skipped.
+func (s *AttributionService) claimDueLiveAttributionRuns(interval time.Duration) ([]int64, error) {
+	var runIDs []int64
+	err := s.db.Select(&runIDs,
+		`UPDATE attribution_runs
+		 SET last_incremental_at = LOCALTIMESTAMP
+		 WHERE id IN (
+			SELECT id FROM attribution_runs
+			WHERE is_live
+			  AND current_version IS NOT NULL
+			  AND status NOT IN ('queued', 'running')
+			  AND (last_incremental_at IS NULL OR last_incremental_at < LOCALTIMESTAMP - make_interval(secs => $1))
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id`,
+		interval.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim live attribution runs: %w", err)
+	}
+	return runIDs, nil
+}
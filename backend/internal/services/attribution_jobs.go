@@ -0,0 +1,478 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrAttributionRunNotFound is returned when a run does not exist for the tenant
+	ErrAttributionRunNotFound = errors.New("attribution run not found")
+	// ErrAttributionRunActive is returned when queueing a run that is already queued or running
+	ErrAttributionRunActive = errors.New("attribution run is already queued or running")
+	// ErrAttributionRunNotActive is returned when cancelling a run that is not queued or running
+	ErrAttributionRunNotActive = errors.New("attribution run is not queued or running")
+	// ErrAttributionRunCancelled is the cancel cause of a run stopped by CancelAttributionRun
+	ErrAttributionRunCancelled = errors.New("attribution run cancelled")
+)
+
+const (
+	// Progress is saved every attributionProgressEvery conversions or
+	// attributionProgressInterval, whichever comes first
+	attributionProgressEvery    = 500
+	attributionProgressInterval = 2 * time.Second
+
+	// A running run's updated_at is refreshed every attributionHeartbeatInterval.
+	// Runs not refreshed for attributionStaleAfter are assumed to belong to a
+	// crashed worker and are picked up again.
+	attributionHeartbeatInterval = 15 * time.Second
+	attributionStaleAfter        = 5 * time.Minute
+)
+
+// attributionRunColumns selects a models.AttributionRun
+const attributionRunColumns = `id, tenant_id, model_id, COALESCE(name, '') as name,
+	COALESCE(description, '') as description, config, status, model_output, current_version,
+	is_live, watermark, last_incremental_at,
+	queued_at, started_at, completed_at, total_conversions, processed_conversions,
+	failed_conversions, cancel_requested, error_message, created_at, updated_at`
+
+// attributionRunProgress counts the conversions handled by an execution of a
+// run, which writes result version Version and covers data ingested up to
+// Watermark
+type attributionRunProgress struct {
+	Version   int
+	Watermark time.Time
+	Total     int
+	Processed int
+	Failed    int
+}
+
+// status is the final status of a run that processed every conversion
+func (p attributionRunProgress) status() string {
+	switch {
+	case p.Failed == 0:
+		return "completed"
+	case p.Failed >= p.Processed:
+		return "failed"
+	default:
+		return "partial"
+	}
+}
+
+// setProgressPercent fills in the run's percent complete
+func setProgressPercent(run *models.AttributionRun) {
+	switch {
+	case run.Status == "completed" || run.Status == "partial":
+		run.ProgressPercent = 100
+	case run.TotalConversions > 0:
+		percent := float64(run.ProcessedConversions) / float64(run.TotalConversions) * 100
+		run.ProgressPercent = math.Round(percent*100) / 100
+	}
+}
+
+// GetAttributionRun returns a run with its progress
+func (s *AttributionService) GetAttributionRun(tenantID, runID int64) (*models.AttributionRun, error) {
+	var run models.AttributionRun
+	err := s.db.Get(&run, `SELECT `+attributionRunColumns+` FROM attribution_runs WHERE id = $1 AND tenant_id = $2`, runID, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrAttributionRunNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution run: %w", err)
+	}
+	setProgressPercent(&run)
+	return &run, nil
+}
+
+// getAttributionRun loads a run by ID regardless of tenant, for the workers
+func (s *AttributionService) getAttributionRun(runID int64) (*models.AttributionRun, error) {
+	var run models.AttributionRun
+	err := s.db.Get(&run, `SELECT `+attributionRunColumns+` FROM attribution_runs WHERE id = $1`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("attribution run not found: %w", err)
+	}
+	return &run, nil
+}
+
+// QueueAttributionRun queues a run for the background workers. Finished runs
+// can be queued again; each execution writes a new result version.
+func (s *AttributionService) QueueAttributionRun(tenantID, runID int64) (*models.AttributionRun, error) {
+	result, err := s.db.Exec(
+		`UPDATE attribution_runs
+		 SET status = 'queued', queued_at = NOW(), cancel_requested = FALSE, error_message = NULL, updated_at = NOW()
+		 WHERE id = $1 AND tenant_id = $2 AND status NOT IN ('queued', 'running')`,
+		runID, tenantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue attribution run: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := s.GetAttributionRun(tenantID, runID); err != nil {
+			return nil, err
+		}
+		return nil, ErrAttributionRunActive
+	}
+
+	// Wake an idle worker without blocking when one is already due to look
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return s.GetAttributionRun(tenantID, runID)
+}
+
+// CancelAttributionRun cancels a queued run immediately, or asks a running run
+// to stop. A running run stops after the conversion it is processing; its
+// partial result version is kept but never becomes current.
+func (s *AttributionService) CancelAttributionRun(tenantID, runID int64) (*models.AttributionRun, error) {
+	result, err := s.db.Exec(
+		`UPDATE attribution_runs
+		 SET status = CASE WHEN status = 'queued' THEN 'cancelled' ELSE status END,
+		     completed_at = CASE WHEN status = 'queued' THEN NOW() ELSE completed_at END,
+		     cancel_requested = TRUE,
+		     updated_at = NOW()
+		 WHERE id = $1 AND tenant_id = $2 AND status IN ('queued', 'running')`,
+		runID, tenantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel attribution run: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := s.GetAttributionRun(tenantID, runID); err != nil {
+			return nil, err
+		}
+		return nil, ErrAttributionRunNotActive
+	}
+
+	// Stop it right away when it runs in this process; otherwise the owning
+	// worker sees cancel_requested on its next heartbeat
+	if cancel, ok := s.running.Load(runID); ok {
+		cancel.(context.CancelCauseFunc)(ErrAttributionRunCancelled)
+	}
+
+	return s.GetAttributionRun(tenantID, runID)
+}
+
+// GetAttributionRunErrors lists the conversions a run failed to attribute in
+// a result version, by default the latest
+func (s *AttributionService) GetAttributionRunErrors(tenantID, runID int64, version, limit, offset int) ([]models.AttributionRunError, error) {
+	if _, err := s.GetAttributionRun(tenantID, runID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, attribution_run_id, conversion_event_id, result_version, error_message, created_at
+		FROM attribution_run_errors
+		WHERE attribution_run_id = $1
+	`
+	args := []interface{}{runID, limit, offset}
+	if version > 0 {
+		query += ` AND result_version = $4`
+		args = append(args, version)
+	} else {
+		query += ` AND result_version = (SELECT COALESCE(MAX(version), 0) FROM attribution_run_versions WHERE attribution_run_id = $1)`
+	}
+	query += ` ORDER BY id LIMIT $2 OFFSET $3`
+
+	var runErrors []models.AttributionRunError
+	if err := s.db.Select(&runErrors, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get attribution run errors: %w", err)
+	}
+	return runErrors, nil
+}
+
+// claimQueuedAttributionRun marks the oldest queued run (or a running run
+// whose worker stopped sending heartbeats) as running and returns its ID.
+// SKIP LOCKED lets concurrent workers claim different runs.
+func (s *AttributionService) claimQueuedAttributionRun() (int64, bool, error) {
+	var runID int64
+	err := s.db.Get(&runID,
+		`UPDATE attribution_runs
+		 SET status = 'running', updated_at = NOW()
+		 WHERE id = (
+			SELECT id FROM attribution_runs
+			WHERE status = 'queued' OR (status = 'running' AND updated_at < LOCALTIMESTAMP - make_interval(secs => $1))
+			ORDER BY queued_at NULLS FIRST, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		 )
+		 RETURNING id`,
+		attributionStaleAfter.Seconds(),
+	)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to claim attribution run: %w", err)
+	}
+	return runID, true, nil
+}
+
+// heartbeatAttributionRun keeps a running run from looking stale and stops it
+// when a cancel was requested through another instance
+func (s *AttributionService) heartbeatAttributionRun(ctx context.Context, runID int64, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(attributionHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var cancelRequested bool
+			err := s.db.Get(&cancelRequested,
+				`UPDATE attribution_runs SET updated_at = NOW() WHERE id = $1 RETURNING cancel_requested`,
+				runID,
+			)
+			if err == nil && cancelRequested {
+				cancel(ErrAttributionRunCancelled)
+				return
+			}
+		}
+	}
+}
+
+// saveAttributionRunProgress stores the run's conversion counts
+func (s *AttributionService) saveAttributionRunProgress(runID int64, progress attributionRunProgress) error {
+	_, err := s.db.Exec(
+		`UPDATE attribution_runs
+		 SET total_conversions = $1, processed_conversions = $2, failed_conversions = $3, updated_at = NOW()
+		 WHERE id = $4`,
+		progress.Total, progress.Processed, progress.Failed, runID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save run progress: %w", err)
+	}
+	return nil
+}
+
+// recordAttributionRunError stores why a conversion could not be attributed
+func (s *AttributionService) recordAttributionRunError(runID int64, version int, conversionID int64, cause error) error {
+	_, err := s.db.Exec(
+		`INSERT INTO attribution_run_errors (attribution_run_id, result_version, conversion_event_id, error_message)
+		 VALUES ($1, $2, $3, $4)`,
+		runID, version, conversionID, cause.Error(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record attribution error: %w", err)
+	}
+	return nil
+}
+
+// finishAttributionRun sets the final status and counts of a run and its
+// result version. A completed version atomically becomes the run's current
+// version; other outcomes leave the previous version current.
+func (s *AttributionService) finishAttributionRun(runID int64, status string, progress attributionRunProgress, cause error) error {
+	var message *string
+	if cause != nil {
+		text := cause.Error()
+		message = &text
+	} else if progress.Failed > 0 {
+		text := fmt.Sprintf("%d of %d conversions failed", progress.Failed, progress.Processed)
+		message = &text
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE attribution_runs
+		 SET status = $1, completed_at = NOW(), updated_at = NOW(), error_message = $2,
+		     total_conversions = $3, processed_conversions = $4, failed_conversions = $5
+		 WHERE id = $6`,
+		status, message, progress.Total, progress.Processed, progress.Failed, runID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update run status: %w", err)
+	}
+
+	if progress.Version > 0 {
+		_, err = tx.Exec(
+			`UPDATE attribution_run_versions v
+			 SET status = $1, completed_at = NOW(), error_message = $2,
+			     total_conversions = $3, processed_conversions = $4, failed_conversions = $5,
+			     model_output = run.model_output,
+			     result_rows = totals.result_rows, attributed_amount = totals.attributed_amount
+			 FROM attribution_runs run,
+			      (SELECT COUNT(*) as result_rows, COALESCE(SUM(attributed_amount), 0) as attributed_amount
+			       FROM attribution_results WHERE attribution_run_id = $6 AND result_version = $7) totals
+			 WHERE run.id = v.attribution_run_id AND v.attribution_run_id = $6 AND v.version = $7`,
+			status, message, progress.Total, progress.Processed, progress.Failed, runID, progress.Version,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update run version: %w", err)
+		}
+
+		if status == "completed" {
+			_, err = tx.Exec(
+				`UPDATE attribution_runs SET current_version = $1, watermark = $2 WHERE id = $3`,
+				progress.Version, progress.Watermark, runID,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to publish run version: %w", err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// requeueAttributionRun puts an interrupted run back on the queue
+func (s *AttributionService) requeueAttributionRun(runID int64) error {
+	_, err := s.db.Exec(
+		`UPDATE attribution_runs SET status = 'queued', updated_at = NOW() WHERE id = $1 AND status = 'running'`,
+		runID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to requeue attribution run: %w", err)
+	}
+	return nil
+}
+
+// AttributionJobRunner executes queued attribution runs on a pool of
+// background workers. Runs are claimed from attribution_runs with
+// FOR UPDATE SKIP LOCKED, so several API instances can share the queue.
+// When incrementalInterval is set it also brings live runs up to date on
+// that schedule.
+type AttributionJobRunner struct {
+	svc                 *AttributionService
+	workers             int
+	pollInterval        time.Duration
+	incrementalInterval time.Duration
+	logger              *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewAttributionJobRunner(svc *AttributionService, workers int, pollInterval, incrementalInterval time.Duration, logger *zap.Logger) *AttributionJobRunner {
+	if workers < 1 {
+		workers = 1
+	}
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+	return &AttributionJobRunner{
+		svc:                 svc,
+		workers:             workers,
+		pollInterval:        pollInterval,
+		incrementalInterval: incrementalInterval,
+		logger:              logger,
+	}
+}
+
+// Start launches the workers and the incremental scheduler
+func (r *AttributionJobRunner) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go r.work(ctx, i)
+	}
+	if r.incrementalInterval > 0 {
+		r.wg.Add(1)
+		go r.schedule(ctx)
+	}
+	r.logger.Info("Attribution job runner started",
+		zap.Int("workers", r.workers),
+		zap.Duration("incremental_interval", r.incrementalInterval),
+	)
+}
+
+// Stop stops the workers and waits for them to exit. Runs in progress are
+// put back on the queue.
+func (r *AttributionJobRunner) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+	r.logger.Info("Attribution job runner stopped")
+}
+
+// schedule runs incremental attribution for live runs that are due
+func (r *AttributionJobRunner) schedule(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		runIDs, err := r.svc.claimDueLiveAttributionRuns(r.incrementalInterval)
+		if err != nil {
+			r.logger.Error("Failed to claim live attribution runs", zap.Error(err))
+			continue
+		}
+		for _, runID := range runIDs {
+			started := time.Now()
+			count, err := r.svc.ExecuteIncrementalAttribution(ctx, runID)
+			if err != nil {
+				r.logger.Error("Incremental attribution failed", zap.Int64("run_id", runID), zap.Error(err))
+				continue
+			}
+			r.logger.Info("Incremental attribution finished",
+				zap.Int64("run_id", runID),
+				zap.Int("conversions", count),
+				zap.Duration("duration", time.Since(started)),
+			)
+		}
+	}
+}
+
+func (r *AttributionJobRunner) work(ctx context.Context, worker int) {
+	defer r.wg.Done()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		runID, ok, err := r.svc.claimQueuedAttributionRun()
+		if err != nil {
+			r.logger.Error("Failed to claim attribution run", zap.Int("worker", worker), zap.Error(err))
+		}
+		if ok {
+			r.execute(ctx, worker, runID)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.svc.wake:
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+func (r *AttributionJobRunner) execute(ctx context.Context, worker int, runID int64) {
+	started := time.Now()
+	r.logger.Info("Attribution run started", zap.Int("worker", worker), zap.Int64("run_id", runID))
+
+	if err := r.svc.ExecuteAttributionRun(ctx, runID); err != nil {
+		r.logger.Error("Attribution run failed", zap.Int64("run_id", runID), zap.Error(err))
+		return
+	}
+
+	r.logger.Info("Attribution run finished",
+		zap.Int64("run_id", runID),
+		zap.Duration("duration", time.Since(started)),
+	)
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidAttributionConfig is returned for a run config that can't be used
+var ErrInvalidAttributionConfig = errors.New("invalid attribution config")
+
+// defaultWindowRule labels the run-wide time_window_hours window
+const defaultWindowRule = "time_window_hours"
+
+// AttributionWindowRule sets the lookback window for touches on a channel,
+// in a direction and/or for conversions of an event type. Empty fields match
+// anything; at least one must be set.
+type AttributionWindowRule struct {
+	Channel   string `json:"channel,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	Hours     int    `json:"hours"`
+}
+
+// String describes the rule, e.g. "channel=Voice direction=inbound (24h)"
+func (r AttributionWindowRule) String() string {
+	var parts []string
+	if r.Channel != "" {
+		parts = append(parts, "channel="+r.Channel)
+	}
+	if r.Direction != "" {
+		parts = append(parts, "direction="+r.Direction)
+	}
+	if r.EventType != "" {
+		parts = append(parts, "event_type="+r.EventType)
+	}
+	return fmt.Sprintf("%s (%dh)", strings.Join(parts, " "), r.Hours)
+}
+
+// specificity is the number of fields the rule matches on
+func (r AttributionWindowRule) specificity() int {
+	n := 0
+	for _, field := range []string{r.Channel, r.Direction, r.EventType} {
+		if field != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// appliesTo reports whether the rule can apply to a conversion of eventType
+func (r AttributionWindowRule) appliesTo(eventType string) bool {
+	return r.EventType == "" || strings.EqualFold(r.EventType, eventType)
+}
+
+// matches reports whether the rule applies to a touch of a conversion of eventType
+func (r AttributionWindowRule) matches(touch attributionTouch, eventType string) bool {
+	if !r.appliesTo(eventType) {
+		return false
+	}
+	if r.Channel != "" && !strings.EqualFold(r.Channel, touch.ChannelName) {
+		return false
+	}
+	if r.Direction != "" && (touch.Direction == nil || !strings.EqualFold(r.Direction, *touch.Direction)) {
+		return false
+	}
+	return true
+}
+
+// touchWindow returns the lookback window in hours for a touch of a conversion
+// of eventType and the rule that set it. Ad impressions always use the
+// view-through window. Otherwise the most specific matching rule wins, the
+// first listed among equally specific ones; time_window_hours applies when no
+// rule matches.
+func (c AttributionConfig) touchWindow(touch attributionTouch, eventType string) (int, string) {
+	if touch.IsViewThrough {
+		return c.viewThroughWindowHours(), viewThroughWindowRule
+	}
+	var best *AttributionWindowRule
+	for i, rule := range c.WindowRules {
+		if rule.matches(touch, eventType) && (best == nil || rule.specificity() > best.specificity()) {
+			best = &c.WindowRules[i]
+		}
+	}
+	if best == nil {
+		return c.TimeWindowHours, defaultWindowRule
+	}
+	return best.Hours, best.String()
+}
+
+// maxWindowHours is the longest window any touch of a conversion of eventType
+// can have; interactions older than that are never credited
+func (c AttributionConfig) maxWindowHours(eventType string) int {
+	hours := c.TimeWindowHours
+	for _, rule := range c.WindowRules {
+		if rule.appliesTo(eventType) && rule.Hours > hours {
+			hours = rule.Hours
+		}
+	}
+	if c.IncludeViewThrough && c.viewThroughWindowHours() > hours {
+		hours = c.viewThroughWindowHours()
+	}
+	return hours
+}
+
+// longestWindowHours is the longest window of any rule or event type
+func (c AttributionConfig) longestWindowHours() int {
+	hours := c.TimeWindowHours
+	for _, rule := range c.WindowRules {
+		if rule.Hours > hours {
+			hours = rule.Hours
+		}
+	}
+	if c.IncludeViewThrough && c.viewThroughWindowHours() > hours {
+		hours = c.viewThroughWindowHours()
+	}
+	return hours
+}
+
+// validateWindowRules checks every rule matches on something and has a window
+func (c AttributionConfig) validateWindowRules() error {
+	for i, rule := range c.WindowRules {
+		if rule.specificity() == 0 {
+			return fmt.Errorf("%w: window rule %d must set channel, direction or event_type", ErrInvalidAttributionConfig, i+1)
+		}
+		if rule.Hours <= 0 {
+			return fmt.Errorf("%w: window rule %d must have positive hours", ErrInvalidAttributionConfig, i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	markovStartState      = "(start)"
+	markovConversionState = "(conversion)"
+	markovNullState       = "(null)"
+
+	markovMaxIterations = 10000
+	markovTolerance     = 1e-12
+)
+
+// markovResult holds the first-order transition matrix built from every path
+// in the tenant and the removal effect of each channel (or channel/vendor) state
+type markovResult struct {
+	Dimension             string                        `json:"dimension"`
+	States                []string                      `json:"states"`
+	TransitionMatrix      map[string]map[string]float64 `json:"transition_matrix"`
+	ConversionProbability float64                       `json:"conversion_probability"`
+	RemovalEffects        map[string]float64            `json:"removal_effects"`
+	Shares                map[string]float64            `json:"shares"`
+	Paths                 int                           `json:"paths"`
+	ConvertingPaths       int                           `json:"converting_paths"`
+}
+
+// computeMarkovAttribution builds the transition matrix over the paths, with
+// every path starting at (start) and ending in (conversion) or (null), and
+// computes each state's removal effect: the relative drop in the probability
+// of reaching (conversion) from (start) when that state is removed.
+func computeMarkovAttribution(paths []attributionPath, dimension string) *markovResult {
+	result := &markovResult{
+		Dimension:        dimension,
+		TransitionMatrix: map[string]map[string]float64{},
+		RemovalEffects:   map[string]float64{},
+		Shares:           map[string]float64{},
+		Paths:            len(paths),
+	}
+
+	counts := map[string]map[string]float64{}
+	addTransition := func(from, to string) {
+		if counts[from] == nil {
+			counts[from] = map[string]float64{}
+		}
+		counts[from][to]++
+	}
+
+	stateSet := map[string]bool{}
+	for _, path := range paths {
+		keys := path.keys(dimension)
+		if len(keys) == 0 {
+			continue
+		}
+		previous := markovStartState
+		for _, key := range keys {
+			stateSet[key] = true
+			addTransition(previous, key)
+			previous = key
+		}
+		if path.Converted {
+			result.ConvertingPaths++
+			addTransition(previous, markovConversionState)
+		} else {
+			addTransition(previous, markovNullState)
+		}
+	}
+
+	for from, row := range counts {
+		total := 0.0
+		for _, count := range row {
+			total += count
+		}
+		result.TransitionMatrix[from] = map[string]float64{}
+		for to, count := range row {
+			result.TransitionMatrix[from][to] = count / total
+		}
+	}
+
+	for state := range stateSet {
+		result.States = append(result.States, state)
+	}
+	sort.Strings(result.States)
+
+	result.ConversionProbability = markovConversionProbability(result.TransitionMatrix, "")
+	if result.ConversionProbability <= 0 {
+		return result
+	}
+
+	total := 0.0
+	for _, state := range result.States {
+		removed := markovConversionProbability(result.TransitionMatrix, state)
+		effect := 1 - removed/result.ConversionProbability
+		if effect < 0 {
+			effect = 0
+		}
+		result.RemovalEffects[state] = effect
+		total += effect
+	}
+	for _, state := range result.States {
+		if total > 0 {
+			result.Shares[state] = result.RemovalEffects[state] / total
+		} else {
+			result.Shares[state] = 0
+		}
+	}
+
+	return result
+}
+
+// markovConversionProbability returns the probability of being absorbed in
+// (conversion) starting from (start). When removed is set, that state is
+// treated as absorbing into (null).
+func markovConversionProbability(matrix map[string]map[string]float64, removed string) float64 {
+	probability := map[string]float64{markovConversionState: 1}
+
+	for iteration := 0; iteration < markovMaxIterations; iteration++ {
+		delta := 0.0
+		for from, row := range matrix {
+			if from == removed {
+				continue
+			}
+			value := 0.0
+			for to, p := range row {
+				if to == removed {
+					continue
+				}
+				value += p * probability[to]
+			}
+			delta = math.Max(delta, math.Abs(value-probability[from]))
+			probability[from] = value
+		}
+		if delta < markovTolerance {
+			break
+		}
+	}
+
+	return probability[markovStartState]
+}
+
+// markovTouchWeights splits a conversion across its touches in proportion to
+// the removal effect of each state on the path
+func markovTouchWeights(touches []attributionTouch, result *markovResult) []float64 {
+	return creditTouchWeights(touches, result.Dimension, result.RemovalEffects, "")
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/lib/pq"
+)
+
+// attributionPath is the ordered sequence of touches for one customer (or
+// account) journey, either ending in a conversion or ending without one (a
+// null path)
+type attributionPath struct {
+	Journey   journeyKey
+	Touches   []attributionTouch
+	Converted bool
+	Value     float64
+}
+
+// keys returns the path expressed at the given dimension (channel, agent, vendor or channel_vendor)
+func (p attributionPath) keys(dimension string) []string {
+	keys := make([]string, len(p.Touches))
+	for i, touch := range p.Touches {
+		keys[i] = touchKey(touch, dimension)
+	}
+	return keys
+}
+
+// touchKey returns the player/state name of a touch at the given dimension
+func touchKey(touch attributionTouch, dimension string) string {
+	switch dimension {
+	case "agent":
+		if touch.AgentID == nil {
+			return "agent:none"
+		}
+		return "agent:" + strconv.Itoa(*touch.AgentID)
+	case "vendor":
+		if touch.VendorID == nil {
+			return "vendor:none"
+		}
+		return "vendor:" + strconv.Itoa(*touch.VendorID)
+	case "channel_vendor":
+		if touch.VendorID == nil {
+			return touch.ChannelName
+		}
+		return touch.ChannelName + "|vendor:" + strconv.Itoa(*touch.VendorID)
+	default:
+		return touch.ChannelName
+	}
+}
+
+// journeyKey identifies whose touches form a path: a customer, or for
+// account-level runs the account of customers that belong to one
+type journeyKey struct {
+	CustomerID int64
+	AccountID  int64
+}
+
+// accountEngagementTouch is an account engagement loaded for the paths of an
+// account-level run
+type accountEngagementTouch struct {
+	AccountID int64 `db:"account_id"`
+	attributionTouch
+}
+
+// loadAttributionPaths builds every converting and non-converting path in the
+// tenant. A converting path holds the touches inside their lookback window
+// before a conversion; touches after a journey's last conversion (or all of
+// them, for journeys that never converted) form that journey's null path.
+// Account-level runs build one journey per account, from every contact's
+// interactions and the account's engagements, as conversions are credited.
+func (s *AttributionService) loadAttributionPaths(tenantID int64, config AttributionConfig) ([]attributionPath, error) {
+	query := `SELECT ` + attributionTouchColumns + attributionTouchJoins + `
+		WHERE i.tenant_id = $1
+		  AND i.customer_id IS NOT NULL
+	`
+	if !config.IncludeViewThrough {
+		query += ` AND NOT COALESCE(i.is_view_through, FALSE)`
+	}
+	args := []interface{}{tenantID}
+	if len(config.IncludeChannels) > 0 {
+		query += ` AND ch.name = ANY($2)`
+		args = append(args, pq.Array(config.IncludeChannels))
+	}
+	query += ` GROUP BY i.id, ch.name ORDER BY i.customer_id, i.started_at ASC`
+
+	var touches []attributionTouch
+	if err := s.db.Select(&touches, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to load interactions for paths: %w", err)
+	}
+
+	conversions, err := s.getRunConversions(tenantID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := map[int64]int64{}
+	var engagements []accountEngagementTouch
+	if config.accountLevel() {
+		var rows []struct {
+			ID        int64 `db:"id"`
+			AccountID int64 `db:"account_id"`
+		}
+		err := s.db.Select(&rows, `SELECT id, account_id FROM customers WHERE tenant_id = $1 AND account_id IS NOT NULL`, tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get customer accounts: %w", err)
+		}
+		for _, row := range rows {
+			accounts[row.ID] = row.AccountID
+		}
+
+		err = s.db.Select(&engagements,
+			`SELECT ae.account_id, `+attributionEngagementColumns+`
+			 FROM account_engagements ae
+			 WHERE ae.tenant_id = $1
+			 ORDER BY ae.account_id, ae.engagement_date`,
+			tenantID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load account engagements for paths: %w", err)
+		}
+	}
+
+	return buildAttributionPaths(touches, engagements, conversions, accounts, config), nil
+}
+
+// buildAttributionPaths splits touches and conversions into journeys, by
+// customer or, for customers in accounts, by account, and builds their paths
+func buildAttributionPaths(touches []attributionTouch, engagements []accountEngagementTouch, conversions []models.ConversionEvent, accounts map[int64]int64, config AttributionConfig) []attributionPath {
+	journeyOf := func(customerID int64) journeyKey {
+		if accountID, ok := accounts[customerID]; ok {
+			return journeyKey{AccountID: accountID}
+		}
+		return journeyKey{CustomerID: customerID}
+	}
+
+	var order []journeyKey
+	journeys := make(map[journeyKey][]attributionTouch)
+	add := func(key journeyKey, touch attributionTouch) {
+		if _, ok := journeys[key]; !ok {
+			order = append(order, key)
+		}
+		journeys[key] = append(journeys[key], touch)
+	}
+	for _, touch := range touches {
+		add(journeyOf(*touch.CustomerID), touch)
+	}
+	for _, engagement := range engagements {
+		add(journeyKey{AccountID: engagement.AccountID}, engagement.attributionTouch)
+	}
+
+	conversionsByJourney := make(map[journeyKey][]models.ConversionEvent)
+	for _, conversion := range conversions {
+		key := journeyOf(conversion.CustomerID)
+		conversionsByJourney[key] = append(conversionsByJourney[key], conversion)
+	}
+
+	var paths []attributionPath
+	for _, key := range order {
+		journeyTouches := journeys[key]
+		journeyConversions := conversionsByJourney[key]
+		if key.AccountID != 0 {
+			// An account's contacts and engagements interleave
+			sort.SliceStable(journeyTouches, func(a, b int) bool {
+				return journeyTouches[a].StartedAt.Before(journeyTouches[b].StartedAt)
+			})
+			sort.SliceStable(journeyConversions, func(a, b int) bool {
+				return journeyConversions[a].OccurredAt.Before(journeyConversions[b].OccurredAt)
+			})
+		}
+
+		var lastConversion time.Time
+		for _, conversion := range journeyConversions {
+			path := attributionPath{Journey: key, Converted: true, Value: conversion.AmountDecimal}
+			for _, touch := range journeyTouches {
+				hours, _ := config.touchWindow(touch, conversion.EventType)
+				windowStart := conversion.OccurredAt.Add(-time.Duration(hours) * time.Hour)
+				if !touch.StartedAt.Before(windowStart) && !touch.StartedAt.After(conversion.OccurredAt) {
+					path.Touches = append(path.Touches, touch)
+				}
+			}
+			if len(path.Touches) > 0 {
+				paths = append(paths, path)
+			}
+			lastConversion = conversion.OccurredAt
+		}
+
+		nullPath := attributionPath{Journey: key}
+		for _, touch := range journeyTouches {
+			if touch.StartedAt.After(lastConversion) {
+				nullPath.Touches = append(nullPath.Touches, touch)
+			}
+		}
+		if len(nullPath.Touches) > 0 {
+			paths = append(paths, nullPath)
+		}
+	}
+
+	return paths
+}
@@ -0,0 +1,471 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// Period close: once a month is closed, the attribution results of the
+// conversions that occurred in it are frozen. Re-executed runs carry them
+// forward into their new version, and any change re-execution, late
+// interactions or reversals would make is written as adjustment rows reported
+// in the next open period, so the closed month's totals never move.
+
+// PermissionClosePeriod is the permission needed to close and reopen periods
+const PermissionClosePeriod = "data.attribution.close_period"
+
+// attributionReportedAt is the time a result row is reported at: the
+// conversion time, or for adjustments a time in the period they went into
+const attributionReportedAt = `COALESCE(ar.reported_at, ce.occurred_at)`
+
+// adjustmentTolerance is the smallest change in attributed amount (or weight)
+// written as an adjustment
+const adjustmentTolerance = 0.005
+
+var (
+	// ErrInvalidPeriod is returned for a period that can't be closed
+	ErrInvalidPeriod = errors.New("invalid attribution period")
+	// ErrPeriodClosed is returned when closing a period that is already closed
+	ErrPeriodClosed = errors.New("attribution period is already closed")
+	// ErrPeriodNotClosed is returned when reopening a period that isn't closed
+	ErrPeriodNotClosed = errors.New("attribution period is not closed")
+	// ErrLaterPeriodClosed is returned when reopening a period followed by a
+	// closed one, whose adjustments may depend on it
+	ErrLaterPeriodClosed = errors.New("a later attribution period is closed")
+)
+
+// AttributionPeriod is a month of a tenant's attribution results
+type AttributionPeriod struct {
+	ID          int64      `db:"id" json:"id"`
+	TenantID    int64      `db:"tenant_id" json:"tenant_id"`
+	PeriodStart time.Time  `db:"period_start" json:"period_start"`
+	Status      string     `db:"status" json:"status"`
+	ClosedAt    *time.Time `db:"closed_at" json:"closed_at,omitempty"`
+	ClosedBy    *int64     `db:"closed_by" json:"closed_by,omitempty"`
+	ReopenedAt  *time.Time `db:"reopened_at" json:"reopened_at,omitempty"`
+	ReopenedBy  *int64     `db:"reopened_by" json:"reopened_by,omitempty"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// AttributionPeriodEvent is an entry of the period close audit trail
+type AttributionPeriodEvent struct {
+	ID          int64        `db:"id" json:"id"`
+	PeriodID    int64        `db:"period_id" json:"period_id"`
+	PeriodStart time.Time    `db:"period_start" json:"period_start"`
+	Action      string       `db:"action" json:"action"`
+	UserID      int64        `db:"user_id" json:"user_id"`
+	Reason      string       `db:"reason" json:"reason"`
+	Details     models.JSONB `db:"details" json:"details"`
+	CreatedAt   time.Time    `db:"created_at" json:"created_at"`
+}
+
+const attributionPeriodColumns = `id, tenant_id, period_start, status, closed_at, closed_by, reopened_at, reopened_by, updated_at`
+
+// periodLock describes the closed period a conversion falls in and where its
+// adjustments go
+type periodLock struct {
+	Period           time.Time
+	AdjustmentPeriod time.Time
+	ReportedAt       time.Time
+}
+
+// periodStart is the first instant of t's month
+func periodStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// closedPeriodLock returns the lock of the closed period occurredAt falls in,
+// or nil when its period is open. Adjustments go into the first open month
+// after it and are reported at now, kept within that month.
+func closedPeriodLock(q sqlx.Queryer, tenantID int64, occurredAt time.Time) (*periodLock, error) {
+	month := periodStart(occurredAt)
+	var closed []time.Time
+	err := sqlx.Select(q, &closed,
+		`SELECT period_start FROM attribution_periods
+		 WHERE tenant_id = $1 AND status = 'closed' AND period_start >= $2
+		 ORDER BY period_start
+		 FOR SHARE`,
+		tenantID, month,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closed periods: %w", err)
+	}
+	if len(closed) == 0 || !periodStart(closed[0]).Equal(month) {
+		return nil, nil
+	}
+
+	next := month.AddDate(0, 1, 0)
+	for _, period := range closed[1:] {
+		if !periodStart(period).Equal(next) {
+			break
+		}
+		next = next.AddDate(0, 1, 0)
+	}
+
+	var now time.Time
+	if err := sqlx.Get(q, &now, `SELECT LOCALTIMESTAMP`); err != nil {
+		return nil, fmt.Errorf("failed to read time: %w", err)
+	}
+	return &periodLock{Period: month, AdjustmentPeriod: next, ReportedAt: adjustmentReportedAt(next, now)}, nil
+}
+
+// adjustmentReportedAt is now, moved into the adjustment period when the
+// period is still ahead or already over
+func adjustmentReportedAt(period, now time.Time) time.Time {
+	now = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), now.Nanosecond(), time.UTC)
+	if now.Before(period) {
+		return period
+	}
+	if end := period.AddDate(0, 1, 0).Add(-time.Microsecond); now.After(end) {
+		return end
+	}
+	return now
+}
+
+// heldCredit is the net credit a result version holds for one touch and agent
+type heldCredit struct {
+	InteractionID       *int64  `db:"interaction_id"`
+	AccountEngagementID *int64  `db:"account_engagement_id"`
+	AgentID             *int    `db:"agent_id"`
+	TeamID              *int    `db:"team_id"`
+	VendorID            *int    `db:"vendor_id"`
+	AgentRole           *string `db:"agent_role"`
+	Weight              float64 `db:"weight"`
+	AttributedAmount    float64 `db:"attributed_amount"`
+	SourceAmount        float64 `db:"source_amount"`
+}
+
+func (c heldCredit) key() string {
+	role := ""
+	if c.AgentRole != nil {
+		role = *c.AgentRole
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s", int64Key(c.InteractionID), int64Key(c.AccountEngagementID),
+		intKey(c.AgentID), intKey(c.TeamID), intKey(c.VendorID), role)
+}
+
+func int64Key(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func intKey(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+// settleClosedConversion brings a result version's credit for a conversion in
+// a closed period in line with freshly computed credit (before reversals)
+// without changing the rows it holds. A new version first carries forward
+// the run's current rows for the conversion; the difference between the
+// fresh credit, net of reversals, and the held credit is then added as
+// adjustment rows in the next open period.
+func settleClosedConversion(tx *sqlx.Tx, run *models.AttributionRun, result attributionResultContext, fresh []attributionResultRow, lock periodLock) error {
+	conversion := result.Conversion
+
+	var held int
+	err := tx.Get(&held,
+		`SELECT COUNT(*) FROM attribution_results
+		 WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3`,
+		result.RunID, result.Version, conversion.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get held results: %w", err)
+	}
+	if held == 0 && run.CurrentVersion != nil && *run.CurrentVersion != result.Version {
+		_, err = tx.Exec(
+			`INSERT INTO attribution_results (
+				tenant_id, attribution_run_id, conversion_event_id, interaction_id,
+				customer_id, agent_id, team_id, vendor_id, model_id,
+				attribution_weight, attributed_amount, is_primary_touch, explanation, result_version,
+				reversal_event_id, currency_id, source_amount, fx_rate, account_engagement_id, account_id,
+				agent_role, agent_share, adjustment_period, reported_at
+			)
+			SELECT tenant_id, attribution_run_id, conversion_event_id, interaction_id,
+			       customer_id, agent_id, team_id, vendor_id, model_id,
+			       attribution_weight, attributed_amount, is_primary_touch, explanation, $2,
+			       reversal_event_id, currency_id, source_amount, fx_rate, account_engagement_id, account_id,
+			       agent_role, agent_share, adjustment_period, reported_at
+			FROM attribution_results
+			WHERE attribution_run_id = $1 AND result_version = $3 AND conversion_event_id = $4`,
+			result.RunID, result.Version, *run.CurrentVersion, conversion.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to carry forward closed results: %w", err)
+		}
+	}
+
+	// Fresh credit is what's left after the conversion's reversals
+	var reversed []float64
+	err = tx.Select(&reversed,
+		`SELECT amount_decimal FROM conversion_events WHERE reverses_event_id = $1 ORDER BY occurred_at, id`,
+		conversion.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get reversals: %w", err)
+	}
+	retained := 1.0
+	for _, fraction := range reversalFractions(conversion.AmountDecimal, reversed) {
+		retained -= fraction
+	}
+
+	var current []heldCredit
+	err = tx.Select(&current,
+		`SELECT interaction_id, account_engagement_id, agent_id, team_id, vendor_id, agent_role,
+		        SUM(attribution_weight) as weight, SUM(attributed_amount) as attributed_amount,
+		        COALESCE(SUM(source_amount), 0) as source_amount
+		 FROM attribution_results
+		 WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3
+		 GROUP BY 1, 2, 3, 4, 5, 6`,
+		result.RunID, result.Version, conversion.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get held results: %w", err)
+	}
+
+	for _, row := range closedPeriodAdjustments(current, fresh, retained) {
+		row.Explanation = models.JSONB{
+			"adjustment":        true,
+			"closed_period":     lock.Period.Format("2006-01"),
+			"adjustment_period": lock.AdjustmentPeriod.Format("2006-01"),
+		}
+		if err := insertAttributionResult(tx, result, row, &lock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closedPeriodAdjustments returns, per touch and agent, the credit to add to
+// the held credit so it matches the fresh credit scaled by retained
+func closedPeriodAdjustments(held []heldCredit, fresh []attributionResultRow, retained float64) []attributionResultRow {
+	var order []string
+	deltas := map[string]*heldCredit{}
+	delta := func(c heldCredit) *heldCredit {
+		key := c.key()
+		d, ok := deltas[key]
+		if !ok {
+			d = &heldCredit{
+				InteractionID: c.InteractionID, AccountEngagementID: c.AccountEngagementID,
+				AgentID: c.AgentID, TeamID: c.TeamID, VendorID: c.VendorID, AgentRole: c.AgentRole,
+			}
+			deltas[key] = d
+			order = append(order, key)
+		}
+		return d
+	}
+
+	for _, row := range fresh {
+		d := delta(heldCredit{
+			InteractionID: row.InteractionID, AccountEngagementID: row.AccountEngagementID,
+			AgentID: row.AgentID, TeamID: row.TeamID, VendorID: row.VendorID, AgentRole: row.AgentRole,
+		})
+		d.Weight += row.Weight * retained
+		d.AttributedAmount += row.AttributedAmount * retained
+		d.SourceAmount += row.SourceAmount * retained
+	}
+	for _, c := range held {
+		d := delta(c)
+		d.Weight -= c.Weight
+		d.AttributedAmount -= c.AttributedAmount
+		d.SourceAmount -= c.SourceAmount
+	}
+
+	var adjustments []attributionResultRow
+	for _, key := range order {
+		d := deltas[key]
+		if math.Abs(d.AttributedAmount) < adjustmentTolerance && math.Abs(d.Weight) < adjustmentTolerance {
+			continue
+		}
+		adjustments = append(adjustments, attributionResultRow{
+			InteractionID:       d.InteractionID,
+			AccountEngagementID: d.AccountEngagementID,
+			AgentID:             d.AgentID,
+			TeamID:              d.TeamID,
+			VendorID:            d.VendorID,
+			AgentRole:           d.AgentRole,
+			Weight:              d.Weight,
+			AttributedAmount:    d.AttributedAmount,
+			SourceAmount:        d.SourceAmount,
+		})
+	}
+	return adjustments
+}
+
+// ListAttributionPeriods returns the tenant's closed and reopened periods,
+// newest first. Months never closed are open and aren't listed.
+func (s *AttributionService) ListAttributionPeriods(tenantID int64) ([]AttributionPeriod, error) {
+	periods := []AttributionPeriod{}
+	err := s.db.Select(&periods,
+		`SELECT `+attributionPeriodColumns+` FROM attribution_periods WHERE tenant_id = $1 ORDER BY period_start DESC`,
+		tenantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution periods: %w", err)
+	}
+	return periods, nil
+}
+
+// ListAttributionPeriodEvents returns the close and reopen audit trail,
+// newest first, optionally for one period
+func (s *AttributionService) ListAttributionPeriodEvents(tenantID int64, period *time.Time) ([]AttributionPeriodEvent, error) {
+	query := `
+		SELECT e.id, e.period_id, p.period_start, e.action, e.user_id, COALESCE(e.reason, '') as reason,
+		       e.details, e.created_at
+		FROM attribution_period_events e
+		INNER JOIN attribution_periods p ON e.period_id = p.id
+		WHERE p.tenant_id = $1`
+	args := []interface{}{tenantID}
+	if period != nil {
+		query += ` AND p.period_start = $2`
+		args = append(args, periodStart(*period))
+	}
+	query += ` ORDER BY e.created_at DESC, e.id DESC`
+
+	events := []AttributionPeriodEvent{}
+	if err := s.db.Select(&events, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get attribution period events: %w", err)
+	}
+	return events, nil
+}
+
+// CloseAttributionPeriod closes a month that has ended, freezing the results
+// of its conversions. The month's totals at close are kept in the audit trail.
+func (s *AttributionService) CloseAttributionPeriod(tenantID, userID int64, period time.Time, reason string) (*AttributionPeriod, error) {
+	month := periodStart(period)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var ended bool
+	if err := tx.Get(&ended, `SELECT $1::date + INTERVAL '1 month' <= LOCALTIMESTAMP`, month); err != nil {
+		return nil, fmt.Errorf("failed to read time: %w", err)
+	}
+	if !ended {
+		return nil, fmt.Errorf("%w: %s hasn't ended", ErrInvalidPeriod, month.Format("2006-01"))
+	}
+
+	var closed AttributionPeriod
+	err = tx.QueryRowx(
+		`INSERT INTO attribution_periods (tenant_id, period_start, status, closed_at, closed_by, updated_at)
+		 VALUES ($1, $2, 'closed', NOW(), $3, NOW())
+		 ON CONFLICT (tenant_id, period_start) DO UPDATE
+		 SET status = 'closed', closed_at = NOW(), closed_by = $3, updated_at = NOW()
+		 WHERE attribution_periods.status <> 'closed'
+		 RETURNING `+attributionPeriodColumns,
+		tenantID, month, userID,
+	).StructScan(&closed)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrPeriodClosed, month.Format("2006-01"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to close attribution period: %w", err)
+	}
+
+	var totals struct {
+		AttributedAmount float64 `db:"attributed_amount"`
+		Conversions      int     `db:"conversions"`
+		Adjustments      int     `db:"adjustments"`
+	}
+	err = tx.Get(&totals,
+		`SELECT COALESCE(SUM(ar.attributed_amount), 0) as attributed_amount,
+		        COUNT(DISTINCT ar.conversion_event_id) as conversions,
+		        COUNT(*) FILTER (WHERE ar.adjustment_period IS NOT NULL) as adjustments
+		 FROM current_attribution_results ar
+		 INNER JOIN conversion_events ce ON ar.conversion_event_id = ce.id
+		 WHERE ar.tenant_id = $1
+		   AND `+attributionReportedAt+` >= $2
+		   AND `+attributionReportedAt+` < $2::date + INTERVAL '1 month'`,
+		tenantID, month,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to total attribution period: %w", err)
+	}
+	details := models.JSONB{
+		"attributed_amount": totals.AttributedAmount,
+		"conversions":       totals.Conversions,
+		"adjustment_rows":   totals.Adjustments,
+	}
+	if err := recordAttributionPeriodEvent(tx, closed.ID, "close", userID, reason, details); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to close attribution period: %w", err)
+	}
+	return &closed, nil
+}
+
+// ReopenAttributionPeriod reopens a closed month so re-executed runs can
+// change its results again. Periods are reopened latest first.
+func (s *AttributionService) ReopenAttributionPeriod(tenantID, userID int64, period time.Time, reason string) (*AttributionPeriod, error) {
+	month := periodStart(period)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var later bool
+	err = tx.Get(&later,
+		`SELECT EXISTS (SELECT 1 FROM attribution_periods WHERE tenant_id = $1 AND period_start > $2 AND status = 'closed')`,
+		tenantID, month,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution periods: %w", err)
+	}
+	if later {
+		return nil, fmt.Errorf("%w: reopen later periods before %s", ErrLaterPeriodClosed, month.Format("2006-01"))
+	}
+
+	var reopened AttributionPeriod
+	err = tx.QueryRowx(
+		`UPDATE attribution_periods
+		 SET status = 'open', reopened_at = NOW(), reopened_by = $3, updated_at = NOW()
+		 WHERE tenant_id = $1 AND period_start = $2 AND status = 'closed'
+		 RETURNING `+attributionPeriodColumns,
+		tenantID, month, userID,
+	).StructScan(&reopened)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrPeriodNotClosed, month.Format("2006-01"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reopen attribution period: %w", err)
+	}
+
+	if err := recordAttributionPeriodEvent(tx, reopened.ID, "reopen", userID, reason, nil); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to reopen attribution period: %w", err)
+	}
+	return &reopened, nil
+}
+
+func recordAttributionPeriodEvent(tx *sqlx.Tx, periodID int64, action string, userID int64, reason string, details models.JSONB) error {
+	_, err := tx.Exec(
+		`INSERT INTO attribution_period_events (period_id, action, user_id, reason, details)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), $5)`,
+		periodID, action, userID, reason, details,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record attribution period event: %w", err)
+	}
+	return nil
+}
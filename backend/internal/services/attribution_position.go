@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/convin/crae/internal/models"
+)
+
+// positionParams are the position-based model percentages stored in
+// attribution_models.params for U_SHAPED, W_SHAPED and CUSTOM_POSITION
+type positionParams struct {
+	FirstPct        float64  `json:"first_pct"`
+	MiddlePct       float64  `json:"middle_pct"`
+	LastPct         float64  `json:"last_pct"`
+	MilestonePct    float64  `json:"milestone_pct"`
+	MilestoneField  string   `json:"milestone_field"`  // primary_intent or funnel_stage
+	MilestoneValues []string `json:"milestone_values"` // values marking the lead-creation touch
+}
+
+// defaultPositionParams returns the standard split for a position-based model
+func defaultPositionParams(modelCode string) positionParams {
+	switch modelCode {
+	case "W_SHAPED":
+		return positionParams{
+			FirstPct: 30, MilestonePct: 30, LastPct: 30, MiddlePct: 10,
+			MilestoneField: "funnel_stage", MilestoneValues: []string{"SQL", "Lead"},
+		}
+	default:
+		// U_SHAPED, and the starting point for CUSTOM_POSITION
+		return positionParams{FirstPct: 40, MiddlePct: 20, LastPct: 40}
+	}
+}
+
+// parsePositionParams overlays the model params on the defaults and validates them
+func parsePositionParams(modelCode string, raw models.JSONB) (positionParams, error) {
+	params := defaultPositionParams(modelCode)
+	if raw != nil {
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return params, fmt.Errorf("failed to read %s params: %w", modelCode, err)
+		}
+		if err := json.Unmarshal(data, &params); err != nil {
+			return params, fmt.Errorf("invalid %s params: %w", modelCode, err)
+		}
+	}
+	if modelCode != "W_SHAPED" {
+		params.MilestonePct = 0
+	}
+	return params, params.validate(modelCode)
+}
+
+func (p positionParams) validate(modelCode string) error {
+	for _, pct := range []float64{p.FirstPct, p.MiddlePct, p.LastPct, p.MilestonePct} {
+		if pct < 0 {
+			return fmt.Errorf("%s percentages must not be negative", modelCode)
+		}
+	}
+	total := p.FirstPct + p.MiddlePct + p.LastPct + p.MilestonePct
+	if math.Abs(total-100) > 0.01 {
+		return fmt.Errorf("%s percentages must add up to 100, got %.2f", modelCode, total)
+	}
+	if modelCode == "W_SHAPED" {
+		switch p.MilestoneField {
+		case "primary_intent", "funnel_stage":
+		default:
+			return fmt.Errorf("W_SHAPED milestone_field must be primary_intent or funnel_stage")
+		}
+		if len(p.MilestoneValues) == 0 {
+			return fmt.Errorf("W_SHAPED requires at least one milestone value")
+		}
+	}
+	return nil
+}
+
+// milestoneIndex returns the first touch whose milestone field matches one of
+// the milestone values, or -1
+func (p positionParams) milestoneIndex(touches []attributionTouch) int {
+	if p.MilestonePct == 0 {
+		return -1
+	}
+	for i, touch := range touches {
+		var value *string
+		switch p.MilestoneField {
+		case "primary_intent":
+			value = touch.PrimaryIntent
+		case "funnel_stage":
+			value = touch.FunnelStage
+		}
+		if value == nil {
+			continue
+		}
+		for _, milestone := range p.MilestoneValues {
+			if strings.EqualFold(*value, milestone) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// positionWeights gives the first and last touches (and, for W_SHAPED, the
+// milestone touch) their configured share and splits the middle share equally
+// across the remaining touches. Shares with no touch to land on (no middle
+// touches, no milestone found) are redistributed in proportion to the rest.
+func positionWeights(touches []attributionTouch, params positionParams) ([]float64, []models.JSONB) {
+	n := len(touches)
+	weights := make([]float64, n)
+	roles := make([][]string, n)
+	if n == 1 {
+		return []float64{1.0}, []models.JSONB{{"positions": []string{"only"}, "weight": 1.0}}
+	}
+
+	unassigned := 0.0
+	weights[0] += params.FirstPct
+	roles[0] = append(roles[0], "first")
+	weights[n-1] += params.LastPct
+	roles[n-1] = append(roles[n-1], "last")
+
+	if n > 2 {
+		share := params.MiddlePct / float64(n-2)
+		for i := 1; i < n-1; i++ {
+			weights[i] += share
+			roles[i] = append(roles[i], "middle")
+		}
+	} else {
+		unassigned += params.MiddlePct
+	}
+
+	if milestone := params.milestoneIndex(touches); milestone >= 0 {
+		weights[milestone] += params.MilestonePct
+		roles[milestone] = append(roles[milestone], "milestone")
+	} else {
+		unassigned += params.MilestonePct
+	}
+
+	assigned := 0.0
+	for _, weight := range weights {
+		assigned += weight
+	}
+	if assigned <= 0 {
+		return linearWeights(n), nil
+	}
+
+	explanations := make([]models.JSONB, n)
+	for i := range weights {
+		weights[i] = (weights[i] + unassigned*weights[i]/assigned) / (assigned + unassigned)
+		explanations[i] = models.JSONB{"positions": roles[i], "weight": weights[i]}
+	}
+	return weights, explanations
+}
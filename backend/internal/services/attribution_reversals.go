@@ -0,0 +1,209 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReversalEventTypes are the conversion event types that reverse an earlier
+// conversion. They must name the conversion they reverse.
+var ReversalEventTypes = []string{"refund", "cancellation", "chargeback"}
+
+var (
+	// ErrOriginalConversionNotFound is returned when a reversal names a
+	// conversion that does not exist for the tenant
+	ErrOriginalConversionNotFound = errors.New("original conversion not found")
+	// ErrReversalWithoutOriginal is returned for a reversal event type that
+	// does not name the conversion it reverses
+	ErrReversalWithoutOriginal = errors.New("reversal requires original_external_event_id")
+	// ErrOriginalWithoutReversal is returned for a conversion that names an
+	// original conversion but isn't of a reversal event type
+	ErrOriginalWithoutReversal = errors.New("original_external_event_id is only allowed on refund, cancellation and chargeback events")
+)
+
+// IsReversalEventType reports whether events of the type reverse a conversion
+func IsReversalEventType(eventType string) bool {
+	return containsString(ReversalEventTypes, eventType)
+}
+
+// reversalFractions returns the share of the original amount each reversal
+// claws back, in order. Reversals beyond the original amount claw back
+// nothing, so over-refunding never makes a conversion's credit negative.
+func reversalFractions(originalAmount float64, reversed []float64) []float64 {
+	fractions := make([]float64, len(reversed))
+	if originalAmount <= 0 {
+		return fractions
+	}
+	remaining := originalAmount
+	for i, amount := range reversed {
+		amount = math.Min(math.Abs(amount), remaining)
+		if amount <= 0 {
+			continue
+		}
+		fractions[i] = amount / originalAmount
+		remaining -= amount
+	}
+	return fractions
+}
+
+// applyConversionReversals rewrites the clawback rows of a conversion in one
+// result version of a run from its credited rows and the reversals ingested
+// so far. The conversion row is locked so ingestion of a reversal and
+// attribution of the conversion can't interleave. A conversion in a closed
+// period keeps its clawbacks; what each reversal should claw back beyond (or
+// short of) what it already has, e.g. after a refund is re-sent with a
+// corrected amount, is added as an adjustment in the next open period.
+func applyConversionReversals(tx *sqlx.Tx, runID int64, version int, conversionID int64) error {
+	var original struct {
+		Amount     float64   `db:"amount_decimal"`
+		TenantID   int64     `db:"tenant_id"`
+		OccurredAt time.Time `db:"occurred_at"`
+	}
+	err := tx.Get(&original, `SELECT amount_decimal, tenant_id, occurred_at FROM conversion_events WHERE id = $1 FOR UPDATE`, conversionID)
+	if err != nil {
+		return fmt.Errorf("failed to lock conversion: %w", err)
+	}
+	lock, err := closedPeriodLock(tx, original.TenantID, original.OccurredAt)
+	if err != nil {
+		return err
+	}
+
+	var reversals []struct {
+		ID     int64   `db:"id"`
+		Amount float64 `db:"amount_decimal"`
+		// ClawedBackWeight is the weight the reversal's clawback rows took
+		ClawedBackWeight float64 `db:"clawed_back_weight"`
+	}
+	err = tx.Select(&reversals,
+		`SELECT ce.id, ce.amount_decimal,
+		        COALESCE((SELECT -SUM(ar.attribution_weight) FROM attribution_results ar
+		                  WHERE ar.attribution_run_id = $2 AND ar.result_version = $3
+		                    AND ar.reversal_event_id = ce.id), 0) as clawed_back_weight
+		 FROM conversion_events ce
+		 WHERE ce.reverses_event_id = $1
+		 ORDER BY ce.occurred_at, ce.id`,
+		conversionID, runID, version,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get reversals: %w", err)
+	}
+	if len(reversals) == 0 {
+		return nil
+	}
+
+	var credited struct {
+		Weight float64 `db:"weight"`
+		Amount float64 `db:"amount"`
+	}
+	var adjustmentPeriod, reportedAt *time.Time
+	if lock != nil {
+		adjustmentPeriod, reportedAt = &lock.AdjustmentPeriod, &lock.ReportedAt
+		err = tx.Get(&credited,
+			`SELECT COALESCE(SUM(attribution_weight), 0) as weight, COALESCE(SUM(attributed_amount), 0) as amount
+			 FROM attribution_results
+			 WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3
+			   AND reversal_event_id IS NULL`,
+			runID, version, conversionID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to get credited results: %w", err)
+		}
+		if credited.Weight == 0 {
+			return nil
+		}
+	} else {
+		_, err = tx.Exec(
+			`DELETE FROM attribution_results
+			 WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3
+			   AND reversal_event_id IS NOT NULL`,
+			runID, version, conversionID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to clear clawbacks: %w", err)
+		}
+	}
+
+	amounts := make([]float64, len(reversals))
+	for i, reversal := range reversals {
+		amounts[i] = reversal.Amount
+	}
+	for i, fraction := range reversalFractions(original.Amount, amounts) {
+		if lock != nil {
+			fraction = clawbackAdjustment(fraction, reversals[i].ClawedBackWeight, credited.Weight, credited.Amount)
+		}
+		if fraction == 0 {
+			continue
+		}
+		_, err = tx.Exec(
+			`INSERT INTO attribution_results (
+				tenant_id, attribution_run_id, conversion_event_id, interaction_id,
+				customer_id, agent_id, team_id, vendor_id, model_id,
+				attribution_weight, attributed_amount, is_primary_touch, result_version, reversal_event_id,
+				currency_id, source_amount, fx_rate, account_engagement_id, account_id,
+				agent_role, agent_share, adjustment_period, reported_at
+			)
+			SELECT tenant_id, attribution_run_id, conversion_event_id, interaction_id,
+			       customer_id, agent_id, team_id, vendor_id, model_id,
+			       -attribution_weight * $4, -attributed_amount * $4, FALSE, result_version, $5,
+			       currency_id, -source_amount * $4, fx_rate, account_engagement_id, account_id,
+			       agent_role, agent_share, $6::date, $7::timestamp
+			FROM attribution_results
+			WHERE attribution_run_id = $1 AND result_version = $2 AND conversion_event_id = $3
+			  AND reversal_event_id IS NULL`,
+			runID, version, conversionID, fraction, reversals[i].ID, adjustmentPeriod, reportedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert clawback: %w", err)
+		}
+	}
+	return nil
+}
+
+// clawbackAdjustment returns the share of a closed conversion's credit a
+// reversal still has to claw back (negative to give back): its fraction less
+// the share its clawback rows already took. Differences too small to adjust
+// are 0.
+func clawbackAdjustment(fraction, clawedBackWeight, creditedWeight, creditedAmount float64) float64 {
+	fraction -= clawedBackWeight / creditedWeight
+	if math.Abs(fraction*creditedAmount) < adjustmentTolerance && math.Abs(fraction*creditedWeight) < adjustmentTolerance {
+		return 0
+	}
+	return fraction
+}
+
+// clawBackConversion applies a conversion's reversals to every run crediting
+// it, in the run's current result version and in any version being written.
+// Earlier versions are left as they were published.
+func clawBackConversion(tx *sqlx.Tx, conversionID int64) error {
+	var targets []struct {
+		RunID   int64 `db:"attribution_run_id"`
+		Version int   `db:"result_version"`
+	}
+	err := tx.Select(&targets,
+		`SELECT DISTINCT ar.attribution_run_id, ar.result_version
+		 FROM attribution_results ar
+		 INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+		 LEFT JOIN attribution_run_versions v ON v.attribution_run_id = ar.attribution_run_id AND v.version = ar.result_version
+		 WHERE ar.conversion_event_id = $1
+		   AND ar.reversal_event_id IS NULL
+		   AND (ar.result_version = run.current_version OR v.status = 'running')`,
+		conversionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get attribution runs to claw back: %w", err)
+	}
+
+	for _, target := range targets {
+		if err := applyConversionReversals(tx, target.RunID, target.Version, conversionID); err != nil {
+			return err
+		}
+		if err := refreshAttributionVersionTotals(tx, target.RunID, target.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/lib/pq"
+)
+
+// Model types: built-in models are implemented in calculateWeights; rule
+// models are defined by a tenant as a ruleModelParams rule set
+const (
+	ModelTypeBuiltin = "builtin"
+	ModelTypeRules   = "rules"
+)
+
+// Rule actions
+const (
+	RuleActionMultiply = "multiply"
+	RuleActionExclude  = "exclude"
+	RuleActionCap      = "cap"
+)
+
+var (
+	// ErrInvalidRuleModel is returned for a rule model that fails validation
+	ErrInvalidRuleModel = errors.New("invalid rule model")
+	// ErrAttributionModelNotFound is returned for a model the tenant can't use
+	ErrAttributionModelNotFound = errors.New("attribution model not found")
+	// ErrAttributionModelExists is returned when a model code is already taken
+	ErrAttributionModelExists = errors.New("attribution model code already in use")
+)
+
+// ruleModelCode is the form of a rule model code, e.g. SALES_FLOOR_V2
+var ruleModelCode = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,49}$`)
+
+// ruleBaseModels are the built-in models a rule model can start from
+var ruleBaseModels = []string{"LINEAR", "FIRST_TOUCH", "LAST_TOUCH", "TIME_DECAY", "U_SHAPED", "AI_WEIGHTED"}
+
+// RuleCondition matches touches; every field that is set must match
+type RuleCondition struct {
+	Channel            string `json:"channel,omitempty"`
+	Direction          string `json:"direction,omitempty"`
+	Intent             string `json:"intent,omitempty"`
+	FunnelStage        string `json:"funnel_stage,omitempty"`
+	Outcome            string `json:"outcome,omitempty"`
+	MinDurationSeconds *int   `json:"min_duration_seconds,omitempty"`
+	MaxDurationSeconds *int   `json:"max_duration_seconds,omitempty"`
+	HasAgent           *bool  `json:"has_agent,omitempty"`
+	VendorID           *int   `json:"vendor_id,omitempty"`
+	ViewThrough        *bool  `json:"view_through,omitempty"`
+}
+
+// AttributionRule is one step of a rule model. multiply scales the weight of
+// matching touches by Factor; exclude gives matching touches no credit; cap
+// limits the share of the conversion any single channel, agent or vendor
+// (Dimension) can get to MaxShare.
+type AttributionRule struct {
+	Name      string        `json:"name,omitempty"`
+	Action    string        `json:"action"`
+	When      RuleCondition `json:"when,omitempty"`
+	Factor    float64       `json:"factor,omitempty"`
+	Dimension string        `json:"dimension,omitempty"`
+	MaxShare  float64       `json:"max_share,omitempty"`
+}
+
+// ruleModelParams is the rule set stored in attribution_models.params
+type ruleModelParams struct {
+	BaseModel     string            `json:"base_model"`
+	HalfLifeHours float64           `json:"half_life_hours,omitempty"`
+	Rules         []AttributionRule `json:"rules"`
+}
+
+// RuleModelRequest creates or replaces a tenant's rule model
+type RuleModelRequest struct {
+	Code          string            `json:"code"`
+	Name          string            `json:"name"`
+	Description   string            `json:"description"`
+	BaseModel     string            `json:"base_model"`
+	HalfLifeHours float64           `json:"half_life_hours"`
+	Rules         []AttributionRule `json:"rules"`
+}
+
+// isSet reports whether the condition matches on anything
+func (c RuleCondition) isSet() bool {
+	return c.Channel != "" || c.Direction != "" || c.Intent != "" || c.FunnelStage != "" ||
+		c.Outcome != "" || c.MinDurationSeconds != nil || c.MaxDurationSeconds != nil ||
+		c.HasAgent != nil || c.VendorID != nil || c.ViewThrough != nil
+}
+
+// matches reports whether a touch meets every condition
+func (c RuleCondition) matches(touch attributionTouch) bool {
+	if c.Channel != "" && !strings.EqualFold(c.Channel, touch.ChannelName) {
+		return false
+	}
+	if c.Direction != "" && !equalFoldPtr(c.Direction, touch.Direction) {
+		return false
+	}
+	if c.Intent != "" && !equalFoldPtr(c.Intent, touch.PrimaryIntent) {
+		return false
+	}
+	if c.FunnelStage != "" && !equalFoldPtr(c.FunnelStage, touch.FunnelStage) {
+		return false
+	}
+	if c.Outcome != "" && !equalFoldPtr(c.Outcome, touch.OutcomePrediction) {
+		return false
+	}
+	if c.MinDurationSeconds != nil && (touch.DurationSeconds == nil || *touch.DurationSeconds < *c.MinDurationSeconds) {
+		return false
+	}
+	if c.MaxDurationSeconds != nil && (touch.DurationSeconds == nil || *touch.DurationSeconds > *c.MaxDurationSeconds) {
+		return false
+	}
+	if c.HasAgent != nil && *c.HasAgent != (touch.AgentID != nil) {
+		return false
+	}
+	if c.VendorID != nil && (touch.VendorID == nil || *touch.VendorID != *c.VendorID) {
+		return false
+	}
+	if c.ViewThrough != nil && *c.ViewThrough != touch.IsViewThrough {
+		return false
+	}
+	return true
+}
+
+func equalFoldPtr(want string, value *string) bool {
+	return value != nil && strings.EqualFold(want, *value)
+}
+
+// label names the rule in explanations
+func (r AttributionRule) label(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rule %d (%s)", index+1, r.Action)
+}
+
+// validate checks a rule set can be evaluated
+func (p ruleModelParams) validate() error {
+	if !containsString(ruleBaseModels, p.BaseModel) {
+		return fmt.Errorf("%w: base_model must be one of %s", ErrInvalidRuleModel, strings.Join(ruleBaseModels, ", "))
+	}
+	if p.HalfLifeHours < 0 {
+		return fmt.Errorf("%w: half_life_hours must be positive", ErrInvalidRuleModel)
+	}
+	for i, rule := range p.Rules {
+		switch rule.Action {
+		case RuleActionMultiply:
+			if rule.Factor <= 0 {
+				return fmt.Errorf("%w: %s: factor must be positive", ErrInvalidRuleModel, rule.label(i))
+			}
+		case RuleActionExclude:
+		case RuleActionCap:
+			switch rule.Dimension {
+			case "channel", "agent", "vendor":
+			default:
+				return fmt.Errorf("%w: %s: dimension must be channel, agent or vendor", ErrInvalidRuleModel, rule.label(i))
+			}
+			if rule.MaxShare <= 0 || rule.MaxShare > 1 {
+				return fmt.Errorf("%w: %s: max_share must be between 0 and 1", ErrInvalidRuleModel, rule.label(i))
+			}
+			if rule.When.isSet() {
+				return fmt.Errorf("%w: %s: cap rules apply to every touch and take no conditions", ErrInvalidRuleModel, rule.label(i))
+			}
+			continue
+		default:
+			return fmt.Errorf("%w: %s: action must be multiply, exclude or cap", ErrInvalidRuleModel, rule.label(i))
+		}
+		if !rule.When.isSet() {
+			return fmt.Errorf("%w: %s: needs at least one condition", ErrInvalidRuleModel, rule.label(i))
+		}
+		if rule.When.MinDurationSeconds != nil && rule.When.MaxDurationSeconds != nil && *rule.When.MinDurationSeconds > *rule.When.MaxDurationSeconds {
+			return fmt.Errorf("%w: %s: min_duration_seconds is above max_duration_seconds", ErrInvalidRuleModel, rule.label(i))
+		}
+	}
+	return nil
+}
+
+// baseState is the model state the base model is evaluated with: the base
+// model's default params and, for TIME_DECAY, the run's half-life if set or
+// else the rule set's
+func (p ruleModelParams) baseState(halfLife time.Duration) *attributionModelState {
+	state := &attributionModelState{AISignals: defaultAISignalParams(), Position: defaultPositionParams(p.BaseModel), HalfLife: halfLife}
+	if halfLife <= 0 && p.HalfLifeHours > 0 {
+		state.HalfLife = time.Duration(p.HalfLifeHours * float64(time.Hour))
+	}
+	return state
+}
+
+// parseRuleModelParams reads and validates a stored rule set
+func parseRuleModelParams(raw models.JSONB) (ruleModelParams, error) {
+	var params ruleModelParams
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return params, fmt.Errorf("failed to read rule model params: %w", err)
+	}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return params, fmt.Errorf("%w: %v", ErrInvalidRuleModel, err)
+	}
+	return params, params.validate()
+}
+
+// ruleWeights evaluates a rule model: excluded touches get no credit, the base
+// model weights the rest, multipliers scale matching touches, the weights are
+// normalized and finally caps move credit away from over-credited groups. If
+// every touch is excluded the conversion gets no credit. A touch's explanation
+// keeps the base model's under "base".
+func (s *AttributionService) ruleWeights(touches []attributionTouch, conversionTime time.Time, params ruleModelParams, halfLife time.Duration) ([]float64, []models.JSONB) {
+	explanations := make([]models.JSONB, len(touches))
+	applied := make([][]string, len(touches))
+	baseExplanations := make([]models.JSONB, len(touches))
+
+	var kept []int
+	for i, touch := range touches {
+		excluded := false
+		for r, rule := range params.Rules {
+			if rule.Action == RuleActionExclude && rule.When.matches(touch) {
+				applied[i] = append(applied[i], rule.label(r))
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, i)
+		}
+	}
+
+	weights := make([]float64, len(touches))
+	if len(kept) > 0 {
+		keptTouches := make([]attributionTouch, len(kept))
+		for k, i := range kept {
+			keptTouches[k] = touches[i]
+		}
+		base, baseExplained := s.calculateWeights(keptTouches, params.BaseModel, conversionTime, params.baseState(halfLife))
+
+		total := 0.0
+		for k, i := range kept {
+			weights[i] = base[k]
+			if baseExplained != nil {
+				baseExplanations[i] = baseExplained[k]
+			}
+			for r, rule := range params.Rules {
+				if rule.Action == RuleActionMultiply && rule.When.matches(touches[i]) {
+					weights[i] *= rule.Factor
+					applied[i] = append(applied[i], rule.label(r))
+				}
+			}
+			total += weights[i]
+		}
+		if total > 0 {
+			for i := range weights {
+				weights[i] /= total
+			}
+		}
+
+		for r, rule := range params.Rules {
+			if rule.Action == RuleActionCap {
+				for _, i := range capGroupShares(touches, weights, rule.Dimension, rule.MaxShare) {
+					applied[i] = append(applied[i], rule.label(r))
+				}
+			}
+		}
+	}
+
+	for i := range touches {
+		explanations[i] = models.JSONB{"base_model": params.BaseModel, "rules_applied": append([]string{}, applied[i]...)}
+		if baseExplanations[i] != nil {
+			explanations[i]["base"] = baseExplanations[i]
+		}
+	}
+	return weights, explanations
+}
+
+// capGroupShares limits the total weight of each channel, agent or vendor to
+// maxShare, spreading the excess over the other groups in proportion to their
+// weight. Touches without an agent or vendor are never capped. Credit only
+// moves between groups, so a conversion whose touches all belong to capped
+// groups keeps its full credit. Returns the touches that were capped.
+func capGroupShares(touches []attributionTouch, weights []float64, dimension string, maxShare float64) []int {
+	capped := map[string]bool{}
+	for {
+		totals := map[string]float64{}
+		for i, touch := range touches {
+			totals[touchKey(touch, dimension)] += weights[i]
+		}
+
+		excess, uncappedTotal := 0.0, 0.0
+		over := map[string]bool{}
+		for key, total := range totals {
+			switch {
+			case capped[key]:
+			case total > maxShare+1e-9 && !strings.HasSuffix(key, ":none"):
+				over[key] = true
+				excess += total - maxShare
+			default:
+				uncappedTotal += total
+			}
+		}
+		if len(over) == 0 || uncappedTotal <= 0 {
+			break
+		}
+
+		for i, touch := range touches {
+			key := touchKey(touch, dimension)
+			switch {
+			case over[key]:
+				weights[i] *= maxShare / totals[key]
+			case !capped[key]:
+				weights[i] += excess * weights[i] / uncappedTotal
+			}
+		}
+		for key := range over {
+			capped[key] = true
+		}
+	}
+
+	var cappedTouches []int
+	for i, touch := range touches {
+		if capped[touchKey(touch, dimension)] {
+			cappedTouches = append(cappedTouches, i)
+		}
+	}
+	return cappedTouches
+}
+
+// ListAttributionModels returns the built-in models and the tenant's rule models
+func (s *AttributionService) ListAttributionModels(tenantID int64) ([]models.AttributionModel, error) {
+	list := []models.AttributionModel{}
+	err := s.db.Select(&list,
+		`SELECT `+attributionModelColumns+` FROM attribution_models
+		 WHERE tenant_id IS NULL OR tenant_id = $1
+		 ORDER BY tenant_id NULLS FIRST, code`,
+		tenantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribution models: %w", err)
+	}
+	return list, nil
+}
+
+// CreateRuleModel validates and saves a tenant rule model. Codes are unique
+// within the tenant and can't be a built-in model's code.
+func (s *AttributionService) CreateRuleModel(tenantID int64, req RuleModelRequest) (*models.AttributionModel, error) {
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if !ruleModelCode.MatchString(code) {
+		return nil, fmt.Errorf("%w: code must be 2-50 letters, digits or underscores, starting with a letter", ErrInvalidRuleModel)
+	}
+	params, err := req.params()
+	if err != nil {
+		return nil, err
+	}
+
+	var builtin bool
+	err = s.db.Get(&builtin, `SELECT EXISTS(SELECT 1 FROM attribution_models WHERE code = $1 AND tenant_id IS NULL)`, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check attribution model code: %w", err)
+	}
+	if builtin {
+		return nil, fmt.Errorf("%w: %s", ErrAttributionModelExists, code)
+	}
+
+	var model models.AttributionModel
+	err = s.db.QueryRowx(
+		`INSERT INTO attribution_models (code, name, description, params, tenant_id, model_type)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+attributionModelColumns,
+		code, req.displayName(code), req.Description, params, tenantID, ModelTypeRules,
+	).StructScan(&model)
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %s", ErrAttributionModelExists, code)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attribution model: %w", err)
+	}
+	return &model, nil
+}
+
+// UpdateRuleModel replaces the rules of a tenant rule model. Runs already
+// executed keep their results until they are re-executed.
+func (s *AttributionService) UpdateRuleModel(tenantID int64, code string, req RuleModelRequest) (*models.AttributionModel, error) {
+	code = strings.ToUpper(code)
+	params, err := req.params()
+	if err != nil {
+		return nil, err
+	}
+
+	var model models.AttributionModel
+	err = s.db.QueryRowx(
+		`UPDATE attribution_models
+		 SET name = $1, description = $2, params = $3, updated_at = NOW()
+		 WHERE code = $4 AND tenant_id = $5 AND model_type = $6
+		 RETURNING `+attributionModelColumns,
+		req.displayName(code), req.Description, params, code, tenantID, ModelTypeRules,
+	).StructScan(&model)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrAttributionModelNotFound, code)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update attribution model: %w", err)
+	}
+	return &model, nil
+}
+
+// params validates the request's rule set and returns it in stored form
+func (req RuleModelRequest) params() (models.JSONB, error) {
+	params := ruleModelParams{
+		BaseModel:     strings.ToUpper(req.BaseModel),
+		HalfLifeHours: req.HalfLifeHours,
+		Rules:         req.Rules,
+	}
+	if params.BaseModel == "" {
+		params.BaseModel = "LINEAR"
+	}
+	if params.Rules == nil {
+		params.Rules = []AttributionRule{}
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save rule model params: %w", err)
+	}
+	var out models.JSONB
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to save rule model params: %w", err)
+	}
+	return out, nil
+}
+
+func (req RuleModelRequest) displayName(code string) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	return code
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// maxShapleyPlayers bounds the coalition space (2^n) for the Shapley model.
+// Less frequent players beyond this limit are pooled into shapleyOtherPlayer.
+const maxShapleyPlayers = 16
+
+const shapleyOtherPlayer = "other"
+
+// shapleyResult holds the cooperative-game contribution of each player
+// (channel, agent or vendor) computed across every path in the tenant
+type shapleyResult struct {
+	Dimension       string             `json:"dimension"`
+	Values          map[string]float64 `json:"values"`
+	Shares          map[string]float64 `json:"shares"`
+	Paths           int                `json:"paths"`
+	ConvertingPaths int                `json:"converting_paths"`
+}
+
+// computeShapleyValues computes Shapley values over the paths. The worth of a
+// coalition S is the sum of the conversion rates of every observed channel
+// set T contained in S, where a set's conversion rate is the share of paths
+// touching exactly T that converted. Non-converting paths therefore lower the
+// worth of the sets they touch.
+func computeShapleyValues(paths []attributionPath, dimension string) *shapleyResult {
+	result := &shapleyResult{
+		Dimension: dimension,
+		Values:    map[string]float64{},
+		Shares:    map[string]float64{},
+		Paths:     len(paths),
+	}
+
+	// Rank players by how many paths they appear in
+	frequency := map[string]int{}
+	pathKeys := make([][]string, len(paths))
+	for i, path := range paths {
+		pathKeys[i] = path.keys(dimension)
+		seen := map[string]bool{}
+		for _, key := range pathKeys[i] {
+			if !seen[key] {
+				seen[key] = true
+				frequency[key]++
+			}
+		}
+		if path.Converted {
+			result.ConvertingPaths++
+		}
+	}
+
+	players := make([]string, 0, len(frequency))
+	for key := range frequency {
+		players = append(players, key)
+	}
+	sort.Slice(players, func(a, b int) bool {
+		if frequency[players[a]] != frequency[players[b]] {
+			return frequency[players[a]] > frequency[players[b]]
+		}
+		return players[a] < players[b]
+	})
+	if len(players) > maxShapleyPlayers {
+		players = append(players[:maxShapleyPlayers-1], shapleyOtherPlayer)
+	}
+	if len(players) == 0 {
+		return result
+	}
+
+	index := make(map[string]int, len(players))
+	for i, player := range players {
+		index[player] = i
+	}
+	playerIndex := func(key string) int {
+		if i, ok := index[key]; ok {
+			return i
+		}
+		return index[shapleyOtherPlayer]
+	}
+
+	// Count paths and conversions for each exact coalition
+	n := len(players)
+	size := 1 << n
+	totals := make([]float64, size)
+	conversions := make([]float64, size)
+	for i, path := range paths {
+		mask := 0
+		for _, key := range pathKeys[i] {
+			mask |= 1 << playerIndex(key)
+		}
+		totals[mask]++
+		if path.Converted {
+			conversions[mask]++
+		}
+	}
+
+	// worth[S] = sum of conversion rates over all subsets of S
+	worth := make([]float64, size)
+	for mask := 1; mask < size; mask++ {
+		if totals[mask] > 0 {
+			worth[mask] = conversions[mask] / totals[mask]
+		}
+	}
+	for bit := 0; bit < n; bit++ {
+		for mask := 0; mask < size; mask++ {
+			if mask&(1<<bit) != 0 {
+				worth[mask] += worth[mask^(1<<bit)]
+			}
+		}
+	}
+
+	// coefficient[k] = k!(n-k-1)!/n! for a coalition of size k without the player
+	coefficient := make([]float64, n)
+	for k := 0; k < n; k++ {
+		coefficient[k] = factorial(k) * factorial(n-k-1) / factorial(n)
+	}
+
+	total := 0.0
+	for i, player := range players {
+		bit := 1 << i
+		value := 0.0
+		for mask := 0; mask < size; mask++ {
+			if mask&bit != 0 {
+				continue
+			}
+			value += coefficient[bits.OnesCount(uint(mask))] * (worth[mask|bit] - worth[mask])
+		}
+		result.Values[player] = value
+		if value > 0 {
+			total += value
+		}
+	}
+
+	for player, value := range result.Values {
+		if total > 0 && value > 0 {
+			result.Shares[player] = value / total
+		} else {
+			result.Shares[player] = 0
+		}
+	}
+
+	return result
+}
+
+// shapleyTouchWeights splits a conversion across its touches in proportion to
+// the Shapley value of each player on the path
+func shapleyTouchWeights(touches []attributionTouch, result *shapleyResult) []float64 {
+	return creditTouchWeights(touches, result.Dimension, result.Values, shapleyOtherPlayer)
+}
+
+// creditTouchWeights splits a conversion across its touches in proportion to
+// each player's tenant-wide credit (Shapley value, removal effect, ...). A
+// player's credit is shared equally between its touches. Players missing from
+// credit use the fallback player's credit. Falls back to linear when no player
+// on the path has positive credit.
+func creditTouchWeights(touches []attributionTouch, dimension string, credit map[string]float64, fallback string) []float64 {
+	counts := map[string]int{}
+	keys := make([]string, len(touches))
+	for i, touch := range touches {
+		keys[i] = touchKey(touch, dimension)
+		counts[keys[i]]++
+	}
+
+	creditOf := func(key string) float64 {
+		value, ok := credit[key]
+		if !ok {
+			value = credit[fallback]
+		}
+		if value < 0 {
+			return 0
+		}
+		return value
+	}
+
+	total := 0.0
+	for key := range counts {
+		total += creditOf(key)
+	}
+	if total <= 0 {
+		return linearWeights(len(touches))
+	}
+
+	weights := make([]float64, len(touches))
+	for i, key := range keys {
+		weights[i] = creditOf(key) / total / float64(counts[key])
+	}
+	return weights
+}
+
+func factorial(n int) float64 {
+	result := 1.0
+	for i := 2; i <= n; i++ {
+		result *= float64(i)
+	}
+	return result
+}
@@ -0,0 +1,612 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func touchOn(channel string) attributionTouch {
+	return attributionTouch{ChannelName: channel}
+}
+
+func pathOf(converted bool, channels ...string) attributionPath {
+	path := attributionPath{Converted: converted}
+	for _, channel := range channels {
+		path.Touches = append(path.Touches, touchOn(channel))
+	}
+	return path
+}
+
+func TestComputeShapleyValues(t *testing.T) {
+	paths := []attributionPath{
+		pathOf(true, "Voice"),
+		pathOf(true, "Voice", "WhatsApp"),
+		pathOf(false, "WhatsApp"),
+		pathOf(false, "WhatsApp"),
+	}
+
+	result := computeShapleyValues(paths, "channel")
+
+	assert.Equal(t, 4, result.Paths)
+	assert.Equal(t, 2, result.ConvertingPaths)
+	assert.InDelta(t, 1.5, result.Values["Voice"], 1e-9)
+	assert.InDelta(t, 0.5, result.Values["WhatsApp"], 1e-9)
+	assert.InDelta(t, 0.75, result.Shares["Voice"], 1e-9)
+}
+
+func TestShapleyTouchWeights(t *testing.T) {
+	result := &shapleyResult{
+		Dimension: "channel",
+		Values:    map[string]float64{"Voice": 1.5, "WhatsApp": 0.5},
+	}
+
+	touches := []attributionTouch{touchOn("Voice"), touchOn("WhatsApp"), touchOn("Voice")}
+	weights := shapleyTouchWeights(touches, result)
+
+	assert.InDelta(t, 0.375, weights[0], 1e-9)
+	assert.InDelta(t, 0.25, weights[1], 1e-9)
+	assert.InDelta(t, 0.375, weights[2], 1e-9)
+
+	// No positive value on the path falls back to linear
+	weights = shapleyTouchWeights([]attributionTouch{touchOn("Email"), touchOn("SMS")}, result)
+	assert.InDelta(t, 0.5, weights[0], 1e-9)
+	assert.InDelta(t, 0.5, weights[1], 1e-9)
+}
+
+func TestComputeMarkovAttribution(t *testing.T) {
+	paths := []attributionPath{
+		pathOf(true, "Voice"),
+		pathOf(true, "WhatsApp", "Voice"),
+		pathOf(false, "WhatsApp"),
+	}
+
+	result := computeMarkovAttribution(paths, "channel")
+
+	assert.InDelta(t, 2.0/3.0, result.TransitionMatrix[markovStartState]["WhatsApp"], 1e-9)
+	assert.InDelta(t, 2.0/3.0, result.ConversionProbability, 1e-9)
+	// Every conversion passes through Voice; only half of WhatsApp's do
+	assert.InDelta(t, 1.0, result.RemovalEffects["Voice"], 1e-9)
+	assert.InDelta(t, 0.5, result.RemovalEffects["WhatsApp"], 1e-9)
+
+	weights := markovTouchWeights([]attributionTouch{touchOn("WhatsApp"), touchOn("Voice")}, result)
+	assert.InDelta(t, 1.0/3.0, weights[0], 1e-9)
+	assert.InDelta(t, 2.0/3.0, weights[1], 1e-9)
+}
+
+func TestBuildAttributionPathsAccountLevel(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	touch := func(customerID int64, channel string, hoursBefore int) attributionTouch {
+		return attributionTouch{CustomerID: &customerID, ChannelName: channel, StartedAt: at.Add(-time.Duration(hoursBefore) * time.Hour)}
+	}
+	touches := []attributionTouch{touch(1, "Voice", 10), touch(2, "Email", 20), touch(3, "SMS", 5)}
+	engagements := []accountEngagementTouch{{AccountID: 50, attributionTouch: attributionTouch{ChannelName: "meeting", StartedAt: at.Add(-15 * time.Hour)}}}
+	conversions := []models.ConversionEvent{{CustomerID: 1, EventType: "purchase", OccurredAt: at, AmountDecimal: 100}}
+	config := AttributionConfig{TimeWindowHours: 72}
+
+	// Customers 1 and 2 are contacts of account 50; customer 3 has no account
+	paths := buildAttributionPaths(touches, engagements, conversions, map[int64]int64{1: 50, 2: 50}, config)
+	assert.Len(t, paths, 2)
+	assert.Equal(t, journeyKey{AccountID: 50}, paths[0].Journey)
+	assert.True(t, paths[0].Converted)
+	assert.Equal(t, []string{"Email", "meeting", "Voice"}, paths[0].keys("channel"))
+	assert.Equal(t, journeyKey{CustomerID: 3}, paths[1].Journey)
+	assert.False(t, paths[1].Converted)
+
+	// At the customer level the engagement and the other contact stay out
+	paths = buildAttributionPaths(touches, nil, conversions, map[int64]int64{}, config)
+	assert.Len(t, paths, 3)
+	assert.Equal(t, []string{"Voice"}, paths[0].keys("channel"))
+	assert.False(t, paths[1].Converted)
+}
+
+func TestTimeDecayWeights(t *testing.T) {
+	conversion := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	touches := []attributionTouch{
+		{StartedAt: conversion.Add(-72 * time.Hour)},
+		{StartedAt: conversion.Add(-24 * time.Hour)},
+		{StartedAt: conversion.Add(-10 * time.Minute)},
+	}
+
+	weights := timeDecayWeights(touches, conversion, 24*time.Hour)
+
+	// Credit halves for every day between the touch and the conversion
+	assert.InDelta(t, weights[2]/2, weights[1], 0.01)
+	assert.InDelta(t, weights[1]/4, weights[0], 0.01)
+	assert.InDelta(t, 1.0, weights[0]+weights[1]+weights[2], 1e-9)
+}
+
+func TestAISignalWeights(t *testing.T) {
+	probability := 0.9
+	intent := "purchase"
+	duration := 600
+	touches := []attributionTouch{
+		{ChannelName: "Voice"},
+		{ChannelName: "Voice", PurchaseProbability: &probability, PrimaryIntent: &intent, DurationSeconds: &duration},
+	}
+
+	params := defaultAISignalParams()
+	weights, explanations := aiSignalWeights(touches, params)
+
+	// base 1.0 vs base 1.0 + 2.0*0.9 + 1.0 intent + 0.05*10 minutes
+	assert.InDelta(t, 1.0/5.3, weights[0], 1e-9)
+	assert.InDelta(t, 4.3/5.3, weights[1], 1e-9)
+	factors := explanations[1]["factors"].(models.JSONB)
+	assert.InDelta(t, 1.8, factors["purchase_probability"], 1e-9)
+	assert.Equal(t, 1.0, factors["primary_intent"])
+}
+
+func TestPositionWeights(t *testing.T) {
+	touches := []attributionTouch{touchOn("Voice"), touchOn("Email"), touchOn("Voice"), touchOn("Voice")}
+
+	params, err := parsePositionParams("U_SHAPED", nil)
+	assert.NoError(t, err)
+	weights, _ := positionWeights(touches, params)
+	assert.InDeltaSlice(t, []float64{0.4, 0.1, 0.1, 0.4}, weights, 1e-9)
+
+	// Two touches share the middle credit in proportion to first/last
+	weights, _ = positionWeights(touches[:2], params)
+	assert.InDeltaSlice(t, []float64{0.5, 0.5}, weights, 1e-9)
+
+	sql := "SQL"
+	touches[1].FunnelStage = &sql
+	params, err = parsePositionParams("W_SHAPED", nil)
+	assert.NoError(t, err)
+	weights, explanations := positionWeights(touches, params)
+	assert.InDeltaSlice(t, []float64{0.30, 0.35, 0.05, 0.30}, weights, 1e-9)
+	assert.Equal(t, []string{"middle", "milestone"}, explanations[1]["positions"])
+
+	_, err = parsePositionParams("CUSTOM_POSITION", models.JSONB{"first_pct": 50.0, "middle_pct": 10.0, "last_pct": 30.0})
+	assert.Error(t, err)
+}
+
+func TestAttributionRunProgressStatus(t *testing.T) {
+	assert.Equal(t, "completed", attributionRunProgress{Total: 10, Processed: 10}.status())
+	assert.Equal(t, "completed", attributionRunProgress{}.status())
+	assert.Equal(t, "partial", attributionRunProgress{Total: 10, Processed: 10, Failed: 3}.status())
+	assert.Equal(t, "failed", attributionRunProgress{Total: 10, Processed: 10, Failed: 10}.status())
+
+	run := &models.AttributionRun{Status: "running", TotalConversions: 3, ProcessedConversions: 1}
+	setProgressPercent(run)
+	assert.InDelta(t, 33.33, run.ProgressPercent, 1e-9)
+}
+
+func TestDiffAttributionBreakdowns(t *testing.T) {
+	from := []AttributionBreakdownRow{
+		{Key: "1", Label: "Asha", AttributedAmount: 100, Conversions: 2},
+		{Key: "2", Label: "Ravi", AttributedAmount: 50, Conversions: 1},
+	}
+	to := []AttributionBreakdownRow{
+		{Key: "1", Label: "Asha", AttributedAmount: 60, Conversions: 2},
+		{Key: "3", Label: "Meera", AttributedAmount: 90, Conversions: 1},
+	}
+
+	diff := diffAttributionBreakdowns(from, to)
+
+	assert.InDelta(t, 150, diff.FromTotal, 1e-9)
+	assert.InDelta(t, 150, diff.ToTotal, 1e-9)
+	assert.Len(t, diff.Rows, 3)
+	assert.Equal(t, "3", diff.Rows[0].Key)
+	assert.InDelta(t, 90, diff.Rows[0].DeltaAmount, 1e-9)
+	assert.Equal(t, "2", diff.Rows[1].Key)
+	assert.InDelta(t, -50, diff.Rows[1].DeltaAmount, 1e-9)
+	assert.InDelta(t, -40, diff.Rows[2].DeltaAmount, 1e-9)
+}
+
+func TestCompareBreakdowns(t *testing.T) {
+	linear := []AttributionBreakdownRow{
+		{Key: "1", Label: "Asha", AttributedAmount: 100},
+		{Key: "2", Label: "Ravi", AttributedAmount: 60},
+		{Key: "3", Label: "Meera", AttributedAmount: 60},
+	}
+	shapley := []AttributionBreakdownRow{
+		{Key: "1", Label: "Asha", AttributedAmount: 50},
+		{Key: "2", Label: "Ravi", AttributedAmount: 120},
+	}
+
+	rows := compareBreakdowns([]int64{10, 11}, [][]AttributionBreakdownRow{linear, shapley})
+
+	assert.Len(t, rows, 3)
+	asha := rows[0]
+	assert.Equal(t, "1", asha.Key)
+	assert.Equal(t, 1, *asha.Values[0].Rank)
+	assert.Equal(t, 2, *asha.Values[1].Rank)
+	assert.Equal(t, -1, *asha.Values[1].RankChange)
+	assert.InDelta(t, -50, asha.Values[1].DeltaAmount, 1e-9)
+	assert.InDelta(t, -50, *asha.Values[1].DeltaPercent, 1e-9)
+
+	ravi := rows[1]
+	assert.Equal(t, 2, *ravi.Values[0].Rank)
+	assert.Equal(t, 1, *ravi.Values[1].RankChange)
+
+	// Meera ties Ravi under the baseline and gets no credit under the second run
+	meera := rows[2]
+	assert.Equal(t, 2, *meera.Values[0].Rank)
+	assert.Nil(t, meera.Values[1].Rank)
+	assert.Nil(t, meera.Values[1].RankChange)
+	assert.InDelta(t, -60, meera.Values[1].DeltaAmount, 1e-9)
+}
+
+func TestTouchExclusion(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	conversion := models.ConversionEvent{EventType: "purchase", OccurredAt: at}
+	agentID := 7
+	config := AttributionConfig{TimeWindowHours: 72, IncludeChannels: []string{"Voice"}}
+
+	touch := attributionTouch{ChannelName: "Voice", StartedAt: at.Add(-time.Hour), AgentID: &agentID}
+	reason, _ := touchExclusion(touch, conversion, config)
+	assert.Equal(t, "", reason)
+
+	late := touch
+	late.StartedAt = at.Add(time.Hour)
+	reason, _ = touchExclusion(late, conversion, config)
+	assert.Equal(t, exclusionAfterConversion, reason)
+
+	old := touch
+	old.StartedAt = at.Add(-96 * time.Hour)
+	reason, detail := touchExclusion(old, conversion, config)
+	assert.Equal(t, exclusionOutsideWindow, reason)
+	assert.Contains(t, detail, "96.0h")
+
+	email := touch
+	email.ChannelName = "Email"
+	reason, _ = touchExclusion(email, conversion, config)
+	assert.Equal(t, exclusionChannelFiltered, reason)
+}
+
+func TestTouchWindowRules(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	inbound, outbound := "inbound", "outbound"
+	config := AttributionConfig{
+		TimeWindowHours: 72,
+		WindowRules: []AttributionWindowRule{
+			{Channel: "Voice", Direction: "inbound", Hours: 24},
+			{Channel: "Field Visit", Hours: 720},
+			{EventType: "renewal", Hours: 2160},
+		},
+	}
+	purchase := models.ConversionEvent{EventType: "purchase", OccurredAt: at}
+	renewal := models.ConversionEvent{EventType: "renewal", OccurredAt: at}
+
+	// An inbound call two days out is past its 24h window; outbound calls keep the default
+	call := attributionTouch{ChannelName: "Voice", Direction: &inbound, StartedAt: at.Add(-48 * time.Hour)}
+	reason, detail := touchExclusion(call, purchase, config)
+	assert.Equal(t, exclusionOutsideWindow, reason)
+	assert.Contains(t, detail, "channel=Voice direction=inbound (24h)")
+
+	call.Direction = &outbound
+	reason, _ = touchExclusion(call, purchase, config)
+	assert.Equal(t, "", reason)
+
+	// Field visits look back 30 days
+	visit := attributionTouch{ChannelName: "Field Visit", StartedAt: at.Add(-20 * 24 * time.Hour)}
+	reason, _ = touchExclusion(visit, purchase, config)
+	assert.Equal(t, "", reason)
+
+	// The channel rule is more specific than the renewal rule, so a field
+	// visit 60 days before a renewal is still outside its window
+	visit.StartedAt = at.Add(-60 * 24 * time.Hour)
+	hours, rule := config.touchWindow(visit, renewal.EventType)
+	assert.Equal(t, 720, hours)
+	assert.Equal(t, "channel=Field Visit (720h)", rule)
+
+	email := attributionTouch{ChannelName: "Email", StartedAt: at.Add(-60 * 24 * time.Hour)}
+	reason, _ = touchExclusion(email, renewal, config)
+	assert.Equal(t, "", reason)
+	_, rule = config.touchWindow(email, purchase.EventType)
+	assert.Equal(t, defaultWindowRule, rule)
+
+	assert.Equal(t, 720, config.maxWindowHours("purchase"))
+	assert.Equal(t, 2160, config.maxWindowHours("renewal"))
+	assert.Error(t, AttributionConfig{WindowRules: []AttributionWindowRule{{Hours: 24}}}.validateWindowRules())
+}
+
+func TestReversalFractions(t *testing.T) {
+	// A partial refund, a chargeback for the rest and a duplicate refund that
+	// would exceed the original amount
+	fractions := reversalFractions(200, []float64{-50, -150, -20})
+	assert.InDeltaSlice(t, []float64{0.25, 0.75, 0}, fractions, 1e-9)
+
+	// Sign of the stored amount doesn't matter
+	assert.InDeltaSlice(t, []float64{0.5}, reversalFractions(200, []float64{100}), 1e-9)
+
+	// Nothing to claw back from a zero-amount conversion
+	assert.Equal(t, []float64{0}, reversalFractions(0, []float64{-10}))
+
+	// A closed conversion's refund corrected from 50 to 80 of 200 claws back
+	// the other 15%; re-sent unchanged it claws back nothing more
+	assert.InDelta(t, 0.15, clawbackAdjustment(0.4, 0.25, 1, 200), 1e-9)
+	assert.Equal(t, 0.0, clawbackAdjustment(0.25, 0.25, 1, 200))
+	// Corrected down, the difference is given back
+	assert.InDelta(t, -0.05, clawbackAdjustment(0.2, 0.25, 1, 200), 1e-9)
+}
+
+func TestAttributionLevel(t *testing.T) {
+	assert.NoError(t, AttributionConfig{}.validate())
+	assert.NoError(t, AttributionConfig{AttributionLevel: AttributionLevelAccount}.validate())
+	assert.ErrorIs(t, AttributionConfig{AttributionLevel: "household"}.validate(), ErrInvalidAttributionConfig)
+
+	assert.False(t, AttributionConfig{}.accountLevel())
+	assert.True(t, AttributionConfig{AttributionLevel: AttributionLevelAccount}.accountLevel())
+
+	// Account engagements are credited without an interaction
+	engagementID := int64(7)
+	assert.Equal(t, int64(3), *attributionTouch{ID: 3}.interactionID())
+	assert.Nil(t, attributionTouch{EngagementID: &engagementID}.interactionID())
+}
+
+func TestViewThroughTouches(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	purchase := models.ConversionEvent{EventType: "purchase", OccurredAt: at}
+	impression := attributionTouch{ChannelName: "Display", IsViewThrough: true, StartedAt: at.Add(-12 * time.Hour)}
+	call := attributionTouch{ChannelName: "Voice", StartedAt: at.Add(-48 * time.Hour)}
+
+	// Impressions are left out unless the run includes them
+	config := AttributionConfig{TimeWindowHours: 72}
+	reason, _ := touchExclusion(impression, purchase, config)
+	assert.Equal(t, exclusionViewThrough, reason)
+
+	// Included impressions use their own, shorter window
+	config.IncludeViewThrough = true
+	reason, _ = touchExclusion(impression, purchase, config)
+	assert.Equal(t, "", reason)
+	impression.StartedAt = at.Add(-30 * time.Hour)
+	reason, detail := touchExclusion(impression, purchase, config)
+	assert.Equal(t, exclusionOutsideWindow, reason)
+	assert.Contains(t, detail, viewThroughWindowRule)
+	assert.Equal(t, 72, config.maxWindowHours("purchase"))
+
+	// A linear split gives the impression half a call's credit by default
+	weights := discountViewThrough([]attributionTouch{impression, call}, []float64{0.5, 0.5}, config.viewThroughDiscount())
+	assert.InDeltaSlice(t, []float64{1.0 / 3, 2.0 / 3}, weights, 1e-9)
+
+	// An impression alone still takes the whole conversion
+	assert.InDeltaSlice(t, []float64{1}, discountViewThrough([]attributionTouch{impression}, []float64{1}, 0.2), 1e-9)
+
+	// A discount of 0 leaves impressions credit only when they are alone
+	none := 0.0
+	config.ViewThroughDiscount = &none
+	assert.NoError(t, config.validate())
+	weights = discountViewThrough([]attributionTouch{impression, call}, []float64{0.5, 0.5}, config.viewThroughDiscount())
+	assert.InDeltaSlice(t, []float64{0, 1}, weights, 1e-9)
+
+	tooMuch := 1.5
+	assert.ErrorIs(t, AttributionConfig{ViewThroughDiscount: &tooMuch}.validate(), ErrInvalidAttributionConfig)
+}
+
+func TestConvertingPaths(t *testing.T) {
+	inbound, outbound := "inbound", "outbound"
+	vendorID := 4
+	web := attributionTouch{ChannelName: "Webchat"}
+	callIn := attributionTouch{ChannelName: "Voice", Direction: &inbound, VendorID: &vendorID}
+	callOut := attributionTouch{ChannelName: "Voice", Direction: &outbound}
+
+	assert.Equal(t, "Voice(inbound)", pathStep(callIn, PathLevelChannel, nil))
+	assert.Equal(t, "Webchat", pathStep(web, PathLevelChannel, nil))
+	assert.Equal(t, "Acme BPO", pathStep(callIn, PathLevelVendor, map[int]string{4: "Acme BPO"}))
+	assert.Equal(t, "no vendor", pathStep(callOut, PathLevelVendor, nil))
+	assert.Equal(t, "unknown", pathStep(web, PathLevelIntent, nil))
+
+	steps := func(touches ...attributionTouch) []string {
+		var out []string
+		for _, touch := range touches {
+			out = append(out, pathStep(touch, PathLevelChannel, nil))
+		}
+		return out
+	}
+	paths := []convertingTouchPath{
+		{Steps: steps(web, callIn, callOut), Revenue: 100, HoursToConvert: 10},
+		{Steps: steps(web, callIn, callOut), Revenue: 300, HoursToConvert: 30},
+		{Steps: steps(callOut), Revenue: 500, HoursToConvert: 1},
+	}
+
+	result, distinct := aggregateConvertingPaths(paths, 4, 10)
+	assert.Equal(t, 2, distinct)
+	assert.Equal(t, "Webchat > Voice(inbound) > Voice(outbound)", result[0].Path)
+	assert.Equal(t, 2, result[0].Conversions)
+	assert.Equal(t, 400.0, result[0].Revenue)
+	assert.Equal(t, 3.0, result[0].AvgPathLength)
+	assert.Equal(t, 20.0, result[0].AvgHoursToConvert)
+	assert.Equal(t, 0.5, result[0].ShareOfConversions)
+
+	// The limit keeps the most common paths
+	result, distinct = aggregateConvertingPaths(paths, 4, 1)
+	assert.Equal(t, 2, distinct)
+	assert.Len(t, result, 1)
+}
+
+func TestAgentCredits(t *testing.T) {
+	primary, transfer, supervisor := "primary", "Transfer", "supervisor"
+	team := 2
+	agents := []touchAgent{
+		{InteractionID: 1, AgentID: 10, Role: &primary},
+		{InteractionID: 1, AgentID: 11, TeamID: &team, Role: &transfer},
+	}
+
+	// Role shares are matched case-insensitively
+	config := AttributionConfig{AgentRoleShares: map[string]float64{"primary": 0.7, "transfer": 0.3}}
+	credits := config.agentCredits(attributionTouch{ID: 1}, agents)
+	assert.Len(t, credits, 2)
+	assert.Equal(t, 10, *credits[0].AgentID)
+	assert.InDelta(t, 0.7, *credits[0].Share, 1e-9)
+	assert.Equal(t, 11, *credits[1].AgentID)
+	assert.Equal(t, &team, credits[1].TeamID)
+	assert.InDelta(t, 0.3, *credits[1].Share, 1e-9)
+
+	// Unlisted roles get the default share, or none without one
+	conference := append(agents, touchAgent{InteractionID: 1, AgentID: 12, Role: &supervisor})
+	credits = config.agentCredits(attributionTouch{ID: 1}, conference)
+	assert.InDelta(t, 0, *credits[2].Share, 1e-9)
+	config.AgentRoleShares[defaultAgentRole] = 1
+	credits = config.agentCredits(attributionTouch{ID: 1}, conference)
+	assert.InDelta(t, 0.5, *credits[2].Share, 1e-9)
+
+	// Without shares the agents split evenly
+	credits = AttributionConfig{}.agentCredits(attributionTouch{ID: 1}, agents)
+	assert.InDelta(t, 0.5, *credits[0].Share, 1e-9)
+	assert.InDelta(t, 0.5, *credits[1].Share, 1e-9)
+
+	// A touch without agents keeps a single, unshared credit
+	credits = config.agentCredits(attributionTouch{ID: 2}, nil)
+	assert.Len(t, credits, 1)
+	assert.Nil(t, credits[0].AgentID)
+	assert.Nil(t, credits[0].Share)
+
+	assert.ErrorIs(t, AttributionConfig{AgentRoleShares: map[string]float64{"primary": -1}}.validate(), ErrInvalidAttributionConfig)
+}
+
+func TestRuleWeights(t *testing.T) {
+	purchase := "purchase"
+	long, short := 200, 60
+	vendorA, vendorB := 1, 2
+	minDuration := 120
+	now := time.Now()
+
+	touches := []attributionTouch{
+		{ID: 1, ChannelName: "Voice", DurationSeconds: &long, PrimaryIntent: &purchase, VendorID: &vendorA, StartedAt: now.Add(-4 * time.Hour)},
+		{ID: 2, ChannelName: "IVR", StartedAt: now.Add(-3 * time.Hour)},
+		{ID: 3, ChannelName: "Webchat", VendorID: &vendorA, StartedAt: now.Add(-2 * time.Hour)},
+		{ID: 4, ChannelName: "Voice", DurationSeconds: &short, VendorID: &vendorB, StartedAt: now.Add(-1 * time.Hour)},
+	}
+	params := ruleModelParams{
+		BaseModel: "LINEAR",
+		Rules: []AttributionRule{
+			{Name: "long purchase calls", Action: RuleActionMultiply, Factor: 3, When: RuleCondition{Channel: "voice", Intent: "Purchase", MinDurationSeconds: &minDuration}},
+			{Name: "no IVR-only touches", Action: RuleActionExclude, When: RuleCondition{Channel: "IVR"}},
+			{Name: "vendor cap", Action: RuleActionCap, Dimension: "vendor", MaxShare: 0.5},
+		},
+	}
+	assert.NoError(t, params.validate())
+
+	// Linear over the 3 kept touches, the long call tripled (0.6, 0.2, 0.2),
+	// then vendor 1 capped at half with the excess going to vendor 2
+	service := &AttributionService{}
+	weights, explanations := service.calculateWeights(touches, "MY_RULES", now, &attributionModelState{Rules: &params})
+	assert.InDelta(t, 0.375, weights[0], 1e-9)
+	assert.Equal(t, 0.0, weights[1])
+	assert.InDelta(t, 0.125, weights[2], 1e-9)
+	assert.InDelta(t, 0.5, weights[3], 1e-9)
+	assert.Equal(t, []string{"long purchase calls", "vendor cap"}, explanations[0]["rules_applied"])
+	assert.Equal(t, []string{"no IVR-only touches"}, explanations[1]["rules_applied"])
+	assert.Equal(t, []string{}, explanations[3]["rules_applied"])
+
+	// A single vendor can't give its excess away and keeps full credit
+	weights, _ = service.calculateWeights(touches[:1], "MY_RULES", now, &attributionModelState{Rules: &params})
+	assert.InDelta(t, 1.0, weights[0], 1e-9)
+
+	// The run's half-life overrides the rule set's for a TIME_DECAY base: one
+	// hour apart with a one hour half-life, the later touch weighs twice as much
+	decay := ruleModelParams{BaseModel: "TIME_DECAY", HalfLifeHours: 1000, Rules: []AttributionRule{}}
+	weights, _ = service.calculateWeights(touches[2:], "MY_RULES", now, &attributionModelState{Rules: &decay, HalfLife: time.Hour})
+	assert.InDelta(t, 1.0/3, weights[0], 1e-9)
+	assert.InDelta(t, 2.0/3, weights[1], 1e-9)
+
+	// The base model's explanation is kept
+	shaped := ruleModelParams{BaseModel: "U_SHAPED", Rules: []AttributionRule{}}
+	_, explanations = service.calculateWeights(touches, "MY_RULES", now, &attributionModelState{Rules: &shaped})
+	assert.Contains(t, explanations[0], "base")
+	assert.Equal(t, "U_SHAPED", explanations[0]["base_model"])
+
+	invalid := []ruleModelParams{
+		{BaseModel: "SHAPLEY"},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: "boost", When: RuleCondition{Channel: "Voice"}}}},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: RuleActionMultiply, Factor: 0, When: RuleCondition{Channel: "Voice"}}}},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: RuleActionExclude}}},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: RuleActionCap, Dimension: "team", MaxShare: 0.5}}},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: RuleActionCap, Dimension: "vendor", MaxShare: 1.5}}},
+		{BaseModel: "LINEAR", Rules: []AttributionRule{{Action: RuleActionCap, Dimension: "vendor", MaxShare: 0.5, When: RuleCondition{Channel: "Voice"}}}},
+	}
+	for _, p := range invalid {
+		assert.ErrorIs(t, p.validate(), ErrInvalidRuleModel)
+	}
+}
+
+func TestBootstrapIntervals(t *testing.T) {
+	assert.Equal(t, 0.0, percentile(nil, 0.5))
+	assert.Equal(t, 2.5, percentile([]float64{1, 2, 3, 4}, 0.5))
+	assert.Equal(t, 4.0, percentile([]float64{1, 2, 3, 4}, 1))
+
+	// Vendor 1 gets 100 from every conversion; vendor 2 shares two of them
+	var contributions []bootstrapContribution
+	for id := int64(1); id <= 20; id++ {
+		contributions = append(contributions, bootstrapContribution{ConversionID: id, Key: "1", Amount: 100})
+		if id <= 2 {
+			contributions = append(contributions, bootstrapContribution{ConversionID: id, Key: "2", Amount: 50})
+		}
+	}
+
+	intervals := bootstrapIntervals(contributions, 500, 42)
+	assert.Len(t, intervals, 2)
+	// Every resample draws 20 conversions, so vendor 1's total never varies
+	assert.Equal(t, ConfidenceInterval{P5: 2000, P50: 2000, P95: 2000}, intervals["1"])
+	// Vendor 2's total depends on how often its conversions are drawn
+	assert.LessOrEqual(t, intervals["2"].P5, intervals["2"].P50)
+	assert.LessOrEqual(t, intervals["2"].P50, intervals["2"].P95)
+	assert.Less(t, intervals["2"].P5, 100.0)
+	assert.Greater(t, intervals["2"].P95, 100.0)
+
+	// The same seed gives the same intervals
+	assert.Equal(t, intervals, bootstrapIntervals(contributions, 500, 42))
+	assert.Empty(t, bootstrapIntervals(nil, 500, 42))
+
+	assert.NoError(t, AttributionConfig{}.validate())
+	assert.NoError(t, AttributionConfig{BootstrapSamples: 1000}.validate())
+	assert.ErrorIs(t, AttributionConfig{BootstrapSamples: 10}.validate(), ErrInvalidAttributionConfig)
+	assert.Equal(t, int64(7), AttributionConfig{}.bootstrapSeed(7))
+	assert.Equal(t, int64(3), AttributionConfig{BootstrapSeed: 3}.bootstrapSeed(7))
+}
+
+func TestClosedPeriodAdjustments(t *testing.T) {
+	assert.Equal(t, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), periodStart(time.Date(2026, 3, 31, 23, 59, 0, 0, time.UTC)))
+
+	april := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 4, 12, 9, 30, 0, 0, time.UTC)
+	assert.Equal(t, now, adjustmentReportedAt(april, now))
+	// Adjustments for a month still ahead go at its start, for a month gone
+	// by at its last instant
+	assert.Equal(t, april, adjustmentReportedAt(april, time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, april.AddDate(0, 1, 0).Add(-time.Microsecond), adjustmentReportedAt(april, time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC)))
+
+	touch1, touch2, touch3 := int64(1), int64(2), int64(3)
+	agent := 7
+	held := []heldCredit{
+		{InteractionID: &touch1, AgentID: &agent, Weight: 0.5, AttributedAmount: 50, SourceAmount: 50},
+		{InteractionID: &touch2, Weight: 0.5, AttributedAmount: 50, SourceAmount: 50},
+	}
+	fresh := []attributionResultRow{
+		{InteractionID: &touch1, AgentID: &agent, Weight: 0.5, AttributedAmount: 50, SourceAmount: 50},
+		{InteractionID: &touch2, Weight: 0.25, AttributedAmount: 25, SourceAmount: 25},
+		{InteractionID: &touch3, Weight: 0.25, AttributedAmount: 25, SourceAmount: 25},
+	}
+
+	// Unchanged credit needs no adjustment; moved credit nets to zero
+	adjustments := closedPeriodAdjustments(held, fresh, 1)
+	assert.Len(t, adjustments, 2)
+	assert.Equal(t, &touch2, adjustments[0].InteractionID)
+	assert.InDelta(t, -25, adjustments[0].AttributedAmount, 1e-9)
+	assert.Equal(t, &touch3, adjustments[1].InteractionID)
+	assert.InDelta(t, 25, adjustments[1].AttributedAmount, 1e-9)
+
+	// A refund of 40% after close claws back from every touch
+	adjustments = closedPeriodAdjustments(held, fresh[:1], 0.6)
+	assert.Len(t, adjustments, 2)
+	assert.Equal(t, &agent, adjustments[0].AgentID)
+	assert.InDelta(t, -20, adjustments[0].AttributedAmount, 1e-9)
+	assert.InDelta(t, -0.2, adjustments[0].Weight, 1e-9)
+	assert.InDelta(t, -50, adjustments[1].AttributedAmount, 1e-9)
+
+	assert.Empty(t, closedPeriodAdjustments(held, heldRows(held), 1))
+}
+
+func heldRows(held []heldCredit) []attributionResultRow {
+	rows := make([]attributionResultRow, len(held))
+	for i, c := range held {
+		rows[i] = attributionResultRow{
+			InteractionID: c.InteractionID, AgentID: c.AgentID,
+			Weight: c.Weight, AttributedAmount: c.AttributedAmount, SourceAmount: c.SourceAmount,
+		}
+	}
+	return rows
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrAttributionVersionNotFound is returned when a run has no such result version
+	ErrAttributionVersionNotFound = errors.New("attribution result version not found")
+	// ErrUnsupportedDimension is returned for an unknown breakdown dimension
+	ErrUnsupportedDimension = errors.New("unsupported dimension")
+)
+
+// attributionDimensions maps a breakdown dimension to the key and label
+// expressions used over attributionBreakdownJoins
+var attributionDimensions = map[string]struct{ key, label string }{
+	"agent":      {"ar.agent_id::text", "a.name"},
+	"team":       {"ar.team_id::text", "t.name"},
+	"vendor":     {"ar.vendor_id::text", "v.name"},
+	"channel":    {"COALESCE(i.channel_id::text, 'engagement:' || ae.engagement_type)", "COALESCE(ch.name, ae.engagement_type)"},
+	"intent":     {"i.primary_intent", "i.primary_intent"},
+	"conversion": {"ar.conversion_event_id::text", "ce.external_event_id"},
+}
+
+const attributionBreakdownJoins = `
+	FROM attribution_results ar
+	LEFT JOIN interactions i ON ar.interaction_id = i.id
+	LEFT JOIN channels ch ON i.channel_id = ch.id
+	LEFT JOIN account_engagements ae ON ar.account_engagement_id = ae.id
+	LEFT JOIN agents a ON ar.agent_id = a.id
+	LEFT JOIN teams t ON ar.team_id = t.id
+	LEFT JOIN vendors v ON ar.vendor_id = v.id
+	LEFT JOIN conversion_events ce ON ar.conversion_event_id = ce.id`
+
+// AttributionBreakdownRow is the credit a run version gave one agent, team,
+// vendor, channel, intent or conversion
+type AttributionBreakdownRow struct {
+	Key              string  `db:"key" json:"key"`
+	Label            string  `db:"label" json:"label"`
+	AttributedAmount float64 `db:"attributed_amount" json:"attributed_amount"`
+	Credit           float64 `db:"credit" json:"credit"`
+	Conversions      int     `db:"conversions" json:"conversions"`
+	// Interval is the bootstrap range of AttributedAmount, when computed
+	Interval *ConfidenceInterval `db:"-" json:"interval,omitempty"`
+}
+
+// AttributionVersionDiff compares two result versions of a run
+type AttributionVersionDiff struct {
+	RunID       int64                       `json:"run_id"`
+	Dimension   string                      `json:"dimension"`
+	FromVersion int                         `json:"from_version"`
+	ToVersion   int                         `json:"to_version"`
+	FromTotal   float64                     `json:"from_total"`
+	ToTotal     float64                     `json:"to_total"`
+	DeltaTotal  float64                     `json:"delta_total"`
+	Rows        []AttributionVersionDiffRow `json:"rows"`
+}
+
+// AttributionVersionDiffRow is the change in one key's credit between versions
+type AttributionVersionDiffRow struct {
+	Key             string  `json:"key"`
+	Label           string  `json:"label"`
+	FromAmount      float64 `json:"from_amount"`
+	ToAmount        float64 `json:"to_amount"`
+	DeltaAmount     float64 `json:"delta_amount"`
+	FromConversions int     `json:"from_conversions"`
+	ToConversions   int     `json:"to_conversions"`
+}
+
+// startAttributionRunVersion returns the result version an execution of the
+// run writes. A version left unfinished by an interrupted execution is
+// cleared and reused; otherwise the next version number is created.
+func (s *AttributionService) startAttributionRunVersion(runID int64) (int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the run so two executions can't take the same version
+	if _, err := tx.Exec(`SELECT id FROM attribution_runs WHERE id = $1 FOR UPDATE`, runID); err != nil {
+		return 0, fmt.Errorf("failed to lock attribution run: %w", err)
+	}
+
+	var version int
+	err = tx.Get(&version,
+		`SELECT version FROM attribution_run_versions
+		 WHERE attribution_run_id = $1 AND status = 'running'
+		 ORDER BY version DESC LIMIT 1`,
+		runID,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.Get(&version,
+			`INSERT INTO attribution_run_versions (attribution_run_id, version)
+			 SELECT $1, COALESCE(MAX(version), 0) + 1 FROM attribution_run_versions WHERE attribution_run_id = $1
+			 RETURNING version`,
+			runID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create run version: %w", err)
+		}
+	case err != nil:
+		return 0, fmt.Errorf("failed to get run version: %w", err)
+	default:
+		if _, err := tx.Exec(`DELETE FROM attribution_results WHERE attribution_run_id = $1 AND result_version = $2`, runID, version); err != nil {
+			return 0, fmt.Errorf("failed to clear unfinished results: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM attribution_run_errors WHERE attribution_run_id = $1 AND result_version = $2`, runID, version); err != nil {
+			return 0, fmt.Errorf("failed to clear unfinished errors: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE attribution_run_versions SET started_at = NOW() WHERE attribution_run_id = $1 AND version = $2`, runID, version)
+		if err != nil {
+			return 0, fmt.Errorf("failed to restart run version: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to start run version: %w", err)
+	}
+	return version, nil
+}
+
+// ListAttributionRunVersions returns every result version of a run, newest first
+func (s *AttributionService) ListAttributionRunVersions(tenantID, runID int64) ([]models.AttributionRunVersion, error) {
+	if _, err := s.GetAttributionRun(tenantID, runID); err != nil {
+		return nil, err
+	}
+
+	var versions []models.AttributionRunVersion
+	err := s.db.Select(&versions,
+		`SELECT v.id, v.attribution_run_id, v.version, v.status,
+		        COALESCE(v.version = run.current_version, false) as is_current,
+		        v.total_conversions, v.processed_conversions, v.failed_conversions,
+		        v.result_rows, v.attributed_amount, v.model_output, v.error_message,
+		        v.started_at, v.completed_at
+		 FROM attribution_run_versions v
+		 INNER JOIN attribution_runs run ON v.attribution_run_id = run.id
+		 WHERE v.attribution_run_id = $1
+		 ORDER BY v.version DESC`,
+		runID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get run versions: %w", err)
+	}
+	return versions, nil
+}
+
+// DiffAttributionRunVersions compares the credit two result versions of a run
+// gave along a dimension. toVersion defaults to the current version (or the
+// latest when none completed) and fromVersion to the version before it.
+func (s *AttributionService) DiffAttributionRunVersions(tenantID, runID int64, fromVersion, toVersion int, dimension string) (*AttributionVersionDiff, error) {
+	if dimension == "" {
+		dimension = "agent"
+	}
+	if _, ok := attributionDimensions[dimension]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDimension, dimension)
+	}
+
+	run, err := s.GetAttributionRun(tenantID, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	if toVersion <= 0 {
+		if run.CurrentVersion != nil {
+			toVersion = *run.CurrentVersion
+		} else {
+			_ = s.db.Get(&toVersion, `SELECT COALESCE(MAX(version), 0) FROM attribution_run_versions WHERE attribution_run_id = $1`, runID)
+		}
+	}
+	if fromVersion <= 0 {
+		_ = s.db.Get(&fromVersion,
+			`SELECT COALESCE(MAX(version), 0) FROM attribution_run_versions WHERE attribution_run_id = $1 AND version < $2`,
+			runID, toVersion,
+		)
+	}
+	for _, version := range []int{fromVersion, toVersion} {
+		var exists bool
+		err := s.db.Get(&exists,
+			`SELECT EXISTS (SELECT 1 FROM attribution_run_versions WHERE attribution_run_id = $1 AND version = $2)`,
+			runID, version,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get run version: %w", err)
+		}
+		if !exists {
+			return nil, ErrAttributionVersionNotFound
+		}
+	}
+
+	from, err := s.attributionBreakdown(tenantID, runID, fromVersion, dimension)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.attributionBreakdown(tenantID, runID, toVersion, dimension)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := diffAttributionBreakdowns(from, to)
+	diff.RunID = runID
+	diff.Dimension = dimension
+	diff.FromVersion = fromVersion
+	diff.ToVersion = toVersion
+	return diff, nil
+}
+
+// attributionBreakdown totals a run version's results along a dimension
+func (s *AttributionService) attributionBreakdown(tenantID, runID int64, version int, dimension string) ([]AttributionBreakdownRow, error) {
+	return queryAttributionBreakdown(s.db, tenantID, runID, version, dimension, nil, nil, nil)
+}
+
+// queryAttributionBreakdown totals a run version's results along a dimension,
+// optionally limited to conversions that occurred between from and to and to
+// conversions of an account
+func queryAttributionBreakdown(db *sqlx.DB, tenantID, runID int64, version int, dimension string, from, to *time.Time, accountID *int64) ([]AttributionBreakdownRow, error) {
+	expr, ok := attributionDimensions[dimension]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDimension, dimension)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT COALESCE(%s, '') as key,
+		       COALESCE(MAX(%s), '') as label,
+		       COALESCE(SUM(ar.attributed_amount), 0) as attributed_amount,
+		       COALESCE(SUM(ar.attribution_weight), 0) as credit,
+		       COUNT(DISTINCT ar.conversion_event_id) as conversions
+		%s
+		WHERE ar.tenant_id = $1 AND ar.attribution_run_id = $2 AND ar.result_version = $3`,
+		expr.key, expr.label, attributionBreakdownJoins,
+	)
+	args := []interface{}{tenantID, runID, version}
+	argPos := 4
+
+	if from != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" >= $%d", argPos)
+		args = append(args, *from)
+		argPos++
+	}
+	if to != nil {
+		query += fmt.Sprintf(" AND "+attributionReportedAt+" <= $%d", argPos)
+		args = append(args, *to)
+		argPos++
+	}
+	if accountID != nil {
+		query += fmt.Sprintf(" AND ar.account_id = $%d", argPos)
+		args = append(args, *accountID)
+		argPos++
+	}
+	query += " GROUP BY 1"
+
+	var rows []AttributionBreakdownRow
+	if err := db.Select(&rows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get attribution breakdown: %w", err)
+	}
+	for i := range rows {
+		if rows[i].Key == "" {
+			rows[i].Label = "Unassigned"
+		}
+	}
+	return rows, nil
+}
+
+// diffAttributionBreakdowns matches two breakdowns by key, largest change first
+func diffAttributionBreakdowns(from, to []AttributionBreakdownRow) *AttributionVersionDiff {
+	diff := &AttributionVersionDiff{Rows: []AttributionVersionDiffRow{}}
+	rows := map[string]*AttributionVersionDiffRow{}
+	row := func(key, label string) *AttributionVersionDiffRow {
+		if r, ok := rows[key]; ok {
+			return r
+		}
+		rows[key] = &AttributionVersionDiffRow{Key: key, Label: label}
+		return rows[key]
+	}
+
+	for _, b := range from {
+		r := row(b.Key, b.Label)
+		r.FromAmount = b.AttributedAmount
+		r.FromConversions = b.Conversions
+		diff.FromTotal += b.AttributedAmount
+	}
+	for _, b := range to {
+		r := row(b.Key, b.Label)
+		r.Label = b.Label
+		r.ToAmount = b.AttributedAmount
+		r.ToConversions = b.Conversions
+		diff.ToTotal += b.AttributedAmount
+	}
+	diff.DeltaTotal = diff.ToTotal - diff.FromTotal
+
+	for _, r := range rows {
+		r.DeltaAmount = r.ToAmount - r.FromAmount
+		diff.Rows = append(diff.Rows, *r)
+	}
+	sort.Slice(diff.Rows, func(a, b int) bool {
+		da, db := math.Abs(diff.Rows[a].DeltaAmount), math.Abs(diff.Rows[b].DeltaAmount)
+		if da != db {
+			return da > db
+		}
+		return diff.Rows[a].Key < diff.Rows[b].Key
+	})
+	return diff
+}
@@ -0,0 +1,65 @@
+package services
+
+import "fmt"
+
+// View-through touches are ad impressions (interactions with is_view_through
+// set). Runs leave them out unless include_view_through is set; included
+// impressions get their own lookback window and have their credit discounted
+// against click and call touches.
+const (
+	defaultViewThroughWindowHours = 24
+	defaultViewThroughDiscount    = 0.5
+
+	// viewThroughWindowRule labels the view_through_window_hours window
+	viewThroughWindowRule = "view_through_window_hours"
+)
+
+// viewThroughWindowHours is the lookback window for ad impressions
+func (c AttributionConfig) viewThroughWindowHours() int {
+	if c.ViewThroughWindowHours > 0 {
+		return c.ViewThroughWindowHours
+	}
+	return defaultViewThroughWindowHours
+}
+
+// viewThroughDiscount is the factor an impression's credit is multiplied by
+// relative to a click or call in the same position
+func (c AttributionConfig) viewThroughDiscount() float64 {
+	if c.ViewThroughDiscount != nil {
+		return *c.ViewThroughDiscount
+	}
+	return defaultViewThroughDiscount
+}
+
+// validateViewThrough checks the view-through window and discount
+func (c AttributionConfig) validateViewThrough() error {
+	if c.ViewThroughWindowHours < 0 {
+		return fmt.Errorf("%w: view_through_window_hours must be positive", ErrInvalidAttributionConfig)
+	}
+	if d := c.ViewThroughDiscount; d != nil && (*d < 0 || *d > 1) {
+		return fmt.Errorf("%w: view_through_discount must be between 0 and 1", ErrInvalidAttributionConfig)
+	}
+	return nil
+}
+
+// discountViewThrough scales the weights of view-through touches by discount
+// and renormalizes so the conversion is still fully credited. A path of
+// impressions alone keeps its weights.
+func discountViewThrough(touches []attributionTouch, weights []float64, discount float64) []float64 {
+	total := 0.0
+	discounted := make([]float64, len(weights))
+	for i, weight := range weights {
+		discounted[i] = weight
+		if touches[i].IsViewThrough {
+			discounted[i] = weight * discount
+		}
+		total += discounted[i]
+	}
+	if total <= 0 {
+		return weights
+	}
+	for i := range discounted {
+		discounted[i] /= total
+	}
+	return discounted
+}
@@ -0,0 +1,387 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dead letters: ingestion and webhook payloads that were rejected are kept
+// with their error so they can be fixed and replayed instead of being lost.
+
+// Dead letter statuses. A dead letter is replaying while a replay has
+// claimed it.
+const (
+	DeadLetterPending   = "pending"
+	DeadLetterReplaying = "replaying"
+	DeadLetterReplayed  = "replayed"
+	DeadLetterDiscarded = "discarded"
+)
+
+// MaxDeadLetterReplay is the most dead letters replayed by one request
+const MaxDeadLetterReplay = 1000
+
+// deadLetterReplayTimeout is how long a dead letter stays claimed by a replay
+// before another replay may claim it, e.g. after a crash mid-replay
+const deadLetterReplayTimeout = 15 * time.Minute
+
+var (
+	// ErrDeadLetterNotFound is returned when a dead letter does not exist for
+	// the tenant
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrDeadLetterNotPending is returned when editing or discarding a dead
+	// letter that was already replayed or discarded
+	ErrDeadLetterNotPending = errors.New("dead letter is not pending")
+	// ErrInvalidDeadLetterPayload is returned when an edited payload is not JSON
+	ErrInvalidDeadLetterPayload = errors.New("dead letter payload must be JSON")
+)
+
+// DeadLetter is a rejected ingestion or webhook payload. Source names the
+// endpoint it was sent to, e.g. conversions or webhooks/convin.
+type DeadLetter struct {
+	ID             int64      `db:"id" json:"id"`
+	TenantID       int64      `db:"tenant_id" json:"tenant_id"`
+	Source         string     `db:"source" json:"source"`
+	RawPayload     string     `db:"payload" json:"-"`
+	StatusCode     int        `db:"status_code" json:"status_code,omitempty"`
+	ErrorMessage   string     `db:"error_message" json:"error_message"`
+	Status         string     `db:"status" json:"status"`
+	Occurrences    int        `db:"occurrences" json:"occurrences"`
+	ReplayAttempts int        `db:"replay_attempts" json:"replay_attempts"`
+	LastReplayedAt *time.Time `db:"last_replayed_at" json:"last_replayed_at,omitempty"`
+	ReplayedAt     *time.Time `db:"replayed_at" json:"replayed_at,omitempty"`
+	EditedAt       *time.Time `db:"edited_at" json:"edited_at,omitempty"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time  `db:"updated_at" json:"updated_at"`
+	// Payload is the payload as sent, or as a JSON string when it wasn't JSON.
+	// Lists leave it out.
+	Payload json.RawMessage `db:"-" json:"payload,omitempty"`
+}
+
+// deadLetterColumns selects a DeadLetter
+const deadLetterColumns = `id, tenant_id, source, payload, status_code, error_message, status,
+	occurrences, replay_attempts, last_replayed_at, replayed_at, edited_at, created_at, updated_at`
+
+// setPayload fills in Payload from the stored payload
+func (l *DeadLetter) setPayload() {
+	if json.Valid([]byte(l.RawPayload)) {
+		l.Payload = json.RawMessage(l.RawPayload)
+		return
+	}
+	l.Payload, _ = json.Marshal(l.RawPayload)
+}
+
+// DeadLetterInput is a rejected payload to keep. Key is the Idempotency-Key
+// the payload was sent with, if any.
+type DeadLetterInput struct {
+	Source     string
+	Payload    []byte
+	StatusCode int
+	Error      string
+	Key        string
+}
+
+// dedupKey identifies repeats of the same rejected request: by its
+// Idempotency-Key when it has one, and otherwise by its payload
+func (l DeadLetterInput) dedupKey() string {
+	hash := sha256.New()
+	if l.Key != "" {
+		hash.Write([]byte("idempotency-key\n" + l.Key))
+	} else {
+		hash.Write(l.Payload)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// dedupedDeadLetter is a rejected payload with the number of times it was
+// rejected
+type dedupedDeadLetter struct {
+	DeadLetterInput
+	DedupKey    string
+	Occurrences int
+}
+
+// dedupDeadLetters merges repeats of a payload to the same source, keeping
+// the latest error
+func dedupDeadLetters(letters []DeadLetterInput) []dedupedDeadLetter {
+	var deduped []dedupedDeadLetter
+	index := map[[2]string]int{}
+	for _, letter := range letters {
+		key := [2]string{letter.Source, letter.dedupKey()}
+		if i, ok := index[key]; ok {
+			deduped[i].StatusCode = letter.StatusCode
+			deduped[i].Error = letter.Error
+			deduped[i].Occurrences++
+			continue
+		}
+		index[key] = len(deduped)
+		deduped = append(deduped, dedupedDeadLetter{DeadLetterInput: letter, DedupKey: key[1], Occurrences: 1})
+	}
+	return deduped
+}
+
+// DeadLetterFilter narrows dead letters down; empty fields match everything
+type DeadLetterFilter struct {
+	Status string
+	Source string
+	// Error matches error messages containing it, ignoring case
+	Error string
+	From  *time.Time
+	To    *time.Time
+}
+
+// where returns the filter's conditions, numbering arguments after args
+func (f DeadLetterFilter) where(args []interface{}) (string, []interface{}) {
+	where := ""
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		where += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	}
+	if f.Source != "" {
+		add("source = $%d", f.Source)
+	}
+	if f.Error != "" {
+		add("error_message ILIKE '%%' || $%d || '%%'", f.Error)
+	}
+	if f.From != nil {
+		add("created_at >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("created_at <= $%d", *f.To)
+	}
+	return where, args
+}
+
+// DeadLetterReplayResult is the outcome of replaying one dead letter
+type DeadLetterReplayResult struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DeadLetterReplay is the outcome of replaying dead letters, in the order
+// they were replayed
+type DeadLetterReplay struct {
+	Replayed int                      `json:"replayed"`
+	Failed   int                      `json:"failed"`
+	Skipped  int                      `json:"skipped"`
+	Results  []DeadLetterReplayResult `json:"results"`
+}
+
+// DeadLetterReplayer processes a dead letter's payload again as if it had
+// just been sent to its source
+type DeadLetterReplayer func(letter *DeadLetter) error
+
+// RecordDeadLetters keeps rejected payloads. A payload that is already
+// pending for its source, e.g. a webhook retried after a server error, isn't
+// kept again: the pending dead letter counts the repeat and takes its error.
+func (s *IngestionService) RecordDeadLetters(tenantID int64, letters []DeadLetterInput) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	deduped := dedupDeadLetters(letters)
+	args := make([]interface{}, 0, len(deduped)*7)
+	for _, letter := range deduped {
+		args = append(args, tenantID, letter.Source, string(letter.Payload), letter.StatusCode, letter.Error,
+			letter.DedupKey, letter.Occurrences)
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO ingestion_dead_letters (tenant_id, source, payload, status_code, error_message, dedup_key, occurrences)
+		 VALUES `+valuesPlaceholders(len(deduped), 7)+`
+		 ON CONFLICT (tenant_id, source, dedup_key) WHERE status IN ('pending', 'replaying') DO UPDATE
+		 SET occurrences = ingestion_dead_letters.occurrences + EXCLUDED.occurrences,
+		     status_code = EXCLUDED.status_code, error_message = EXCLUDED.error_message, updated_at = NOW()`,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record dead letters: %w", err)
+	}
+	return nil
+}
+
+// ListDeadLetters lists a tenant's dead letters, newest first, without their
+// payloads
+func (s *IngestionService) ListDeadLetters(tenantID int64, filter DeadLetterFilter, limit, offset int) ([]DeadLetter, int, error) {
+	where, args := filter.where([]interface{}{tenantID})
+
+	var total int
+	err := s.db.Get(&total, `SELECT COUNT(*) FROM ingestion_dead_letters WHERE tenant_id = $1`+where, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count dead letters: %w", err)
+	}
+
+	letters := []DeadLetter{}
+	err = s.db.Select(&letters,
+		fmt.Sprintf(`SELECT %s FROM ingestion_dead_letters WHERE tenant_id = $1%s
+		 ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`,
+			deadLetterColumns, where, len(args)+1, len(args)+2),
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	return letters, total, nil
+}
+
+// GetDeadLetter returns a dead letter with its payload
+func (s *IngestionService) GetDeadLetter(tenantID, id int64) (*DeadLetter, error) {
+	var letter DeadLetter
+	err := s.db.Get(&letter, `SELECT `+deadLetterColumns+` FROM ingestion_dead_letters WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+	letter.setPayload()
+	return &letter, nil
+}
+
+// UpdateDeadLetterPayload replaces the payload of a pending dead letter, e.g.
+// to correct a code before replaying it
+func (s *IngestionService) UpdateDeadLetterPayload(tenantID, id int64, payload json.RawMessage) (*DeadLetter, error) {
+	if !json.Valid(payload) {
+		return nil, ErrInvalidDeadLetterPayload
+	}
+	return s.changePendingDeadLetter(tenantID, id,
+		`UPDATE ingestion_dead_letters SET payload = $3, edited_at = NOW(), updated_at = NOW()
+		 WHERE id = $1 AND tenant_id = $2 AND status = 'pending'`,
+		string(payload),
+	)
+}
+
+// DiscardDeadLetter marks a pending dead letter as not to be replayed
+func (s *IngestionService) DiscardDeadLetter(tenantID, id int64) (*DeadLetter, error) {
+	return s.changePendingDeadLetter(tenantID, id,
+		`UPDATE ingestion_dead_letters SET status = 'discarded', updated_at = NOW()
+		 WHERE id = $1 AND tenant_id = $2 AND status = 'pending'`,
+	)
+}
+
+func (s *IngestionService) changePendingDeadLetter(tenantID, id int64, query string, args ...interface{}) (*DeadLetter, error) {
+	result, err := s.db.Exec(query, append([]interface{}{id, tenantID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update dead letter: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := s.GetDeadLetter(tenantID, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrDeadLetterNotPending
+	}
+	return s.GetDeadLetter(tenantID, id)
+}
+
+// PendingDeadLetterIDs returns the pending dead letters matching the filter,
+// oldest first, up to MaxDeadLetterReplay
+func (s *IngestionService) PendingDeadLetterIDs(tenantID int64, filter DeadLetterFilter) ([]int64, error) {
+	filter.Status = DeadLetterPending
+	where, args := filter.where([]interface{}{tenantID})
+
+	var ids []int64
+	err := s.db.Select(&ids,
+		fmt.Sprintf(`SELECT id FROM ingestion_dead_letters WHERE tenant_id = $1%s
+		 ORDER BY created_at, id LIMIT %d`, where, MaxDeadLetterReplay),
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	return ids, nil
+}
+
+// ReplayDeadLetters replays dead letters in the order they were rejected, so
+// a conversion is replayed before its refund. Each dead letter is claimed
+// before it is replayed, so concurrent replays never process one twice;
+// those that aren't pending, or that another replay claimed, are skipped. A
+// failed replay puts the dead letter back to pending with the new error.
+func (s *IngestionService) ReplayDeadLetters(tenantID int64, ids []int64, replay DeadLetterReplayer) (*DeadLetterReplay, error) {
+	if len(ids) > MaxDeadLetterReplay {
+		return nil, fmt.Errorf("at most %d dead letters can be replayed at once", MaxDeadLetterReplay)
+	}
+
+	var letters []DeadLetter
+	err := s.db.Select(&letters,
+		`SELECT `+deadLetterColumns+` FROM ingestion_dead_letters
+		 WHERE tenant_id = $1 AND id = ANY($2)
+		 ORDER BY created_at, id`,
+		tenantID, pq.Array(ids),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+
+	result := &DeadLetterReplay{Results: make([]DeadLetterReplayResult, 0, len(letters))}
+	for i := range letters {
+		letter := &letters[i]
+		claimed, err := s.claimDeadLetter(letter)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			result.Skipped++
+			result.Results = append(result.Results, DeadLetterReplayResult{ID: letter.ID, Status: letter.Status})
+			continue
+		}
+
+		replayErr := replay(letter)
+		if replayErr != nil {
+			_, err = s.db.Exec(
+				`UPDATE ingestion_dead_letters
+				 SET status = 'pending', error_message = $1, replay_attempts = replay_attempts + 1,
+				     last_replayed_at = NOW(), updated_at = NOW()
+				 WHERE id = $2`,
+				replayErr.Error(), letter.ID,
+			)
+			result.Failed++
+			result.Results = append(result.Results, DeadLetterReplayResult{ID: letter.ID, Status: "failed", Error: replayErr.Error()})
+		} else {
+			_, err = s.db.Exec(
+				`UPDATE ingestion_dead_letters
+				 SET status = 'replayed', replay_attempts = replay_attempts + 1, last_replayed_at = NOW(),
+				     replayed_at = NOW(), updated_at = NOW()
+				 WHERE id = $1`,
+				letter.ID,
+			)
+			result.Replayed++
+			result.Results = append(result.Results, DeadLetterReplayResult{ID: letter.ID, Status: DeadLetterReplayed})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update dead letter: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// claimDeadLetter marks a pending dead letter as replaying, or one whose
+// replay timed out, and reloads its payload, which may have been edited. When
+// it can't be claimed it reloads the dead letter's status instead.
+func (s *IngestionService) claimDeadLetter(letter *DeadLetter) (bool, error) {
+	err := s.db.Get(&letter.RawPayload,
+		`UPDATE ingestion_dead_letters SET status = 'replaying', updated_at = NOW()
+		 WHERE id = $1
+		   AND (status = 'pending' OR (status = 'replaying' AND updated_at <= NOW() - make_interval(secs => $2)))
+		 RETURNING payload`,
+		letter.ID, deadLetterReplayTimeout.Seconds(),
+	)
+	if err == nil {
+		letter.Status = DeadLetterReplaying
+		return true, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to claim dead letter: %w", err)
+	}
+	if err := s.db.Get(&letter.Status, `SELECT status FROM ingestion_dead_letters WHERE id = $1`, letter.ID); err != nil {
+		return false, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+	return false, nil
+}
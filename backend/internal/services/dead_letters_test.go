@@ -0,0 +1,53 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterFilter(t *testing.T) {
+	where, args := DeadLetterFilter{}.where([]interface{}{int64(1)})
+	assert.Equal(t, "", where)
+	assert.Len(t, args, 1)
+
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	where, args = DeadLetterFilter{Status: DeadLetterPending, Error: "currency", From: &from}.where([]interface{}{int64(1)})
+	assert.Equal(t, " AND status = $2 AND error_message ILIKE '%' || $3 || '%' AND created_at >= $4", where)
+	assert.Equal(t, []interface{}{int64(1), DeadLetterPending, "currency", from}, args)
+}
+
+func TestDeadLetterPayload(t *testing.T) {
+	letter := DeadLetter{RawPayload: `{"currency": "INRR"}`}
+	letter.setPayload()
+	assert.JSONEq(t, `{"currency": "INRR"}`, string(letter.Payload))
+
+	// Bodies that weren't JSON are returned as a string
+	letter = DeadLetter{RawPayload: `{"currency": `}
+	letter.setPayload()
+	var text string
+	assert.NoError(t, json.Unmarshal(letter.Payload, &text))
+	assert.Equal(t, `{"currency": `, text)
+}
+
+func TestDedupDeadLetters(t *testing.T) {
+	refund := []byte(`{"external_event_id": "r-1"}`)
+	deduped := dedupDeadLetters([]DeadLetterInput{
+		{Source: "conversions", Payload: refund, Error: "conversion not found"},
+		{Source: "conversions", Payload: refund, Error: "currency not found: INRR"},
+		{Source: "conversions/batch", Payload: refund, Error: "conversion not found"},
+		// Retries with the same Idempotency-Key are repeats even if the body differs
+		{Source: "webhooks/telephony", Payload: []byte(`{"a": 1}`), Key: "k-1", StatusCode: 500},
+		{Source: "webhooks/telephony", Payload: []byte(`{"a": 2}`), Key: "k-1", StatusCode: 500},
+	})
+
+	assert.Len(t, deduped, 3)
+	assert.Equal(t, 2, deduped[0].Occurrences)
+	assert.Equal(t, "currency not found: INRR", deduped[0].Error)
+	assert.Equal(t, 1, deduped[1].Occurrences)
+	assert.Equal(t, deduped[0].DedupKey, deduped[1].DedupKey)
+	assert.Equal(t, 2, deduped[2].Occurrences)
+	assert.Len(t, deduped[2].DedupKey, 64)
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const fxRateDateLayout = "2006-01-02"
+
+var (
+	// ErrUnknownCurrency is returned for a currency code not in currencies
+	ErrUnknownCurrency = errors.New("unknown currency")
+	// ErrInvalidFXRate is returned for an FX rate that can't be loaded
+	ErrInvalidFXRate = errors.New("invalid FX rate")
+	// ErrMissingFXRate is returned when no rate converts an amount into the
+	// tenant's reporting currency
+	ErrMissingFXRate = errors.New("no FX rate")
+)
+
+// FXService manages FX rates and the tenant reporting currency
+type FXService struct {
+	db *sqlx.DB
+}
+
+func NewFXService(db *sqlx.DB) *FXService {
+	return &FXService{db: db}
+}
+
+// FXRateInput is one daily rate to load: one unit of BaseCurrency is worth
+// Rate units of QuoteCurrency on Date (YYYY-MM-DD)
+type FXRateInput struct {
+	Date          string  `json:"date"`
+	BaseCurrency  string  `json:"base_currency"`
+	QuoteCurrency string  `json:"quote_currency"`
+	Rate          float64 `json:"rate"`
+}
+
+// ReportingCurrency is the currency a tenant's attributed amounts are
+// reported in; nil when amounts are kept as ingested
+type ReportingCurrency struct {
+	Currency *models.Currency `json:"currency"`
+}
+
+// GetReportingCurrency returns the tenant's reporting currency
+func (s *FXService) GetReportingCurrency(tenantID int64) (*ReportingCurrency, error) {
+	var currency models.Currency
+	err := s.db.Get(&currency,
+		`SELECT cur.id, cur.code, cur.name, cur.created_at
+		 FROM tenants t
+		 INNER JOIN currencies cur ON t.reporting_currency_id = cur.id
+		 WHERE t.id = $1`,
+		tenantID,
+	)
+	if err == sql.ErrNoRows {
+		return &ReportingCurrency{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reporting currency: %w", err)
+	}
+	return &ReportingCurrency{Currency: &currency}, nil
+}
+
+// SetReportingCurrency sets the tenant's reporting currency, or clears it
+// when code is empty. Existing runs must be re-executed to restate their
+// results in the new currency.
+func (s *FXService) SetReportingCurrency(tenantID int64, code string) (*ReportingCurrency, error) {
+	var currencyID *int
+	if code != "" {
+		id, err := s.currencyID(s.db, code)
+		if err != nil {
+			return nil, err
+		}
+		currencyID = &id
+	}
+
+	_, err := s.db.Exec(
+		`UPDATE tenants SET reporting_currency_id = $1, updated_at = NOW() WHERE id = $2`,
+		currencyID, tenantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set reporting currency: %w", err)
+	}
+	return s.GetReportingCurrency(tenantID)
+}
+
+// LoadFXRates inserts or replaces daily rates. The load is all or nothing:
+// any invalid rate rejects the whole batch.
+func (s *FXService) LoadFXRates(tenantID int64, rates []FXRateInput) (int, error) {
+	if len(rates) == 0 {
+		return 0, fmt.Errorf("%w: no rates given", ErrInvalidFXRate)
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, rate := range rates {
+		date, err := time.Parse(fxRateDateLayout, rate.Date)
+		if err != nil {
+			return 0, fmt.Errorf("%w: rate %d: date must be YYYY-MM-DD", ErrInvalidFXRate, i+1)
+		}
+		if rate.Rate <= 0 {
+			return 0, fmt.Errorf("%w: rate %d: rate must be positive", ErrInvalidFXRate, i+1)
+		}
+		if strings.EqualFold(rate.BaseCurrency, rate.QuoteCurrency) {
+			return 0, fmt.Errorf("%w: rate %d: base and quote currency are the same", ErrInvalidFXRate, i+1)
+		}
+		baseID, err := s.currencyID(tx, rate.BaseCurrency)
+		if err != nil {
+			return 0, fmt.Errorf("rate %d: %w", i+1, err)
+		}
+		quoteID, err := s.currencyID(tx, rate.QuoteCurrency)
+		if err != nil {
+			return 0, fmt.Errorf("rate %d: %w", i+1, err)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO fx_rates (tenant_id, rate_date, base_currency_id, quote_currency_id, rate)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (tenant_id, base_currency_id, quote_currency_id, rate_date)
+			 DO UPDATE SET rate = EXCLUDED.rate, updated_at = NOW()`,
+			tenantID, date, baseID, quoteID, rate.Rate,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to save FX rate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to save FX rates: %w", err)
+	}
+	return len(rates), nil
+}
+
+// ListFXRates returns loaded rates, newest first, optionally filtered by
+// currency (either side of the pair) and date range
+func (s *FXService) ListFXRates(tenantID int64, currency string, from, to *time.Time, limit, offset int) ([]models.FXRate, error) {
+	query := `
+		SELECT r.id, r.tenant_id, r.rate_date, base.code as base_currency, quote.code as quote_currency,
+		       r.rate, r.created_at, r.updated_at
+		FROM fx_rates r
+		INNER JOIN currencies base ON r.base_currency_id = base.id
+		INNER JOIN currencies quote ON r.quote_currency_id = quote.id
+		WHERE r.tenant_id = $1`
+	args := []interface{}{tenantID}
+	argPos := 2
+
+	if currency != "" {
+		query += fmt.Sprintf(" AND (base.code = $%d OR quote.code = $%d)", argPos, argPos)
+		args = append(args, strings.ToUpper(currency))
+		argPos++
+	}
+	if from != nil {
+		query += fmt.Sprintf(" AND r.rate_date >= $%d", argPos)
+		args = append(args, *from)
+		argPos++
+	}
+	if to != nil {
+		query += fmt.Sprintf(" AND r.rate_date <= $%d", argPos)
+		args = append(args, *to)
+		argPos++
+	}
+	query += fmt.Sprintf(" ORDER BY r.rate_date DESC, base.code, quote.code LIMIT $%d OFFSET $%d", argPos, argPos+1)
+	args = append(args, limit, offset)
+
+	rates := []models.FXRate{}
+	if err := s.db.Select(&rates, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get FX rates: %w", err)
+	}
+	return rates, nil
+}
+
+func (s *FXService) currencyID(q sqlx.Queryer, code string) (int, error) {
+	var id int
+	err := sqlx.Get(q, &id, `SELECT id FROM currencies WHERE code = $1`, strings.ToUpper(code))
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, code)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get currency: %w", err)
+	}
+	return id, nil
+}
+
+// ParseFXRatesCSV reads rates from CSV with a header naming the columns
+// date, base_currency, quote_currency and rate, in any order
+func ParseFXRatesCSV(r io.Reader) ([]FXRateInput, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty CSV", ErrInvalidFXRate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFXRate, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"date", "base_currency", "quote_currency", "rate"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: CSV header is missing %s", ErrInvalidFXRate, name)
+		}
+	}
+
+	var rates []FXRateInput
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFXRate, err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[columns["rate"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: rate is not a number", ErrInvalidFXRate, line)
+		}
+		rates = append(rates, FXRateInput{
+			Date:          strings.TrimSpace(record[columns["date"]]),
+			BaseCurrency:  strings.TrimSpace(record[columns["base_currency"]]),
+			QuoteCurrency: strings.TrimSpace(record[columns["quote_currency"]]),
+			Rate:          rate,
+		})
+	}
+	return rates, nil
+}
+
+// reportingFXRate returns the rate converting an amount in currencyID on the
+// given date into the tenant's reporting currency (1 when none is set)
+func reportingFXRate(q sqlx.Queryer, tenantID int64, currencyID int, on time.Time) (float64, error) {
+	var rate sql.NullFloat64
+	err := sqlx.Get(q, &rate,
+		`SELECT fx_rate(t.id, $2, COALESCE(t.reporting_currency_id, $2), $3::date) FROM tenants t WHERE t.id = $1`,
+		tenantID, currencyID, on.Format(fxRateDateLayout),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get FX rate: %w", err)
+	}
+	if !rate.Valid {
+		var code string
+		_ = sqlx.Get(q, &code, `SELECT code FROM currencies WHERE id = $1`, currencyID)
+		return 0, fmt.Errorf("%w for %s into the reporting currency on or before %s", ErrMissingFXRate, code, on.Format(fxRateDateLayout))
+	}
+	return rate.Float64, nil
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFXRatesCSV(t *testing.T) {
+	rates, err := ParseFXRatesCSV(strings.NewReader("rate,date,base_currency,quote_currency\n0.012, 2024-01-02,INR,USD\n83.1,2024-01-02,USD,INR\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []FXRateInput{
+		{Date: "2024-01-02", BaseCurrency: "INR", QuoteCurrency: "USD", Rate: 0.012},
+		{Date: "2024-01-02", BaseCurrency: "USD", QuoteCurrency: "INR", Rate: 83.1},
+	}, rates)
+
+	_, err = ParseFXRatesCSV(strings.NewReader("date,base_currency,rate\n2024-01-02,INR,0.012\n"))
+	assert.ErrorIs(t, err, ErrInvalidFXRate)
+
+	_, err = ParseFXRatesCSV(strings.NewReader("date,base_currency,quote_currency,rate\n2024-01-02,INR,USD,abc\n"))
+	assert.ErrorIs(t, err, ErrInvalidFXRate)
+}
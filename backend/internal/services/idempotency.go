@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Idempotency keys: a request sent with an Idempotency-Key header is
+// processed once; the same key within IdempotencyKeyTTL replays the response
+// stored for it instead.
+
+// IdempotencyKeyTTL is how long a key's response is replayed
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// idempotencyClaimTimeout is how long a claimed key waits for its response
+// before a retry may claim it again, e.g. after a crash mid-request
+const idempotencyClaimTimeout = 15 * time.Minute
+
+// idempotencyPurgeInterval is how often expired keys are deleted
+const idempotencyPurgeInterval = time.Hour
+
+// maxIdempotencyKeyLength is the longest key accepted
+const maxIdempotencyKeyLength = 255
+
+var (
+	// ErrInvalidIdempotencyKey is returned for a key that is too long
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a
+	// different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+	// ErrIdempotencyKeyInProgress is returned when a key is sent again while
+	// the first request is still being processed
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+// IdempotentResponse is the stored response of a request
+type IdempotentResponse struct {
+	StatusCode  int    `db:"status_code"`
+	ContentType string `db:"content_type"`
+	Body        []byte `db:"response_body"`
+}
+
+// ClaimIdempotencyKey claims a key for a request identified by requestHash.
+// It returns nil when the request should be processed, and the stored
+// response when it has been processed already. An expired key is claimed
+// afresh, as is one whose request never completed.
+func (s *IngestionService) ClaimIdempotencyKey(tenantID int64, key, requestHash string) (*IdempotentResponse, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+
+	var claimed bool
+	err := s.db.Get(&claimed,
+		`INSERT INTO idempotency_keys (tenant_id, idempotency_key, request_hash, expires_at)
+		 VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		 ON CONFLICT (tenant_id, idempotency_key) DO UPDATE
+		 SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = NULL,
+		     response_body = NULL, created_at = NOW(), expires_at = EXCLUDED.expires_at
+		 WHERE idempotency_keys.expires_at <= NOW()
+		    OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at <= NOW() - make_interval(secs => $5))
+		 RETURNING TRUE`,
+		tenantID, key, requestHash, IdempotencyKeyTTL.Seconds(), idempotencyClaimTimeout.Seconds(),
+	)
+	if err == nil && claimed {
+		return nil, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	var stored struct {
+		RequestHash string `db:"request_hash"`
+		StatusCode  *int   `db:"status_code"`
+		ContentType string `db:"content_type"`
+		Body        []byte `db:"response_body"`
+	}
+	err = s.db.Get(&stored,
+		`SELECT request_hash, status_code, COALESCE(content_type, '') as content_type, response_body
+		 FROM idempotency_keys WHERE tenant_id = $1 AND idempotency_key = $2`,
+		tenantID, key,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	if stored.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if stored.StatusCode == nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return &IdempotentResponse{StatusCode: *stored.StatusCode, ContentType: stored.ContentType, Body: stored.Body}, nil
+}
+
+// CompleteIdempotencyKey stores the response of a claimed key for replay
+func (s *IngestionService) CompleteIdempotencyKey(tenantID int64, key string, resp IdempotentResponse) error {
+	_, err := s.db.Exec(
+		`UPDATE idempotency_keys SET status_code = $3, content_type = $4, response_body = $5
+		 WHERE tenant_id = $1 AND idempotency_key = $2`,
+		tenantID, key, resp.StatusCode, resp.ContentType, resp.Body,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey gives up a claimed key, so the request can be retried
+// with it, e.g. after a server error
+func (s *IngestionService) ReleaseIdempotencyKey(tenantID int64, key string) error {
+	_, err := s.db.Exec(
+		`DELETE FROM idempotency_keys WHERE tenant_id = $1 AND idempotency_key = $2 AND status_code IS NULL`,
+		tenantID, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes expired keys and returns how many
+func (s *IngestionService) PurgeExpiredIdempotencyKeys() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// IdempotencyKeyPurger deletes expired idempotency keys in the background.
+// An expired key is reclaimed if it is sent again, but most never are.
+type IdempotencyKeyPurger struct {
+	svc      *IngestionService
+	interval time.Duration
+	logger   *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewIdempotencyKeyPurger(svc *IngestionService, interval time.Duration, logger *zap.Logger) *IdempotencyKeyPurger {
+	if interval <= 0 {
+		interval = idempotencyPurgeInterval
+	}
+	return &IdempotencyKeyPurger{svc: svc, interval: interval, logger: logger}
+}
+
+// Start launches the purge loop
+func (p *IdempotencyKeyPurger) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.wg.Add(1)
+	go p.run(ctx)
+}
+
+// Stop stops the purge loop and waits for it to exit
+func (p *IdempotencyKeyPurger) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *IdempotencyKeyPurger) run(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := p.svc.PurgeExpiredIdempotencyKeys()
+		if err != nil {
+			p.logger.Error("Failed to purge idempotency keys", zap.Error(err))
+			continue
+		}
+		if purged > 0 {
+			p.logger.Info("Purged expired idempotency keys", zap.Int64("keys", purged))
+		}
+	}
+}
@@ -0,0 +1,638 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+const (
+	// importChunkSize rows are ingested in one batch, and progress is saved
+	// after each
+	importChunkSize = 1000
+	// maxDryRunErrors caps the row errors a dry run returns
+	maxDryRunErrors = 1000
+	// Running imports save progress after every chunk. Imports not updated
+	// for importStaleAfter are assumed to belong to a crashed worker and are
+	// picked up again where they stopped.
+	importStaleAfter = 5 * time.Minute
+)
+
+// ErrImportNotFound is returned when an import does not exist for the tenant
+var ErrImportNotFound = errors.New("import not found")
+
+// ImportJob is an uploaded file and its progress through ingestion
+type ImportJob struct {
+	ID              int64          `db:"id" json:"id"`
+	TenantID        int64          `db:"tenant_id" json:"tenant_id"`
+	Entity          string         `db:"entity" json:"entity"`
+	Format          string         `db:"format" json:"format"`
+	FileName        string         `db:"file_name" json:"file_name"`
+	Mapping         []byte         `db:"mapping" json:"-"`
+	Header          pq.StringArray `db:"header" json:"-"`
+	Status          string         `db:"status" json:"status"`
+	TotalRows       int            `db:"total_rows" json:"total_rows"`
+	ProcessedRows   int            `db:"processed_rows" json:"processed_rows"`
+	CreatedRows     int            `db:"created_rows" json:"created_rows"`
+	UpdatedRows     int            `db:"updated_rows" json:"updated_rows"`
+	UnchangedRows   int            `db:"unchanged_rows" json:"unchanged_rows"`
+	RejectedRows    int            `db:"rejected_rows" json:"rejected_rows"`
+	ProgressPercent float64        `db:"-" json:"progress_percent"`
+	ErrorMessage    *string        `db:"error_message" json:"error_message,omitempty"`
+	QueuedAt        time.Time      `db:"queued_at" json:"queued_at"`
+	StartedAt       *time.Time     `db:"started_at" json:"started_at"`
+	CompletedAt     *time.Time     `db:"completed_at" json:"completed_at"`
+	CreatedAt       time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// importJobColumns selects an ImportJob, without the file itself
+const importJobColumns = `id, tenant_id, entity, format, file_name, mapping, header, status,
+	total_rows, processed_rows, created_rows, updated_rows, unchanged_rows, rejected_rows, error_message,
+	queued_at, started_at, completed_at, created_at, updated_at`
+
+// ImportRowError is why a row of an import file can't be ingested
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportDryRun is the outcome of validating an import file without
+// ingesting it
+type ImportDryRun struct {
+	Entity          string           `json:"entity"`
+	Format          string           `json:"format"`
+	TotalRows       int              `json:"total_rows"`
+	ValidRows       int              `json:"valid_rows"`
+	RejectedRows    int              `json:"rejected_rows"`
+	Errors          []ImportRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated"`
+}
+
+// ImportService stores uploaded files and ingests them in the background
+type ImportService struct {
+	db           *sqlx.DB
+	ingestionSvc *IngestionService
+	// wake signals idle import workers that a file was queued
+	wake chan struct{}
+}
+
+func NewImportService(db *sqlx.DB, ingestionSvc *IngestionService) *ImportService {
+	return &ImportService{db: db, ingestionSvc: ingestionSvc, wake: make(chan struct{}, 1)}
+}
+
+// importRequests are the rows of a chunk mapped onto requests, with the
+// position in the chunk of the row each request came from
+type importRequests struct {
+	rows         []int
+	interactions []IngestInteractionRequest
+	conversions  []IngestConversionRequest
+}
+
+// mapRows maps a chunk of rows onto requests and returns why each row that
+// couldn't be mapped was rejected
+func (s importSpec) mapRows(rows []importRow) (importRequests, []string) {
+	var mapped importRequests
+	reasons := make([]string, len(rows))
+	for i, row := range rows {
+		if row.Err != "" {
+			reasons[i] = row.Err
+			continue
+		}
+		var err error
+		if s.Entity == ImportEntityInteractions {
+			var req IngestInteractionRequest
+			if req, err = s.interactionRequest(row); err == nil {
+				mapped.interactions = append(mapped.interactions, req)
+			}
+		} else {
+			var req IngestConversionRequest
+			if req, err = s.conversionRequest(row); err == nil {
+				mapped.conversions = append(mapped.conversions, req)
+			}
+		}
+		if err != nil {
+			reasons[i] = err.Error()
+			continue
+		}
+		mapped.rows = append(mapped.rows, i)
+	}
+	return mapped, reasons
+}
+
+// eachChunk calls fn with the file's rows from row index skip onwards, in
+// chunks of importChunkSize
+func (s importSpec) eachChunk(data []byte, skip int, fn func([]importRow) error) error {
+	var chunk []importRow
+	err := s.readImportRows(data, func(row importRow) error {
+		if row.Index < skip {
+			return nil
+		}
+		chunk = append(chunk, row)
+		if len(chunk) < importChunkSize {
+			return nil
+		}
+		err := fn(chunk)
+		chunk = nil
+		return err
+	})
+	if err == nil && len(chunk) > 0 {
+		err = fn(chunk)
+	}
+	return err
+}
+
+// DryRunImport validates every row of a file the way ingestion would,
+// without storing anything. Rows already ingested are valid; they would
+// update the stored records.
+func (s *ImportService) DryRunImport(tenantID int64, entity, format, fileName string, mapping ImportMapping, data []byte) (*ImportDryRun, error) {
+	spec, err := newImportSpec(entity, format, fileName, mapping, data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportDryRun{Entity: spec.Entity, Format: spec.Format, Errors: []ImportRowError{}}
+	err = spec.eachChunk(data, 0, func(rows []importRow) error {
+		mapped, reasons := spec.mapRows(rows)
+		if len(mapped.interactions) > 0 {
+			lookups, err := loadInteractionLookups(s.db, tenantID, mapped.interactions)
+			if err != nil {
+				return err
+			}
+			for k, req := range mapped.interactions {
+				reasons[mapped.rows[k]] = lookups.reject(req)
+			}
+		}
+		if len(mapped.conversions) > 0 {
+			lookups, err := loadConversionLookups(s.db, tenantID, mapped.conversions)
+			if err != nil {
+				return err
+			}
+			for k, req := range mapped.conversions {
+				reasons[mapped.rows[k]] = lookups.reject(req)
+			}
+		}
+
+		for i, reason := range reasons {
+			result.TotalRows++
+			if reason == "" {
+				result.ValidRows++
+				continue
+			}
+			result.RejectedRows++
+			if len(result.Errors) < maxDryRunErrors {
+				result.Errors = append(result.Errors, ImportRowError{Line: rows[i].Line, Error: reason})
+			} else {
+				result.ErrorsTruncated = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CreateImport checks a file and its mapping and queues it for ingestion
+func (s *ImportService) CreateImport(tenantID int64, entity, format, fileName string, mapping ImportMapping, data []byte) (*ImportJob, error) {
+	spec, err := newImportSpec(entity, format, fileName, mapping, data)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	if err := spec.readImportRows(data, func(importRow) error { total++; return nil }); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: the file has no rows", ErrInvalidImport)
+	}
+	mappingJSON, err := json.Marshal(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode mapping: %w", err)
+	}
+
+	var id int64
+	err = s.db.Get(&id,
+		`INSERT INTO import_jobs (tenant_id, entity, format, file_name, mapping, header, file_content, total_rows)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING id`,
+		tenantID, spec.Entity, spec.Format, fileName, mappingJSON, pq.StringArray(spec.Header), data, total,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create import: %w", err)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return s.GetImport(tenantID, id)
+}
+
+// setImportProgressPercent fills in the import's percent complete
+func setImportProgressPercent(job *ImportJob) {
+	switch {
+	case job.Status == "completed":
+		job.ProgressPercent = 100
+	case job.TotalRows > 0:
+		percent := float64(job.ProcessedRows) / float64(job.TotalRows) * 100
+		job.ProgressPercent = math.Round(percent*100) / 100
+	}
+}
+
+// GetImport returns an import with its progress
+func (s *ImportService) GetImport(tenantID, id int64) (*ImportJob, error) {
+	var job ImportJob
+	err := s.db.Get(&job, `SELECT `+importJobColumns+` FROM import_jobs WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrImportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import: %w", err)
+	}
+	setImportProgressPercent(&job)
+	return &job, nil
+}
+
+// ListImports lists a tenant's imports, newest first
+func (s *ImportService) ListImports(tenantID int64, limit, offset int) ([]ImportJob, error) {
+	var jobs []ImportJob
+	err := s.db.Select(&jobs,
+		`SELECT `+importJobColumns+` FROM import_jobs WHERE tenant_id = $1
+		 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`,
+		tenantID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list imports: %w", err)
+	}
+	for i := range jobs {
+		setImportProgressPercent(&jobs[i])
+	}
+	return jobs, nil
+}
+
+// WriteRejectedRows writes the rows of an import that weren't ingested in the
+// import's own format, so they can be fixed and uploaded again. Each row gets
+// its line number and reason: CSV files gain import_line and import_error
+// columns, NDJSON objects gain those keys.
+func (s *ImportService) WriteRejectedRows(job *ImportJob, w io.Writer) error {
+	rows, err := s.db.Queryx(
+		`SELECT line_number, raw_row, reason FROM import_job_rejections
+		 WHERE import_job_id = $1 ORDER BY row_index`,
+		job.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get rejected rows: %w", err)
+	}
+	defer rows.Close()
+
+	writer := newRejectedRowWriter(job.Format, job.Header, w)
+	for rows.Next() {
+		var line int
+		var raw, reason string
+		if err := rows.Scan(&line, &raw, &reason); err != nil {
+			return fmt.Errorf("failed to read rejected row: %w", err)
+		}
+		if err := writer.write(line, raw, reason); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read rejected rows: %w", err)
+	}
+	return writer.flush()
+}
+
+// rejectedRowWriter writes rejected rows back out in their file's format
+type rejectedRowWriter struct {
+	format string
+	header []string
+	csv    *csv.Writer
+	w      io.Writer
+}
+
+func newRejectedRowWriter(format string, header []string, w io.Writer) *rejectedRowWriter {
+	writer := &rejectedRowWriter{format: format, header: header, w: w}
+	if format == ImportFormatCSV {
+		writer.csv = csv.NewWriter(w)
+	}
+	return writer
+}
+
+func (r *rejectedRowWriter) write(line int, raw, reason string) error {
+	if r.csv != nil {
+		if r.header != nil {
+			if err := r.csv.Write(append(append([]string{}, r.header...), "import_line", "import_error")); err != nil {
+				return err
+			}
+			r.header = nil
+		}
+		var fields []string
+		if raw != "" {
+			reader := csv.NewReader(strings.NewReader(raw))
+			reader.FieldsPerRecord = -1
+			reader.LazyQuotes = true
+			fields, _ = reader.Read()
+		}
+		return r.csv.Write(append(fields, fmt.Sprint(line), reason))
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		object = map[string]interface{}{"import_raw": raw}
+	}
+	object["import_line"] = line
+	object["import_error"] = reason
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", encoded)
+	return err
+}
+
+func (r *rejectedRowWriter) flush() error {
+	if r.csv == nil {
+		return nil
+	}
+	if r.header != nil {
+		if err := r.csv.Write(append(append([]string{}, r.header...), "import_line", "import_error")); err != nil {
+			return err
+		}
+	}
+	r.csv.Flush()
+	return r.csv.Error()
+}
+
+// claimQueuedImport marks the oldest queued import (or a running import whose
+// worker stopped saving progress) as running and returns its ID
+func (s *ImportService) claimQueuedImport() (int64, bool, error) {
+	var id int64
+	err := s.db.Get(&id,
+		`UPDATE import_jobs
+		 SET status = 'running', started_at = COALESCE(started_at, NOW()), updated_at = NOW()
+		 WHERE id = (
+			SELECT id FROM import_jobs
+			WHERE status = 'queued' OR (status = 'running' AND updated_at < LOCALTIMESTAMP - make_interval(secs => $1))
+			ORDER BY queued_at, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		 )
+		 RETURNING id`,
+		importStaleAfter.Seconds(),
+	)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to claim import: %w", err)
+	}
+	return id, true, nil
+}
+
+// importChunkResult is the outcome of ingesting a chunk of rows
+type importChunkResult struct {
+	created   int
+	updated   int
+	unchanged int
+	// reasons holds why each row of the chunk was rejected, or ""
+	reasons []string
+}
+
+// ingestImportChunk ingests a chunk of rows through batch ingestion
+func (s *ImportService) ingestImportChunk(tenantID int64, spec importSpec, rows []importRow) (*importChunkResult, error) {
+	mapped, reasons := spec.mapRows(rows)
+	result := &importChunkResult{reasons: reasons}
+	if len(mapped.rows) == 0 {
+		return result, nil
+	}
+
+	var resp *BatchIngestResponse
+	var err error
+	if spec.Entity == ImportEntityInteractions {
+		resp, err = s.ingestionSvc.IngestInteractionBatch(tenantID, mapped.interactions)
+	} else {
+		resp, err = s.ingestionSvc.IngestConversionBatch(tenantID, mapped.conversions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, record := range resp.Results {
+		switch record.Status {
+		case BatchRecordCreated:
+			result.created++
+		case BatchRecordUpdated:
+			result.updated++
+		case BatchRecordUnchanged:
+			result.unchanged++
+		default:
+			reasons[mapped.rows[k]] = record.Reason
+		}
+	}
+	return result, nil
+}
+
+// saveImportProgress stores a chunk's rejected rows and adds its counts to
+// the import
+func (s *ImportService) saveImportProgress(jobID int64, rows []importRow, result *importChunkResult) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var args []interface{}
+	for i, reason := range result.reasons {
+		if reason != "" {
+			args = append(args, jobID, rows[i].Index, rows[i].Line, rows[i].Raw, reason)
+		}
+	}
+	rejected := len(args) / 5
+	if rejected > 0 {
+		_, err = tx.Exec(
+			`INSERT INTO import_job_rejections (import_job_id, row_index, line_number, raw_row, reason)
+			 VALUES `+valuesPlaceholders(rejected, 5),
+			args...,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save rejected rows: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE import_jobs
+		 SET processed_rows = processed_rows + $1, created_rows = created_rows + $2,
+		     updated_rows = updated_rows + $3, unchanged_rows = unchanged_rows + $4,
+		     rejected_rows = rejected_rows + $5, updated_at = NOW()
+		 WHERE id = $6`,
+		len(rows), result.created, result.updated, result.unchanged, rejected, jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save import progress: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ExecuteImport ingests a claimed import from the first row it hasn't
+// processed. When ctx is cancelled the import goes back on the queue after
+// the chunk in progress.
+func (s *ImportService) ExecuteImport(ctx context.Context, id int64) error {
+	var job struct {
+		ImportJob
+		Content []byte `db:"file_content"`
+	}
+	err := s.db.Get(&job, `SELECT `+importJobColumns+`, file_content FROM import_jobs WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("import not found: %w", err)
+	}
+
+	spec := importSpec{Entity: job.Entity, Format: job.Format, Header: job.Header}
+	if err := json.Unmarshal(job.Mapping, &spec.Mapping); err != nil {
+		err = fmt.Errorf("invalid mapping: %w", err)
+		if finishErr := s.finishImport(id, "failed", err); finishErr != nil {
+			return finishErr
+		}
+		return err
+	}
+
+	// Rejections saved past processed_rows belong to a chunk whose progress
+	// was never saved; the chunk is ingested again
+	_, err = s.db.Exec(`DELETE FROM import_job_rejections WHERE import_job_id = $1 AND row_index >= $2`, id, job.ProcessedRows)
+	if err != nil {
+		return fmt.Errorf("failed to clear rejected rows: %w", err)
+	}
+
+	err = spec.eachChunk(job.Content, job.ProcessedRows, func(rows []importRow) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result, err := s.ingestImportChunk(job.TenantID, spec, rows)
+		if err != nil {
+			return err
+		}
+		return s.saveImportProgress(id, rows, result)
+	})
+	if ctx.Err() != nil {
+		_, err := s.db.Exec(`UPDATE import_jobs SET status = 'queued', updated_at = NOW() WHERE id = $1 AND status = 'running'`, id)
+		if err != nil {
+			return fmt.Errorf("failed to requeue import: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		if finishErr := s.finishImport(id, "failed", err); finishErr != nil {
+			return finishErr
+		}
+		return err
+	}
+	return s.finishImport(id, "completed", nil)
+}
+
+// finishImport sets the final status of an import
+func (s *ImportService) finishImport(id int64, status string, cause error) error {
+	var message *string
+	if cause != nil {
+		text := cause.Error()
+		message = &text
+	}
+	_, err := s.db.Exec(
+		`UPDATE import_jobs SET status = $1, error_message = $2, completed_at = NOW(), updated_at = NOW() WHERE id = $3`,
+		status, message, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update import status: %w", err)
+	}
+	return nil
+}
+
+// ImportJobRunner ingests queued imports on a pool of background workers.
+// Imports are claimed with FOR UPDATE SKIP LOCKED, so several API instances
+// can share the queue.
+type ImportJobRunner struct {
+	svc          *ImportService
+	workers      int
+	pollInterval time.Duration
+	logger       *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewImportJobRunner(svc *ImportService, workers int, pollInterval time.Duration, logger *zap.Logger) *ImportJobRunner {
+	if workers < 1 {
+		workers = 1
+	}
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+	return &ImportJobRunner{svc: svc, workers: workers, pollInterval: pollInterval, logger: logger}
+}
+
+// Start launches the workers
+func (r *ImportJobRunner) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go r.work(ctx, i)
+	}
+	r.logger.Info("Import job runner started", zap.Int("workers", r.workers))
+}
+
+// Stop stops the workers and waits for them to exit. Imports in progress are
+// put back on the queue.
+func (r *ImportJobRunner) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+	r.logger.Info("Import job runner stopped")
+}
+
+func (r *ImportJobRunner) work(ctx context.Context, worker int) {
+	defer r.wg.Done()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		id, ok, err := r.svc.claimQueuedImport()
+		if err != nil {
+			r.logger.Error("Failed to claim import", zap.Int("worker", worker), zap.Error(err))
+		}
+		if ok {
+			started := time.Now()
+			r.logger.Info("Import started", zap.Int("worker", worker), zap.Int64("import_id", id))
+			if err := r.svc.ExecuteImport(ctx, id); err != nil {
+				r.logger.Error("Import failed", zap.Int64("import_id", id), zap.Error(err))
+			} else {
+				r.logger.Info("Import finished", zap.Int64("import_id", id), zap.Duration("duration", time.Since(started)))
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.svc.wake:
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
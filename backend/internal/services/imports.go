@@ -0,0 +1,482 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+)
+
+// File imports: interactions or conversion events uploaded as CSV or NDJSON
+// files are mapped row by row onto ingestion requests and ingested in the
+// background through batch ingestion.
+
+const (
+	ImportEntityInteractions = "interactions"
+	ImportEntityConversions  = "conversions"
+
+	ImportFormatCSV    = "csv"
+	ImportFormatNDJSON = "ndjson"
+)
+
+const (
+	// MaxImportFileSize is the largest file accepted for import
+	MaxImportFileSize = 100 << 20
+	// maxImportLineSize is the longest NDJSON line accepted
+	maxImportLineSize = 1 << 20
+)
+
+// ErrInvalidImport is returned for an import file or mapping that can't be
+// used
+var ErrInvalidImport = errors.New("invalid import")
+
+// customerIdentifierField prefixes the import fields holding customer
+// identifiers, e.g. customer_identifier.phone
+const customerIdentifierField = "customer_identifier."
+
+// importFields are the fields an import row maps onto, by entity
+var importFields = map[string][]string{
+	ImportEntityInteractions: {
+		"external_interaction_id", "channel", "vendor_code", "started_at", "ended_at",
+		"direction", "language", "transcript_url", "primary_intent", "secondary_intents",
+		"outcome_prediction", "purchase_probability", "external_campaign_id",
+		"is_view_through", "ad_viewed_at", "ad_platform", "agent_id", "agent_role",
+	},
+	ImportEntityConversions: {
+		"external_event_id", "event_source", "event_type", "product_external_id",
+		"currency", "amount_decimal", "occurred_at", "original_external_event_id",
+	},
+}
+
+// requiredImportFields must be mapped, defaulted or present in a CSV header
+var requiredImportFields = map[string][]string{
+	ImportEntityInteractions: {"external_interaction_id", "channel", "started_at"},
+	ImportEntityConversions:  {"external_event_id", "event_source", "event_type", "currency", "occurred_at"},
+}
+
+// importTimeLayouts are tried, after the mapping's own layout, to parse times
+var importTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ImportMapping maps the columns of an import file onto the fields of an
+// ingestion request. A field not in Columns is read from the column of the
+// same name, and Defaults fill fields a row leaves empty. NDJSON files
+// without a mapping are read as ingestion requests as they are.
+type ImportMapping struct {
+	// Columns maps fields to the file's columns (CSV) or keys (NDJSON)
+	Columns map[string]string `json:"columns"`
+	// Defaults are constant values for fields, e.g. {"currency": "INR"}
+	Defaults map[string]string `json:"defaults"`
+	// TimeLayout is a Go time layout for the file's timestamps; RFC 3339 and
+	// "2006-01-02 15:04:05" are always accepted
+	TimeLayout string `json:"time_layout,omitempty"`
+}
+
+func (m ImportMapping) empty() bool {
+	return len(m.Columns) == 0 && len(m.Defaults) == 0 && m.TimeLayout == ""
+}
+
+// column is the column a field is read from
+func (m ImportMapping) column(field string) string {
+	if column, ok := m.Columns[field]; ok {
+		return column
+	}
+	return field
+}
+
+// importSpec describes how an import file is read
+type importSpec struct {
+	Entity  string
+	Format  string
+	Mapping ImportMapping
+	// Header is a CSV file's header row
+	Header []string
+}
+
+// native reports whether rows are decoded as ingestion requests as they are
+func (s importSpec) native() bool {
+	return s.Format == ImportFormatNDJSON && s.Mapping.empty()
+}
+
+// newImportSpec checks an import's entity, format (inferred from the file
+// name when empty) and mapping against the file
+func newImportSpec(entity, format, fileName string, mapping ImportMapping, data []byte) (*importSpec, error) {
+	if _, ok := importFields[entity]; !ok {
+		return nil, fmt.Errorf("%w: entity must be %s or %s", ErrInvalidImport, ImportEntityInteractions, ImportEntityConversions)
+	}
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".csv":
+			format = ImportFormatCSV
+		case ".ndjson", ".jsonl":
+			format = ImportFormatNDJSON
+		}
+	}
+	if format != ImportFormatCSV && format != ImportFormatNDJSON {
+		return nil, fmt.Errorf("%w: format must be %s or %s", ErrInvalidImport, ImportFormatCSV, ImportFormatNDJSON)
+	}
+	if len(data) > MaxImportFileSize {
+		return nil, fmt.Errorf("%w: file is larger than %d MB", ErrInvalidImport, MaxImportFileSize>>20)
+	}
+
+	spec := &importSpec{Entity: entity, Format: format, Mapping: mapping}
+	if format == ImportFormatCSV {
+		header, err := csv.NewReader(bytes.NewReader(data)).Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: empty CSV", ErrInvalidImport)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+		}
+		for i := range header {
+			header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+		}
+		spec.Header = header
+	}
+	if err := spec.validateMapping(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// validateMapping checks the mapping names known fields and, for CSV files,
+// columns of the header and every required field
+func (s importSpec) validateMapping() error {
+	known := func(field string) bool {
+		if strings.HasPrefix(field, customerIdentifierField) {
+			return len(field) > len(customerIdentifierField)
+		}
+		return containsString(importFields[s.Entity], field)
+	}
+	for field, column := range s.Mapping.Columns {
+		if !known(field) {
+			return fmt.Errorf("%w: unknown field %s", ErrInvalidImport, field)
+		}
+		if s.Header != nil && !containsString(s.Header, column) {
+			return fmt.Errorf("%w: column %q mapped to %s is not in the file", ErrInvalidImport, column, field)
+		}
+	}
+	for field := range s.Mapping.Defaults {
+		if !known(field) {
+			return fmt.Errorf("%w: unknown field %s", ErrInvalidImport, field)
+		}
+	}
+	if s.Header == nil {
+		return nil
+	}
+	for _, field := range requiredImportFields[s.Entity] {
+		if _, ok := s.Mapping.Defaults[field]; ok {
+			continue
+		}
+		if !containsString(s.Header, s.Mapping.column(field)) {
+			return fmt.Errorf("%w: no column for required field %s", ErrInvalidImport, field)
+		}
+	}
+	return nil
+}
+
+// importRow is a data row of an import file
+type importRow struct {
+	// Index counts data rows from 0; Line is where the row starts in the file
+	Index int
+	Line  int
+	// Raw is the row as it appears in the file
+	Raw    string
+	Values map[string]string
+	JSON   []byte
+	// Err is set for rows that can't be parsed
+	Err string
+}
+
+// readImportRows calls fn for each data row of the file, in order
+func (s importSpec) readImportRows(data []byte, fn func(importRow) error) error {
+	if s.Format == ImportFormatCSV {
+		return s.readCSVRows(data, fn)
+	}
+	return s.readNDJSONRows(data, fn)
+}
+
+func (s importSpec) readCSVRows(data []byte, fn func(importRow) error) error {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if _, err := reader.Read(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	for index := 0; ; index++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		row := importRow{Index: index}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return fmt.Errorf("%w: %v", ErrInvalidImport, err)
+			}
+			row.Line = parseErr.StartLine
+			row.Err = parseErr.Err.Error()
+		} else {
+			row.Line, _ = reader.FieldPos(0)
+			row.Raw = csvLine(record)
+			if len(record) != len(s.Header) {
+				row.Err = fmt.Sprintf("expected %d columns, got %d", len(s.Header), len(record))
+			} else {
+				row.Values = make(map[string]string, len(record))
+				for i, value := range record {
+					row.Values[s.Header[i]] = value
+				}
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+func (s importSpec) readNDJSONRows(data []byte, fn func(importRow) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+
+	index := 0
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if raw == "" {
+			continue
+		}
+		row := importRow{Index: index, Line: line, Raw: raw, JSON: []byte(raw)}
+		index++
+
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.UseNumber()
+		var values map[string]interface{}
+		if err := decoder.Decode(&values); err != nil {
+			row.Err = "invalid JSON: " + err.Error()
+		} else {
+			row.Values = make(map[string]string, len(values))
+			for key, value := range values {
+				row.Values[key] = jsonValueString(value)
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	return nil
+}
+
+// jsonValueString is an NDJSON value as it would appear in a CSV cell
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// csvLine encodes a record as a CSV line without the line break
+func csvLine(record []string) string {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(record)
+	w.Flush()
+	return strings.TrimRight(b.String(), "\r\n")
+}
+
+// importValues reads the mapped fields of a row
+type importValues struct {
+	spec importSpec
+	row  importRow
+	err  error
+}
+
+func (v *importValues) text(field string) string {
+	if value := strings.TrimSpace(v.row.Values[v.spec.Mapping.column(field)]); value != "" {
+		return value
+	}
+	return v.spec.Mapping.Defaults[field]
+}
+
+func (v *importValues) optionalText(field string) *string {
+	if value := v.text(field); value != "" {
+		return &value
+	}
+	return nil
+}
+
+func (v *importValues) time(field string) *time.Time {
+	value := v.text(field)
+	if value == "" {
+		return nil
+	}
+	layouts := importTimeLayouts
+	if v.spec.Mapping.TimeLayout != "" {
+		layouts = append([]string{v.spec.Mapping.TimeLayout}, layouts...)
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t
+		}
+	}
+	v.fail("%s: %q is not a time", field, value)
+	return nil
+}
+
+func (v *importValues) number(field string) *float64 {
+	value := strings.ReplaceAll(v.text(field), ",", "")
+	if value == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		v.fail("%s: %q is not a number", field, value)
+		return nil
+	}
+	return &f
+}
+
+func (v *importValues) boolean(field string) bool {
+	value := v.text(field)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(strings.ToLower(value))
+	if err != nil {
+		v.fail("%s: %q is not true or false", field, value)
+	}
+	return b
+}
+
+// identifiers reads the customer_identifier.<type> fields that are mapped,
+// defaulted or named by a column
+func (v *importValues) identifiers() []models.CustomerIdentifier {
+	types := map[string]bool{}
+	for field := range v.spec.Mapping.Columns {
+		types[field] = true
+	}
+	for field := range v.spec.Mapping.Defaults {
+		types[field] = true
+	}
+	for column := range v.row.Values {
+		types[column] = true
+	}
+	var fields []string
+	for field := range types {
+		if strings.HasPrefix(field, customerIdentifierField) && len(field) > len(customerIdentifierField) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	var identifiers []models.CustomerIdentifier
+	for _, field := range fields {
+		if value := v.text(field); value != "" {
+			identifiers = append(identifiers, models.CustomerIdentifier{
+				Type:         strings.TrimPrefix(field, customerIdentifierField),
+				Value:        value,
+				SourceSystem: "import",
+			})
+		}
+	}
+	return identifiers
+}
+
+func (v *importValues) fail(format string, args ...interface{}) {
+	if v.err == nil {
+		v.err = fmt.Errorf(format, args...)
+	}
+}
+
+// interactionRequest maps a row onto an interaction
+func (s importSpec) interactionRequest(row importRow) (IngestInteractionRequest, error) {
+	var req IngestInteractionRequest
+	if s.native() {
+		err := json.Unmarshal(row.JSON, &req)
+		return req, err
+	}
+
+	v := &importValues{spec: s, row: row}
+	req = IngestInteractionRequest{
+		ExternalInteractionID: v.text("external_interaction_id"),
+		Channel:               v.text("channel"),
+		VendorCode:            v.optionalText("vendor_code"),
+		CustomerIdentifiers:   v.identifiers(),
+		EndedAt:               v.time("ended_at"),
+		Direction:             v.text("direction"),
+		Language:              v.text("language"),
+		TranscriptURL:         v.text("transcript_url"),
+		PrimaryIntent:         v.text("primary_intent"),
+		OutcomePrediction:     v.text("outcome_prediction"),
+		PurchaseProbability:   v.number("purchase_probability"),
+		IsViewThrough:         v.boolean("is_view_through"),
+		AdViewedAt:            v.time("ad_viewed_at"),
+		AdPlatform:            v.text("ad_platform"),
+		ExternalCampaignID:    v.optionalText("external_campaign_id"),
+	}
+	if startedAt := v.time("started_at"); startedAt != nil {
+		req.StartedAt = *startedAt
+	}
+	if intents := v.text("secondary_intents"); intents != "" {
+		for _, intent := range strings.Split(intents, "|") {
+			if intent = strings.TrimSpace(intent); intent != "" {
+				req.SecondaryIntents = append(req.SecondaryIntents, intent)
+			}
+		}
+	}
+	if agentID := v.optionalText("agent_id"); agentID != nil {
+		req.Participants = []InteractionParticipantRequest{{
+			ParticipantType: "agent",
+			ExternalAgentID: agentID,
+			Role:            v.text("agent_role"),
+		}}
+	}
+	return req, v.err
+}
+
+// conversionRequest maps a row onto a conversion event
+func (s importSpec) conversionRequest(row importRow) (IngestConversionRequest, error) {
+	var req IngestConversionRequest
+	if s.native() {
+		err := json.Unmarshal(row.JSON, &req)
+		return req, err
+	}
+
+	v := &importValues{spec: s, row: row}
+	req = IngestConversionRequest{
+		EventSource:             v.text("event_source"),
+		ExternalEventID:         v.text("external_event_id"),
+		CustomerIdentifiers:     v.identifiers(),
+		EventType:               v.text("event_type"),
+		ProductExternalID:       v.optionalText("product_external_id"),
+		Currency:                v.text("currency"),
+		OriginalExternalEventID: v.optionalText("original_external_event_id"),
+	}
+	if amount := v.number("amount_decimal"); amount != nil {
+		req.AmountDecimal = *amount
+	}
+	if occurredAt := v.time("occurred_at"); occurredAt != nil {
+		req.OccurredAt = *occurredAt
+	}
+	return req, v.err
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readRows(t *testing.T, spec *importSpec, data []byte) []importRow {
+	var rows []importRow
+	require.NoError(t, spec.readImportRows(data, func(row importRow) error {
+		rows = append(rows, row)
+		return nil
+	}))
+	return rows
+}
+
+func TestImportCSVMapping(t *testing.T) {
+	data := []byte("Order No,Phone,Amount,Date,Kind\n" +
+		"A-1,9876543210,\"1,250.50\",2024-03-05 10:30:00,purchase\n" +
+		"\n" +
+		"A-2,,abc,2024-03-06,purchase\n" +
+		"A-3,9876543211\n")
+	mapping := ImportMapping{
+		Columns: map[string]string{
+			"external_event_id":         "Order No",
+			"customer_identifier.phone": "Phone",
+			"amount_decimal":            "Amount",
+			"occurred_at":               "Date",
+			"event_type":                "Kind",
+		},
+		Defaults: map[string]string{"event_source": "billing", "currency": "INR"},
+	}
+
+	spec, err := newImportSpec(ImportEntityConversions, "", "orders.csv", mapping, data)
+	require.NoError(t, err)
+	assert.Equal(t, ImportFormatCSV, spec.Format)
+	assert.Equal(t, []string{"Order No", "Phone", "Amount", "Date", "Kind"}, spec.Header)
+
+	rows := readRows(t, spec, data)
+	require.Len(t, rows, 3)
+	assert.Equal(t, []int{2, 4, 5}, []int{rows[0].Line, rows[1].Line, rows[2].Line})
+	assert.Equal(t, "expected 5 columns, got 2", rows[2].Err)
+
+	req, err := spec.conversionRequest(rows[0])
+	require.NoError(t, err)
+	assert.Equal(t, "A-1", req.ExternalEventID)
+	assert.Equal(t, "billing", req.EventSource)
+	assert.Equal(t, "INR", req.Currency)
+	assert.Equal(t, 1250.5, req.AmountDecimal)
+	assert.Equal(t, time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC), req.OccurredAt)
+	require.Len(t, req.CustomerIdentifiers, 1)
+	assert.Equal(t, "phone", req.CustomerIdentifiers[0].Type)
+	assert.Equal(t, "9876543210", req.CustomerIdentifiers[0].Value)
+
+	_, err = spec.conversionRequest(rows[1])
+	assert.EqualError(t, err, `amount_decimal: "abc" is not a number`)
+
+	mapped, reasons := spec.mapRows(rows)
+	assert.Equal(t, []int{0}, mapped.rows)
+	assert.Equal(t, []string{"", `amount_decimal: "abc" is not a number`, "expected 5 columns, got 2"}, reasons)
+}
+
+func TestImportMappingValidation(t *testing.T) {
+	data := []byte("id,channel,started\n1,Voice,2024-01-01\n")
+
+	_, err := newImportSpec("customers", "", "calls.csv", ImportMapping{}, data)
+	assert.ErrorIs(t, err, ErrInvalidImport)
+	_, err = newImportSpec(ImportEntityInteractions, "", "calls.xlsx", ImportMapping{}, data)
+	assert.ErrorIs(t, err, ErrInvalidImport)
+
+	// started_at has no column
+	_, err = newImportSpec(ImportEntityInteractions, "", "calls.csv",
+		ImportMapping{Columns: map[string]string{"external_interaction_id": "id"}}, data)
+	assert.ErrorContains(t, err, "required field started_at")
+
+	_, err = newImportSpec(ImportEntityInteractions, "", "calls.csv",
+		ImportMapping{Columns: map[string]string{"external_interaction_id": "id", "started_at": "start"}}, data)
+	assert.ErrorContains(t, err, `column "start"`)
+
+	_, err = newImportSpec(ImportEntityInteractions, "", "calls.csv",
+		ImportMapping{Columns: map[string]string{"amount_decimal": "id"}}, data)
+	assert.ErrorContains(t, err, "unknown field amount_decimal")
+
+	spec, err := newImportSpec(ImportEntityInteractions, "", "calls.csv",
+		ImportMapping{Columns: map[string]string{"external_interaction_id": "id", "started_at": "started"}}, data)
+	require.NoError(t, err)
+	req, err := spec.interactionRequest(readRows(t, spec, data)[0])
+	require.NoError(t, err)
+	assert.Equal(t, "1", req.ExternalInteractionID)
+	assert.Equal(t, "Voice", req.Channel)
+}
+
+func TestImportNDJSON(t *testing.T) {
+	data := []byte(`{"external_interaction_id":"c-1","channel":"Voice","started_at":"2024-01-01T09:00:00Z","participants":[{"participant_type":"agent","external_agent_id":"ag-1"}]}
+
+{"external_interaction_id":"c-2",
+{"call_id":"c-3","channel":"Voice","start":"01/02/2024 09:00","agent":"ag-2","intents":"renewal| upgrade"}
+`)
+
+	// Without a mapping each line is an ingestion request
+	spec, err := newImportSpec(ImportEntityInteractions, "", "calls.ndjson", ImportMapping{}, data)
+	require.NoError(t, err)
+	rows := readRows(t, spec, data)
+	require.Len(t, rows, 3)
+	assert.Equal(t, []int{1, 3, 4}, []int{rows[0].Line, rows[1].Line, rows[2].Line})
+	assert.Contains(t, rows[1].Err, "invalid JSON")
+
+	req, err := spec.interactionRequest(rows[0])
+	require.NoError(t, err)
+	require.Len(t, req.Participants, 1)
+	assert.Equal(t, "ag-1", *req.Participants[0].ExternalAgentID)
+
+	spec, err = newImportSpec(ImportEntityInteractions, ImportFormatNDJSON, "calls.txt", ImportMapping{
+		Columns: map[string]string{
+			"external_interaction_id": "call_id",
+			"started_at":              "start",
+			"agent_id":                "agent",
+			"secondary_intents":       "intents",
+		},
+		TimeLayout: "01/02/2006 15:04",
+	}, data)
+	require.NoError(t, err)
+	req, err = spec.interactionRequest(rows[2])
+	require.NoError(t, err)
+	assert.Equal(t, "c-3", req.ExternalInteractionID)
+	assert.Equal(t, time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), req.StartedAt)
+	assert.Equal(t, []string{"renewal", "upgrade"}, req.SecondaryIntents)
+	require.Len(t, req.Participants, 1)
+	assert.Equal(t, "agent", req.Participants[0].ParticipantType)
+	assert.Equal(t, "ag-2", *req.Participants[0].ExternalAgentID)
+}
+
+func TestRejectedRowWriter(t *testing.T) {
+	var csvOut bytes.Buffer
+	writer := newRejectedRowWriter(ImportFormatCSV, []string{"id", "note"}, &csvOut)
+	require.NoError(t, writer.write(2, `7,"a, b"`, "channel not found: Fax"))
+	require.NoError(t, writer.write(5, "", "bare \" in non-quoted-field"))
+	require.NoError(t, writer.flush())
+	assert.Equal(t, "id,note,import_line,import_error\n"+
+		"7,\"a, b\",2,channel not found: Fax\n"+
+		"5,\"bare \"\" in non-quoted-field\"\n", csvOut.String())
+
+	var empty bytes.Buffer
+	writer = newRejectedRowWriter(ImportFormatCSV, []string{"id"}, &empty)
+	require.NoError(t, writer.flush())
+	assert.Equal(t, "id,import_line,import_error\n", empty.String())
+
+	var ndjsonOut bytes.Buffer
+	writer = newRejectedRowWriter(ImportFormatNDJSON, nil, &ndjsonOut)
+	require.NoError(t, writer.write(1, `{"id":12345678901234567890}`, "bad"))
+	require.NoError(t, writer.write(3, `{"id":`, "invalid JSON"))
+	require.NoError(t, writer.flush())
+	assert.Equal(t, `{"id":12345678901234567890,"import_error":"bad","import_line":1}`+"\n"+
+		`{"import_error":"invalid JSON","import_line":3,"import_raw":"{\"id\":"}`+"\n", ndjsonOut.String())
+}
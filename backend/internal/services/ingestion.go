@@ -1,7 +1,13 @@
 package services
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/convin/crae/internal/models"
@@ -42,6 +48,11 @@ type IngestInteractionRequest struct {
 	OutcomePrediction     string                            `json:"outcome_prediction"`
 	PurchaseProbability   *float64                          `json:"purchase_probability"`
 	RawMetadata           map[string]interface{}            `json:"raw_metadata"`
+	// View-through (ad impression) fields; see IngestImpression
+	IsViewThrough         bool                              `json:"is_view_through"`
+	AdViewedAt            *time.Time                        `json:"ad_viewed_at"`
+	AdPlatform            string                            `json:"ad_platform"`
+	ExternalCampaignID    *string                           `json:"external_campaign_id"`
 }
 
 type InteractionParticipantRequest struct {
@@ -51,7 +62,74 @@ type InteractionParticipantRequest struct {
 	Metadata        map[string]interface{} `json:"metadata"`
 }
 
-// IngestInteraction ingests an interaction and returns the created interaction ID
+// Ingestion statuses: re-sending a record with the same external ID updates
+// it instead of storing it again
+const (
+	IngestStatusCreated   = "created"
+	IngestStatusUpdated   = "updated"
+	IngestStatusUnchanged = "unchanged"
+)
+
+// upsertColumn is a column a re-sent record updates and the value it is
+// updated to
+type upsertColumn struct {
+	Column string
+	Value  string
+}
+
+// upsertUpdate returns the SET and WHERE of an ON CONFLICT DO UPDATE on table
+// that only touches the row when one of the columns changes, so re-sending an
+// unchanged record leaves it (and its updated_at) alone
+func upsertUpdate(table string, columns []upsertColumn) string {
+	set := make([]string, len(columns))
+	stored := make([]string, len(columns))
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = c.Column + " = " + c.Value
+		stored[i] = table + "." + c.Column
+		values[i] = c.Value
+	}
+	return "SET " + strings.Join(set, ", ") + ", updated_at = NOW()" +
+		" WHERE (" + strings.Join(stored, ", ") + ") IS DISTINCT FROM (" + strings.Join(values, ", ") + ")"
+}
+
+// keepStored keeps the stored value of a column the re-sent record leaves out
+func keepStored(table, column string) upsertColumn {
+	return upsertColumn{column, "COALESCE(EXCLUDED." + column + ", " + table + "." + column + ")"}
+}
+
+// keepStoredText is keepStored for text columns, where empty means left out
+func keepStoredText(table, column string) upsertColumn {
+	return upsertColumn{column, "COALESCE(NULLIF(EXCLUDED." + column + ", ''), " + table + "." + column + ")"}
+}
+
+// interactionUpsert updates an interaction re-sent with the same external ID.
+// Fields the re-sent interaction leaves out keep their stored values, so a
+// retried call.started webhook doesn't blank what call.ended filled in.
+var interactionUpsert = upsertUpdate("interactions", []upsertColumn{
+	keepStored("interactions", "customer_id"),
+	{"channel_id", "EXCLUDED.channel_id"},
+	keepStored("interactions", "vendor_id"),
+	keepStored("interactions", "vendor_code"),
+	{"started_at", "EXCLUDED.started_at"},
+	keepStored("interactions", "ended_at"),
+	keepStored("interactions", "duration_seconds"),
+	keepStoredText("interactions", "direction"),
+	keepStoredText("interactions", "language"),
+	keepStoredText("interactions", "transcript_location"),
+	keepStoredText("interactions", "primary_intent"),
+	keepStored("interactions", "secondary_intents"),
+	keepStoredText("interactions", "outcome_prediction"),
+	keepStored("interactions", "purchase_probability"),
+	keepStored("interactions", "raw_metadata"),
+	{"is_view_through", "EXCLUDED.is_view_through"},
+	keepStored("interactions", "ad_viewed_at"),
+	keepStored("interactions", "ad_platform"),
+	keepStored("interactions", "campaign_id"),
+})
+
+// IngestInteraction ingests an interaction and returns its ID. An interaction
+// already ingested with the same external ID is updated instead.
 func (s *IngestionService) IngestInteraction(tenantID int64, req IngestInteractionRequest) (*IngestInteractionResponse, error) {
 	tx, err := s.db.Beginx()
 	if err != nil {
@@ -76,16 +154,42 @@ func (s *IngestionService) IngestInteraction(tenantID int64, req IngestInteracti
 		return nil, fmt.Errorf("channel not found: %s", req.Channel)
 	}
 
-	// Get vendor ID if vendor code provided
+	// Get vendor ID if vendor code provided. An unknown vendor is left out
+	// and queued as unresolved.
 	var vendorID *int
 	if req.VendorCode != nil {
-		err = tx.Get(&vendorID, `SELECT id FROM vendors WHERE tenant_id = $1 AND code = $2`, tenantID, *req.VendorCode)
+		vendors, err := lookupReferences(tx, tenantID, ReferenceVendor, []string{*req.VendorCode})
+		if err != nil {
+			return nil, err
+		}
+		vendorID = optionalID(vendors, req.VendorCode)
+	}
+	var storedVendorCode *string
+	if vendorID == nil && req.VendorCode != nil {
+		storedVendorCode, err = storedReferenceKey(tx,
+			`SELECT vendor_code FROM interactions WHERE tenant_id = $1 AND external_interaction_id = $2`,
+			tenantID, req.ExternalInteractionID,
+		)
 		if err != nil {
-			// Vendor not found, but continue without vendor
-			vendorID = nil
+			return nil, err
 		}
 	}
 
+	// Get campaign ID if an external campaign ID is provided
+	var campaignID *int
+	if req.ExternalCampaignID != nil {
+		err = tx.Get(&campaignID, `SELECT id FROM campaigns WHERE tenant_id = $1 AND external_campaign_id = $2`, tenantID, *req.ExternalCampaignID)
+		if err != nil {
+			// Campaign not found, but continue without campaign
+			campaignID = nil
+		}
+	}
+
+	var adPlatform *string
+	if req.AdPlatform != "" {
+		adPlatform = &req.AdPlatform
+	}
+
 	// Calculate duration
 	var durationSeconds *int
 	if req.EndedAt != nil {
@@ -106,52 +210,126 @@ func (s *IngestionService) IngestInteraction(tenantID int64, req IngestInteracti
 		rawMetadataJSON = models.JSONB(req.RawMetadata)
 	}
 
-	// Insert interaction
+	// Insert interaction, or update the one with the same external ID
 	var interaction models.Interaction
+	var inserted bool
 	err = tx.QueryRowx(
 		`INSERT INTO interactions (
 			tenant_id, customer_id, external_interaction_id, channel_id, vendor_id,
 			started_at, ended_at, duration_seconds, direction, language,
 			transcript_location, primary_intent, secondary_intents,
-			outcome_prediction, purchase_probability, raw_metadata
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-		RETURNING id, created_at, updated_at`,
+			outcome_prediction, purchase_probability, raw_metadata,
+			is_view_through, ad_viewed_at, ad_platform, campaign_id, vendor_code
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+		ON CONFLICT (tenant_id, external_interaction_id) DO UPDATE `+interactionUpsert+`
+		RETURNING id, customer_id, created_at, updated_at, (xmax = 0) as inserted`,
 		tenantID, customerID, req.ExternalInteractionID, channelID, vendorID,
 		req.StartedAt, req.EndedAt, durationSeconds, req.Direction, req.Language,
 		req.TranscriptURL, req.PrimaryIntent, secondaryIntentsJSON,
 		req.OutcomePrediction, req.PurchaseProbability, rawMetadataJSON,
-	).Scan(&interaction.ID, &interaction.CreatedAt, &interaction.UpdatedAt)
+		req.IsViewThrough, req.AdViewedAt, adPlatform, campaignID, req.VendorCode,
+	).Scan(&interaction.ID, &customerID, &interaction.CreatedAt, &interaction.UpdatedAt, &inserted)
+	status := IngestStatusCreated
+	if !inserted {
+		status = IngestStatusUpdated
+	}
+	if err == sql.ErrNoRows {
+		// Re-sent unchanged
+		status = IngestStatusUnchanged
+		err = tx.QueryRowx(
+			`SELECT id, customer_id FROM interactions WHERE tenant_id = $1 AND external_interaction_id = $2`,
+			tenantID, req.ExternalInteractionID,
+		).Scan(&interaction.ID, &customerID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert interaction: %w", err)
 	}
 
-	// Insert participants
+	// Unknown agents are left out and queued as unresolved
+	var agentKeys []string
 	for _, partReq := range req.Participants {
-		var agentID *int
 		if partReq.ExternalAgentID != nil {
-			err = tx.Get(&agentID, `SELECT id FROM agents WHERE external_agent_id = $1`, *partReq.ExternalAgentID)
-			if err != nil {
-				// Agent not found, continue without agent ID
-				agentID = nil
-			}
+			agentKeys = append(agentKeys, *partReq.ExternalAgentID)
+		}
+	}
+	var agents map[string]int
+	if len(agentKeys) > 0 {
+		if agents, err = lookupReferences(tx, tenantID, ReferenceAgent, agentKeys); err != nil {
+			return nil, err
 		}
+	}
 
+	participants := make([]ingestedParticipant, len(req.Participants))
+	for i, partReq := range req.Participants {
 		var metadataJSON models.JSONB
 		if partReq.Metadata != nil {
 			metadataJSON = models.JSONB(partReq.Metadata)
 		}
+		participants[i] = ingestedParticipant{
+			partReq.ParticipantType, optionalID(agents, partReq.ExternalAgentID), partReq.ExternalAgentID,
+			partReq.Role, metadataJSON,
+		}
+	}
 
-		_, err = tx.Exec(
-			`INSERT INTO interaction_participants (
-				interaction_id, participant_type, agent_id, role, metadata
-			) VALUES ($1, $2, $3, $4, $5)`,
-			interaction.ID, partReq.ParticipantType, agentID, partReq.Role, metadataJSON,
-		)
+	// A re-sent interaction's participants replace the stored ones when it
+	// names any and they differ
+	replace := inserted
+	if !inserted && len(participants) > 0 {
+		replace, err = participantsChanged(tx, interaction.ID, participants)
 		if err != nil {
-			return nil, fmt.Errorf("failed to insert participant: %w", err)
+			return nil, err
+		}
+	}
+	var storedAgentKeys []string
+	if replace {
+		if !inserted {
+			err = tx.Select(&storedAgentKeys,
+				`SELECT external_agent_id FROM interaction_participants
+				 WHERE interaction_id = $1 AND agent_id IS NULL AND external_agent_id IS NOT NULL`,
+				interaction.ID,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get participants: %w", err)
+			}
+			_, err = tx.Exec(`DELETE FROM interaction_participants WHERE interaction_id = $1`, interaction.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to replace participants: %w", err)
+			}
+			// Live runs re-attribute interactions by updated_at
+			_, err = tx.Exec(`UPDATE interactions SET updated_at = NOW() WHERE id = $1`, interaction.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update interaction: %w", err)
+			}
+			status = IngestStatusUpdated
+		}
+		for _, p := range participants {
+			_, err = tx.Exec(
+				`INSERT INTO interaction_participants (
+					interaction_id, participant_type, agent_id, external_agent_id, role, metadata
+				) VALUES ($1, $2, $3, $4, $5, $6)`,
+				interaction.ID, p.ParticipantType, p.AgentID, p.ExternalAgentID, p.Role, p.Metadata,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to insert participant: %w", err)
+			}
 		}
 	}
 
+	// Unresolved references count once per record stored with them, so a
+	// record re-sent with a key it was already stored with doesn't count
+	misses := referenceMisses{}
+	misses.addNew(ReferenceVendor, req.VendorCode, vendorID, storedVendorCode)
+	if replace {
+		for _, p := range participants {
+			if p.ExternalAgentID == nil || !containsString(storedAgentKeys, *p.ExternalAgentID) {
+				misses.add(ReferenceAgent, p.ExternalAgentID, p.AgentID)
+			}
+		}
+	}
+	if err = queueUnresolvedReferences(tx, tenantID, misses); err != nil {
+		return nil, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
@@ -159,12 +337,119 @@ func (s *IngestionService) IngestInteraction(tenantID int64, req IngestInteracti
 	return &IngestInteractionResponse{
 		InteractionID: interaction.ID,
 		CustomerID:    customerID,
+		Status:        status,
 	}, nil
 }
 
 type IngestInteractionResponse struct {
 	InteractionID int64   `json:"interaction_id"`
 	CustomerID    *int64  `json:"customer_id"`
+	Status        string  `json:"status"`
+}
+
+// ingestedParticipant is a participant of an interaction being ingested
+type ingestedParticipant struct {
+	ParticipantType string       `db:"participant_type"`
+	AgentID         *int         `db:"agent_id"`
+	ExternalAgentID *string      `db:"external_agent_id"`
+	Role            string       `db:"role"`
+	Metadata        models.JSONB `db:"metadata"`
+}
+
+func (p ingestedParticipant) key() string {
+	agent := ""
+	if p.AgentID != nil {
+		agent = strconv.Itoa(*p.AgentID)
+	}
+	externalAgent := ""
+	if p.ExternalAgentID != nil {
+		externalAgent = *p.ExternalAgentID
+	}
+	metadata, _ := json.Marshal(p.Metadata)
+	return p.ParticipantType + "|" + agent + "|" + externalAgent + "|" + p.Role + "|" + string(metadata)
+}
+
+// participantsChanged reports whether an interaction's stored participants
+// differ from participants, in any order
+func participantsChanged(tx *sqlx.Tx, interactionID int64, participants []ingestedParticipant) (bool, error) {
+	var stored []ingestedParticipant
+	err := tx.Select(&stored,
+		`SELECT participant_type, agent_id, external_agent_id, COALESCE(role, '') as role, metadata
+		 FROM interaction_participants WHERE interaction_id = $1`,
+		interactionID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to get participants: %w", err)
+	}
+	return participantsDiffer(stored, participants), nil
+}
+
+// participantsDiffer reports whether two sets of participants differ, in any
+// order
+func participantsDiffer(stored, participants []ingestedParticipant) bool {
+	if len(stored) != len(participants) {
+		return true
+	}
+	counts := map[string]int{}
+	for _, p := range stored {
+		counts[p.key()]++
+	}
+	for _, p := range participants {
+		counts[p.key()]--
+		if counts[p.key()] < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrInvalidImpression is returned for an ad impression that can't be ingested
+var ErrInvalidImpression = errors.New("invalid impression")
+
+// defaultImpressionChannel is the channel impressions are recorded on when
+// the request doesn't name one
+const defaultImpressionChannel = "Display"
+
+// IngestImpressionRequest represents an ad impression: the customer saw an ad
+// without clicking or calling. It is stored as a view-through interaction.
+type IngestImpressionRequest struct {
+	ExternalImpressionID string                      `json:"external_impression_id"`
+	Channel              string                      `json:"channel"`
+	AdPlatform           string                      `json:"ad_platform"`
+	ExternalCampaignID   *string                     `json:"external_campaign_id"`
+	VendorCode           *string                     `json:"vendor_code"`
+	CustomerIdentifiers  []models.CustomerIdentifier `json:"customer_identifiers"`
+	ViewedAt             time.Time                   `json:"viewed_at"`
+	RawMetadata          map[string]interface{}      `json:"raw_metadata"`
+}
+
+// IngestImpression ingests an ad impression as a view-through interaction
+func (s *IngestionService) IngestImpression(tenantID int64, req IngestImpressionRequest) (*IngestInteractionResponse, error) {
+	if req.ViewedAt.IsZero() {
+		return nil, fmt.Errorf("%w: viewed_at is required", ErrInvalidImpression)
+	}
+	if len(req.CustomerIdentifiers) == 0 {
+		return nil, fmt.Errorf("%w: customer_identifiers are required", ErrInvalidImpression)
+	}
+
+	channel := req.Channel
+	if channel == "" {
+		channel = defaultImpressionChannel
+	}
+	viewedAt := req.ViewedAt
+
+	return s.IngestInteraction(tenantID, IngestInteractionRequest{
+		ExternalInteractionID: req.ExternalImpressionID,
+		Channel:               channel,
+		VendorCode:            req.VendorCode,
+		CustomerIdentifiers:   req.CustomerIdentifiers,
+		StartedAt:             viewedAt,
+		RawMetadata:           req.RawMetadata,
+		IsViewThrough:         true,
+		AdViewedAt:            &viewedAt,
+		AdPlatform:            req.AdPlatform,
+		ExternalCampaignID:    req.ExternalCampaignID,
+	})
 }
 
 // IngestConversionRequest represents a conversion event ingestion request
@@ -178,22 +463,43 @@ type IngestConversionRequest struct {
 	AmountDecimal       float64                    `json:"amount_decimal"`
 	OccurredAt          time.Time                  `json:"occurred_at"`
 	RawPayload          map[string]interface{}     `json:"raw_payload"`
+	// OriginalExternalEventID makes the event a reversal (refund, cancellation,
+	// chargeback) of the conversion with that external event ID
+	OriginalExternalEventID *string `json:"original_external_event_id"`
 }
 
-// IngestConversion ingests a conversion event
+// conversionUpsert updates a conversion re-sent with the same event source and
+// external event ID. It keeps its customer and the conversion it reverses.
+var conversionUpsert = upsertUpdate("conversion_events", []upsertColumn{
+	{"event_type", "EXCLUDED.event_type"},
+	keepStored("conversion_events", "product_id"),
+	keepStored("conversion_events", "product_external_id"),
+	{"currency_id", "EXCLUDED.currency_id"},
+	{"amount_decimal", "EXCLUDED.amount_decimal"},
+	{"occurred_at", "EXCLUDED.occurred_at"},
+	keepStored("conversion_events", "raw_payload"),
+})
+
+// IngestConversion ingests a conversion event. A reversal (refund,
+// cancellation, chargeback) is stored with a negative amount against the
+// customer of the conversion it reverses, and claws back the credit every run
+// gave that conversion. A conversion already ingested from the event source
+// with the same external event ID is updated instead, so re-sending it never
+// counts its revenue twice.
 func (s *IngestionService) IngestConversion(tenantID int64, req IngestConversionRequest) (*IngestConversionResponse, error) {
+	if IsReversalEventType(req.EventType) && req.OriginalExternalEventID == nil {
+		return nil, fmt.Errorf("%w: %s", ErrReversalWithoutOriginal, req.EventType)
+	}
+	if !IsReversalEventType(req.EventType) && req.OriginalExternalEventID != nil {
+		return nil, fmt.Errorf("%w, not %s", ErrOriginalWithoutReversal, req.EventType)
+	}
+
 	tx, err := s.db.Beginx()
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Find or create customer
-	customer, err := s.identitySvc.FindOrCreateCustomer(tenantID, req.CustomerIdentifiers)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find/create customer: %w", err)
-	}
-
 	// Get event source ID
 	var eventSourceID int
 	err = tx.Get(&eventSourceID, `SELECT id FROM event_sources WHERE name = $1`, req.EventSource)
@@ -201,6 +507,23 @@ func (s *IngestionService) IngestConversion(tenantID int64, req IngestConversion
 		return nil, fmt.Errorf("event source not found: %s", req.EventSource)
 	}
 
+	var customerID int64
+	var original *reversedConversion
+	if req.OriginalExternalEventID != nil {
+		original, err = s.findReversedConversion(tx, tenantID, eventSourceID, *req.OriginalExternalEventID, req.ExternalEventID)
+		if err != nil {
+			return nil, err
+		}
+		customerID = original.CustomerID
+	} else {
+		// Find or create customer
+		customer, err := s.identitySvc.FindOrCreateCustomer(tenantID, req.CustomerIdentifiers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find/create customer: %w", err)
+		}
+		customerID = customer.ID
+	}
+
 	// Get currency ID
 	var currencyID int
 	err = tx.Get(&currencyID, `SELECT id FROM currencies WHERE code = $1`, req.Currency)
@@ -208,49 +531,150 @@ func (s *IngestionService) IngestConversion(tenantID int64, req IngestConversion
 		return nil, fmt.Errorf("currency not found: %s", req.Currency)
 	}
 
-	// Get product ID if provided
+	// Get product ID if provided. An unknown product is left out and queued
+	// as unresolved.
 	var productID *int
 	if req.ProductExternalID != nil {
-		err = tx.Get(&productID, `SELECT id FROM products WHERE external_product_id = $1`, *req.ProductExternalID)
+		products, err := lookupReferences(tx, tenantID, ReferenceProduct, []string{*req.ProductExternalID})
+		if err != nil {
+			return nil, err
+		}
+		productID = optionalID(products, req.ProductExternalID)
+	}
+	var storedProductKey *string
+	if productID == nil && req.ProductExternalID != nil {
+		storedProductKey, err = storedReferenceKey(tx,
+			`SELECT product_external_id FROM conversion_events
+			 WHERE tenant_id = $1 AND event_source_id = $2 AND external_event_id = $3`,
+			tenantID, eventSourceID, req.ExternalEventID,
+		)
 		if err != nil {
-			// Product not found, continue without product
-			productID = nil
+			return nil, err
 		}
 	}
 
+	resp, err := upsertConversionEvent(tx, tenantID, customerID, eventSourceID, currencyID, productID, req, original)
+	if err != nil {
+		return nil, err
+	}
+
+	misses := referenceMisses{}
+	misses.addNew(ReferenceProduct, req.ProductExternalID, productID, storedProductKey)
+	if err = queueUnresolvedReferences(tx, tenantID, misses); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return resp, nil
+}
+
+// upsertConversionEvent inserts a conversion event, or updates the one with
+// the same event source and external event ID. A reversal of original is
+// stored negative and claws back the credit given to original.
+func upsertConversionEvent(tx *sqlx.Tx, tenantID, customerID int64, eventSourceID, currencyID int, productID *int, req IngestConversionRequest, original *reversedConversion) (*IngestConversionResponse, error) {
 	// Convert raw payload to JSONB
 	var rawPayloadJSON models.JSONB
 	if req.RawPayload != nil {
 		rawPayloadJSON = models.JSONB(req.RawPayload)
 	}
 
+	// Reversals are stored negative; without an amount the rest of the
+	// original amount is reversed
+	amount := req.AmountDecimal
+	var reversesEventID *int64
+	if original != nil {
+		amount = -math.Abs(amount)
+		if amount == 0 {
+			amount = -math.Max(original.Remaining, 0)
+		}
+		reversesEventID = &original.ID
+	}
+
 	// Insert conversion event
 	var conversion models.ConversionEvent
-	err = tx.QueryRowx(
+	var inserted bool
+	err := tx.QueryRowx(
 		`INSERT INTO conversion_events (
 			tenant_id, customer_id, event_source_id, external_event_id,
-			event_type, product_id, currency_id, amount_decimal, occurred_at, raw_payload
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id, created_at`,
-		tenantID, customer.ID, eventSourceID, req.ExternalEventID,
-		req.EventType, productID, currencyID, req.AmountDecimal, req.OccurredAt, rawPayloadJSON,
-	).Scan(&conversion.ID, &conversion.CreatedAt)
+			event_type, product_id, currency_id, amount_decimal, occurred_at, raw_payload,
+			reverses_event_id, product_external_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (tenant_id, event_source_id, external_event_id) DO UPDATE `+conversionUpsert+`
+		RETURNING id, customer_id, reverses_event_id, created_at, (xmax = 0) as inserted`,
+		tenantID, customerID, eventSourceID, req.ExternalEventID,
+		req.EventType, productID, currencyID, amount, req.OccurredAt, rawPayloadJSON,
+		reversesEventID, req.ProductExternalID,
+	).Scan(&conversion.ID, &customerID, &reversesEventID, &conversion.CreatedAt, &inserted)
+	status := IngestStatusCreated
+	if !inserted {
+		status = IngestStatusUpdated
+	}
+	if err == sql.ErrNoRows {
+		// Re-sent unchanged
+		status = IngestStatusUnchanged
+		err = tx.QueryRowx(
+			`SELECT id, customer_id, reverses_event_id FROM conversion_events
+			 WHERE tenant_id = $1 AND event_source_id = $2 AND external_event_id = $3`,
+			tenantID, eventSourceID, req.ExternalEventID,
+		).Scan(&conversion.ID, &customerID, &reversesEventID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert conversion event: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	if reversesEventID != nil && status != IngestStatusUnchanged {
+		if err := clawBackConversion(tx, *reversesEventID); err != nil {
+			return nil, err
+		}
 	}
 
 	return &IngestConversionResponse{
 		ConversionEventID: conversion.ID,
-		CustomerID:        customer.ID,
+		CustomerID:        customerID,
+		ReversesEventID:   reversesEventID,
+		Status:            status,
 	}, nil
 }
 
 type IngestConversionResponse struct {
-	ConversionEventID int64 `json:"conversion_event_id"`
-	CustomerID        int64 `json:"customer_id"`
+	ConversionEventID int64  `json:"conversion_event_id"`
+	CustomerID        int64  `json:"customer_id"`
+	ReversesEventID   *int64 `json:"reverses_event_id,omitempty"`
+	Status            string `json:"status"`
+}
+
+// reversedConversion is the conversion a reversal event reverses
+type reversedConversion struct {
+	ID         int64   `db:"id"`
+	CustomerID int64   `db:"customer_id"`
+	Remaining  float64 `db:"remaining"`
+}
+
+// findReversedConversion looks up the conversion a reversal names, preferring
+// one from the reversal's own event source, with the amount not yet reversed
+// by other reversals than the one being ingested
+func (s *IngestionService) findReversedConversion(tx *sqlx.Tx, tenantID int64, eventSourceID int, externalEventID, reversalExternalID string) (*reversedConversion, error) {
+	var original reversedConversion
+	err := tx.Get(&original,
+		`SELECT ce.id, ce.customer_id,
+		        ce.amount_decimal + COALESCE((SELECT SUM(r.amount_decimal) FROM conversion_events r
+		                                   WHERE r.reverses_event_id = ce.id
+		                                     AND NOT (r.event_source_id = $3 AND r.external_event_id = $4)), 0) as remaining
+		 FROM conversion_events ce
+		 WHERE ce.tenant_id = $1 AND ce.external_event_id = $2 AND ce.reverses_event_id IS NULL
+		 ORDER BY (ce.event_source_id = $3) DESC, ce.id
+		 LIMIT 1`,
+		tenantID, externalEventID, eventSourceID, reversalExternalID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrOriginalConversionNotFound, externalEventID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get original conversion: %w", err)
+	}
+	return &original, nil
 }
 
@@ -0,0 +1,1031 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Batch ingestion: a batch is validated and resolved against the reference
+// tables up front, then written in one transaction with multi-row upserts of
+// ingestBatchChunkSize records. A chunk that fails is retried a record at a
+// time, so a bad record only rejects itself.
+
+// MaxIngestBatchSize is the most records a batch may hold
+const MaxIngestBatchSize = 5000
+
+const ingestBatchChunkSize = 500
+
+// Batch record statuses: a record re-sent with the same external ID updates
+// the stored one, as for single records
+const (
+	BatchRecordCreated   = IngestStatusCreated
+	BatchRecordUpdated   = IngestStatusUpdated
+	BatchRecordUnchanged = IngestStatusUnchanged
+	BatchRecordRejected  = "rejected"
+)
+
+// ErrInvalidBatch is returned for a batch that is empty or too large
+var ErrInvalidBatch = errors.New("invalid ingestion batch")
+
+// BatchRecordResult is the outcome of one record of a batch. Records that
+// were stored carry the ID of the stored record.
+type BatchRecordResult struct {
+	Index      int    `json:"index"`
+	ExternalID string `json:"external_id"`
+	Status     string `json:"status"`
+	ID         *int64 `json:"id,omitempty"`
+	CustomerID *int64 `json:"customer_id,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// BatchIngestResponse is the outcome of a batch, one result per record in
+// request order
+type BatchIngestResponse struct {
+	Created   int                 `json:"created"`
+	Updated   int                 `json:"updated"`
+	Unchanged int                 `json:"unchanged"`
+	Rejected  int                 `json:"rejected"`
+	Results   []BatchRecordResult `json:"results"`
+	// DeadLetterError is set when the rejected records couldn't be kept as
+	// dead letters
+	DeadLetterError string `json:"dead_letter_error,omitempty"`
+}
+
+func newBatchIngestResponse(externalIDs []string) *BatchIngestResponse {
+	resp := &BatchIngestResponse{Results: make([]BatchRecordResult, len(externalIDs))}
+	for i, id := range externalIDs {
+		resp.Results[i] = BatchRecordResult{Index: i, ExternalID: id}
+	}
+	return resp
+}
+
+// stored records that record i was stored as id with the ingestion status
+func (r *BatchIngestResponse) stored(i int, status string, id int64, customerID *int64) {
+	r.Results[i].Status = status
+	r.Results[i].ID = &id
+	r.Results[i].CustomerID = customerID
+}
+
+// repeat gives record i, which repeats record j of the batch, j's outcome
+func (r *BatchIngestResponse) repeat(i, j int) {
+	result := r.Results[j]
+	result.Index = i
+	result.ExternalID = r.Results[i].ExternalID
+	r.Results[i] = result
+}
+
+func (r *BatchIngestResponse) reject(i int, reason string) {
+	r.Results[i].Status = BatchRecordRejected
+	r.Results[i].Reason = reason
+}
+
+func (r *BatchIngestResponse) tally() {
+	for _, result := range r.Results {
+		switch result.Status {
+		case BatchRecordCreated:
+			r.Created++
+		case BatchRecordUpdated:
+			r.Updated++
+		case BatchRecordUnchanged:
+			r.Unchanged++
+		case BatchRecordRejected:
+			r.Rejected++
+		}
+	}
+}
+
+func validateBatchSize(n int) error {
+	if n == 0 {
+		return fmt.Errorf("%w: no records", ErrInvalidBatch)
+	}
+	if n > MaxIngestBatchSize {
+		return fmt.Errorf("%w: %d records, at most %d allowed", ErrInvalidBatch, n, MaxIngestBatchSize)
+	}
+	return nil
+}
+
+// IngestInteractionBatch ingests a batch of interactions. Interactions
+// already stored are updated, as for single records, and records that can't
+// be stored are rejected with a reason without failing the batch. Records
+// repeated in the batch get the outcome of their first copy.
+func (s *IngestionService) IngestInteractionBatch(tenantID int64, reqs []IngestInteractionRequest) (*BatchIngestResponse, error) {
+	if err := validateBatchSize(len(reqs)); err != nil {
+		return nil, err
+	}
+	externalIDs := make([]string, len(reqs))
+	for i, req := range reqs {
+		externalIDs[i] = req.ExternalInteractionID
+	}
+	resp := newBatchIngestResponse(externalIDs)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	lookups, err := loadInteractionLookups(tx, tenantID, reqs)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := storedInteractions(tx, tenantID, externalIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	first := map[string]int{}
+	repeats := map[int]int{}
+	var pending []int
+	for i, req := range reqs {
+		if reason := lookups.reject(req); reason != "" {
+			resp.reject(i, reason)
+			continue
+		}
+		if j, ok := first[req.ExternalInteractionID]; ok {
+			repeats[i] = j
+			continue
+		}
+		first[req.ExternalInteractionID] = i
+		pending = append(pending, i)
+	}
+
+	// Only interactions with identifiers get a customer
+	var identified []int
+	var sets [][]models.CustomerIdentifier
+	for _, i := range pending {
+		if len(reqs[i].CustomerIdentifiers) > 0 {
+			identified = append(identified, i)
+			sets = append(sets, reqs[i].CustomerIdentifiers)
+		}
+	}
+	customerIDs, err := resolveBatchCustomers(tx, tenantID, sets)
+	if err != nil {
+		return nil, err
+	}
+	customers := make(map[int]*int64, len(identified))
+	for k, i := range identified {
+		customers[i] = &customerIDs[k]
+	}
+
+	replaced := map[int]bool{}
+	insertBatchChunks(tx, pending, resp, func(chunk []int) error {
+		return upsertInteractionChunk(tx, tenantID, reqs, chunk, customers, lookups, stored, replaced, resp)
+	})
+
+	// Unknown vendors and agents of the stored interactions are queued, once
+	// per interaction stored with them
+	misses := referenceMisses{}
+	for _, i := range pending {
+		req := reqs[i]
+		if resp.Results[i].Status == BatchRecordRejected {
+			continue
+		}
+		previous := stored[req.ExternalInteractionID]
+		misses.addNew(ReferenceVendor, req.VendorCode, optionalID(lookups.vendors, req.VendorCode), previous.VendorCode)
+		if !replaced[i] {
+			continue
+		}
+		for _, p := range req.Participants {
+			if p.ExternalAgentID == nil || !containsString(previous.unresolvedAgents(), *p.ExternalAgentID) {
+				misses.add(ReferenceAgent, p.ExternalAgentID, optionalID(lookups.agents, p.ExternalAgentID))
+			}
+		}
+	}
+	if err = queueUnresolvedReferences(tx, tenantID, misses); err != nil {
+		return nil, err
+	}
+
+	// Records repeating an earlier one share its outcome
+	for i, j := range repeats {
+		resp.repeat(i, j)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	resp.tally()
+	return resp, nil
+}
+
+// interactionLookups resolves the names and codes a batch of interactions
+// refers to
+type interactionLookups struct {
+	channels  map[string]int
+	vendors   map[string]int
+	campaigns map[string]int
+	agents    map[string]int
+}
+
+func loadInteractionLookups(q sqlx.Queryer, tenantID int64, reqs []IngestInteractionRequest) (*interactionLookups, error) {
+	var vendorCodes, campaignIDs, agentIDs []string
+	for _, req := range reqs {
+		if req.VendorCode != nil {
+			vendorCodes = append(vendorCodes, *req.VendorCode)
+		}
+		if req.ExternalCampaignID != nil {
+			campaignIDs = append(campaignIDs, *req.ExternalCampaignID)
+		}
+		for _, p := range req.Participants {
+			if p.ExternalAgentID != nil {
+				agentIDs = append(agentIDs, *p.ExternalAgentID)
+			}
+		}
+	}
+
+	lookups := &interactionLookups{}
+	var err error
+	if lookups.channels, err = lookupIDs(q, `SELECT name as key, id FROM channels`); err != nil {
+		return nil, fmt.Errorf("failed to get channels: %w", err)
+	}
+	if lookups.vendors, err = lookupReferences(q, tenantID, ReferenceVendor, vendorCodes); err != nil {
+		return nil, err
+	}
+	lookups.campaigns, err = lookupIDs(q,
+		`SELECT external_campaign_id as key, id FROM campaigns WHERE tenant_id = $1 AND external_campaign_id = ANY($2)`,
+		tenantID, pq.Array(campaignIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get campaigns: %w", err)
+	}
+	if lookups.agents, err = lookupReferences(q, tenantID, ReferenceAgent, agentIDs); err != nil {
+		return nil, err
+	}
+	return lookups, nil
+}
+
+// reject returns why an interaction can't be ingested, or "" if it can.
+// Unknown vendors, campaigns and agents are left out, as for single records,
+// and unknown vendors and agents are queued as unresolved.
+func (l *interactionLookups) reject(req IngestInteractionRequest) string {
+	if req.ExternalInteractionID == "" {
+		return "external_interaction_id is required"
+	}
+	if req.StartedAt.IsZero() {
+		return "started_at is required"
+	}
+	if _, ok := l.channels[req.Channel]; !ok {
+		return fmt.Sprintf("channel not found: %s", req.Channel)
+	}
+	for _, p := range req.Participants {
+		if p.ParticipantType == "" {
+			return "participant_type is required"
+		}
+	}
+	for _, ident := range req.CustomerIdentifiers {
+		if ident.Type == "" || ident.Value == "" {
+			return "customer identifiers need a type and value"
+		}
+	}
+	return ""
+}
+
+// optionalID returns the ID of an optional reference, or nil when it's
+// missing or unknown
+func optionalID(ids map[string]int, key *string) *int {
+	if key == nil {
+		return nil
+	}
+	if id, ok := ids[*key]; ok {
+		return &id
+	}
+	return nil
+}
+
+// lookupIDs maps the key column of the query's rows to their id
+func lookupIDs(q sqlx.Queryer, query string, args ...interface{}) (map[string]int, error) {
+	var rows []struct {
+		Key string `db:"key"`
+		ID  int    `db:"id"`
+	}
+	if err := sqlx.Select(q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int, len(rows))
+	for _, row := range rows {
+		if _, ok := ids[row.Key]; !ok {
+			ids[row.Key] = row.ID
+		}
+	}
+	return ids, nil
+}
+
+// storedInteraction is an interaction already stored with an external ID a
+// batch sends
+type storedInteraction struct {
+	ID           int64   `db:"id"`
+	ExternalID   string  `db:"external_interaction_id"`
+	CustomerID   *int64  `db:"customer_id"`
+	VendorCode   *string `db:"vendor_code"`
+	Participants []ingestedParticipant
+}
+
+// unresolvedAgents returns the keys of the interaction's unknown agents
+func (i storedInteraction) unresolvedAgents() []string {
+	var keys []string
+	for _, p := range i.Participants {
+		if p.AgentID == nil && p.ExternalAgentID != nil {
+			keys = append(keys, *p.ExternalAgentID)
+		}
+	}
+	return keys
+}
+
+// storedInteractions returns the interactions stored with the external IDs,
+// with their participants
+func storedInteractions(tx *sqlx.Tx, tenantID int64, externalIDs []string) (map[string]storedInteraction, error) {
+	var rows []storedInteraction
+	err := tx.Select(&rows,
+		`SELECT id, external_interaction_id, customer_id, vendor_code FROM interactions
+		 WHERE tenant_id = $1 AND external_interaction_id = ANY($2)`,
+		tenantID, pq.Array(externalIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing interactions: %w", err)
+	}
+	stored := make(map[string]storedInteraction, len(rows))
+	if len(rows) == 0 {
+		return stored, nil
+	}
+	ids := make([]int64, len(rows))
+	for k, row := range rows {
+		ids[k] = row.ID
+	}
+
+	var participants []struct {
+		InteractionID int64 `db:"interaction_id"`
+		ingestedParticipant
+	}
+	err = tx.Select(&participants,
+		`SELECT interaction_id, participant_type, agent_id, external_agent_id, COALESCE(role, '') as role, metadata
+		 FROM interaction_participants WHERE interaction_id = ANY($1)`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get participants: %w", err)
+	}
+	byInteraction := map[int64][]ingestedParticipant{}
+	for _, p := range participants {
+		byInteraction[p.InteractionID] = append(byInteraction[p.InteractionID], p.ingestedParticipant)
+	}
+
+	for _, row := range rows {
+		row.Participants = byInteraction[row.ID]
+		stored[row.ExternalID] = row
+	}
+	return stored, nil
+}
+
+// upsertInteractionChunk inserts the interactions at the chunk's indexes, or
+// updates the ones stored with the same external ID, and stores their
+// participants. A stored interaction's participants are replaced when the
+// record names any and they differ; replaced records which ones were.
+func upsertInteractionChunk(tx *sqlx.Tx, tenantID int64, reqs []IngestInteractionRequest, chunk []int, customers map[int]*int64, lookups *interactionLookups, stored map[string]storedInteraction, replaced map[int]bool, resp *BatchIngestResponse) error {
+	const columns = 21
+	args := make([]interface{}, 0, len(chunk)*columns)
+	for _, i := range chunk {
+		req := reqs[i]
+		channelID := lookups.channels[req.Channel]
+
+		var durationSeconds *int
+		if req.EndedAt != nil {
+			dur := int(req.EndedAt.Sub(req.StartedAt).Seconds())
+			durationSeconds = &dur
+		}
+		var secondaryIntentsJSON models.JSONB
+		if len(req.SecondaryIntents) > 0 {
+			secondaryIntentsJSON = models.JSONB{"intents": req.SecondaryIntents}
+		}
+		var rawMetadataJSON models.JSONB
+		if req.RawMetadata != nil {
+			rawMetadataJSON = models.JSONB(req.RawMetadata)
+		}
+		var adPlatform *string
+		if req.AdPlatform != "" {
+			adPlatform = &req.AdPlatform
+		}
+
+		args = append(args,
+			tenantID, customers[i], req.ExternalInteractionID, channelID, optionalID(lookups.vendors, req.VendorCode),
+			req.StartedAt, req.EndedAt, durationSeconds, req.Direction, req.Language,
+			req.TranscriptURL, req.PrimaryIntent, secondaryIntentsJSON,
+			req.OutcomePrediction, req.PurchaseProbability, rawMetadataJSON,
+			req.IsViewThrough, req.AdViewedAt, adPlatform, optionalID(lookups.campaigns, req.ExternalCampaignID),
+			req.VendorCode,
+		)
+	}
+
+	// Interactions re-sent unchanged aren't returned
+	var upserted []struct {
+		ID         int64  `db:"id"`
+		ExternalID string `db:"external_interaction_id"`
+		CustomerID *int64 `db:"customer_id"`
+		Inserted   bool   `db:"inserted"`
+	}
+	err := tx.Select(&upserted,
+		`INSERT INTO interactions (
+			tenant_id, customer_id, external_interaction_id, channel_id, vendor_id,
+			started_at, ended_at, duration_seconds, direction, language,
+			transcript_location, primary_intent, secondary_intents,
+			outcome_prediction, purchase_probability, raw_metadata,
+			is_view_through, ad_viewed_at, ad_platform, campaign_id, vendor_code
+		) VALUES `+valuesPlaceholders(len(chunk), columns)+`
+		ON CONFLICT (tenant_id, external_interaction_id) DO UPDATE `+interactionUpsert+`
+		RETURNING id, external_interaction_id, customer_id, (xmax = 0) as inserted`,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upsert interactions: %w", err)
+	}
+	results := make(map[string]storedInteraction, len(chunk))
+	statuses := make(map[string]string, len(chunk))
+	for _, row := range upserted {
+		results[row.ExternalID] = storedInteraction{ID: row.ID, CustomerID: row.CustomerID}
+		statuses[row.ExternalID] = IngestStatusUpdated
+		if row.Inserted {
+			statuses[row.ExternalID] = IngestStatusCreated
+		}
+	}
+
+	// Unchanged interactions stored concurrently since the batch was checked
+	// aren't in stored
+	var unknown []string
+	for _, i := range chunk {
+		externalID := reqs[i].ExternalInteractionID
+		if _, ok := results[externalID]; ok {
+			continue
+		}
+		if previous, ok := stored[externalID]; ok {
+			results[externalID] = previous
+		} else {
+			unknown = append(unknown, externalID)
+		}
+		statuses[externalID] = IngestStatusUnchanged
+	}
+	if len(unknown) > 0 {
+		concurrent, err := storedInteractions(tx, tenantID, unknown)
+		if err != nil {
+			return err
+		}
+		for externalID, interaction := range concurrent {
+			results[externalID] = interaction
+		}
+	}
+
+	var participantArgs []interface{}
+	var replacedIDs []int64
+	replace := make(map[int]bool, len(chunk))
+	for _, i := range chunk {
+		req := reqs[i]
+		interaction, ok := results[req.ExternalInteractionID]
+		if !ok {
+			return fmt.Errorf("interaction %s was not stored", req.ExternalInteractionID)
+		}
+		participants := make([]ingestedParticipant, len(req.Participants))
+		for k, p := range req.Participants {
+			var metadataJSON models.JSONB
+			if p.Metadata != nil {
+				metadataJSON = models.JSONB(p.Metadata)
+			}
+			participants[k] = ingestedParticipant{
+				p.ParticipantType, optionalID(lookups.agents, p.ExternalAgentID), p.ExternalAgentID, p.Role, metadataJSON,
+			}
+		}
+
+		inserted := statuses[req.ExternalInteractionID] == IngestStatusCreated
+		replace[i] = inserted || (len(participants) > 0 &&
+			participantsDiffer(stored[req.ExternalInteractionID].Participants, participants))
+		if !replace[i] {
+			continue
+		}
+		if !inserted {
+			replacedIDs = append(replacedIDs, interaction.ID)
+		}
+		for _, p := range participants {
+			participantArgs = append(participantArgs,
+				interaction.ID, p.ParticipantType, p.AgentID, p.ExternalAgentID, p.Role, p.Metadata)
+		}
+	}
+	if len(replacedIDs) > 0 {
+		_, err = tx.Exec(`DELETE FROM interaction_participants WHERE interaction_id = ANY($1)`, pq.Array(replacedIDs))
+		if err != nil {
+			return fmt.Errorf("failed to replace participants: %w", err)
+		}
+		// Live runs re-attribute interactions by updated_at
+		_, err = tx.Exec(`UPDATE interactions SET updated_at = NOW() WHERE id = ANY($1)`, pq.Array(replacedIDs))
+		if err != nil {
+			return fmt.Errorf("failed to update interactions: %w", err)
+		}
+	}
+	if len(participantArgs) > 0 {
+		_, err = tx.Exec(
+			`INSERT INTO interaction_participants (
+				interaction_id, participant_type, agent_id, external_agent_id, role, metadata
+			) VALUES `+valuesPlaceholders(len(participantArgs)/6, 6),
+			participantArgs...,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert participants: %w", err)
+		}
+	}
+
+	for _, i := range chunk {
+		externalID := reqs[i].ExternalInteractionID
+		status := statuses[externalID]
+		if replace[i] && status == IngestStatusUnchanged {
+			status = IngestStatusUpdated
+		}
+		replaced[i] = replace[i]
+		resp.stored(i, status, results[externalID].ID, results[externalID].CustomerID)
+	}
+	return nil
+}
+
+// IngestConversionBatch ingests a batch of conversion events. Conversions
+// already stored are updated, as for single records. Reversals are applied
+// after the batch's conversions, one at a time, so a reversal may name a
+// conversion earlier in the same batch.
+func (s *IngestionService) IngestConversionBatch(tenantID int64, reqs []IngestConversionRequest) (*BatchIngestResponse, error) {
+	if err := validateBatchSize(len(reqs)); err != nil {
+		return nil, err
+	}
+	externalIDs := make([]string, len(reqs))
+	for i, req := range reqs {
+		externalIDs[i] = req.ExternalEventID
+	}
+	resp := newBatchIngestResponse(externalIDs)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	lookups, err := loadConversionLookups(tx, tenantID, reqs)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := storedConversions(tx, tenantID, externalIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	first := map[string]int{}
+	repeats := map[int]int{}
+	var pending, reversals []int
+	for i, req := range reqs {
+		if reason := lookups.reject(req); reason != "" {
+			resp.reject(i, reason)
+			continue
+		}
+		key := conversionKey(lookups.eventSources[req.EventSource], req.ExternalEventID)
+		if j, ok := first[key]; ok {
+			repeats[i] = j
+			continue
+		}
+		first[key] = i
+		if req.OriginalExternalEventID != nil {
+			reversals = append(reversals, i)
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	sets := make([][]models.CustomerIdentifier, len(pending))
+	for k, i := range pending {
+		sets[k] = reqs[i].CustomerIdentifiers
+	}
+	customerIDs, err := resolveBatchCustomers(tx, tenantID, sets)
+	if err != nil {
+		return nil, err
+	}
+	customers := make(map[int]int64, len(pending))
+	for k, i := range pending {
+		customers[i] = customerIDs[k]
+	}
+
+	insertBatchChunks(tx, pending, resp, func(chunk []int) error {
+		return upsertConversionChunk(tx, tenantID, reqs, chunk, customers, lookups, stored, resp)
+	})
+
+	for _, i := range reversals {
+		req := reqs[i]
+		err := withSavepoint(tx, func() error {
+			eventSourceID := lookups.eventSources[req.EventSource]
+			original, err := s.findReversedConversion(tx, tenantID, eventSourceID, *req.OriginalExternalEventID, req.ExternalEventID)
+			if err != nil {
+				return err
+			}
+			reversal, err := upsertConversionEvent(tx, tenantID, original.CustomerID, eventSourceID,
+				lookups.currencies[req.Currency], optionalID(lookups.products, req.ProductExternalID), req, original)
+			if err != nil {
+				return err
+			}
+			resp.stored(i, reversal.Status, reversal.ConversionEventID, &reversal.CustomerID)
+			return nil
+		})
+		if err != nil {
+			resp.reject(i, err.Error())
+		}
+	}
+
+	// Unknown products of the stored conversions are queued, once per
+	// conversion stored with them
+	misses := referenceMisses{}
+	for i, req := range reqs {
+		if _, ok := repeats[i]; ok || resp.Results[i].Status == BatchRecordRejected {
+			continue
+		}
+		previous := stored[conversionKey(lookups.eventSources[req.EventSource], req.ExternalEventID)]
+		misses.addNew(ReferenceProduct, req.ProductExternalID, optionalID(lookups.products, req.ProductExternalID), previous.ProductExternalID)
+	}
+	if err = queueUnresolvedReferences(tx, tenantID, misses); err != nil {
+		return nil, err
+	}
+
+	// Records repeating an earlier one share its outcome
+	for i, j := range repeats {
+		resp.repeat(i, j)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	resp.tally()
+	return resp, nil
+}
+
+// conversionLookups resolves the names and codes a batch of conversions
+// refers to
+type conversionLookups struct {
+	eventSources map[string]int
+	currencies   map[string]int
+	products     map[string]int
+}
+
+func loadConversionLookups(q sqlx.Queryer, tenantID int64, reqs []IngestConversionRequest) (*conversionLookups, error) {
+	var productIDs []string
+	for _, req := range reqs {
+		if req.ProductExternalID != nil {
+			productIDs = append(productIDs, *req.ProductExternalID)
+		}
+	}
+
+	lookups := &conversionLookups{}
+	var err error
+	if lookups.eventSources, err = lookupIDs(q, `SELECT name as key, id FROM event_sources`); err != nil {
+		return nil, fmt.Errorf("failed to get event sources: %w", err)
+	}
+	if lookups.currencies, err = lookupIDs(q, `SELECT code as key, id FROM currencies`); err != nil {
+		return nil, fmt.Errorf("failed to get currencies: %w", err)
+	}
+	if lookups.products, err = lookupReferences(q, tenantID, ReferenceProduct, productIDs); err != nil {
+		return nil, err
+	}
+	return lookups, nil
+}
+
+// reject returns why a conversion can't be ingested, or "" if it can.
+// Unknown products are left out and queued, as for single records.
+func (l *conversionLookups) reject(req IngestConversionRequest) string {
+	if req.ExternalEventID == "" {
+		return "external_event_id is required"
+	}
+	if req.EventType == "" {
+		return "event_type is required"
+	}
+	if req.OccurredAt.IsZero() {
+		return "occurred_at is required"
+	}
+	if IsReversalEventType(req.EventType) && req.OriginalExternalEventID == nil {
+		return fmt.Sprintf("%s: %s", ErrReversalWithoutOriginal, req.EventType)
+	}
+	if !IsReversalEventType(req.EventType) && req.OriginalExternalEventID != nil {
+		return fmt.Sprintf("%s, not %s", ErrOriginalWithoutReversal, req.EventType)
+	}
+	if _, ok := l.eventSources[req.EventSource]; !ok {
+		return fmt.Sprintf("event source not found: %s", req.EventSource)
+	}
+	if _, ok := l.currencies[req.Currency]; !ok {
+		return fmt.Sprintf("currency not found: %s", req.Currency)
+	}
+	for _, ident := range req.CustomerIdentifiers {
+		if ident.Type == "" || ident.Value == "" {
+			return "customer identifiers need a type and value"
+		}
+	}
+	return ""
+}
+
+// conversionKey identifies a conversion within a tenant
+func conversionKey(eventSourceID int, externalEventID string) string {
+	return fmt.Sprintf("%d|%s", eventSourceID, externalEventID)
+}
+
+// storedConversion is a conversion already stored with an external ID a
+// batch sends
+type storedConversion struct {
+	ID                int64   `db:"id"`
+	EventSourceID     int     `db:"event_source_id"`
+	ExternalID        string  `db:"external_event_id"`
+	CustomerID        int64   `db:"customer_id"`
+	ProductExternalID *string `db:"product_external_id"`
+}
+
+// storedConversions returns the conversions stored with the external IDs,
+// by conversionKey
+func storedConversions(tx *sqlx.Tx, tenantID int64, externalIDs []string) (map[string]storedConversion, error) {
+	var rows []storedConversion
+	err := tx.Select(&rows,
+		`SELECT id, event_source_id, external_event_id, customer_id, product_external_id FROM conversion_events
+		 WHERE tenant_id = $1 AND external_event_id = ANY($2)`,
+		tenantID, pq.Array(externalIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing conversions: %w", err)
+	}
+	stored := make(map[string]storedConversion, len(rows))
+	for _, row := range rows {
+		stored[conversionKey(row.EventSourceID, row.ExternalID)] = row
+	}
+	return stored, nil
+}
+
+// upsertConversionChunk inserts the conversions (never reversals) at the
+// chunk's indexes, or updates the ones stored with the same event source and
+// external event ID. An updated reversal claws back its original again.
+func upsertConversionChunk(tx *sqlx.Tx, tenantID int64, reqs []IngestConversionRequest, chunk []int, customers map[int]int64, lookups *conversionLookups, stored map[string]storedConversion, resp *BatchIngestResponse) error {
+	const columns = 11
+	args := make([]interface{}, 0, len(chunk)*columns)
+	for _, i := range chunk {
+		req := reqs[i]
+		var rawPayloadJSON models.JSONB
+		if req.RawPayload != nil {
+			rawPayloadJSON = models.JSONB(req.RawPayload)
+		}
+		args = append(args,
+			tenantID, customers[i], lookups.eventSources[req.EventSource], req.ExternalEventID,
+			req.EventType, optionalID(lookups.products, req.ProductExternalID), lookups.currencies[req.Currency],
+			req.AmountDecimal, req.OccurredAt, rawPayloadJSON, req.ProductExternalID,
+		)
+	}
+
+	// Conversions re-sent unchanged aren't returned
+	var upserted []struct {
+		ID              int64  `db:"id"`
+		EventSourceID   int    `db:"event_source_id"`
+		ExternalID      string `db:"external_event_id"`
+		CustomerID      int64  `db:"customer_id"`
+		ReversesEventID *int64 `db:"reverses_event_id"`
+		Inserted        bool   `db:"inserted"`
+	}
+	err := tx.Select(&upserted,
+		`INSERT INTO conversion_events (
+			tenant_id, customer_id, event_source_id, external_event_id,
+			event_type, product_id, currency_id, amount_decimal, occurred_at, raw_payload,
+			product_external_id
+		) VALUES `+valuesPlaceholders(len(chunk), columns)+`
+		ON CONFLICT (tenant_id, event_source_id, external_event_id) DO UPDATE `+conversionUpsert+`
+		RETURNING id, event_source_id, external_event_id, customer_id, reverses_event_id, (xmax = 0) as inserted`,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upsert conversion events: %w", err)
+	}
+	results := make(map[string]storedConversion, len(chunk))
+	statuses := make(map[string]string, len(chunk))
+	for _, row := range upserted {
+		key := conversionKey(row.EventSourceID, row.ExternalID)
+		results[key] = storedConversion{ID: row.ID, CustomerID: row.CustomerID}
+		statuses[key] = IngestStatusUpdated
+		if row.Inserted {
+			statuses[key] = IngestStatusCreated
+		}
+		if row.ReversesEventID != nil && !row.Inserted {
+			if err := clawBackConversion(tx, *row.ReversesEventID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Unchanged conversions stored concurrently since the batch was checked
+	// aren't in stored
+	var unknown []string
+	for _, i := range chunk {
+		key := conversionKey(lookups.eventSources[reqs[i].EventSource], reqs[i].ExternalEventID)
+		if _, ok := results[key]; ok {
+			continue
+		}
+		if previous, ok := stored[key]; ok {
+			results[key] = previous
+		} else {
+			unknown = append(unknown, reqs[i].ExternalEventID)
+		}
+		statuses[key] = IngestStatusUnchanged
+	}
+	if len(unknown) > 0 {
+		concurrent, err := storedConversions(tx, tenantID, unknown)
+		if err != nil {
+			return err
+		}
+		for key, conversion := range concurrent {
+			if _, ok := results[key]; !ok {
+				results[key] = conversion
+			}
+		}
+	}
+
+	for _, i := range chunk {
+		key := conversionKey(lookups.eventSources[reqs[i].EventSource], reqs[i].ExternalEventID)
+		conversion, ok := results[key]
+		if !ok {
+			return fmt.Errorf("conversion event %s was not stored", reqs[i].ExternalEventID)
+		}
+		customerID := conversion.CustomerID
+		resp.stored(i, statuses[key], conversion.ID, &customerID)
+	}
+	return nil
+}
+
+// insertBatchChunks inserts the records at pending in chunks. A chunk that
+// fails is rolled back and retried one record at a time, rejecting the
+// records that fail on their own.
+func insertBatchChunks(tx *sqlx.Tx, pending []int, resp *BatchIngestResponse, insert func(chunk []int) error) {
+	for start := 0; start < len(pending); start += ingestBatchChunkSize {
+		chunk := pending[start:min(start+ingestBatchChunkSize, len(pending))]
+		if err := withSavepoint(tx, func() error { return insert(chunk) }); err == nil {
+			continue
+		}
+		for _, i := range chunk {
+			if err := withSavepoint(tx, func() error { return insert([]int{i}) }); err != nil {
+				resp.reject(i, err.Error())
+			}
+		}
+	}
+}
+
+// withSavepoint runs fn in a savepoint, rolling back to it if fn fails so the
+// transaction can go on
+func withSavepoint(tx *sqlx.Tx, fn func() error) error {
+	if _, err := tx.Exec(`SAVEPOINT ingest_batch`); err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	if err := fn(); err != nil {
+		if _, rbErr := tx.Exec(`ROLLBACK TO SAVEPOINT ingest_batch`); rbErr != nil {
+			return fmt.Errorf("failed to roll back savepoint: %w", rbErr)
+		}
+		tx.Exec(`RELEASE SAVEPOINT ingest_batch`)
+		return err
+	}
+	if _, err := tx.Exec(`RELEASE SAVEPOINT ingest_batch`); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return nil
+}
+
+// valuesPlaceholders returns the placeholders of a multi-row VALUES list,
+// "($1, $2), ($3, $4)" for two rows of two columns
+func valuesPlaceholders(rows, columns int) string {
+	var b strings.Builder
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := 0; c < columns; c++ {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d", r*columns+c+1)
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+func identifierKey(ident models.CustomerIdentifier) string {
+	return ident.Type + "\x00" + ident.Value
+}
+
+// resolveBatchCustomers finds or creates the customer of each identifier set
+// in bulk. A set matching an existing customer gets it; the others get new
+// customers, shared by sets with an identifier in common. An empty set gets
+// a customer of its own.
+func resolveBatchCustomers(tx *sqlx.Tx, tenantID int64, sets [][]models.CustomerIdentifier) ([]int64, error) {
+	ids := make([]int64, len(sets))
+	if len(sets) == 0 {
+		return ids, nil
+	}
+
+	seen := map[string]bool{}
+	var types, values []string
+	for _, set := range sets {
+		for _, ident := range set {
+			if key := identifierKey(ident); !seen[key] {
+				seen[key] = true
+				types = append(types, ident.Type)
+				values = append(values, ident.Value)
+			}
+		}
+	}
+
+	var matches []struct {
+		Type       string `db:"type"`
+		Value      string `db:"value"`
+		CustomerID int64  `db:"customer_id"`
+	}
+	if len(types) > 0 {
+		err := tx.Select(&matches,
+			`SELECT DISTINCT ON (ci.type, ci.value) ci.type, ci.value, ci.customer_id
+			 FROM customer_identifiers ci
+			 INNER JOIN customers c ON ci.customer_id = c.id
+			 INNER JOIN unnest($2::text[], $3::text[]) AS k(type, value) ON ci.type = k.type AND ci.value = k.value
+			 WHERE c.tenant_id = $1
+			 ORDER BY ci.type, ci.value, ci.customer_id`,
+			tenantID, pq.Array(types), pq.Array(values),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find customers: %w", err)
+		}
+	}
+	known := make(map[string]int64, len(matches))
+	for _, m := range matches {
+		known[identifierKey(models.CustomerIdentifier{Type: m.Type, Value: m.Value})] = m.CustomerID
+	}
+
+	// Sets without a known customer are numbered by the new customer they get
+	slots := map[string]int{}
+	slotOf := make([]int, len(sets))
+	newCustomers := 0
+	for i, set := range sets {
+		slotOf[i] = -1
+		for _, ident := range set {
+			if id, ok := known[identifierKey(ident)]; ok {
+				ids[i] = id
+				break
+			}
+		}
+		if ids[i] != 0 {
+			continue
+		}
+		for _, ident := range set {
+			if slot, ok := slots[identifierKey(ident)]; ok {
+				slotOf[i] = slot
+				break
+			}
+		}
+		if slotOf[i] < 0 {
+			slotOf[i] = newCustomers
+			newCustomers++
+		}
+		for _, ident := range set {
+			if _, ok := slots[identifierKey(ident)]; !ok {
+				slots[identifierKey(ident)] = slotOf[i]
+			}
+		}
+	}
+	if newCustomers == 0 {
+		return ids, nil
+	}
+
+	var created []int64
+	err := tx.Select(&created,
+		`INSERT INTO customers (tenant_id) SELECT $1 FROM generate_series(1, $2) RETURNING id`,
+		tenantID, newCustomers,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create customers: %w", err)
+	}
+
+	var customerIDs []int64
+	var identTypes, identValues, sourceSystems []string
+	var primary []bool
+	for i, set := range sets {
+		if slotOf[i] < 0 {
+			continue
+		}
+		ids[i] = created[slotOf[i]]
+		for _, ident := range set {
+			customerIDs = append(customerIDs, ids[i])
+			identTypes = append(identTypes, ident.Type)
+			identValues = append(identValues, ident.Value)
+			sourceSystems = append(sourceSystems, ident.SourceSystem)
+			primary = append(primary, ident.IsPrimary)
+		}
+	}
+	if len(customerIDs) > 0 {
+		_, err = tx.Exec(
+			`INSERT INTO customer_identifiers (customer_id, type, value, source_system, is_primary)
+			 SELECT * FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::boolean[])
+			 ON CONFLICT (customer_id, type, value) DO NOTHING`,
+			pq.Array(customerIDs), pq.Array(identTypes), pq.Array(identValues), pq.Array(sourceSystems), pq.Array(primary),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert identifiers: %w", err)
+		}
+	}
+	return ids, nil
+}
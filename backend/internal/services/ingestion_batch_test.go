@@ -0,0 +1,67 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestBatchValidation(t *testing.T) {
+	assert.Equal(t, "($1, $2), ($3, $4), ($5, $6)", valuesPlaceholders(3, 2))
+	assert.Equal(t, "($1)", valuesPlaceholders(1, 1))
+
+	assert.ErrorIs(t, validateBatchSize(0), ErrInvalidBatch)
+	assert.ErrorIs(t, validateBatchSize(MaxIngestBatchSize+1), ErrInvalidBatch)
+	assert.NoError(t, validateBatchSize(MaxIngestBatchSize))
+
+	now := time.Now()
+	interactions := &interactionLookups{channels: map[string]int{"Voice": 1}}
+	valid := IngestInteractionRequest{ExternalInteractionID: "call-1", Channel: "Voice", StartedAt: now}
+	assert.Equal(t, "", interactions.reject(valid))
+	assert.Equal(t, "channel not found: Fax", interactions.reject(IngestInteractionRequest{ExternalInteractionID: "call-1", Channel: "Fax", StartedAt: now}))
+	assert.Equal(t, "started_at is required", interactions.reject(IngestInteractionRequest{ExternalInteractionID: "call-1", Channel: "Voice"}))
+	invalid := valid
+	invalid.CustomerIdentifiers = []models.CustomerIdentifier{{Type: "phone"}}
+	assert.NotEmpty(t, interactions.reject(invalid))
+
+	conversions := &conversionLookups{eventSources: map[string]int{"billing": 1}, currencies: map[string]int{"USD": 1}}
+	order := IngestConversionRequest{ExternalEventID: "order-1", EventType: "purchase", EventSource: "billing", Currency: "USD", OccurredAt: now}
+	assert.Equal(t, "", conversions.reject(order))
+	refund := order
+	refund.EventType = "refund"
+	assert.Contains(t, conversions.reject(refund), ErrReversalWithoutOriginal.Error())
+	original := "order-1"
+	refund.OriginalExternalEventID = &original
+	assert.Equal(t, "", conversions.reject(refund))
+	upsell := order
+	upsell.OriginalExternalEventID = &original
+	assert.Contains(t, conversions.reject(upsell), ErrOriginalWithoutReversal.Error())
+	order.Currency = "EUR"
+	assert.Equal(t, "currency not found: EUR", conversions.reject(order))
+
+	resp := newBatchIngestResponse([]string{"a", "b", "c", "d", "e"})
+	resp.stored(0, BatchRecordCreated, 10, nil)
+	resp.stored(1, BatchRecordUpdated, 9, nil)
+	resp.reject(2, "bad")
+	resp.stored(3, BatchRecordCreated, 11, nil)
+	resp.stored(4, BatchRecordUnchanged, 8, nil)
+	resp.tally()
+	assert.Equal(t, 2, resp.Created)
+	assert.Equal(t, 1, resp.Updated)
+	assert.Equal(t, 1, resp.Unchanged)
+	assert.Equal(t, 1, resp.Rejected)
+	assert.Equal(t, "c", resp.Results[2].ExternalID)
+
+	// A repeat of a rejected record is rejected with it
+	resp = newBatchIngestResponse([]string{"a", "a"})
+	resp.reject(0, "bad")
+	resp.repeat(1, 0)
+	assert.Equal(t, BatchRecordResult{Index: 1, ExternalID: "a", Status: BatchRecordRejected, Reason: "bad"}, resp.Results[1])
+
+	code, unknown := "convin", "other"
+	assert.Equal(t, 4, *optionalID(map[string]int{"convin": 4}, &code))
+	assert.Nil(t, optionalID(map[string]int{"convin": 4}, &unknown))
+	assert.Nil(t, optionalID(map[string]int{"convin": 4}, nil))
+}
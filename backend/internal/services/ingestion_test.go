@@ -0,0 +1,56 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/convin/crae/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsertUpdate(t *testing.T) {
+	update := upsertUpdate("interactions", []upsertColumn{
+		{"channel_id", "EXCLUDED.channel_id"},
+		keepStored("interactions", "ended_at"),
+		keepStoredText("interactions", "language"),
+	})
+	assert.Equal(t,
+		"SET channel_id = EXCLUDED.channel_id, "+
+			"ended_at = COALESCE(EXCLUDED.ended_at, interactions.ended_at), "+
+			"language = COALESCE(NULLIF(EXCLUDED.language, ''), interactions.language), "+
+			"updated_at = NOW() "+
+			"WHERE (interactions.channel_id, interactions.ended_at, interactions.language) IS DISTINCT FROM "+
+			"(EXCLUDED.channel_id, COALESCE(EXCLUDED.ended_at, interactions.ended_at), COALESCE(NULLIF(EXCLUDED.language, ''), interactions.language))",
+		update)
+}
+
+func TestIngestedParticipantKey(t *testing.T) {
+	agent := 7
+	a := ingestedParticipant{ParticipantType: "agent", AgentID: &agent, Role: "closer", Metadata: models.JSONB{"b": 1.0, "a": "x"}}
+	b := ingestedParticipant{ParticipantType: "agent", AgentID: &agent, Role: "closer", Metadata: models.JSONB{"a": "x", "b": 1.0}}
+	assert.Equal(t, a.key(), b.key())
+
+	b.AgentID = nil
+	assert.NotEqual(t, a.key(), b.key())
+	assert.Equal(t, "bot||||null", ingestedParticipant{ParticipantType: "bot"}.key())
+
+	// An unresolved agent differs from another unresolved agent
+	unknown, other := "ag-1", "ag-2"
+	b.ExternalAgentID = &unknown
+	c := b
+	c.ExternalAgentID = &other
+	assert.NotEqual(t, b.key(), c.key())
+}
+
+func TestParticipantsDiffer(t *testing.T) {
+	agent, unknown := 7, "ag-1"
+	closer := ingestedParticipant{ParticipantType: "agent", AgentID: &agent, Role: "closer"}
+	bot := ingestedParticipant{ParticipantType: "bot"}
+	unresolved := ingestedParticipant{ParticipantType: "agent", ExternalAgentID: &unknown}
+
+	assert.False(t, participantsDiffer([]ingestedParticipant{closer, bot}, []ingestedParticipant{bot, closer}))
+	assert.True(t, participantsDiffer([]ingestedParticipant{closer, bot}, []ingestedParticipant{closer, closer}))
+	assert.True(t, participantsDiffer(nil, []ingestedParticipant{bot}))
+
+	stored := storedInteraction{Participants: []ingestedParticipant{closer, unresolved, bot}}
+	assert.Equal(t, []string{"ag-1"}, stored.unresolvedAgents())
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"database/sql"
 	"fmt"
 
 	"github.com/convin/crae/internal/models"
@@ -64,6 +65,23 @@ func (s *PermissionService) CheckPermission(userID int64, permissionCodeName str
 	return hasPermission, nil
 }
 
+// CheckTenantPermission checks a user of the tenant has a permission. Users
+// that don't exist or belong to another tenant never do.
+func (s *PermissionService) CheckTenantPermission(tenantID, userID int64, permissionCodeName string) (bool, error) {
+	var userTenantID int64
+	err := s.db.Get(&userTenantID, `SELECT tenant_id FROM users WHERE id = $1`, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get user: %w", err)
+	}
+	if userTenantID != tenantID {
+		return false, nil
+	}
+	return s.CheckPermission(userID, permissionCodeName)
+}
+
 // GetUserPermissions returns all permissions for a user
 func (s *PermissionService) GetUserPermissions(userID int64) ([]string, error) {
 	// Get user details
@@ -0,0 +1,375 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Unresolved references: ingested records that name an agent, vendor or
+// product that isn't known are stored without it, and the key they sent is
+// queued with how many records sent it. Mapping the key to an existing one,
+// or creating one for it, fills in the records already stored and resolves
+// the key for records ingested later.
+
+// Reference types
+const (
+	ReferenceAgent   = "agent"
+	ReferenceVendor  = "vendor"
+	ReferenceProduct = "product"
+)
+
+// Unresolved reference statuses
+const (
+	ReferenceOpen    = "open"
+	ReferenceMapped  = "mapped"
+	ReferenceCreated = "created"
+)
+
+// PermissionMapReferences is the permission needed to map unresolved
+// references or create their agents, vendors and products
+const PermissionMapReferences = "data.references.map"
+
+var (
+	// ErrUnresolvedReferenceNotFound is returned when an unresolved reference
+	// does not exist for the tenant
+	ErrUnresolvedReferenceNotFound = errors.New("unresolved reference not found")
+	// ErrReferenceAlreadyResolved is returned when mapping a reference that
+	// was already mapped or created
+	ErrReferenceAlreadyResolved = errors.New("reference is already resolved")
+	// ErrInvalidReferenceTarget is returned for an agent, vendor or product a
+	// reference can't be mapped to or created as
+	ErrInvalidReferenceTarget = errors.New("invalid reference target")
+)
+
+// UnresolvedReference is an agent, vendor or product key ingested records
+// sent that wasn't known. ResolvedID is the agent, vendor or product it was
+// mapped to or created as.
+type UnresolvedReference struct {
+	ID            int64      `db:"id" json:"id"`
+	TenantID      int64      `db:"tenant_id" json:"tenant_id"`
+	ReferenceType string     `db:"reference_type" json:"reference_type"`
+	ExternalKey   string     `db:"external_key" json:"external_key"`
+	Occurrences   int64      `db:"occurrences" json:"occurrences"`
+	Status        string     `db:"status" json:"status"`
+	ResolvedID    *int       `db:"resolved_id" json:"resolved_id,omitempty"`
+	ResolvedBy    *int64     `db:"resolved_by" json:"resolved_by,omitempty"`
+	FirstSeenAt   time.Time  `db:"first_seen_at" json:"first_seen_at"`
+	LastSeenAt    time.Time  `db:"last_seen_at" json:"last_seen_at"`
+	ResolvedAt    *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+}
+
+// unresolvedReferenceColumns selects an UnresolvedReference
+const unresolvedReferenceColumns = `id, tenant_id, reference_type, external_key, occurrences, status,
+	resolved_id, resolved_by, first_seen_at, last_seen_at, resolved_at`
+
+// ReferenceResolution is a resolved reference and how many stored records
+// were filled in with it
+type ReferenceResolution struct {
+	Reference  *UnresolvedReference `json:"reference"`
+	Backfilled int64                `json:"backfilled"`
+}
+
+// CreateReferenceTargetRequest describes the agent, vendor or product to
+// create for an unresolved reference. Its key is the reference's key.
+type CreateReferenceTargetRequest struct {
+	Name string `json:"name" binding:"required"`
+	// VendorID is the vendor a new agent works for, required for agents
+	VendorID *int    `json:"vendor_id"`
+	TeamID   *int    `json:"team_id"`
+	Email    *string `json:"email"`
+	// Category is a new product's category
+	Category *string `json:"category"`
+}
+
+// referenceLookups look up the known references of each type by key, with
+// priority 0: $1 is the tenant and $2 the keys
+var referenceLookups = map[string]string{
+	ReferenceAgent: `SELECT a.external_agent_id as key, a.id, 0 as priority FROM agents a
+		JOIN vendors v ON v.id = a.vendor_id AND v.tenant_id = $1
+		WHERE a.external_agent_id = ANY($2)`,
+	ReferenceVendor:  `SELECT code as key, id, 0 as priority FROM vendors WHERE tenant_id = $1 AND code = ANY($2)`,
+	ReferenceProduct: `SELECT external_product_id as key, id, 0 as priority FROM products WHERE external_product_id = ANY($2)`,
+}
+
+// lookupReferences maps the keys of a reference type to IDs: the agent,
+// vendor or product with the key, or else the one the key was mapped to
+func lookupReferences(q sqlx.Queryer, tenantID int64, refType string, keys []string) (map[string]int, error) {
+	ids, err := lookupIDs(q,
+		`SELECT key, id FROM (`+referenceLookups[refType]+`
+		 UNION ALL
+		 SELECT external_key, resolved_id, 1 FROM unresolved_references
+		 WHERE tenant_id = $1 AND reference_type = $3 AND external_key = ANY($2) AND resolved_id IS NOT NULL
+		) refs ORDER BY priority`,
+		tenantID, pq.Array(keys), refType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %ss: %w", refType, err)
+	}
+	return ids, nil
+}
+
+// referenceKey is a key of a reference type
+type referenceKey struct {
+	Type string
+	Key  string
+}
+
+// referenceMisses counts the keys stored records sent that weren't resolved
+type referenceMisses map[referenceKey]int64
+
+// add counts key when it was sent but not resolved to an ID
+func (m referenceMisses) add(refType string, key *string, id *int) {
+	if key == nil || *key == "" || id != nil {
+		return
+	}
+	m[referenceKey{refType, *key}]++
+}
+
+// addNew counts key like add, unless the record was already stored with it
+// (stored), so re-sending the record doesn't count it again
+func (m referenceMisses) addNew(refType string, key *string, id *int, stored *string) {
+	if key != nil && stored != nil && *key == *stored {
+		return
+	}
+	m.add(refType, key, id)
+}
+
+// storedReferenceKey returns the key a stored record was sent with, or nil
+// when the record isn't stored yet or was stored without one
+func storedReferenceKey(tx *sqlx.Tx, query string, args ...interface{}) (*string, error) {
+	var key *string
+	err := tx.Get(&key, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get stored record: %w", err)
+	}
+	return key, nil
+}
+
+// sorted returns the keys in order, so concurrent ingestion queues them in
+// the same order
+func (m referenceMisses) sorted() []referenceKey {
+	keys := make([]referenceKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// queueUnresolvedReferences adds the misses to the tenant's queue of
+// unresolved references
+func queueUnresolvedReferences(tx *sqlx.Tx, tenantID int64, misses referenceMisses) error {
+	keys := misses.sorted()
+	for start := 0; start < len(keys); start += ingestBatchChunkSize {
+		chunk := keys[start:min(start+ingestBatchChunkSize, len(keys))]
+		args := make([]interface{}, 0, len(chunk)*4)
+		for _, key := range chunk {
+			args = append(args, tenantID, key.Type, key.Key, misses[key])
+		}
+		_, err := tx.Exec(
+			`INSERT INTO unresolved_references (tenant_id, reference_type, external_key, occurrences)
+			 VALUES `+valuesPlaceholders(len(chunk), 4)+`
+			 ON CONFLICT (tenant_id, reference_type, external_key) DO UPDATE
+			 SET occurrences = unresolved_references.occurrences + EXCLUDED.occurrences,
+			     last_seen_at = NOW(), updated_at = NOW()`,
+			args...,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to queue unresolved references: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListUnresolvedReferences lists a tenant's unresolved references, those
+// sent most often first, optionally of one type and status
+func (s *IngestionService) ListUnresolvedReferences(tenantID int64, refType, status string, limit, offset int) ([]UnresolvedReference, int, error) {
+	where := ` WHERE tenant_id = $1 AND ($2 = '' OR reference_type = $2) AND ($3 = '' OR status = $3)`
+	args := []interface{}{tenantID, refType, status}
+
+	var total int
+	if err := s.db.Get(&total, `SELECT COUNT(*) FROM unresolved_references`+where, args...); err != nil {
+		return nil, 0, fmt.Errorf("failed to count unresolved references: %w", err)
+	}
+
+	refs := []UnresolvedReference{}
+	err := s.db.Select(&refs,
+		`SELECT `+unresolvedReferenceColumns+` FROM unresolved_references`+where+`
+		 ORDER BY occurrences DESC, last_seen_at DESC, id LIMIT $4 OFFSET $5`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list unresolved references: %w", err)
+	}
+	return refs, total, nil
+}
+
+// MapUnresolvedReference maps an open reference to an existing agent, vendor
+// or product of the tenant and fills it in on the records that sent it
+func (s *IngestionService) MapUnresolvedReference(tenantID, userID, id int64, targetID int) (*ReferenceResolution, error) {
+	return s.resolveReference(tenantID, userID, id, ReferenceMapped, func(tx *sqlx.Tx, ref *UnresolvedReference) (int, error) {
+		var exists bool
+		var err error
+		switch ref.ReferenceType {
+		case ReferenceAgent:
+			err = tx.Get(&exists,
+				`SELECT EXISTS(SELECT 1 FROM agents a JOIN vendors v ON v.id = a.vendor_id WHERE a.id = $1 AND v.tenant_id = $2)`,
+				targetID, tenantID)
+		case ReferenceVendor:
+			err = tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM vendors WHERE id = $1 AND tenant_id = $2)`, targetID, tenantID)
+		case ReferenceProduct:
+			// Products are shared by all tenants
+			err = tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM products WHERE id = $1)`, targetID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to get %s: %w", ref.ReferenceType, err)
+		}
+		if !exists {
+			return 0, fmt.Errorf("%w: %s %d not found", ErrInvalidReferenceTarget, ref.ReferenceType, targetID)
+		}
+		return targetID, nil
+	})
+}
+
+// CreateReferenceTarget creates the agent, vendor or product an open
+// reference names, with the reference's key, and fills it in on the records
+// that sent it
+func (s *IngestionService) CreateReferenceTarget(tenantID, userID, id int64, req CreateReferenceTargetRequest) (*ReferenceResolution, error) {
+	return s.resolveReference(tenantID, userID, id, ReferenceCreated, func(tx *sqlx.Tx, ref *UnresolvedReference) (int, error) {
+		var targetID int
+		var err error
+		switch ref.ReferenceType {
+		case ReferenceAgent:
+			if req.VendorID == nil {
+				return 0, fmt.Errorf("%w: vendor_id is required for agents", ErrInvalidReferenceTarget)
+			}
+			var valid bool
+			err = tx.Get(&valid,
+				`SELECT EXISTS(SELECT 1 FROM vendors WHERE id = $1 AND tenant_id = $2)
+				 AND ($3::int IS NULL OR EXISTS(SELECT 1 FROM teams WHERE id = $3 AND vendor_id = $1))`,
+				*req.VendorID, tenantID, req.TeamID,
+			)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get vendor: %w", err)
+			}
+			if !valid {
+				return 0, fmt.Errorf("%w: vendor or team not found", ErrInvalidReferenceTarget)
+			}
+			err = tx.Get(&targetID,
+				`INSERT INTO agents (vendor_id, team_id, name, email, external_agent_id)
+				 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+				*req.VendorID, req.TeamID, req.Name, req.Email, ref.ExternalKey,
+			)
+		case ReferenceVendor:
+			err = tx.Get(&targetID,
+				`INSERT INTO vendors (tenant_id, name, code) VALUES ($1, $2, $3)
+				 ON CONFLICT (tenant_id, code) DO NOTHING RETURNING id`,
+				tenantID, req.Name, ref.ExternalKey,
+			)
+		case ReferenceProduct:
+			err = tx.Get(&targetID,
+				`INSERT INTO products (external_product_id, name, category) VALUES ($1, $2, $3)
+				 ON CONFLICT (external_product_id) DO NOTHING RETURNING id`,
+				ref.ExternalKey, req.Name, req.Category,
+			)
+		}
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%w: %s %s already exists, map the reference to it", ErrInvalidReferenceTarget, ref.ReferenceType, ref.ExternalKey)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to create %s: %w", ref.ReferenceType, err)
+		}
+		return targetID, nil
+	})
+}
+
+// resolveReference resolves an open reference to the ID target returns,
+// backfills the records that sent it and marks it with status
+func (s *IngestionService) resolveReference(tenantID, userID, id int64, status string, target func(tx *sqlx.Tx, ref *UnresolvedReference) (int, error)) (*ReferenceResolution, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var ref UnresolvedReference
+	err = tx.Get(&ref,
+		`SELECT `+unresolvedReferenceColumns+` FROM unresolved_references WHERE id = $1 AND tenant_id = $2 FOR UPDATE`,
+		id, tenantID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnresolvedReferenceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unresolved reference: %w", err)
+	}
+	if ref.Status != ReferenceOpen {
+		return nil, ErrReferenceAlreadyResolved
+	}
+
+	targetID, err := target(tx, &ref)
+	if err != nil {
+		return nil, err
+	}
+	backfilled, err := backfillReference(tx, tenantID, ref.ReferenceType, ref.ExternalKey, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Get(&ref,
+		`UPDATE unresolved_references
+		 SET status = $2, resolved_id = $3, resolved_by = $4, resolved_at = NOW(), updated_at = NOW()
+		 WHERE id = $1 RETURNING `+unresolvedReferenceColumns,
+		id, status, targetID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve reference: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &ReferenceResolution{Reference: &ref, Backfilled: backfilled}, nil
+}
+
+// backfillReference fills in targetID on the tenant's records stored without
+// it that sent key, and returns how many interactions or conversions it
+// changed. Their updated_at moves so live runs re-attribute them.
+func backfillReference(tx *sqlx.Tx, tenantID int64, refType, key string, targetID int) (int64, error) {
+	var query string
+	switch refType {
+	case ReferenceAgent:
+		query = `WITH filled AS (
+				UPDATE interaction_participants ip SET agent_id = $3
+				FROM interactions i
+				WHERE ip.interaction_id = i.id AND i.tenant_id = $1
+				  AND ip.external_agent_id = $2 AND ip.agent_id IS NULL
+				RETURNING ip.interaction_id
+			)
+			UPDATE interactions SET updated_at = NOW() WHERE id IN (SELECT interaction_id FROM filled)`
+	case ReferenceVendor:
+		query = `UPDATE interactions SET vendor_id = $3, updated_at = NOW()
+			WHERE tenant_id = $1 AND vendor_code = $2 AND vendor_id IS NULL`
+	case ReferenceProduct:
+		query = `UPDATE conversion_events SET product_id = $3, updated_at = NOW()
+			WHERE tenant_id = $1 AND product_external_id = $2 AND product_id IS NULL`
+	default:
+		return 0, fmt.Errorf("unknown reference type %s", refType)
+	}
+	result, err := tx.Exec(query, tenantID, key, targetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to backfill %s: %w", refType, err)
+	}
+	return result.RowsAffected()
+}
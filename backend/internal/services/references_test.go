@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferenceMisses(t *testing.T) {
+	known := 3
+	agent, vendor, product, empty := "ag-9", "acme", "sku-1", ""
+
+	misses := referenceMisses{}
+	misses.add(ReferenceVendor, &vendor, nil)
+	misses.add(ReferenceAgent, &agent, nil)
+	misses.add(ReferenceVendor, &vendor, nil)
+	misses.add(ReferenceProduct, &product, &known)
+	misses.add(ReferenceAgent, nil, nil)
+	misses.add(ReferenceAgent, &empty, nil)
+
+	assert.Equal(t, referenceMisses{
+		{ReferenceVendor, "acme"}: 2,
+		{ReferenceAgent, "ag-9"}:  1,
+	}, misses)
+	assert.Equal(t, []referenceKey{{ReferenceAgent, "ag-9"}, {ReferenceVendor, "acme"}}, misses.sorted())
+}
+
+func TestReferenceMissesAddNew(t *testing.T) {
+	vendor, other := "acme", "globex"
+
+	misses := referenceMisses{}
+	misses.addNew(ReferenceVendor, &vendor, nil, nil)
+	// Re-sent with the key it was stored with
+	misses.addNew(ReferenceVendor, &vendor, nil, &vendor)
+	// Re-sent with a different unknown key
+	misses.addNew(ReferenceVendor, &other, nil, &vendor)
+
+	assert.Equal(t, referenceMisses{
+		{ReferenceVendor, "acme"}:   1,
+		{ReferenceVendor, "globex"}: 1,
+	}, misses)
+}
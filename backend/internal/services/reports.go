@@ -179,7 +179,7 @@ func (s *ReportService) executeAttributionReport(tenantID int64, report *SavedRe
 			ch.name as channel_name,
 			SUM(ar.attributed_revenue) as total_revenue,
 			COUNT(DISTINCT ar.conversion_event_id) as conversions
-		FROM attribution_results ar
+		FROM current_attribution_results ar
 		LEFT JOIN channels ch ON ar.channel_id = ch.id
 		WHERE ar.tenant_id = $1
 		GROUP BY ar.model_type, ch.name
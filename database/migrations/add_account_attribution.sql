@@ -0,0 +1,35 @@
+-- Account-level (B2B) attribution
+-- Runs with attribution_level "account" credit a conversion across the
+-- interactions of every contact of the converting customer's account and the
+-- account's engagements. A result row credits either an interaction or an
+-- account engagement; account_id records the converting customer's account.
+
+ALTER TABLE attribution_results ALTER COLUMN interaction_id DROP NOT NULL;
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS account_engagement_id BIGINT REFERENCES account_engagements(id) ON DELETE CASCADE;
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS account_id BIGINT REFERENCES accounts(id) ON DELETE SET NULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'attribution_results_touch_check') THEN
+        ALTER TABLE attribution_results ADD CONSTRAINT attribution_results_touch_check
+            CHECK (interaction_id IS NOT NULL OR account_engagement_id IS NOT NULL);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_attribution_results_account ON attribution_results(account_id) WHERE account_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_account_engagements_account_date ON account_engagements(account_id, engagement_date);
+
+-- Results written before this are credited to their customer's account
+UPDATE attribution_results ar
+SET account_id = c.account_id
+FROM customers c
+WHERE ar.customer_id = c.id
+  AND c.account_id IS NOT NULL
+  AND ar.account_id IS NULL;
+
+-- Pick up the new attribution_results columns
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
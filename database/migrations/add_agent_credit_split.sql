@@ -0,0 +1,17 @@
+-- Split credit among the agents of an interaction
+-- A touch handled by several agents (warm transfers, conference calls) gets
+-- one attribution_results row per agent. agent_share is the agent's part of
+-- the touch's credit, from the run's agent_role_shares and the participant's
+-- role in interaction_participants.
+
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS agent_role VARCHAR(50);
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS agent_share DECIMAL(10, 6);
+
+CREATE INDEX IF NOT EXISTS idx_interaction_participants_interaction_type ON interaction_participants(interaction_id, participant_type);
+
+-- Pick up the new attribution_results columns
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
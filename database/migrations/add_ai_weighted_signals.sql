@@ -0,0 +1,23 @@
+-- Signal-weighted AI attribution
+-- AI_WEIGHTED scores each touch from Convin conversation signals
+-- (purchase_probability, primary/secondary intents, outcome_prediction,
+-- call duration and direction) using coefficients in attribution_models.params,
+-- and stores a per-touch explanation of the weight on attribution_results.
+
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS explanation JSONB;
+
+UPDATE attribution_models
+SET params = '{
+    "base": 1.0,
+    "purchase_probability": 2.0,
+    "intent_weights": {"purchase": 1.0, "upgrade": 0.8, "renewal": 0.6, "pricing": 0.5, "support": 0.0, "complaint": -0.5, "cancellation": -0.5},
+    "secondary_intent_factor": 0.25,
+    "outcome_weights": {"converted": 1.0, "likely_purchase": 0.75, "follow_up": 0.25, "not_interested": -0.5},
+    "duration_per_minute": 0.05,
+    "duration_cap_minutes": 20,
+    "direction_weights": {"inbound": 0.25, "outbound": 0.0},
+    "min_score": 0.05
+}'::jsonb,
+    description = 'Weights touches by Convin conversation signals: purchase probability, intents, predicted outcome, duration and direction'
+WHERE code = 'AI_WEIGHTED'
+  AND params IS NULL;
@@ -0,0 +1,27 @@
+-- Background attribution job runner
+-- Runs are queued and picked up by a worker pool; progress, cancellation and
+-- per-conversion errors are tracked on the run
+
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS queued_at TIMESTAMP;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS total_conversions INT NOT NULL DEFAULT 0;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS processed_conversions INT NOT NULL DEFAULT 0;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS failed_conversions INT NOT NULL DEFAULT 0;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS cancel_requested BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS error_message TEXT;
+
+-- Status values: pending, queued, running, completed, partial, failed, cancelled
+-- The workers claim queued runs in queued_at order; idx_attribution_runs_status
+-- (status alone) already exists, so this one needs its own name
+CREATE INDEX IF NOT EXISTS idx_attribution_runs_status_queued ON attribution_runs(status, queued_at);
+
+CREATE TABLE IF NOT EXISTS attribution_run_errors (
+    id BIGSERIAL PRIMARY KEY,
+    attribution_run_id BIGINT NOT NULL,
+    conversion_event_id BIGINT,
+    error_message TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (attribution_run_id) REFERENCES attribution_runs(id) ON DELETE CASCADE,
+    FOREIGN KEY (conversion_event_id) REFERENCES conversion_events(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_attribution_run_errors_run ON attribution_run_errors(attribution_run_id);
@@ -0,0 +1,58 @@
+-- Attribution period close
+-- Once a month is closed, the attribution results of conversions that
+-- occurred in it are frozen: re-executed runs carry them forward and late
+-- data or reversals are written as adjustment rows in the next open period.
+-- adjustment_period is the month an adjustment row went into and reported_at
+-- the time it is reported at (instead of the conversion's occurred_at).
+
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS adjustment_period DATE;
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS reported_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_attribution_results_adjustment_period ON attribution_results(tenant_id, adjustment_period) WHERE adjustment_period IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS attribution_periods (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL,
+    period_start DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open',
+    closed_at TIMESTAMP,
+    closed_by BIGINT,
+    reopened_at TIMESTAMP,
+    reopened_by BIGINT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id) ON DELETE CASCADE,
+    UNIQUE (tenant_id, period_start)
+);
+
+-- Audit trail of closes and reopens
+CREATE TABLE IF NOT EXISTS attribution_period_events (
+    id BIGSERIAL PRIMARY KEY,
+    period_id BIGINT NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    user_id BIGINT NOT NULL,
+    reason TEXT,
+    details JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (period_id) REFERENCES attribution_periods(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_attribution_period_events_period ON attribution_period_events(period_id, created_at);
+
+INSERT INTO permissions (code_name, name, description, group_id)
+SELECT 'data.attribution.close_period', 'Close Attribution Periods', 'Close and reopen attribution accounting periods', id
+FROM permission_groups WHERE name = 'Data Management'
+ON CONFLICT (code_name) DO NOTHING;
+
+-- Grant it to the default Admin role, which can't be edited through the API
+UPDATE roles
+SET code_names = array_append(code_names, 'data.attribution.close_period')
+WHERE name = 'Admin' AND is_default AND NOT can_be_edited
+  AND NOT ('data.attribution.close_period' = ANY(code_names));
+
+-- Pick up the new attribution_results columns
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
@@ -0,0 +1,54 @@
+-- Versioned attribution results
+-- Every execution of a run writes a new result version. The run's
+-- current_version only moves to a version once it completes, so analytics
+-- never see a half-written or failed execution and earlier versions are kept
+-- for audit.
+
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS current_version INT;
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS result_version INT NOT NULL DEFAULT 1;
+ALTER TABLE attribution_run_errors ADD COLUMN IF NOT EXISTS result_version INT NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_attribution_results_run_version ON attribution_results(attribution_run_id, result_version);
+
+CREATE TABLE IF NOT EXISTS attribution_run_versions (
+    id BIGSERIAL PRIMARY KEY,
+    attribution_run_id BIGINT NOT NULL,
+    version INT NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'running',
+    total_conversions INT NOT NULL DEFAULT 0,
+    processed_conversions INT NOT NULL DEFAULT 0,
+    failed_conversions INT NOT NULL DEFAULT 0,
+    result_rows INT NOT NULL DEFAULT 0,
+    attributed_amount DECIMAL(18, 4) NOT NULL DEFAULT 0,
+    model_output JSONB,
+    error_message TEXT,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+    FOREIGN KEY (attribution_run_id) REFERENCES attribution_runs(id) ON DELETE CASCADE,
+    UNIQUE (attribution_run_id, version)
+);
+
+-- Results written before versioning become version 1 of their run
+INSERT INTO attribution_run_versions (
+    attribution_run_id, version, status, total_conversions, processed_conversions,
+    failed_conversions, result_rows, attributed_amount, model_output, started_at, completed_at
+)
+SELECT run.id, 1, run.status, run.total_conversions, run.processed_conversions,
+       run.failed_conversions, COUNT(ar.id), COALESCE(SUM(ar.attributed_amount), 0),
+       run.model_output, run.started_at, run.completed_at
+FROM attribution_runs run
+INNER JOIN attribution_results ar ON ar.attribution_run_id = run.id
+GROUP BY run.id
+ON CONFLICT (attribution_run_id, version) DO NOTHING;
+
+UPDATE attribution_runs run
+SET current_version = 1
+WHERE current_version IS NULL
+  AND EXISTS (SELECT 1 FROM attribution_results ar WHERE ar.attribution_run_id = run.id);
+
+-- Results of each run's current version; analytics read from this view
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
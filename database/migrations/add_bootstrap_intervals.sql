@@ -0,0 +1,20 @@
+-- Bootstrap confidence intervals on attributed revenue
+-- Runs with bootstrap_samples in their config resample their conversions and
+-- store, per result version, the p5/p50/p95 range of every agent, vendor and
+-- channel total. key matches the breakdown keys (agent_id, vendor_id, or
+-- channel_id / 'engagement:<type>'; '' for unassigned credit).
+
+CREATE TABLE IF NOT EXISTS attribution_result_intervals (
+    id BIGSERIAL PRIMARY KEY,
+    attribution_run_id BIGINT NOT NULL,
+    result_version INT NOT NULL,
+    dimension VARCHAR(20) NOT NULL,
+    key VARCHAR(100) NOT NULL,
+    samples INT NOT NULL,
+    p5 DECIMAL(18, 4) NOT NULL,
+    p50 DECIMAL(18, 4) NOT NULL,
+    p95 DECIMAL(18, 4) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (attribution_run_id) REFERENCES attribution_runs(id) ON DELETE CASCADE,
+    UNIQUE (attribution_run_id, result_version, dimension, key)
+);
@@ -0,0 +1,19 @@
+-- Refunds, cancellations and chargebacks
+-- A reversal event is a conversion event that names the conversion it
+-- reverses; its amount is stored negative. Every run crediting the original
+-- conversion gets clawback rows: copies of the original's result rows, scaled
+-- by the reversed share of the amount, negated and tagged with the reversal
+-- event. Summing attributed_amount therefore gives net revenue.
+
+ALTER TABLE conversion_events ADD COLUMN IF NOT EXISTS reverses_event_id BIGINT REFERENCES conversion_events(id) ON DELETE CASCADE;
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS reversal_event_id BIGINT REFERENCES conversion_events(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_conversion_events_reverses ON conversion_events(reverses_event_id) WHERE reverses_event_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_attribution_results_conversion ON attribution_results(conversion_event_id);
+
+-- Pick up the new attribution_results column
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
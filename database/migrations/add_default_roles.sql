@@ -39,6 +39,7 @@ BEGIN
             'roles.view', 'roles.create', 'roles.edit', 'roles.delete',
             -- Data Management
             'data.ingest', 'data.attribution.run', 'data.attribution.view', 'data.export',
+            'data.attribution.close_period', 'data.references.map',
             -- Reporting
             'reports.view', 'reports.create', 'reports.edit', 'reports.delete'
         ],
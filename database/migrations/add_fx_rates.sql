@@ -0,0 +1,72 @@
+-- Multi-currency normalization
+-- Each tenant can set a reporting currency and load daily FX rates. Attributed
+-- amounts are converted into the reporting currency at the rate on the
+-- conversion's date when results are written; analytics that aggregate raw
+-- conversion amounts convert them with to_reporting_currency(). Tenants
+-- without a reporting currency keep amounts as ingested.
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS reporting_currency_id INT REFERENCES currencies(id);
+
+-- One unit of base_currency is worth rate units of quote_currency on rate_date
+CREATE TABLE IF NOT EXISTS fx_rates (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL,
+    rate_date DATE NOT NULL,
+    base_currency_id INT NOT NULL,
+    quote_currency_id INT NOT NULL,
+    rate DECIMAL(20, 10) NOT NULL CHECK (rate > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id) ON DELETE CASCADE,
+    FOREIGN KEY (base_currency_id) REFERENCES currencies(id),
+    FOREIGN KEY (quote_currency_id) REFERENCES currencies(id),
+    UNIQUE (tenant_id, base_currency_id, quote_currency_id, rate_date)
+);
+
+-- Attributed amounts are in the reporting currency; the conversion's own
+-- currency, amount and the rate used are kept alongside
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS currency_id INT REFERENCES currencies(id);
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS source_amount DECIMAL(18, 4);
+ALTER TABLE attribution_results ADD COLUMN IF NOT EXISTS fx_rate DECIMAL(20, 10);
+
+-- Rate to convert from_currency into to_currency on a date: the most recent
+-- rate on or before the date, either way round. NULL when none is loaded.
+CREATE OR REPLACE FUNCTION fx_rate(p_tenant_id BIGINT, p_from_currency_id INT, p_to_currency_id INT, p_on DATE)
+RETURNS NUMERIC AS $$
+    SELECT CASE WHEN p_from_currency_id = p_to_currency_id THEN 1 ELSE (
+        SELECT r.rate FROM (
+            SELECT rate_date, rate FROM fx_rates
+            WHERE tenant_id = p_tenant_id AND base_currency_id = p_from_currency_id
+              AND quote_currency_id = p_to_currency_id AND rate_date <= p_on
+            UNION ALL
+            SELECT rate_date, 1 / rate FROM fx_rates
+            WHERE tenant_id = p_tenant_id AND base_currency_id = p_to_currency_id
+              AND quote_currency_id = p_from_currency_id AND rate_date <= p_on
+        ) r
+        ORDER BY r.rate_date DESC
+        LIMIT 1
+    ) END
+$$ LANGUAGE SQL STABLE;
+
+-- Amount in the tenant's reporting currency (unchanged when none is set);
+-- NULL when no rate is loaded
+CREATE OR REPLACE FUNCTION to_reporting_currency(p_tenant_id BIGINT, p_amount NUMERIC, p_currency_id INT, p_on TIMESTAMP)
+RETURNS NUMERIC AS $$
+    SELECT p_amount * fx_rate(p_tenant_id, p_currency_id, COALESCE(t.reporting_currency_id, p_currency_id), p_on::date)
+    FROM tenants t
+    WHERE t.id = p_tenant_id
+$$ LANGUAGE SQL STABLE;
+
+-- Results written before normalization are in their conversion's currency
+UPDATE attribution_results ar
+SET currency_id = ce.currency_id, source_amount = ar.attributed_amount, fx_rate = 1
+FROM conversion_events ce
+WHERE ar.conversion_event_id = ce.id
+  AND ar.currency_id IS NULL;
+
+-- Pick up the new attribution_results columns
+CREATE OR REPLACE VIEW current_attribution_results AS
+SELECT ar.*
+FROM attribution_results ar
+INNER JOIN attribution_runs run ON ar.attribution_run_id = run.id
+WHERE ar.result_version = run.current_version;
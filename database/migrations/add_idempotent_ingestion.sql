@@ -0,0 +1,30 @@
+-- Idempotent ingestion
+-- Re-sent interactions and conversions update the stored row with the same
+-- external ID instead of inserting another, and requests carrying an
+-- Idempotency-Key header replay their first response for 24 hours.
+
+-- The upserts conflict on the unique (tenant_id, external_interaction_id) and
+-- (tenant_id, event_source_id, external_event_id) constraints of schema.sql.
+
+-- Updated conversions are re-attributed by live runs. Existing rows are left
+-- NULL so adding the column doesn't re-attribute every conversion.
+ALTER TABLE conversion_events ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+ALTER TABLE conversion_events ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_conversion_events_tenant_updated ON conversion_events(tenant_id, updated_at);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    -- NULL until the first request completes
+    status_code INT,
+    content_type VARCHAR(255),
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE (tenant_id, idempotency_key)
+);
+
+-- Expired keys are reclaimed when reused; the server purges the rest hourly
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at);
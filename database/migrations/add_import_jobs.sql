@@ -0,0 +1,49 @@
+-- File imports
+-- CSV and NDJSON files of interactions or conversion events are stored with
+-- their column mapping and ingested by a background worker in chunks; rows
+-- that can't be ingested are kept with their line number and reason
+
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    entity VARCHAR(32) NOT NULL,            -- interactions, conversions
+    format VARCHAR(16) NOT NULL,            -- csv, ndjson
+    file_name VARCHAR(255) NOT NULL DEFAULT '',
+    mapping JSONB NOT NULL DEFAULT '{}',
+    header TEXT[],                          -- CSV header row
+    file_content BYTEA NOT NULL,
+    -- Status values: queued, running, completed, failed
+    status VARCHAR(32) NOT NULL DEFAULT 'queued',
+    total_rows INT NOT NULL DEFAULT 0,
+    processed_rows INT NOT NULL DEFAULT 0,
+    created_rows INT NOT NULL DEFAULT 0,
+    updated_rows INT NOT NULL DEFAULT 0,
+    unchanged_rows INT NOT NULL DEFAULT 0,
+    rejected_rows INT NOT NULL DEFAULT 0,
+    error_message TEXT,
+    queued_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_jobs_tenant ON import_jobs(tenant_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_import_jobs_status ON import_jobs(status, queued_at);
+
+CREATE TABLE IF NOT EXISTS import_job_rejections (
+    id BIGSERIAL PRIMARY KEY,
+    import_job_id BIGINT NOT NULL REFERENCES import_jobs(id) ON DELETE CASCADE,
+    row_index INT NOT NULL,                 -- data row, counted from 0
+    line_number INT NOT NULL,               -- line of the file the row starts on
+    raw_row TEXT NOT NULL,
+    reason TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_job_rejections_job ON import_job_rejections(import_job_id, row_index);
+
+-- Re-imported rows update the stored records instead of counting as
+-- duplicates
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS updated_rows INT NOT NULL DEFAULT 0;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS unchanged_rows INT NOT NULL DEFAULT 0;
+ALTER TABLE import_jobs DROP COLUMN IF EXISTS duplicate_rows;
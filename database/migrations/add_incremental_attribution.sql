@@ -0,0 +1,44 @@
+-- Incremental attribution
+-- One run per tenant and model can be designated live. A scheduler
+-- re-attributes, in the live run's current result version, conversions
+-- ingested since the run's watermark and conversions whose lookback window
+-- gained late-arriving interactions.
+
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS is_live BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS watermark TIMESTAMP;
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS last_incremental_at TIMESTAMP;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_attribution_runs_live ON attribution_runs(tenant_id, model_id) WHERE is_live;
+
+CREATE INDEX IF NOT EXISTS idx_conversion_events_tenant_created ON conversion_events(tenant_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_interactions_tenant_updated ON interactions(tenant_id, updated_at);
+
+-- Runs that already completed are up to date as of their current version's start
+UPDATE attribution_runs run
+SET watermark = v.started_at
+FROM attribution_run_versions v
+WHERE v.attribution_run_id = run.id
+  AND v.version = run.current_version
+  AND run.watermark IS NULL;
+
+-- Live runs pick up changed interactions by updated_at, so a participant
+-- added, removed or reassigned to another agent touches its interaction.
+-- Interactions already touched in the transaction are left alone.
+CREATE OR REPLACE FUNCTION touch_interaction_participants() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE interactions SET updated_at = NOW()
+        WHERE id = OLD.interaction_id AND updated_at IS DISTINCT FROM NOW();
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE interactions SET updated_at = NOW()
+        WHERE id = NEW.interaction_id AND updated_at IS DISTINCT FROM NOW();
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_interaction_participants_touch ON interaction_participants;
+CREATE TRIGGER trg_interaction_participants_touch
+AFTER INSERT OR UPDATE OR DELETE ON interaction_participants
+FOR EACH ROW EXECUTE FUNCTION touch_interaction_participants();
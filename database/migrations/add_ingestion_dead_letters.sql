@@ -0,0 +1,32 @@
+-- Dead-letter queue for rejected ingestion
+-- Payloads rejected by the ingestion endpoints and webhooks, and records
+-- rejected from batches, are kept with their error so they can be edited and
+-- replayed once reference data (channels, event sources, currencies) is fixed
+
+CREATE TABLE IF NOT EXISTS ingestion_dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    source VARCHAR(64) NOT NULL,            -- endpoint, e.g. conversions, webhooks/convin
+    payload TEXT NOT NULL,                  -- request body as received (or as edited)
+    status_code INT NOT NULL DEFAULT 0,     -- response status; 0 for batch records
+    error_message TEXT NOT NULL,            -- latest error, updated by failed replays
+    -- Status values: pending, replaying (claimed by a replay), replayed, discarded
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    replay_attempts INT NOT NULL DEFAULT 0,
+    last_replayed_at TIMESTAMP,
+    replayed_at TIMESTAMP,
+    edited_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ingestion_dead_letters_tenant ON ingestion_dead_letters(tenant_id, status, created_at);
+
+-- A payload rejected again while its dead letter is pending, e.g. a webhook
+-- retried after a server error, is counted in occurrences instead of being
+-- kept twice. dedup_key is the SHA-256 of the Idempotency-Key the payload
+-- was sent with, or else of the payload.
+ALTER TABLE ingestion_dead_letters ADD COLUMN IF NOT EXISTS dedup_key VARCHAR(64);
+ALTER TABLE ingestion_dead_letters ADD COLUMN IF NOT EXISTS occurrences INT NOT NULL DEFAULT 1;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ingestion_dead_letters_dedup
+    ON ingestion_dead_letters(tenant_id, source, dedup_key) WHERE status IN ('pending', 'replaying');
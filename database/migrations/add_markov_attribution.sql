@@ -0,0 +1,10 @@
+-- Markov-chain removal-effect attribution model
+-- Builds a transition matrix over channels (optionally per vendor) from
+-- interactions ordered by started_at, including null paths, and credits each
+-- state by its removal effect. The matrix is stored in attribution_runs.model_output.
+
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS model_output JSONB;
+
+INSERT INTO attribution_models (code, name, description, params) VALUES
+    ('MARKOV', 'Markov Chain', 'Data-driven model crediting each channel by its removal effect in a first-order Markov chain of customer paths', '{"include_vendor": false}')
+ON CONFLICT DO NOTHING;
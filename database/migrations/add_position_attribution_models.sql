@@ -0,0 +1,12 @@
+-- Position-based attribution models
+-- U_SHAPED: 40% first touch, 40% last touch, 20% split across the middle
+-- W_SHAPED: 30% first, 30% lead-creation milestone, 30% last, 10% middle. The
+--           milestone is the first interaction whose milestone_field
+--           (primary_intent or funnel_stage) matches one of milestone_values
+-- CUSTOM_POSITION: first/middle/last percentages set in params (must add up to 100)
+
+INSERT INTO attribution_models (code, name, description, params) VALUES
+    ('U_SHAPED', 'U-Shaped', 'Weights the first and last touches most heavily, splitting the rest across middle touches', '{"first_pct": 40, "middle_pct": 20, "last_pct": 40}'),
+    ('W_SHAPED', 'W-Shaped', 'Weights the first touch, the lead-creation milestone touch and the last touch most heavily', '{"first_pct": 30, "milestone_pct": 30, "last_pct": 30, "middle_pct": 10, "milestone_field": "funnel_stage", "milestone_values": ["SQL", "Lead"]}'),
+    ('CUSTOM_POSITION', 'Custom Position-Based', 'First, middle and last touch percentages configured in params', '{"first_pct": 40, "middle_pct": 20, "last_pct": 40}')
+ON CONFLICT DO NOTHING;
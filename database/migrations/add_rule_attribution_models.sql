@@ -0,0 +1,16 @@
+-- Tenant-defined rule models
+-- A tenant can add its own attribution model as a declarative rule set
+-- (base model, multipliers, exclusions and caps) stored in params. Built-in
+-- models keep tenant_id NULL and model_type 'builtin'. Built-in codes are
+-- unique among themselves and a tenant's codes within the tenant, so tenants
+-- can reuse each other's codes.
+
+ALTER TABLE attribution_models ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants(id) ON DELETE CASCADE;
+ALTER TABLE attribution_models ADD COLUMN IF NOT EXISTS model_type VARCHAR(20) NOT NULL DEFAULT 'builtin';
+ALTER TABLE attribution_models ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_attribution_models_tenant ON attribution_models(tenant_id) WHERE tenant_id IS NOT NULL;
+
+ALTER TABLE attribution_models DROP CONSTRAINT IF EXISTS attribution_models_code_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_attribution_models_builtin_code ON attribution_models(code) WHERE tenant_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_attribution_models_tenant_code ON attribution_models(tenant_id, code) WHERE tenant_id IS NOT NULL;
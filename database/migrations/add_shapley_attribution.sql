@@ -0,0 +1,10 @@
+-- Shapley-value data-driven attribution model
+-- Credits channels (or agents/vendors) by their cooperative-game contribution
+-- across every converting and non-converting path in the tenant
+
+-- Tenant-wide model output (e.g. Shapley values) computed for a run
+ALTER TABLE attribution_runs ADD COLUMN IF NOT EXISTS model_output JSONB;
+
+INSERT INTO attribution_models (code, name, description, params) VALUES
+    ('SHAPLEY', 'Shapley Value', 'Data-driven model crediting each channel by its Shapley value across converting and non-converting paths', '{"dimension": "channel"}')
+ON CONFLICT DO NOTHING;
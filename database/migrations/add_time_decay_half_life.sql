@@ -0,0 +1,10 @@
+-- Timestamp-based time-decay attribution
+-- TIME_DECAY now decays credit by the real gap between each interaction's
+-- started_at and the conversion's occurred_at. The half-life (hours) is read
+-- from the run config (half_life_hours) or, if unset, from the model params.
+
+UPDATE attribution_models
+SET params = COALESCE(params, '{}'::jsonb) || '{"half_life_hours": 168}'::jsonb,
+    description = 'Credit halves for every half-life between the interaction and the conversion'
+WHERE code = 'TIME_DECAY'
+  AND (params IS NULL OR NOT params ? 'half_life_hours');
@@ -0,0 +1,46 @@
+-- Unresolved reference queue
+-- Ingested records that name an agent, vendor or product that isn't known are
+-- stored without it, and the key they sent is queued here with how many
+-- records sent it. Mapping a key to an existing agent, vendor or product, or
+-- creating one for it, fills in the records already stored and resolves the
+-- key for records ingested later.
+
+CREATE TABLE IF NOT EXISTS unresolved_references (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id BIGINT NOT NULL,
+    reference_type VARCHAR(20) NOT NULL,
+    external_key VARCHAR(255) NOT NULL,
+    occurrences BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'open',
+    resolved_id INT,
+    resolved_by BIGINT,
+    first_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id) ON DELETE CASCADE,
+    UNIQUE (tenant_id, reference_type, external_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_unresolved_references_status ON unresolved_references(tenant_id, status, occurrences DESC);
+
+-- The keys records were sent with, so they can be filled in once resolved
+ALTER TABLE interactions ADD COLUMN IF NOT EXISTS vendor_code VARCHAR(255);
+ALTER TABLE interaction_participants ADD COLUMN IF NOT EXISTS external_agent_id VARCHAR(255);
+ALTER TABLE conversion_events ADD COLUMN IF NOT EXISTS product_external_id VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_interactions_unresolved_vendor ON interactions(tenant_id, vendor_code) WHERE vendor_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_interaction_participants_unresolved_agent ON interaction_participants(external_agent_id) WHERE agent_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_conversion_events_unresolved_product ON conversion_events(tenant_id, product_external_id) WHERE product_id IS NULL;
+
+INSERT INTO permissions (code_name, name, description, group_id)
+SELECT 'data.references.map', 'Map Unresolved References', 'Map or create the agents, vendors and products ingested records refer to', id
+FROM permission_groups WHERE name = 'Data Management'
+ON CONFLICT (code_name) DO NOTHING;
+
+-- Grant it to the default Admin role, which can't be edited through the API
+UPDATE roles
+SET code_names = array_append(code_names, 'data.references.map')
+WHERE name = 'Admin' AND is_default AND NOT can_be_edited
+  AND NOT ('data.references.map' = ANY(code_names));
@@ -0,0 +1,13 @@
+-- View-through attribution
+-- Ad impressions are ingested as interactions with is_view_through set (see
+-- add_funnel_stages.sql). Runs with include_view_through credit them within
+-- view_through_window_hours, discounted by view_through_discount.
+
+INSERT INTO channels (name, description) VALUES
+    ('Display', 'Ad impressions (view-through)')
+ON CONFLICT (name) DO NOTHING;
+
+UPDATE interactions SET is_view_through = FALSE WHERE is_view_through IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_interactions_view_through ON interactions(customer_id, started_at) WHERE is_view_through;
+CREATE INDEX IF NOT EXISTS idx_interactions_campaign ON interactions(campaign_id) WHERE campaign_id IS NOT NULL;